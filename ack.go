@@ -0,0 +1,94 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * ack.go - Quiet acknowledgements. Commands with nothing to say but
+ * "Yes, sire." answer through CommandContext.Ack(), which either replies
+ * as usual or just reacts to the command with a check mark, keeping the
+ * channel tidy. AckMode picks which for every command, and AckOverrides
+ * picks for single commands, e.g. "stop=reply, playlist add=react".
+ * Both can be pinned per guild with `config pin`. Errors, and anything
+ * with more to say, are always replied in text.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ackLog = moduleLogger("ack")
+
+var AckModes = []string{"reply", "react"}
+
+const ackEmoji = "✅"
+
+func checkAckMode(value string) error {
+	if !contains(AckModes, value) {
+		return fmt.Errorf("%q isn't one of %s", value, strings.Join(AckModes, ", "))
+	}
+	return nil
+}
+
+/*
+ * Read AckOverrides: commands (without the prefix) and their modes, as
+ * COMMAND=MODE separated by commas.
+ */
+func parseAckOverrides(value string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q isn't COMMAND=MODE", strings.TrimSpace(pair))
+		}
+
+		command := strings.Join(strings.Fields(parts[0]), " ")
+		mode := strings.TrimSpace(parts[1])
+		if err := checkAckMode(mode); err != nil {
+			return nil, err
+		}
+		overrides[command] = mode
+	}
+
+	return overrides, nil
+}
+
+func checkAckOverrides(value string) error {
+	_, err := parseAckOverrides(value)
+	return err
+}
+
+// How a command (named without the prefix) acknowledges success.
+func ackMode(command string) string {
+	// Checked when set, so this can't fail
+	overrides, _ := parseAckOverrides(Settings.AckOverrides)
+	if mode, ok := overrides[command]; ok {
+		return mode
+	}
+	return Settings.AckMode
+}
+
+/*
+ * Acknowledge that the command went through, by reply or reaction. If
+ * the reaction can't be added (say, the bard may not react in this
+ * channel), it falls back to a reply.
+ */
+func (ctx *CommandContext) Ack() {
+	command := strings.TrimPrefix(ctx.CommandName, ctx.Prefix)
+	if ackMode(command) == "react" {
+		err := ctx.Session.MessageReactionAdd(ctx.Event.ChannelID, ctx.Event.ID, ackEmoji)
+		if err == nil {
+			return
+		}
+		ackLog.Warn("Couldn't react, so replying instead", "err", err)
+	}
+
+	ctx.Reply(OkMessage)
+}
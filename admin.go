@@ -0,0 +1,103 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * admin.go - Owner commands for looking into the bard's insides
+ * without a shell on the host, starting with the database.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var adminLog = moduleLogger("admin")
+
+func cmdAdminDb(ctx *CommandContext, args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "tables":
+		adminDbTables(ctx)
+	case len(args) == 2 && args[0] == "count":
+		adminDbCount(ctx, args[1])
+	case len(args) == 1 && args[0] == "vacuum":
+		adminDbVacuum(ctx)
+	case len(args) == 1 && args[0] == "size":
+		adminDbSize(ctx)
+	default:
+		ctx.SendUsage()
+	}
+}
+
+func adminDbTables(ctx *CommandContext) {
+	tables, err := dbInspector.Tables()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	ctx.ReplyLong("My tables, sire: `" + strings.Join(tables, "`, `") + "`")
+}
+
+func adminDbCount(ctx *CommandContext, table string) {
+	count, ok, err := dbInspector.Count(table)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !ok {
+		ctx.Reply("Sire, I have no table named `" + table + "`.")
+		return
+	}
+
+	ctx.Reply(fmt.Sprintf("Sire, `%s` has %d rows.", table, count))
+}
+
+func adminDbVacuum(ctx *CommandContext) {
+	before, err := dbInspector.Size()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	start := time.Now()
+	if handleCommandErrors(ctx, SqlError, dbInspector.Vacuum()) {
+		return
+	}
+
+	after, err := dbInspector.Size()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	adminLog.Info("Vacuumed the database", "before", before, "after", after)
+	ctx.Reply(fmt.Sprintf("Swept out, sire: %s down to %s, in %s.",
+		formatBytes(before), formatBytes(after),
+		time.Since(start).Round(time.Millisecond)))
+}
+
+func adminDbSize(ctx *CommandContext) {
+	size, err := dbInspector.Size()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	ctx.Reply("Sire, the database takes up " + formatBytes(size) + ".")
+}
+
+// Write a byte count the way people read them, e.g. "1.5 MiB".
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,706 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * api.go - An HTTP API, for tools and dashboards that would rather not
+ * talk to the bard through Discord. It's off unless ApiListen (an
+ * address like 127.0.0.1:8080) is set, along with ApiToken or the web
+ * dashboard (see dashboard.go). Every request must carry the token:
+ *
+ *   Authorization: Bearer TOKEN
+ *
+ * or a dashboard session's cookie, in which case it may only do what
+ * its user could do with commands.
+ *
+ * Bodies and answers are JSON. The routes, under /api:
+ *
+ *   GET    /me                 who's asking, and the schedule modes
+ *   GET    /tags               every tag
+ *   GET    /tags/NAME/thumb    a small JPEG of a tag's image
+ *   POST   /tags               make a tag: {"name", "url", "description"}
+ *   DELETE /tags/NAME          forget a tag
+ *   GET    /playlists          every playlist, with its tags
+ *   GET    /playlists/NAME     one playlist
+ *   PUT    /playlists/NAME     make or replace a playlist: {"tags": [...]}
+ *   DELETE /playlists/NAME     forget a playlist
+ *   GET    /schedule           the running schedule, if any
+ *   PUT    /schedule           start one: {"mode", "interval", "tags" or "playlist"}
+ *   DELETE /schedule           stop it
+ *   PUT    /banner             put a tag up now, stopping any schedule: {"tag"}
+ *
+ * Modes are the scheduler's PickerModes (shuffle, cycle, play, ...), and
+ * intervals are written as for commands (e.g. "6h"), and no shorter than
+ * theirs. Errors answer with {"error": "..."}. Changes are refused
+ * while the bard is draining, and the server shuts down as it finishes,
+ * letting requests under way end first.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var apiLog = moduleLogger("api")
+
+// The running server, for stopAPI(); nil if it isn't serving.
+var apiHTTP struct {
+	mutex  sync.Mutex
+	server *http.Server
+}
+
+// How long stopAPI() waits for requests under way.
+const apiShutdownTimeout = 10 * time.Second
+
+// The most a request body may hold.
+const apiBodyLimit = 1024 * 1024 // 1 MB
+
+type apiTag struct {
+	Name        string    `json:"name"`
+	Url         string    `json:"url"`
+	Description string    `json:"description"`
+	Author      string    `json:"author"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+type apiPlaylist struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+	Crew string   `json:"crew,omitempty"`
+}
+
+type apiSchedule struct {
+	Active     bool       `json:"active"`
+	Tags       []string   `json:"tags"`
+	Next       int        `json:"next"` // index into tags, or -1 if unknown
+	Banner     string     `json:"banner"`
+	NextChange *time.Time `json:"next_change,omitempty"`
+}
+
+// An image to answer a request with, instead of JSON.
+type apiImage []byte
+
+// An error to answer a request with, and its status.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func apiFail(status int, message string) error {
+	return &apiError{status: status, message: message}
+}
+
+/*
+ * A request, with the session to act through, who made it, and the
+ * path under /api.
+ */
+type apiRequest struct {
+	*http.Request
+	session  *discordgo.Session
+	caller   *dashboardSession // or nil, if it came with the token
+	resource string            // e.g. "tags"
+	name     string            // e.g. the tag's, or "" for the collection
+	part     string            // e.g. "thumb", under the name
+}
+
+/*
+ * Fail unless the caller may do what a command with these perms does,
+ * on the playlist if there is one. The token may do anything.
+ */
+func (r *apiRequest) allow(perms byte, playlist string) error {
+	if r.caller == nil || r.caller.permitted(r.session, perms, playlist) {
+		return nil
+	}
+	return apiFail(http.StatusForbidden, "you may not do that")
+}
+
+// Refuse to replace or delete someone else's tag, as refuseTagChange() does.
+func (r *apiRequest) allowTagChange(name string) error {
+	if !Settings.StrictOwnership || r.caller == nil {
+		return nil
+	}
+
+	author, err := otherTagAuthor(name, r.caller.UserID)
+	if err != nil {
+		return err
+	} else if author != "" && !r.caller.permitted(r.session, PermManageServer, "") {
+		return apiFail(http.StatusForbidden, "that tag is someone else's")
+	}
+	return nil
+}
+
+// Fail with a conflict if err says what was to be changed is locked, see lock.go.
+func apiLockFail(err error) error {
+	if errors.Is(err, ErrTagLocked) || errors.Is(err, ErrPlaylistLocked) {
+		return apiFail(http.StatusConflict, err.Error())
+	}
+	return err
+}
+
+// Keep a change the request made, see auditlog.go.
+func (r *apiRequest) audit(action string, target string, detail string) {
+	userID := ""
+	if r.caller != nil {
+		userID = r.caller.UserID
+	}
+	recordAudit(r.session, userID, action, target, detail)
+}
+
+// Keep a change the request made for `undo`, as its author's, see undo.go.
+func (r *apiRequest) journal(action string, target string, snapshot undoSnapshot) {
+	journalChange(r.author(), action, target, snapshot)
+}
+
+// Who to credit for what the request makes.
+func (r *apiRequest) author() string {
+	if r.caller == nil {
+		// Tags made with the token are the owner's, as far as credit goes.
+		return firstOwner()
+	}
+	return r.caller.UserID
+}
+
+// Read the request's JSON body into v.
+func (r *apiRequest) decode(v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apiFail(http.StatusBadRequest, "bad body: "+err.Error())
+	}
+	return nil
+}
+
+type apiServer struct {
+	session *discordgo.Session
+}
+
+func (api *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, body := api.serve(r)
+	apiLog.Info("API request", "method", r.Method, "path", r.URL.Path, "status", status)
+
+	if image, ok := body.(apiImage); ok {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		w.WriteHeader(status)
+		w.Write(image)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+/*
+ * Who's making a request: nil for the token, or their dashboard
+ * session. Fails if it's neither, or a session that may not do it.
+ */
+func (api *apiServer) authenticate(r *http.Request) (*dashboardSession, error) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if Settings.ApiToken != "" &&
+		subtle.ConstantTimeCompare([]byte(auth), []byte(Settings.ApiToken)) == 1 {
+		return nil, nil
+	}
+
+	caller := dashboardSessionOf(r)
+	switch {
+	case caller == nil:
+		return nil, apiFail(http.StatusUnauthorized, "bad token")
+	case userBanned(caller.UserID):
+		return nil, apiFail(http.StatusForbidden, "you're barred from my commands")
+	case r.Method != http.MethodGet && r.Header.Get(dashboardHeader) == "":
+		return nil, apiFail(http.StatusForbidden, "changes need the "+dashboardHeader+" header")
+	case !caller.permitted(api.session, dashboardPerms, ""):
+		return nil, apiFail(http.StatusForbidden, "you may not use the dashboard")
+	}
+	return caller, nil
+}
+
+// Answer a request with a status and (unless nil) a body to encode.
+func (api *apiServer) serve(r *http.Request) (int, interface{}) {
+	caller, err := api.authenticate(r)
+	var failed *apiError
+	if errors.As(err, &failed) {
+		return failed.status, map[string]string{"error": failed.message}
+	}
+
+	if r.Method != http.MethodGet && Drain.Active() {
+		return http.StatusServiceUnavailable, map[string]string{
+			"error": "draining; back " + Drain.Eta()}
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	resource, name, _ := strings.Cut(path, "/")
+	name, part, _ := strings.Cut(name, "/")
+	r.Body = http.MaxBytesReader(nil, r.Body, apiBodyLimit)
+	req := &apiRequest{Request: r, session: api.session, caller: caller,
+		resource: resource, name: name, part: part}
+
+	body, err := api.route(req)
+	switch {
+	case errors.As(err, &failed):
+		return failed.status, map[string]string{"error": failed.message}
+	case err != nil:
+		apiLog.Error("Error while answering an API request", "path", r.URL.Path, "err", err)
+		reportError(ErrorReport{Kind: "sql", Message: err.Error(),
+			Command: "api " + r.Method + " " + r.URL.Path})
+		return http.StatusInternalServerError, map[string]string{"error": err.Error()}
+	case body == nil:
+		return http.StatusNoContent, nil
+	}
+	return http.StatusOK, body
+}
+
+func (api *apiServer) route(r *apiRequest) (interface{}, error) {
+	collection := r.name == ""
+	if r.part != "" {
+		if r.resource == "tags" && r.part == "thumb" && r.Method == http.MethodGet {
+			return apiTagThumb(r)
+		}
+		return nil, apiFail(http.StatusNotFound, "no such route")
+	}
+
+	switch {
+	case r.resource == "me" && collection && r.Method == http.MethodGet:
+		return apiShowMe(r)
+	case r.resource == "tags" && collection && r.Method == http.MethodGet:
+		return apiListTags(r)
+	case r.resource == "tags" && collection && r.Method == http.MethodPost:
+		return apiNewTag(r)
+	case r.resource == "tags" && !collection && r.Method == http.MethodDelete:
+		return nil, apiDelTag(r)
+	case r.resource == "playlists" && collection && r.Method == http.MethodGet:
+		return apiListPlaylists(r)
+	case r.resource == "playlists" && !collection && r.Method == http.MethodGet:
+		return apiShowPlaylist(r.name)
+	case r.resource == "playlists" && !collection && r.Method == http.MethodPut:
+		return apiPutPlaylist(r)
+	case r.resource == "playlists" && !collection && r.Method == http.MethodDelete:
+		return nil, apiDelPlaylist(r)
+	case r.resource == "schedule" && collection && r.Method == http.MethodGet:
+		return apiShowSchedule()
+	case r.resource == "schedule" && collection && r.Method == http.MethodPut:
+		return apiPutSchedule(r)
+	case r.resource == "schedule" && collection && r.Method == http.MethodDelete:
+		return nil, apiStopSchedule(r)
+	case r.resource == "banner" && collection && r.Method == http.MethodPut:
+		return apiPutBanner(r)
+	}
+
+	return nil, apiFail(http.StatusNotFound, "no such route")
+}
+
+func apiShowMe(r *apiRequest) (interface{}, error) {
+	modes := []string{}
+	for mode := range PickerModes {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+
+	me := map[string]interface{}{"modes": modes}
+	if r.caller != nil {
+		me["user"] = r.caller.UserID
+		me["name"] = r.caller.Name
+	}
+	return me, nil
+}
+
+// Tags
+
+func apiListTags(r *apiRequest) (interface{}, error) {
+	tags, err := allTags()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]apiTag, len(tags))
+	for i, tag := range tags {
+		list[i] = apiTag{Name: tag.Name, Url: tag.Url, Description: tag.Description,
+			Author: tag.AuthorID, Created: tag.CreatedAt, Updated: tag.UpdatedAt}
+	}
+	return list, nil
+}
+
+func apiNewTag(r *apiRequest) (interface{}, error) {
+	var body struct {
+		Name        string `json:"name"`
+		Url         string `json:"url"`
+		Description string `json:"description"`
+	}
+	if err := r.decode(&body); err != nil {
+		return nil, err
+	} else if err = r.allow(PermDefault, ""); err != nil {
+		return nil, err
+	} else if err = r.allowTagChange(body.Name); err != nil {
+		return nil, err
+	}
+
+	if body.Name == "" || strings.ContainsAny(body.Name, " \t\n") {
+		return nil, apiFail(http.StatusBadRequest, "a tag needs a name without spaces")
+	} else if problem := imageTypeProblem(body.Url); problem != "" {
+		return nil, apiFail(http.StatusBadRequest, problem)
+	}
+
+	if err := insertTag(body.Name, r.author(), body.Url); err != nil {
+		return nil, apiLockFail(err)
+	}
+	if body.Description != "" {
+		if _, err := describeTag(body.Name, body.Description); err != nil {
+			return nil, err
+		}
+	}
+	apiLog.Info("Remembered a tag", "tag", body.Name, "url", body.Url)
+	r.audit("tag new", normTag(body.Name), body.Url)
+
+	answer := map[string]interface{}{"name": normTag(body.Name)}
+	data, err := cacheImage(body.Url)
+	if err != nil {
+		apiLog.Warn("Couldn't cache a tag's image", "tag", body.Name, "err", err)
+		answer["warning"] = "couldn't keep a copy of its image: " + err.Error()
+		return answer, nil
+	}
+
+	alike, err := hashNewTag(body.Name, data)
+	if err != nil {
+		apiLog.Warn("Couldn't hash a tag's image", "tag", body.Name, "err", err)
+	}
+	answer["lookalikes"] = alike
+	return answer, nil
+}
+
+func apiDelTag(r *apiRequest) error {
+	if err := r.allow(PermDefault, ""); err != nil {
+		return err
+	}
+
+	exists, err := tagExists(r.name)
+	if err != nil {
+		return err
+	} else if !exists {
+		return apiFail(http.StatusNotFound, "no tag named "+r.name)
+	} else if err = r.allowTagChange(r.name); err != nil {
+		return err
+	}
+
+	snapshot, err := takeTagsSnapshot([]string{r.name})
+	if err != nil {
+		return err
+	}
+
+	if err = delTag(r.name); err != nil {
+		return apiLockFail(err)
+	}
+	apiLog.Info("Removed a tag", "tag", r.name)
+	r.audit("tag del", normTag(r.name), "")
+	r.journal("tag del", normTag(r.name), snapshot)
+	return nil
+}
+
+func apiTagThumb(r *apiRequest) (interface{}, error) {
+	tag, err := namedTag(r.name)
+	if err == sql.ErrNoRows {
+		return nil, apiFail(http.StatusNotFound, "no tag named "+r.name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	thumb, err := fetchThumb(tag.Url)
+	if err != nil {
+		return nil, apiFail(http.StatusBadGateway, err.Error())
+	}
+	return apiImage(thumb), nil
+}
+
+// Playlists
+
+func apiListPlaylists(r *apiRequest) (interface{}, error) {
+	names, err := allPlaylists()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	list := []apiPlaylist{}
+	for _, name := range names {
+		playlist, err := apiShowPlaylist(name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, playlist.(apiPlaylist))
+	}
+	return list, nil
+}
+
+func apiShowPlaylist(name string) (interface{}, error) {
+	tags, err := playlistTags(name)
+	if err != nil {
+		return nil, err
+	} else if len(tags) == 0 {
+		return nil, apiFail(http.StatusNotFound, "no playlist named "+name)
+	}
+
+	crew, err := playlistCrew(name)
+	return apiPlaylist{Name: name, Tags: tags, Crew: crew}, err
+}
+
+func apiPutPlaylist(r *apiRequest) (interface{}, error) {
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := r.decode(&body); err != nil {
+		return nil, err
+	} else if err = r.allow(PermDefault|PermCrew, r.name); err != nil {
+		return nil, err
+	}
+
+	if len(body.Tags) == 0 {
+		return nil, apiFail(http.StatusBadRequest, "a playlist needs tags")
+	}
+	if err := apiCheckTags(body.Tags); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := takeSnapshot(nil, []string{r.name})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := editPlaylist(r.name, body.Tags); err != nil {
+		return nil, apiLockFail(err)
+	}
+	apiLog.Info("Replaced a playlist", "playlist", r.name, "count", len(body.Tags))
+	r.audit("playlist new", r.name, auditList(body.Tags, 20))
+	r.journal("playlist new", r.name, snapshot)
+	return apiShowPlaylist(r.name)
+}
+
+func apiDelPlaylist(r *apiRequest) error {
+	if err := r.allow(PermDefault|PermCrew, r.name); err != nil {
+		return err
+	}
+
+	exists, err := playlistExists(r.name)
+	if err != nil {
+		return err
+	} else if !exists {
+		return apiFail(http.StatusNotFound, "no playlist named "+r.name)
+	}
+
+	snapshot, err := takeSnapshot(nil, []string{r.name})
+	if err != nil {
+		return err
+	}
+
+	if err = clearPlaylist(r.name); err != nil {
+		return apiLockFail(err)
+	}
+	apiLog.Info("Removed a playlist", "playlist", r.name)
+	r.audit("playlist del", r.name, "")
+	r.journal("playlist del", r.name, snapshot)
+	return nil
+}
+
+// Fail with the tags that don't exist, if any.
+func apiCheckTags(tags []string) error {
+	missing := []string{}
+	for _, tag := range tags {
+		exists, err := tagExists(tag)
+		if err != nil {
+			return err
+		} else if !exists {
+			missing = append(missing, tag)
+		}
+	}
+
+	if len(missing) > 0 {
+		return apiFail(http.StatusBadRequest, "no tags named "+strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// The schedule and banner
+
+func apiShowSchedule() (interface{}, error) {
+	banner, err := currentBanner()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, next, active := Scheduler.Queue()
+	schedule := apiSchedule{Active: active, Tags: tags, Next: next, Banner: banner}
+	if schedule.Tags == nil {
+		schedule.Tags = []string{}
+	}
+	if at := Status.nextChange(); active && !at.IsZero() {
+		schedule.NextChange = &at
+	}
+	return schedule, nil
+}
+
+func apiPutSchedule(r *apiRequest) (interface{}, error) {
+	var body struct {
+		Mode     string   `json:"mode"`
+		Interval string   `json:"interval"`
+		Tags     []string `json:"tags"`
+		Playlist string   `json:"playlist"`
+	}
+	if err := r.decode(&body); err != nil {
+		return nil, err
+	} else if err = r.allow(PermDefault, ""); err != nil {
+		return nil, err
+	}
+
+	picker, ok := PickerModes[body.Mode]
+	if !ok {
+		return nil, apiFail(http.StatusBadRequest, "no mode named "+body.Mode)
+	}
+
+	interval, err := parseTime(body.Interval)
+	if err != nil || interval <= 0 {
+		return nil, apiFail(http.StatusBadRequest, "bad interval "+body.Interval)
+	} else if interval < MinimumInterval {
+		return nil, apiFail(http.StatusBadRequest,
+			"the interval must be at least "+MinimumInterval.String())
+	}
+
+	tags := body.Tags
+	if body.Playlist != "" {
+		if tags, err = playlistTags(body.Playlist); err != nil {
+			return nil, err
+		}
+	}
+	if len(tags) == 0 {
+		return nil, apiFail(http.StatusBadRequest, "a schedule needs tags or a playlist")
+	} else if err = apiCheckTags(tags); err != nil {
+		return nil, err
+	}
+
+	if _, err = Scheduler.Set(interval, tags, picker); err != nil {
+		return nil, err
+	}
+	apiLog.Info("Started a schedule", "mode", body.Mode, "interval", interval,
+		"count", len(tags))
+	r.audit("schedule start", LaneBanner, fmt.Sprintf("%s every %s, %d tags", body.Mode,
+		interval, len(tags)))
+	return apiShowSchedule()
+}
+
+func apiStopSchedule(r *apiRequest) error {
+	if err := r.allow(PermDefault, ""); err != nil {
+		return err
+	}
+
+	if Scheduler.Stop() {
+		r.audit("schedule stop", LaneBanner, "")
+	}
+	apiLog.Info("Stopped the schedule")
+	return nil
+}
+
+func apiPutBanner(r *apiRequest) (interface{}, error) {
+	var body struct {
+		Tag string `json:"tag"`
+	}
+	if err := r.decode(&body); err != nil {
+		return nil, err
+	} else if err = r.allow(PermDefault, ""); err != nil {
+		return nil, err
+	}
+
+	exists, err := tagExists(body.Tag)
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, apiFail(http.StatusNotFound, "no tag named "+body.Tag)
+	}
+
+	Scheduler.Stop()
+	if err = setBanner(r.session, body.Tag, "api"); err != nil {
+		var guided *GuidedError
+		if errors.As(err, &guided) {
+			return nil, apiFail(http.StatusBadGateway, guided.Guidance)
+		}
+		return nil, apiFail(http.StatusBadGateway, err.Error())
+	}
+
+	return map[string]interface{}{"banner": normTag(body.Tag),
+		"kill_switch": KillSwitch.Engaged()}, nil
+}
+
+/*
+ * Serve the API, and the dashboard and webhook triggers if they're on,
+ * if they're set up. This lasts forever, so call it with `go`.
+ */
+func StartAPI(s *discordgo.Session) {
+	if Settings.ApiListen == "" {
+		return
+	} else if Settings.ApiToken == "" && !dashboardOn() && Settings.TriggerSecret == "" {
+		apiLog.Error("Not serving the API; ApiListen is set, but none of ApiToken, " +
+			"the dashboard, or TriggerSecret is")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", &apiServer{session: s})
+	if Settings.TriggerSecret != "" {
+		mux.Handle("/trigger", &triggerServer{})
+	}
+	if dashboardOn() {
+		mux.Handle("/", newDashboardServer(s))
+		go sweepDashboardSessions()
+	}
+
+	server := &http.Server{
+		Addr:              Settings.ApiListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	apiHTTP.mutex.Lock()
+	apiHTTP.server = server
+	apiHTTP.mutex.Unlock()
+
+	apiLog.Info("Serving the API", "address", Settings.ApiListen,
+		"dashboard", dashboardOn(), "triggers", Settings.TriggerSecret != "")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		apiLog.Error("The API stopped", "err", err)
+	}
+}
+
+// Stop serving the API, letting requests under way finish.
+func stopAPI() {
+	apiHTTP.mutex.Lock()
+	server := apiHTTP.server
+	apiHTTP.server = nil
+	apiHTTP.mutex.Unlock()
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		apiLog.Warn("Couldn't stop the API gracefully", "err", err)
+	}
+}
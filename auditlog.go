@@ -0,0 +1,157 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * auditlog.go - Who changed what. Making, deleting, renaming, and
+ * repointing tags, editing playlists, starting and stopping schedules,
+ * and imports are each kept in the audit_log table as they happen, by
+ * commands and the API alike, and posted as a small embed to
+ * LogChannelID. `audit log [N]` shows the last few.
+ *
+ * Keeping the record never gets in the way of the change itself: it's
+ * written with the next batch (see batch.go), so `audit log` may lag a
+ * few seconds behind, and a failure to keep or post it is only logged.
+ *
+ * (Not to be confused with `audit` itself, in health.go, which checks
+ * every tag's link.)
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var auditLog = moduleLogger("auditlog")
+
+// How many entries `audit log` shows, unless asked for more (up to auditLogMost).
+const (
+	auditLogShows = 10
+	auditLogMost  = 100
+)
+
+// Keep and post a change the command's user made.
+func (ctx *CommandContext) Audit(action string, target string, detail string) {
+	recordAudit(ctx.Session, ctx.Event.Author.ID, action, target, detail)
+}
+
+/*
+ * Keep and post a change. The user is whoever made it, or "" for the
+ * API token.
+ */
+func recordAudit(s *discordgo.Session, userID string, action string, target string,
+	detail string) {
+
+	entry := AuditEntry{At: time.Now(), UserID: userID, Action: action, Target: target,
+		Detail: detail}
+	queueAuditEntry(entry)
+
+	if Settings.LogChannelID == "" || s == nil {
+		return
+	}
+
+	description := "**" + target + "**, by " + auditUser(userID)
+	if detail != "" {
+		description += "\n" + detail
+	}
+	_, err := s.ChannelMessageSendEmbed(Settings.LogChannelID, &discordgo.MessageEmbed{
+		Title:       clipText(action, EmbedTitleLimit),
+		Description: clipText(description, EmbedDescriptionLimit),
+		Timestamp:   entry.At.Format(time.RFC3339),
+	})
+	if err != nil {
+		auditLog.Warn("Couldn't post an audit entry", "action", action, "err", err)
+	}
+}
+
+// Who made a change, as a mention.
+func auditUser(userID string) string {
+	if userID == "" {
+		return "the API token"
+	}
+	return "<@" + userID + ">"
+}
+
+// Up to n of the things, as "a, b, and 3 more", for an entry's detail.
+func auditList(things []string, n int) string {
+	if len(things) <= n {
+		return strings.Join(things, ", ")
+	}
+	return fmt.Sprintf("%s, and %d more", strings.Join(things[:n], ", "), len(things)-n)
+}
+
+/*
+ * Keep a change to several tags at once as one entry, so a bulk change
+ * doesn't flood LogChannelID.
+ */
+func (ctx *CommandContext) auditTags(action string, tags []string, detail string) {
+	if len(tags) == 1 {
+		ctx.Audit(action, tags[0], detail)
+		return
+	}
+
+	if detail != "" {
+		detail = "; " + detail
+	}
+	ctx.Audit(action, fmt.Sprintf("%d tags", len(tags)), auditList(tags, 20)+detail)
+}
+
+// Keep the schedule a lane's just started.
+func (ctx *CommandContext) auditSchedule(lane *BannerScheduler) {
+	for _, info := range lane.Schedules() {
+		detail := fmt.Sprintf("%s every %s in the %s lane", info.Mode, info.Interval,
+			info.Lane)
+		if info.Source == "" {
+			detail += fmt.Sprintf(", %d tags", len(info.Tags))
+		}
+		ctx.Audit("schedule start", info.Label, detail)
+	}
+}
+
+func cmdAuditLog(ctx *CommandContext, args []string) {
+	count := auditLogShows
+	switch {
+	case len(args) == 0:
+	case len(args) == 1:
+		var err error
+		if count, err = strconv.Atoi(args[0]); err != nil || count < 1 {
+			ctx.SendUsage()
+			return
+		}
+		if count > auditLogMost {
+			count = auditLogMost
+		}
+	default:
+		ctx.SendUsage()
+		return
+	}
+
+	entries, err := recentAuditEntries(count)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(entries) == 0 {
+		ctx.Reply("Sire, nobody's changed anything I keep track of yet.")
+		return
+	}
+
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = fmt.Sprintf("`%s` %s: %s **%s**",
+			entry.At.In(guildLocation()).Format(DateFormat), auditUser(entry.UserID),
+			entry.Action, entry.Target)
+		if entry.Detail != "" {
+			lines[i] += ", " + entry.Detail
+		}
+	}
+	// In embeds, so nobody's pinged.
+	ctx.ReplyList("The latest changes, newest first", lines, RenderEmbed)
+}
@@ -0,0 +1,130 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * avif.go - Reading AVIF images. There's no AVIF decoder in Go's image
+ * libraries, so AvifConverter names a program that reads an AVIF on its
+ * standard input and writes a PNG to its standard output, ImageMagick's
+ * by default. It's registered with image.Decode() as WebP is, so
+ * banners, thumbnails, and image hashes all go through it, and AVIFs
+ * are turned into PNGs when the banner is set, as WebPs are. If the
+ * program isn't installed, AVIF links are refused with a word on why.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var avifLog = moduleLogger("avif")
+
+// How long AvifConverter may take over an image.
+const avifTimeout = 30 * time.Second
+
+// The most AvifConverter may write, since it's read into memory.
+const avifOutputLimit = 64 * 1024 * 1024 // 64 MB
+
+var errNoAvifConverter = errors.New("no AVIF converter is installed")
+
+func init() {
+	// AVIF images and image sequences, by their ftyp box.
+	for _, magic := range []string{"????ftypavif", "????ftypavis"} {
+		image.RegisterFormat("avif", magic, decodeAvif, decodeAvifConfig)
+	}
+}
+
+// Whether the data's an AVIF, by its ftyp box.
+func isAvif(data []byte) bool {
+	return len(data) >= 12 && string(data[4:8]) == "ftyp" &&
+		(string(data[8:12]) == "avif" || string(data[8:12]) == "avis")
+}
+
+// The AvifConverter command, or nil if it isn't set or installed.
+func avifCommand() []string {
+	command := strings.Fields(Settings.AvifConverter)
+	if len(command) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil
+	}
+	return command
+}
+
+// Turn an AVIF into a PNG with AvifConverter.
+func convertAvif(data []byte) ([]byte, error) {
+	command := avifCommand()
+	if command == nil {
+		return nil, errNoAvifConverter
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), avifTimeout)
+	defer cancel()
+
+	out := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &limitedWriter{w: &out, left: avifOutputLimit}
+	cmd.Stderr = &limitedWriter{w: &stderr, left: 4096}
+	if err := cmd.Run(); err != nil {
+		avifLog.Warn("AvifConverter failed", "command", command[0], "err", err,
+			"stderr", strings.TrimSpace(stderr.String()))
+		return nil, fmt.Errorf("converting the AVIF: %w", err)
+	}
+
+	if !bytes.HasPrefix(out.Bytes(), []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, errors.New("AvifConverter didn't write a PNG")
+	}
+	return out.Bytes(), nil
+}
+
+func decodeAvif(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := convertAvif(data)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(converted))
+}
+
+func decodeAvifConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	converted, err := convertAvif(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return png.DecodeConfig(bytes.NewReader(converted))
+}
+
+// A writer that fails once it's been given more than left bytes.
+type limitedWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.left {
+		return 0, errors.New("too much output")
+	}
+	w.left -= int64(len(p))
+	return w.w.Write(p)
+}
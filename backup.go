@@ -0,0 +1,244 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * backup.go - Backups on their own. Every BackupHours, the bard makes an
+ * export (see export.go), a zip with every image if BackupFull is on,
+ * and keeps it in BackupDir, uploads it to BackupChannelID, or both.
+ * Only the last BackupKeep are kept in each; older ones are deleted as
+ * new ones are made. `backup` makes one then and there.
+ *
+ * Backups are named bannerbard-backup-TIME, so they sort by when they
+ * were made, and only files and uploads named so are ever deleted. When
+ * the last one was made is kept in the database, so restarting the bard
+ * doesn't make one early, or put one off.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var backupLog = moduleLogger("backup")
+
+const (
+	backupPrefix     = "bannerbard-backup-"
+	backupTimeFormat = "2006-01-02T150405Z"
+	// The setting when the last backup was made is remembered under.
+	backupLastKey = "backup:last"
+)
+
+// Held while a backup is made, so two don't prune each other's.
+var backupMutex sync.Mutex
+
+/*
+ * Make a backup every BackupHours, if it's set. This procedure lasts
+ * forever, so call it with `go`.
+ */
+func StartBackups(s *discordgo.Session) {
+	if Settings.BackupHours <= 0 {
+		backupLog.Info("Backups are off")
+		return
+	}
+
+	every := time.Duration(Settings.BackupHours) * time.Hour
+	for {
+		time.Sleep(backupWait(every))
+
+		if Settings.BackupDir == "" && Settings.BackupChannelID == "" {
+			backupLog.Warn("Not backing up; set BackupDir or BackupChannelID")
+			time.Sleep(every)
+			continue
+		}
+		name, errs := makeBackup(s)
+		if !handleErrors(s, "", GeneralError, "backup", errs...) {
+			backupLog.Info("Made a backup", "name", name)
+		}
+	}
+}
+
+// How long until the next backup is due, from when the last was made.
+func backupWait(every time.Duration) time.Duration {
+	value, err := getSetting(backupLastKey)
+	if err != nil {
+		backupLog.Error("Couldn't tell when the last backup was made", "err", err)
+		return every
+	}
+
+	last, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0
+	}
+	if wait := time.Until(last.Add(every)); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+/*
+ * Make a backup, and put it wherever backups go, pruning the old ones.
+ * Returns the backup's name, and what went wrong, wherever it went
+ * wrong; a backup that only one place took still counts.
+ */
+func makeBackup(s *discordgo.Session) (name string, errs []error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+
+	now := time.Now().UTC()
+	errs = append(errs, putSetting(backupLastKey, now.Format(time.RFC3339)))
+
+	var running *SavedSchedule
+	schedule, ok, err := Scheduler.Snapshot()
+	if err != nil {
+		return "", append(errs, err)
+	} else if ok {
+		running = &schedule
+	}
+
+	export, err := buildExport(running)
+	if err != nil {
+		return "", append(errs, err)
+	}
+
+	buf := bytes.Buffer{}
+	name = backupPrefix + now.Format(backupTimeFormat)
+	if Settings.BackupFull {
+		name += ".zip"
+		missing, err := writeArchive(&buf, export)
+		if err != nil {
+			return "", append(errs, err)
+		} else if len(missing) > 0 {
+			backupLog.Warn("Left images out of a backup", "count", len(missing),
+				"err", errors.Join(missing...))
+		}
+	} else {
+		name += ".json"
+		if err := writeJSONExport(&buf, export); err != nil {
+			return "", append(errs, err)
+		}
+	}
+
+	if Settings.BackupDir != "" {
+		errs = append(errs, backupToDir(name, buf.Bytes()))
+	}
+	if Settings.BackupChannelID != "" {
+		errs = append(errs, backupToChannel(s, name, buf.Bytes()))
+	}
+	return name, errs
+}
+
+// Keep a backup in BackupDir, deleting all but the last BackupKeep.
+func backupToDir(name string, data []byte) error {
+	if err := os.MkdirAll(Settings.BackupDir, 0o700); err != nil {
+		return err
+	}
+
+	// Written aside and moved into place, so a backup is never half there.
+	path := filepath.Join(Settings.BackupDir, name)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(Settings.BackupDir)
+	if err != nil {
+		return err
+	}
+	backups := []string{}
+	for _, entry := range entries {
+		if isBackupName(entry.Name()) && entry.Type().IsRegular() {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > Settings.BackupKeep {
+		if err := os.Remove(filepath.Join(Settings.BackupDir, backups[0])); err != nil {
+			return err
+		}
+		backupLog.Info("Deleted an old backup", "name", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+/*
+ * Upload a backup to BackupChannelID, deleting all but the last
+ * BackupKeep of the bard's. Only the last 100 messages are looked
+ * through, so the channel is best kept to backups.
+ */
+func backupToChannel(s *discordgo.Session, name string, data []byte) error {
+	_, err := s.ChannelFileSendWithMessage(Settings.BackupChannelID,
+		fmt.Sprintf("A backup, sire, as of <t:%d:f>.", time.Now().Unix()), name,
+		bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("couldn't upload %s, at %s: %w", name,
+			formatBytes(int64(len(data))), err)
+	}
+
+	// Newest first.
+	messages, err := s.ChannelMessages(Settings.BackupChannelID, 100, "", "", "")
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for _, message := range messages {
+		if message.Author == nil || message.Author.ID != s.State.User.ID ||
+			len(message.Attachments) != 1 ||
+			!isBackupName(message.Attachments[0].Filename) {
+			continue
+		}
+
+		if kept++; kept <= Settings.BackupKeep {
+			continue
+		}
+		if err := s.ChannelMessageDelete(message.ChannelID, message.ID); err != nil {
+			return err
+		}
+		backupLog.Info("Deleted an old backup", "name", message.Attachments[0].Filename)
+	}
+	return nil
+}
+
+// Whether a file is one of the bard's backups.
+func isBackupName(name string) bool {
+	return strings.HasPrefix(name, backupPrefix) &&
+		(strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".zip"))
+}
+
+func cmdBackup(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	} else if Settings.BackupDir == "" && Settings.BackupChannelID == "" {
+		ctx.Reply("Sire, I've nowhere to put a backup; set `BackupDir` or " +
+			"`BackupChannelID` first.")
+		return
+	}
+
+	if Settings.BackupFull {
+		ctx.Reply("Sire, I'm gathering every image; this may take a while.")
+	}
+	name, errs := makeBackup(ctx.Session)
+	if handleCommandErrors(ctx, GeneralError, errs...) {
+		return
+	}
+	backupLog.Info("Made a backup", "name", name, "user", ctx.Event.Author.ID)
+	ctx.Reply("Sire, I've made a backup, `" + name + "`.")
+}
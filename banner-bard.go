@@ -14,19 +14,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -37,16 +35,22 @@ const SettingsFile = "settings.json"
 
 // Static error messages
 const GeneralError = "Sire, I've seem to be hit with troubles."
+const PanicError = "Sire, that went badly wrong, but I'm still standing. I've noted it " +
+	"for whoever keeps me."
 const SqlError = "Sire, the SQL server is having many troubles. " +
 	"Perchance the maintainer could diagnose this probelm in our future."
 const DiscordError = "I'm sorry, sire, but Discord gives us woe! " +
 	"Mayhaps we find a better fortune anon when times are less dark."
 const FileTypeError = "Sire, I can't find the filetype for this tag. " +
-	"I need a URL that ends in jpg, jpeg, or png."
+	"I need a URL that ends in jpg, jpeg, png, gif, webp, or avif."
 
 const OkMessage = "Yes, sire."
 const NoActiveScheduleMessage = "Sire, I don't have any tags queued up at the moment."
 
+// How dates are shown to users, and how timestamps go into exported files.
+const DateFormat = "2006-01-02 15:04 MST"
+const ExportTimeFormat = time.RFC3339
+
 var TimeUnits = map[rune]time.Duration{
 	's': time.Second,
 	'm': time.Minute,
@@ -55,47 +59,248 @@ var TimeUnits = map[rune]time.Duration{
 	'w': time.Hour * 24 * 7,
 }
 
-var logger = log.New(os.Stdout, "Banner Bard: ",
-	log.Ldate|log.Ltime|log.Lshortfile)
-
 var Settings struct {
-	ClientID     string
-	Token        string
-	OwnerID      string
-	AllowedRoles []string
-	GuildID      string
-	LogChannelID string
-	Prefix       string
+	ClientID             string
+	Token                string
+	OwnerIDs             string
+	AllowedRoles         []string
+	GuildID              string
+	LogChannelID         string
+	StatusChannelID      string
+	ArtForumChannelID    string
+	SuggestChannelID     string
+	SubmissionsChannelID string
+	SubmissionsConfirm   bool
+	StrictOwnership      bool
+	ElectionChannelID    string
+	ElectionCloses       string
+	ElectionVoteHours    int
+	Prefix               string
+	TagsPerPage          int
+	KillSwitch           bool
+	Timezone             string
+
+	EventCheckMinutes  int
+	RecheckDays        int
+	GifFallbackFrame   int
+	ImageMemoryMB      int
+	AvifConverter      string
+	BlobDir            string
+	TagFold            string
+	AckMode            string
+	AckOverrides       string
+	DisabledCommands   string
+	CommandCooldowns   string
+	CommandChannels    string
+	ConfirmDestructive bool
+	RetryAttempts      int
+	RetryBaseSeconds   int
+	WatchdogSeconds    int
+	UpdateCheck        bool
+	UpdateRepo         string
+	LogLevel           string
+	LogFormat          string
+	SentryDSN          string
+	ErrorWebhook       string
+	ApiListen          string
+	ApiToken           string
+	ClientSecret       string
+	DashboardURL       string
+	TriggerSecret      string
+	NotifyEmail        string
+	NotifyMatrix       string
+	NotifyWebhook      string
+	NotifyRoutes       string
+
+	TwitchChannel      string
+	TwitchLiveTag      string
+	TwitchClientID     string
+	TwitchClientSecret string
+	TwitchCheckMinutes int
+
+	CalendarURL          string
+	CalendarCheckMinutes int
+	HolidayCountry       string
+
+	BackupHours     int
+	BackupDir       string
+	BackupChannelID string
+	BackupKeep      int
+	BackupFull      bool
 }
 
 var BardEvaluator CommandEvaluator
 var Scheduler *BannerScheduler
 
+// Held while a banner is being set, so it can be finished before exiting.
+var bannerMutex sync.Mutex
+
+// The setting the tag currently up as the banner is remembered under.
+const currentBannerKey = "banner"
+
+// Formats `at` understands, tried in order.
+var AtTimeFormats = []string{
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"15:04",
+}
+
 // Open the globally-set SettingsFile path and marshall the data in the global Settings struct.
 func loadSettingsOrPanic() {
-	f, err := os.Open(SettingsFile)
+	data, err := os.ReadFile(SettingsFile)
 	if err != nil {
 		panic(err)
 	}
 
-	decoder := json.NewDecoder(f)
-	if err = decoder.Decode(&Settings); err != nil {
+	if err = json.Unmarshal(data, &Settings); err != nil {
+		panic(err)
+	}
+
+	// Note which settings the file gave, so they can be layered with
+	// the defaults and environment. See config.go.
+	raw := map[string]interface{}{}
+	if err = json.Unmarshal(data, &raw); err != nil {
 		panic(err)
 	}
+
+	// Settings named as they were before they were renamed, like
+	// OwnerID before OwnerIDs; see config.go for the environment.
+	for _, key := range ConfigKeys {
+		if key.Formerly == "" {
+			continue
+		}
+		if value, ok := raw[key.Formerly]; ok && raw[key.Name] == nil {
+			configLog.Warn("A setting's been renamed", "was", key.Formerly, "now", key.Name)
+			raw[key.Name] = value
+		}
+		if _, ok := os.LookupEnv(key.formerEnv()); ok {
+			configLog.Warn("A setting's been renamed", "was", key.formerEnv(), "now", key.env())
+		}
+	}
+
+	loadFileConfig(raw)
+	applyConfig()
+}
+
+/* The guild's timezone, for reading and showing wall-clock times. It's
+ * the Timezone setting, which `timezone` sets for the guild, or else
+ * UTC -- never the host machine's.
+ */
+var timezone struct {
+	mutex sync.Mutex
+	loc   *time.Location
+}
+
+const timezoneKey = "timezone"
+
+func guildLocation() *time.Location {
+	timezone.mutex.Lock()
+	defer timezone.mutex.Unlock()
+
+	if timezone.loc == nil {
+		return time.UTC
+	}
+	return timezone.loc
+}
+
+// Load the guild's timezone from the settings.
+func loadTimezone() error {
+	loc, err := time.LoadLocation(Settings.Timezone)
+	if err != nil {
+		return err
+	}
+
+	timezone.mutex.Lock()
+	timezone.loc = loc
+	timezone.mutex.Unlock()
+	return nil
+}
+
+// Return the tag currently up as the banner, or "" if we don't know.
+func currentBanner() (string, error) {
+	return getSetting(currentBannerKey)
+}
+
+/* Read a wall-clock time in the guild's timezone. A time without a date
+ * means the next time the clock reads that.
+ */
+func parseWallTime(raw string, now time.Time) (time.Time, error) {
+	loc := guildLocation()
+	now = now.In(loc)
+
+	for _, format := range AtTimeFormats {
+		at, err := time.ParseInLocation(format, raw, loc)
+		if err != nil {
+			continue
+		}
+
+		if format == "15:04" {
+			at = time.Date(now.Year(), now.Month(), now.Day(),
+				at.Hour(), at.Minute(), 0, 0, loc)
+			if !at.After(now) {
+				at = at.AddDate(0, 0, 1)
+			}
+		}
+
+		return at, nil
+	}
+
+	return time.Time{}, errors.New("not a time I know the format of")
 }
 
 // Return the URL recommended to start the bot.
 func botUrl() string {
 	return fmt.Sprintf("https://discordapp.com/oauth2/authorize"+
-		"?client_id=%s&scope=bot&permissions=3104",
+		"?client_id=%s&scope=bot%%20applications.commands&permissions=3104",
 		Settings.ClientID)
 }
 
+/* Tell the staff about something that needs them: in the log channel if
+ * there is one, or else in a DM to the owner.
+ */
+func notifyStaff(s *discordgo.Session, event string, message string) {
+	notify(event, message)
+	if Settings.LogChannelID == "" {
+		notifyOwner(s, message)
+		return
+	}
+
+	logger.Warn(message)
+	if _, err := s.ChannelMessageSend(Settings.LogChannelID, message); err != nil {
+		logger.Error("Couldn't notify the staff", "err", err)
+	}
+}
+
+// Send each owner a message directly.
+func notifyOwner(s *discordgo.Session, message string) {
+	logger.Warn(message)
+
+	for _, owner := range ownerIDs() {
+		channel, err := s.UserChannelCreate(owner)
+		if err == nil {
+			_, err = s.ChannelMessageSend(channel.ID, message)
+		}
+		if err != nil {
+			logger.Error("Couldn't message an owner", "owner", owner, "err", err)
+		}
+	}
+}
+
 /* Generic handling of errors. If errors exist, log them all out. Return
  * whether there were errors.
  */
 func handleErrors(s *discordgo.Session, channelID string,
 	flavor string, source string, errs ...error) bool {
+	return handleReportedErrors(s, channelID, flavor,
+		ErrorReport{Command: source}, errs...)
+}
+
+/* Handle errors like handleErrors(), reporting each one (see errreport.go)
+ * with what the report says was going on.
+ */
+func handleReportedErrors(s *discordgo.Session, channelID string,
+	flavor string, report ErrorReport, errs ...error) bool {
 	// Yes, handling errors in Go is extremely messy, and Go doesn't have
 	// many tools to abstract away Error handling -- and this messy
 	// function shows it. However, handling errors by value (alongside
@@ -107,7 +312,11 @@ func handleErrors(s *discordgo.Session, channelID string,
 	for _, err := range errs {
 		if err != nil {
 			realErrs = append(realErrs, err)
-			logger.Println(source + ": " + err.Error())
+			logger.Error(flavor, "command", report.Command, "err", err)
+
+			report.Kind = errorKind(flavor)
+			report.Message = err.Error()
+			reportError(report)
 		}
 	}
 
@@ -131,17 +340,19 @@ func handleErrors(s *discordgo.Session, channelID string,
 func handleCommandErrors(ctx *CommandContext, flavor string, errs ...error) bool {
 	// Helper function to unwrap error-handling within context of
 	// a command.
-	return handleErrors(ctx.Session, ctx.Event.ChannelID,
-		flavor, ctx.CommandName, errs...)
+	return handleReportedErrors(ctx.Session, ctx.Event.ChannelID, flavor,
+		ErrorReport{Command: ctx.CommandName, User: ctx.Event.Author.ID,
+			Channel: ctx.Event.ChannelID}, errs...)
 }
 
 // Banner setting
 
 /* Return the MIME subtype of a banner-allowed file by its extension, or "" if
  * not recognized. Banners allow only png and jpg, so we only check for this.
+ * A URL's query is left out, since Discord's attachment links end in one.
  */
 func imageType(url string) string {
-	url = strings.ToLower(url)
+	url = strings.ToLower(linkPath(url))
 	switch {
 	case strings.HasSuffix(url, "jpg"):
 		return "jpg"
@@ -149,6 +360,12 @@ func imageType(url string) string {
 		return "jpg"
 	case strings.HasSuffix(url, "png"):
 		return "png"
+	case strings.HasSuffix(url, "gif"):
+		return "gif"
+	case strings.HasSuffix(url, "webp"):
+		return "webp"
+	case strings.HasSuffix(url, "avif"):
+		return "avif"
 	default:
 		return ""
 	}
@@ -156,37 +373,112 @@ func imageType(url string) string {
 
 /* Set the banner of the guild configured by the SettingsFile with the name of
  * the tag. An error is returned if the tag doesn't exist, the tag's URL
- * rotted, or Discord failed to set the banner.
+ * rotted, or Discord failed to set the banner. GIFs are only animated
+ * if the guild's boost level allows it, see gif.go. source is what set
+ * it ("set", "schedule", "twitch", and so on), for `stats`.
  */
-func setBanner(s *discordgo.Session, name string) error {
+func setBanner(s *discordgo.Session, name string, source string) error {
+	bannerMutex.Lock()
+	defer bannerMutex.Unlock()
+
 	tag, err := namedTag(name)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Get(tag.Url)
+	data, err := fetchImage(tag.Url)
 	if err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
-	buf := bytes.Buffer{}
-	buf.WriteString("data:image/" + imageType(tag.Url) + ";base64,")
-	enc := base64.NewEncoder(base64.StdEncoding, &buf)
-	io.Copy(enc, resp.Body)
-	enc.Close()
+	if err = checkImageMemory(data); err != nil {
+		return err
+	}
+
+	data, filetype, err := bannerImage(data, imageType(tag.Url))
+	if err != nil {
+		return err
+	}
+
+	if filetype == "gif" {
+		animates, err := guildAnimates(s)
+		if err != nil {
+			return err
+		}
+
+		if !animates {
+			logger.Info("Guild can't animate its banner; using one frame",
+				"tag", tag.Name, "frame", Settings.GifFallbackFrame)
+			if data, err = gifFrame(data, Settings.GifFallbackFrame); err != nil {
+				return err
+			}
+			filetype = "png"
+		}
+	}
+
+	crop, err := tagCrop(tag.Name)
+	if err != nil {
+		return err
+	}
+
+	data, filetype, err = cropBanner(data, filetype, crop)
+	if err != nil {
+		return err
+	}
 
-	_, err = s.GuildEdit(Settings.GuildID,
-		discordgo.GuildParams{Banner: buf.String()})
+	data, filetype, err = fitBanner(data, filetype)
 	if err != nil {
 		return err
 	}
 
+	if KillSwitch.Engaged() {
+		logger.Info("Kill switch is on; would have set the banner", "tag", tag.Name)
+		return nil
+	}
+
+	if err = preflightBanner(s); err != nil {
+		return err
+	}
+
+	if err = uploadBanner(s, data, filetype); err != nil {
+		return err
+	}
+
 	// Log the action
-	logger.Printf("Set banner to tag %s\n", tag)
+	logger.Info("Set the banner", "tag", tag.Name)
+	if err = putSetting(currentBannerKey, name); err != nil {
+		return err
+	}
+	queueUsage(tag.Name, source, time.Now())
+
+	Status.Touch()
+	if err = creditArt(s, tag); err != nil {
+		logger.Warn("Couldn't credit the banner's artist", "tag", tag.Name, "err", err)
+	}
 	return nil
 }
 
+/* Return the user ID out of a mention like <@1234> or <@!1234>. Plain
+ * IDs are returned as-is, and anything else returns "".
+ */
+func parseUserID(arg string) string {
+	if strings.HasPrefix(arg, "<@") && strings.HasSuffix(arg, ">") {
+		arg = strings.TrimPrefix(arg[2:len(arg)-1], "!")
+	}
+
+	if arg == "" {
+		return ""
+	}
+
+	for _, chr := range arg {
+		if !isDigit(chr) {
+			return ""
+		}
+	}
+
+	return arg
+}
+
 func isDigit(chr rune) bool {
 	return chr >= '0' && chr <= '9'
 }
@@ -226,74 +518,399 @@ func init() {
 	// declaration because Go gives a circular dependence
 	// otherwise (BardEvaluator references cmdHelp, which in turn
 	// references BardEvaluator to buld the help message).
-	const PermDefault = PermRole | PermManageServer
 
 	BardEvaluator = BuildCommandEvaluator("I switch out banners for you, sire").
 		//
 		Simple("help", cmdHelp, "to show a synopsis of all my commands",
-			"", PermEveryone).
+			"[--search TEXT...]", PermEveryone|FlagReadOnly).
+		Examples("--search banner", "--search playlist").
 		//
 		Group("Tags").
-		Simple("new", cmdNew, "to make a new tag or replace a preexisting tag",
-			"TAG URL", PermDefault).
-		Simple("del", cmdDel, "to delete a preexisting tag",
-			"TAG", PermDefault).
+		Simple("new", cmdNew,
+			"to make a new tag or replace a preexisting tag, from a URL or an attached image, or tags of several images",
+			"TAG [URL] | [PREFIX]", PermDefault).
+		Examples("snowy https://example.com/snow.png").
+		Simple("suggest", cmdSuggest,
+			"to suggest a new tag to the staff, from a URL or an attached image",
+			"TAG [URL]", PermEveryone).
+		Examples("snowy https://example.com/snow.png").
+		Simple("suggestions", cmdSuggestions, "to list the suggestions waiting on the staff",
+			"", PermDefault|FlagReadOnly).
+		Simple("del", cmdDel,
+			"to delete preexisting tags; * in a TAG matches any run of characters",
+			"TAGS...", PermDefault).
+		Examples("snowy", "halloween-*").
+		Simple("rename", cmdRename,
+			"to rename a tag, keeping it in its playlists and schedules",
+			"OLD NEW", PermDefault).
+		Examples("snowy snowy-night").
+		Simple("update", cmdUpdate,
+			"to point a preexisting tag at a new URL or attached image",
+			"TAG [URL]", PermDefault).
+		Examples("snowy https://example.com/snow2.png").
+		Simple("transfer", cmdTransfer, "to give a tag to another member",
+			"TAG USER", PermDefault).
+		Examples("snowy @artist").
+		Simple("undo", cmdUndo,
+			"to take back your latest tag deletion, playlist edit, or import",
+			"", PermDefault).
+		Simple("lock", cmdLock,
+			"to keep a tag from being replaced or deleted until it's unlocked, or list what's locked",
+			"[TAG]", PermManageServer).
+		Examples("default-banner").
+		Simple("unlock", cmdUnlock, "to let a locked tag be replaced or deleted again",
+			"TAG", PermManageServer).
 		Simple("set", cmdSet, "to set the banner to a tag",
 			"TAG", PermDefault).
-		Simple("shuffle", cmdShuffle, "to shuffle through multiple tags over time",
-			"INTERVAL TAGS...", PermDefault).
-		Simple("cycle", cmdCycle, "to cycle through ordered tags over time",
+		Examples("snowy").
+		Simple("vote", cmdVote, "to let members vote on the next banner",
 			"INTERVAL TAGS...", PermDefault).
+		Examples("1d snowy rainy sunny").
+		Simple("votes", cmdVotes, "to list the votes open",
+			"", PermEveryone|FlagReadOnly).
+		Compound("election", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("nominate", cmdElectionNominate,
+				"to nominate a tag for this week's banner election",
+				"TAG", PermEveryone).
+			Examples("snowy").
+			Simple("ls", cmdElectionLs, "to list the nominations, and when voting opens",
+				"", PermEveryone|FlagReadOnly).
+			Simple("winners", cmdElectionWinners,
+				"to list past banners of the week, and whose tags won most",
+				"", PermEveryone|FlagReadOnly)).
+		Simple("shuffle", cmdShuffle,
+			"to shuffle through multiple tags, and playlists' with pl:, over time",
+			"[--label LABEL] [--lane LANE] INTERVAL TAGS... [--except PATTERN]", PermDefault).
+		Examples("1h snowy rainy sunny", "2d30m snowy rainy",
+			"--label weeknights 6h cozy rainy", "1h pl:winter snowman extra-tag",
+			"--lane icon 1d icon-red icon-blue",
+			"1h pl:all --except halloween-*").
+		Simple("cycle", cmdCycle,
+			"to cycle through ordered tags, and playlists' with pl:, over time",
+			"[--label LABEL] [--lane LANE] INTERVAL TAGS... [--except PATTERN]", PermDefault).
+		Examples("1h snowy rainy sunny", "1h pl:christmas pl:newyear").
 		Simple("play", cmdPlay, "to play through tags once only over time",
-			"INTERVAL TAGS...", PermDefault).
+			"[--label LABEL] [--lane LANE] [--reverse|--random-once|--pingpong] INTERVAL TAGS... [--except PATTERN]", PermDefault).
+		Examples("30m countdown-3 countdown-2 countdown-1",
+			"--random-once 1h snowy rainy sunny").
 		Simple("ls", cmdLs, "to list all tags",
-			"", PermEveryone).
+			"[PAGE]", PermEveryone|FlagReadOnly).
 		Simple("show", cmdShow, "to show the tag's description",
-			"TAG", PermEveryone).
+			"TAG", PermEveryone|FlagReadOnly).
+		Simple("stats", cmdStats,
+			"to show which tags go up most and least, and whose tags are shown most",
+			"[TAG]", PermEveryone|FlagReadOnly).
+		Examples("snowy").
+		Simple("describe", cmdDescribe, "to give a tag a description",
+			"TAG TEXT...", PermDefault).
+		Simple("credit", cmdCredit,
+			"to show or change who a tag's art is credited to",
+			"TAG [ARTIST...|none]", PermDefault).
+		Examples("sunset @someone", "sunset Jane Doe (janedoe.art)").
+		Compound("audit", BuildCompoundCommand(PermDefault|FlagReadOnly).
+			Fallback(cmdAudit,
+				"to check every tag's link, and optionally forget or pass over the broken ones",
+				"[--delete|--quarantine]", PermDefault|FlagReadOnly).
+			Examples("--quarantine").
+			Simple("log", cmdAuditLog,
+				"to show who's changed tags, playlists, and schedules lately",
+				"[N]", PermDefault|FlagReadOnly).
+			Examples("25")).
+		Simple("dupes", cmdDupes, "to list tags that look like one another",
+			"", PermEveryone|FlagReadOnly).
+		Simple("crop", cmdCrop,
+			"to show or change how a tag's image is cropped to a banner's shape",
+			"TAG [none|center|entropy]", PermDefault).
+		Examples("portrait-cat entropy").
 		//
 		Group("Playlists").
-		Compound("playlist", BuildCompoundCommand(PermEveryone).
+		Compound("playlist", BuildCompoundCommand(PermEveryone|FlagReadOnly).
 			Simple("new", cmdPlaylistNew,
-				"to create a new playlist",
-				"PLAYLIST TAGS...", PermDefault).
+				"to create a new playlist, from tags or an attached file of them",
+				"PLAYLIST [TAGS...]", PermDefault|PermCrew).
+			Examples("winter snowy icy").
 			Simple("add", cmdPlaylistAdd,
 				"to add tags to a playlist",
-				"PLAYLIST TAGS...", PermDefault).
+				"PLAYLIST TAGS...", PermDefault|PermCrew).
 			Simple("rm", cmdPlaylistRm,
 				"to remove tags from a playlist",
-				"PLAYLIST TAGS...", PermDefault).
+				"PLAYLIST TAGS...", PermDefault|PermCrew).
 			Simple("del", cmdPlaylistDel, "to delete a playlist",
-				"PLAYLIST", PermDefault).
+				"PLAYLIST", PermDefault|PermCrew).
+			Simple("copy", cmdPlaylistCopy,
+				"to add a playlist's tags to another, making it if need be",
+				"SRC DST", PermDefault|PermCrew).
+			Examples("winter winter-2024").
+			Simple("merge", cmdPlaylistMerge,
+				"to gather several playlists' tags into one, leaving them as they are",
+				"PLAYLISTS... [into] DST", PermDefault|PermCrew).
+			Examples("christmas newyear into holidays").
+			Simple("nest", cmdPlaylistNest,
+				"to include other playlists in a playlist, so it plays their tags too",
+				"PLAYLIST CHILDREN...", PermDefault|PermCrew).
+			Examples("winter christmas newyear generic-snow").
+			Simple("unnest", cmdPlaylistUnnest,
+				"to take nested playlists out of a playlist",
+				"PLAYLIST CHILDREN...", PermDefault|PermCrew).
+			Simple("smart", cmdPlaylistSmart,
+				"to show or change the tags a playlist takes in on its own, by name or maker",
+				"PLAYLIST [PATTERN|none] [--author USER]", PermDefault|PermCrew).
+			Examples("cats cat-*", "alices-art --author @Alice", "cats none").
+			Simple("crew", cmdPlaylistCrew,
+				"to show or change the role whose members keep a playlist",
+				"PLAYLIST [ROLE|none]", PermManageServer).
+			Examples("art-team-picks @ArtTeam", "art-team-picks none").
+			Simple("lock", cmdPlaylistLock,
+				"to keep a playlist from being changed or deleted until it's unlocked",
+				"PLAYLIST", PermManageServer).
+			Simple("unlock", cmdPlaylistUnlock, "to let a locked playlist be changed again",
+				"PLAYLIST", PermManageServer).
 			Simple("shuffle", cmdPlaylistShuffle,
 				"to shuffle through a playlist over time",
-				"INTERVAL PLAYLIST", PermDefault).
+				"[--label LABEL] [--lane LANE] INTERVAL PLAYLIST [--except PATTERN]", PermDefault).
+			Examples("6h winter").
 			Simple("cycle", cmdPlaylistCycle,
 				"to cycle through the playlist over time",
-				"INTERVAL PLAYLIST", PermDefault).
+				"[--label LABEL] [--lane LANE] INTERVAL PLAYLIST [--except PATTERN]", PermDefault).
 			Simple("play", cmdPlaylistPlay,
 				"to go through a playlist once only over time",
-				"INTERVAL PLAYLIST", PermDefault).
+				"[--label LABEL] [--lane LANE] [--reverse|--random-once|--pingpong] INTERVAL PLAYLIST [--except PATTERN]", PermDefault).
 			Simple("ls", cmdPlaylistLs, "to list all playlists",
-				"", PermEveryone).
-			Simple("show", cmdPlaylistShow, "to show the tags in a playlist",
-				"PLAYLIST", PermEveryone)).
+				"", PermEveryone|FlagReadOnly).
+			Simple("show", cmdPlaylistShow,
+				"to show the tags and nested playlists in a playlist",
+				"PLAYLIST", PermEveryone|FlagReadOnly)).
+		Simple("share", cmdShare,
+			"to make a code another bard can import a playlist from, or a zip with its images",
+			"PLAYLIST [full]", PermEveryone|FlagReadOnly).
+		Simple("curate", cmdCurate,
+			"to open a thread for gathering tags and images into a playlist",
+			"PLAYLIST", PermDefault|PermCrew).
+		//
+		Group("Seasons").
+		Compound("season", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("set", cmdSeasonSet,
+				"to put a playlist in season between two dates each year",
+				"PLAYLIST START END", PermDefault).
+			Examples("october 10-01 10-31", "winter 12-01 02-28").
+			Simple("rm", cmdSeasonRm, "to take a playlist's season away",
+				"PLAYLIST", PermDefault).
+			Simple("default", cmdSeasonDefault,
+				"to show or change the playlist for between seasons",
+				"[PLAYLIST|none]", PermDefault).
+			Simple("ls", cmdSeasonLs, "to list the seasons",
+				"", PermEveryone|FlagReadOnly).
+			Simple("auto", cmdSeasonAuto,
+				"to shuffle (or cycle) through whichever playlist is in season",
+				"INTERVAL [--cycle]", PermDefault).
+			Examples("6h", "1d --cycle")).
 		//
 		Group("Scheduler").
-		Simple("stop", cmdStop, "to stop playing through the banner queue",
-			"", PermDefault).
-		Simple("next", cmdNext, "to skip to the next tag in the banner queue",
-			"", PermDefault).
+		Simple("timezone", cmdTimezone, "to show or change the timezone I read times in",
+			"[ZONE]", PermDefault).
+		Examples("America/New_York", "Europe/Berlin", "UTC").
+		Compound("quiet", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("add", cmdQuietAdd,
+				"to keep the schedule from changing the banner between two times each day",
+				"START END", PermDefault).
+			Examples("01:00 07:00", "22:30 06:00").
+			Simple("rm", cmdQuietRm, "to remove quiet hours",
+				"ID", PermDefault).
+			Simple("ls", cmdQuietLs, "to list quiet hours",
+				"", PermEveryone|FlagReadOnly)).
+		Simple("stop", cmdStop, "to stop playing through the banner queue, or a lane's",
+			"[LANE|all]", PermDefault).
+		Examples("icon", "all").
+		Compound("schedules", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("ls", cmdSchedulesLs, "to list the running schedules by label",
+				"", PermEveryone|FlagReadOnly).
+			Simple("show", cmdSchedulesShow, "to show how a running schedule is going",
+				"LABEL", PermEveryone|FlagReadOnly).
+			Simple("stop", cmdSchedulesStop, "to stop one running schedule",
+				"LABEL", PermDefault).
+			Examples("weeknights")).
+		Simple("next", cmdNext,
+			"to skip to the next tag in the banner queue, or COUNT tags ahead",
+			"[COUNT]", PermDefault).
+		Examples("3").
+		Simple("interval", cmdInterval,
+			"to change the time between tags without starting the queue over",
+			"INTERVAL", PermDefault).
+		Examples("6h").
+		Simple("duration", cmdDuration,
+			"to show or change how long a tag stays up in a schedule, whatever the interval",
+			"TAG [INTERVAL|none]", PermDefault).
+		Examples("game-night 6h", "game-night none").
+		Simple("catchup", cmdCatchUp,
+			"to show or change what the queue does about banners missed while I was away",
+			"[skip-missed|fire-once|fast-forward]", PermDefault).
+		Examples("fast-forward").
+		Simple("jump", cmdJump, "to skip ahead to a tag in the banner queue",
+			"TAG", PermDefault).
+		Compound("queue", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("show", cmdQueueShow, "to show the banner queue",
+				"", PermEveryone|FlagReadOnly).
+			Simple("add", cmdQueueAdd,
+				"to add a tag to the banner queue without starting it over",
+				"TAG", PermDefault).
+			Simple("rm", cmdQueueRm,
+				"to take a tag out of the banner queue without starting it over",
+				"TAG", PermDefault)).
+		Compound("schedule", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("export", cmdScheduleExport,
+				"to upload what's planned for the banner as a calendar file",
+				"ics", PermEveryone|FlagReadOnly)).
+		Simple("at", cmdAt,
+			"to set a tag at a given time, and optionally put the old one back after a while",
+			"TIME TAG [FOR] | ls | cancel ID", PermDefault).
+		Examples("2024-12-25T00:00 christmas 1d", "18:30 movie-night 3h", "ls").
+		//
+		Group("Events").
+		Compound("event", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("add", cmdEventAdd,
+				"to put up a tag while a scheduled event has enough RSVPs",
+				"EVENT_ID TAG RSVPS", PermDefault).
+			Examples("1000000000000000000 game-night 10").
+			Simple("rm", cmdEventRm, "to remove an event rule",
+				"ID", PermDefault).
+			Simple("ls", cmdEventLs, "to list upcoming events and my rules for them",
+				"", PermEveryone|FlagReadOnly)).
+		Compound("milestone", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("add", cmdMilestoneAdd,
+				"to put up a tag for a while when we reach a member count, or the boost level changes",
+				"members COUNT TAG FOR | boost-up TAG FOR | boost-down TAG FOR", PermDefault).
+			Examples("members 1000 thousand-strong 1d", "boost-up level-up 12h").
+			Simple("rm", cmdMilestoneRm, "to remove a milestone",
+				"ID", PermDefault).
+			Simple("ls", cmdMilestoneLs, "to list the milestones I'm waiting on",
+				"", PermEveryone|FlagReadOnly)).
+		Compound("holiday", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("map", cmdHolidayMap,
+				"to put up a tag (or one of a playlist's) on a holiday each year",
+				"HOLIDAY TAG|PLAYLIST", PermDefault).
+			Examples("christmas xmas-playlist", "independence-day fireworks").
+			Simple("unmap", cmdHolidayUnmap, "to stop marking a holiday",
+				"HOLIDAY", PermDefault).
+			Simple("ls", cmdHolidayLs, "to list this year's holidays and what I'll put up",
+				"", PermEveryone|FlagReadOnly)).
+		Compound("calendar", BuildCompoundCommand(PermEveryone|FlagReadOnly).
+			Simple("ls", cmdCalendarLs,
+				"to list the week's calendar entries, and the tags they'll put up",
+				"", PermEveryone|FlagReadOnly)).
 		//
 		Group("Backups").
-		Simple("export", cmdExport, "to upload all tags as a csv file.",
-			"", PermDefault).
-		Simple("import", cmdImport, "to import tags from a csv file.",
-			"", PermDefault).
+		Simple("export", cmdExport,
+			"to upload all tags, playlists, and the schedule as a json file, with every image as a zip, or the tags alone as csv.",
+			"[full|csv]", PermDefault).
+		Simple("import", cmdImport,
+			"to import tags and playlists from an export, replacing mine or merged in with merge, or a playlist shared by another bard.",
+			"[merge] [--dry-run] | code CODE [PLAYLIST]", PermDefault).
+		Simple("backup", cmdBackup,
+			"to make a backup now, wherever backups go.",
+			"", PermOwner).
+		Simple("userdata", cmdUserData,
+			"to upload everything I remember about a user as a json file.",
+			"USER", PermOwner|FlagReadOnly).
+		//
+		Group("Maintenance").
+		Simple("version", cmdVersion, "to show which Banner Bard I am",
+			"", PermEveryone|FlagReadOnly).
+		Simple("whatsnew", cmdWhatsnew,
+			"to show what I've learned since the last release (or all along)",
+			"[all]", PermDefault|FlagReadOnly).
+		Simple("killswitch", cmdKillSwitch,
+			"to stop (or resume) actually changing the banner",
+			"[on|off]", PermOwner).
+		Simple("drain", cmdDrain,
+			"to finish up, save the schedule, and shut down for a deploy",
+			"[ETA]", PermOwner).
+		Compound("perms", BuildCompoundCommand(PermDefault|FlagReadOnly).
+			Simple("test", cmdPermsTest,
+				"to explain whether someone may run a command, and why",
+				"USER COMMAND [SUBCOMMAND [PLAYLIST]]", PermDefault|FlagReadOnly).
+			Examples("@someone shuffle", "@someone playlist add art-team-picks").
+			Simple("set", cmdPermsSet,
+				"to let a role run a command",
+				"COMMAND [SUBCOMMAND] role ROLE", PermOwner).
+			Examples("shuffle role @DJ", "playlist add role @Curators").
+			Simple("unset", cmdPermsUnset,
+				"to take a command back from a role",
+				"COMMAND [SUBCOMMAND] role ROLE", PermOwner).
+			Simple("list", cmdPermsList,
+				"to show which roles I've given which commands",
+				"", PermDefault|FlagReadOnly)).
+		Compound("admin", BuildCompoundCommand(PermOwner|FlagReadOnly).
+			Simple("db", cmdAdminDb, "to look into (or tidy up) my database",
+				"tables | count TABLE | vacuum | size", PermOwner).
+			Examples("tables", "count tag").
+			Simple("commands", cmdAdminCommands,
+				"to show how often each command's been run, and how long it takes",
+				"", PermOwner|FlagReadOnly).
+			Simple("ban", cmdAdminBan,
+				"to bar a member from my commands, whatever roles they hold",
+				"USER [REASON]", PermOwner).
+			Examples("@someone spamming set").
+			Simple("unban", cmdAdminUnban,
+				"to let a barred member run my commands again",
+				"USER", PermOwner).
+			Simple("bans", cmdAdminBans,
+				"to list the members barred from my commands",
+				"", PermOwner|FlagReadOnly).
+			Simple("channels", cmdAdminChannels,
+				"to show or change the channels I take commands in",
+				"[add|rm CHANNEL]", PermOwner).
+			Examples("add #banner-staff", "rm #general")).
+		Compound("cache", BuildCompoundCommand(PermOwner|FlagReadOnly).
+			Simple("stats", cmdCacheStats,
+				"to show how often I remember tags without asking the database",
+				"", PermOwner|FlagReadOnly)).
+		Compound("config", BuildCompoundCommand(PermOwner|FlagReadOnly).
+			Simple("effective", cmdConfigEffective,
+				"to show my settings and where each one comes from",
+				"", PermOwner|FlagReadOnly).
+			Simple("set", cmdConfigSet,
+				"to change a setting until I restart",
+				"NAME VALUE", PermOwner).
+			Examples("TagsPerPage 10").
+			Simple("pin", cmdConfigPin,
+				"to change a setting for the guild, for good",
+				"NAME VALUE", PermOwner).
+			Examples("LogChannelID 1000000000000000000").
+			Simple("unset", cmdConfigUnset,
+				"to drop the guild and runtime changes to a setting",
+				"NAME", PermOwner).
+			Simple("disable", cmdConfigDisable,
+				"to turn a command off for the guild",
+				"COMMAND [SUBCOMMAND]", PermOwner).
+			Examples("import", "playlist del").
+			Simple("enable", cmdConfigEnable,
+				"to turn a disabled command back on",
+				"COMMAND [SUBCOMMAND]", PermOwner)).
 		//
 		Done()
+
+	RegisterReadOnlyComponent("ls", componentLs)
+	RegisterComponent("curate-done", componentCurateDone)
+	RegisterComponent("curate-cancel", componentCurateCancel)
+	RegisterComponent("suggest-approve", componentSuggestApprove)
+	RegisterComponent("suggest-reject", componentSuggestReject)
+	RegisterComponent("save-tag", componentSaveTag)
+	RegisterMenuCommand(SaveTagMenuName, menuSaveTag)
+	RegisterComponent("new-tag", componentNewTag)
+	RegisterComponent("new-tag-edit", componentNewTagEdit)
+	RegisterComponent("vote", componentVote)
+	RegisterComponent("confirm", componentConfirm)
+	RegisterReadOnlyComponent("confirm-cancel", componentConfirmCancel)
+	RegisterSlashCommand(NewSlashCommand, slashNew)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulateMain(os.Args[2:])
+		return
+	}
+	cliMain(os.Args[1:])
+
 	loadSettingsOrPanic()
 	fmt.Println("Invite this bot at", botUrl())
 
@@ -304,42 +921,108 @@ func main() {
 	}
 	defer closeDbOrPanic()
 
+	if err = loadGuildConfig(); err != nil {
+		panic(err)
+	}
+
+	if err = reloadConfig(); err != nil {
+		panic(err)
+	}
+
+	// Without an owner, nobody could run the commands only owners may.
+	if len(ownerIDs()) == 0 {
+		panic("no owner: set OwnerIDs in settings.json, or BANNER_BARD_OWNERIDS")
+	}
+
+	migrateTagNamesOrPanic()
+
+	go StartWriter()
+
 	discord, err := discordgo.New("Bot " + Settings.Token)
 	if err != nil {
 		panic(err)
 	}
 
 	discord.AddHandler(messageCreate)
+	discord.AddHandler(interactionCreate)
+	discord.AddHandler(submitReactionAdd)
+	discord.AddHandler(milestoneGuildCreate)
+	discord.AddHandler(milestoneGuildUpdate)
+	discord.AddHandler(milestoneMemberAdd)
+
+	// Counting members takes a privileged intent, so only ask if needed.
+	counting, err := memberMilestonesWaiting()
+	if err != nil {
+		panic(err)
+	} else if counting {
+		discord.Identify.Intents |= discordgo.IntentsGuildMembers
+	}
 
 	// Open websocket connection and begin listening
 	if err = discord.Open(); err != nil {
 		panic(err)
 	}
 
-	// Set up the banner scheduler
-	Scheduler = NewScheduler(discord)
-	go Scheduler.StartJob(discord)
-
-	// Wait here until Ctrl-C or other term signal is received.
-	logger.Println("Bot is now running. Press ^C to exit.")
+	// Set up the banner scheduler, and the other lanes beside it
+	Lanes = NewScheduleManager(discord)
+	Scheduler, _ = Lanes.Lane(LaneBanner)
+	Lanes.Start(discord)
+	go StartRecheck(discord)
+	go StartUpdateCheck(discord)
+	go AnnounceWhatsnew(discord)
+	go StartAppCommands(discord)
+	go StartStatus(discord)
+	go StartPolls(discord)
+	go StartAPI(discord)
+	go StartBackups(discord)
+
+	// Pick up the schedules where the last run drained them.
+	restored, errs := Lanes.Restore()
+	handleErrors(discord, "", SqlError, "restore", errs...)
+	if len(restored) > 0 {
+		logger.Info("Resumed the saved schedules", "lanes", restored)
+	}
+
+	// Wait here until Ctrl-C or other term signal is received, or
+	// until the bard is drained.
+	logger.Info("Bot is now running. Press ^C to exit.")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	<-sc
-
-	// Close the session with dignity.
-	logger.Println("Closing gracefully...")
+	select {
+	case <-sc:
+		drainOnSignal(discord)
+	case <-drained:
+	}
+
+	// Close the session with dignity, once everything's written. The
+	// database is closed on the way out.
+	logger.Info("Closing gracefully...")
+	Lanes.Shutdown()
+	FlushWrites()
+	announceShutdown(discord)
 	discord.Close()
-	logger.Println("Bye!")
+	logger.Info("Bye!")
 }
 
 func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	defer recoverEvent("messageCreate")
+
 	if m.GuildID != Settings.GuildID {
 		// Ignore all commands outside the server
 		return
 	}
 
-	if m.Author.Bot || !strings.HasPrefix(m.Content, Settings.Prefix) {
-		// Disregard all bot comments and non-prefixed messages
+	if m.Author.Bot {
+		// Disregard all bot comments
+		return
+	}
+
+	if !strings.HasPrefix(m.Content, Settings.Prefix) {
+		// Disregard non-prefixed messages, unless they're in a
+		// curation thread or the submissions channel
+		if !curateMessage(s, m) {
+			submitMessage(s, m)
+		}
 		return
 	}
 
@@ -349,68 +1032,199 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 /// Commands
 
 func cmdHelp(ctx *CommandContext, args []string) {
-	ctx.Reply(BardEvaluator.Help(ctx))
+	if len(args) == 0 {
+		ctx.ReplyLong(BardEvaluator.Help(ctx))
+		return
+	}
+
+	if args[0] != "--search" || len(args) < 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	query := strings.Join(args[1:], " ")
+	help := BardEvaluator.Search(ctx, query)
+	if help == "" {
+		ctx.Reply("Sire, I know of no commands about **" + query + "**.")
+		return
+	}
+
+	ctx.ReplyLong(help)
 }
 
 // Tag Commands
 
+// What's wrong with an image's type, if anything.
+func imageTypeProblem(url string) string {
+	if imageType(url) == "avif" && avifCommand() == nil {
+		return "Sire, I can't read AVIF images without AvifConverter " +
+			"installed. A PNG, JPEG, GIF, or WebP of it will do."
+	} else if imageType(url) == "" {
+		return FileTypeError
+	}
+	return ""
+}
+
+// Check that it's a good image type, and say so if it isn't.
+func refuseImageType(ctx *CommandContext, url string) bool {
+	if problem := imageTypeProblem(url); problem != "" {
+		ctx.Reply(problem)
+		return true
+	}
+	return false
+}
+
+/*
+ * Make a tag, or point one at a new image, keep a copy of the image,
+ * and say how it went, warning if it looks like another tag. Only a
+ * failure to remember the tag at all is an error.
+ */
+func rememberTag(tag string, authorID string, url string) (string, error) {
+	err := insertTag(tag, authorID, url)
+	if err != nil {
+		return "", err
+	}
+
+	// Log the action
+	logger.Info("Remembered a tag", "tag", tag, "url", url, "user", authorID)
+
+	// Keep a copy of the image, in case the link rots.
+	data, err := cacheImage(url)
+	if err != nil {
+		logger.Warn("Couldn't cache a tag's image", "tag", tag, "err", err)
+		return fmt.Sprintf("I'll remember tag **%s**, sire, though I "+
+			"couldn't keep a copy of its image: %s.", tag, err), nil
+	}
+
+	// Warn if it's the same picture as another tag's. A failure here
+	// is only logged, since the tag itself is fine.
+	alike, err := hashNewTag(tag, data)
+	if err != nil {
+		logger.Warn("Couldn't hash a tag's image", "tag", tag, "err", err)
+	}
+
+	if len(alike) > 0 {
+		return fmt.Sprintf("I'll remember tag **%s**, though it looks "+
+			"just like **%s**, sire.", tag, strings.Join(alike, "**, **")), nil
+	}
+	return fmt.Sprintf("I'll remember tag **%s**.", tag), nil
+}
+
 func cmdNew(ctx *CommandContext, args []string) {
-	if len(args) != 2 {
+	var tag, url string
+	switch {
+	case len(args) == 2:
+		tag, url = args[0], args[1]
+	case len(args) == 1 && len(ctx.Event.Attachments) == 1:
+		tag, url = args[0], ctx.Event.Attachments[0].URL
+	case len(args) == 1 && len(ctx.Event.Attachments) > 1:
+		cmdNewBulk(ctx, args[0])
+		return
+	case len(args) == 0 && len(ctx.Event.Attachments) > 0:
+		cmdNewBulk(ctx, "")
+		return
+	default:
 		ctx.SendUsage()
 		return
 	}
 
-	tag, url := args[0], args[1]
+	if refuseImageType(ctx, url) || refuseTagChange(ctx, tag) {
+		return
+	}
+
+	reply, err := rememberTag(tag, ctx.Event.Author.ID, url)
+	if handleLockErrors(ctx, tag, err) {
+		return
+	}
+	ctx.Audit("tag new", normTag(tag), url)
+	ctx.Reply(reply)
+}
+
+/*
+ * Rename a tag, keeping its place in playlists, the schedule, and
+ * everything else that knows it by name.
+ */
+func cmdRename(ctx *CommandContext, args []string) {
+	if len(args) != 2 {
+		ctx.SendUsage()
+		return
+	}
+	from, to := normTag(args[0]), normTag(args[1])
 
-	// Check that it's a good image type.
-	filetype := imageType(url)
-	if filetype == "" {
-		ctx.Reply(FileTypeError)
+	exists, err := tagExists(from)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + args[0] + "`.")
 		return
 	}
 
-	err := insertTag(tag, ctx.Event.Author.ID, url)
+	taken, err := tagExists(to)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
+	} else if taken && to != from {
+		ctx.Reply("Sire, I already have a tag named **" + to + "**.")
+		return
+	} else if to == from {
+		ctx.Reply("Sire, that's its name already.")
+		return
 	}
 
-	// Log the action
-	logger.Printf("I'll remember `%s` as %s", tag, url)
+	// Renaming is as good as deleting, as far as the old name goes.
+	locked, err := tagLocked(from)
+	if handleLockErrors(ctx, from, lockedOr(ErrTagLocked, locked, err)) ||
+		refuseTagChange(ctx, from) {
+		return
+	}
 
-	// Send user response
-	ctx.Reply(fmt.Sprintf("I'll remember tag **%s**.", tag))
+	if handleCommandErrors(ctx, SqlError, renameTag(from, to)) {
+		return
+	}
+	Scheduler.QueueRename(from, to)
+
+	logger.Info("Renamed a tag", "tag", from, "to", to, "user", ctx.Event.Author.ID)
+	ctx.Audit("tag rename", from, "now "+to)
+	ctx.Reply(fmt.Sprintf("Sire, **%s** is **%s** now.", from, to))
 }
 
-func cmdDel(ctx *CommandContext, args []string) {
-	// TODO make variadic command
-	if len(args) != 1 {
+// Point a tag at a new image, keeping everything else about it.
+func cmdUpdate(ctx *CommandContext, args []string) {
+	var name, url string
+	switch {
+	case len(args) == 2:
+		name, url = args[0], args[1]
+	case len(args) == 1 && len(ctx.Event.Attachments) == 1:
+		name, url = args[0], ctx.Event.Attachments[0].URL
+	default:
 		ctx.SendUsage()
 		return
 	}
 
-	tag := args[0]
-
-	// Check that the tag already exists
-	exists, err := tagExists(tag)
+	exists, err := tagExists(name)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
-	}
-
-	if !exists {
-		ctx.Reply("Sire, I don't remember a tag named that anyways.")
+	} else if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + name + "`. `" +
+			Settings.Prefix + "new` makes one.")
 		return
 	}
 
-	// Delete from the tags table and cycle list.
-	err = delTag(tag)
+	tag, err := namedTag(name)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
 	}
 
-	logger.Printf("Removed tag `%s`.\n", tag)
+	if refuseImageType(ctx, url) || refuseTagChange(ctx, tag.Name) {
+		return
+	}
 
-	// Send user response
-	ctx.Reply(fmt.Sprintf("Removed the tag **%s**.", tag))
+	// The tag is still its author's, whoever fixed its link.
+	reply, err := rememberTag(tag.Name, tag.AuthorID, url)
+	if handleLockErrors(ctx, tag.Name, err) {
+		return
+	}
+	ctx.Audit("tag update", tag.Name, url)
+	ctx.Reply(reply)
 }
 
 func cmdSet(ctx *CommandContext, args []string) {
@@ -422,127 +1236,353 @@ func cmdSet(ctx *CommandContext, args []string) {
 	name := args[0]
 
 	Scheduler.Stop()
-	err := setBanner(ctx.Session, name)
+	err := setBanner(ctx.Session, name, "set")
 	if handleCommandErrors(ctx, GeneralError, err) {
 		return
 	}
 
 	// Send user response
-	ctx.Reply(OkMessage)
+	if KillSwitch.Engaged() {
+		ctx.Reply("Sire, the kill switch is on, so I only pretended to.")
+	} else {
+		ctx.Ack()
+	}
 }
 
-// A helper function for setting up banner scheduler commands
-func scheduleTags(ctx *CommandContext, timespec string, tags []string,
-	picker func() BannerPicker, invalidTagsFlavor string) {
+// The shortest time between tags a schedule may have, so Discord doesn't rate limit us.
+const MinimumInterval = 15 * time.Minute
 
+/*
+ * Read the time between tags for a schedule, replying and returning
+ * false if it won't do.
+ */
+func parseInterval(ctx *CommandContext, timespec string) (time.Duration, bool) {
 	interval, err := parseTime(timespec)
 	if err != nil {
 		ctx.Reply("Sire, I can't understand the time format **" +
 			timespec + "**.")
-		return
+		return 0, false
 	}
 
-	if interval < time.Minute*15 {
+	if interval < MinimumInterval {
 		ctx.Reply("Sire, that's a heavy burden. Please pick a time duration longer than 15 minutes.")
+		return 0, false
+	}
+
+	return interval, true
+}
+
+/* Take a `--label NAME` off the front of a schedule command's arguments,
+ * from among any other flags there. ok is false if NAME is missing.
+ */
+func scheduleLabel(args []string) (label string, rest []string, ok bool) {
+	rest = []string{}
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			rest = append(rest, args[i:]...)
+			break
+		}
+
+		if args[i] != "--label" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 == len(args) {
+			return "", nil, false
+		}
+		label = args[i+1]
+		i++
+	}
+	return label, rest, true
+}
+
+// A helper function for setting up banner scheduler commands, in the given lane
+func scheduleTags(ctx *CommandContext, lane *BannerScheduler, timespec string, tags []string,
+	except []string, picker func() BannerPicker, label string, invalidTagsFlavor string) {
+
+	interval, ok := parseInterval(ctx, timespec)
+	if !ok {
+		return
+	}
+
+	kept := exceptTags(tags, except)
+	if len(kept) == 0 && len(tags) > 0 {
+		ctx.Reply("Sire, that leaves out every tag.")
 		return
 	}
+	tags = kept
 
 	// Add them all to the scheduler.
-	ok, err := Scheduler.Set(interval, tags, picker)
+	ok, err := lane.Set(interval, tags, picker)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
 	} else if !ok {
 		ctx.Reply(invalidTagsFlavor)
-	} else {
-		ctx.Reply(OkMessage)
-	}
-}
-
-func cmdShuffle(ctx *CommandContext, args []string) {
-	if len(args) < 2 {
-		ctx.SendUsage()
 		return
 	}
 
-	timespec, tags := args[0], args[1:]
-	scheduleTags(ctx, timespec, tags, ScheduleShuffle,
-		"Sire, I don't seem to remember at least one of those tags.")
+	if label != "" {
+		lane.SetLabel(label)
+	}
+	if len(except) > 0 {
+		lane.SetExcept(except)
+	}
+	ctx.auditSchedule(lane)
+	ctx.Ack()
 }
 
-func cmdCycle(ctx *CommandContext, args []string) {
-	if len(args) < 2 {
+/*
+ * The tags a schedule command names, where `pl:PLAYLIST` stands for a
+ * playlist's tags, in the order given and each only once. Replies and
+ * returns false if a playlist is unknown.
+ */
+func scheduleArgTags(ctx *CommandContext, args []string) ([]string, bool) {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, arg := range args {
+		names := []string{normTag(arg)}
+		if playlist, ok := strings.CutPrefix(arg, "pl:"); ok {
+			var err error
+			names, err = playlistTags(playlist)
+			if handleCommandErrors(ctx, SqlError, err) {
+				return nil, false
+			} else if len(names) == 0 {
+				ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.",
+					playlist))
+				return nil, false
+			}
+		}
+
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				tags = append(tags, name)
+			}
+		}
+	}
+	return tags, true
+}
+
+func cmdShuffle(ctx *CommandContext, args []string) {
+	except, args, ok := scheduleExcept(ctx, args)
+	if !ok {
+		return
+	}
+	lane, args, ok := scheduleLane(ctx, args)
+	if !ok {
+		return
+	}
+	label, args, ok := scheduleLabel(args)
+	if !ok || len(args) < 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	timespec := args[0]
+	tags, ok := scheduleArgTags(ctx, args[1:])
+	if !ok {
+		return
+	}
+	scheduleTags(ctx, lane, timespec, tags, except, ScheduleShuffle, label,
+		"Sire, I don't seem to remember at least one of those tags.")
+}
+
+func cmdCycle(ctx *CommandContext, args []string) {
+	except, args, ok := scheduleExcept(ctx, args)
+	if !ok {
+		return
+	}
+	lane, args, ok := scheduleLane(ctx, args)
+	if !ok {
+		return
+	}
+	label, args, ok := scheduleLabel(args)
+	if !ok || len(args) < 2 {
 		ctx.SendUsage()
 		return
 	}
 
-	timespec, tags := args[0], args[1:]
-	scheduleTags(ctx, timespec, tags, ScheduleCycle,
+	timespec := args[0]
+	tags, ok := scheduleArgTags(ctx, args[1:])
+	if !ok {
+		return
+	}
+	scheduleTags(ctx, lane, timespec, tags, except, ScheduleCycle, label,
 		"Sire, I don't seem to remember at least one of those tags.")
 }
 
 // Playlist Commands
 
+// The orders `play` can go in, by flag.
+var PlayOrders = map[string]func() BannerPicker{
+	"--reverse":     ScheduleReverseOnceonly,
+	"--random-once": ScheduleRandomOnceonly,
+	"--pingpong":    SchedulePingpongOnceonly,
+}
+
+/* Take an optional order flag off the front of `play`'s arguments and
+ * return the picker for it. A flag we don't know returns nil.
+ */
+func playOrder(args []string) (func() BannerPicker, []string) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "--") {
+		return ScheduleOnceonly, args
+	}
+
+	return PlayOrders[args[0]], args[1:]
+}
+
 func cmdPlay(ctx *CommandContext, args []string) {
-	if len(args) < 2 {
+	except, args, ok := scheduleExcept(ctx, args)
+	if !ok {
+		return
+	}
+	lane, args, ok := scheduleLane(ctx, args)
+	if !ok {
+		return
+	}
+	label, args, ok := scheduleLabel(args)
+	if !ok {
+		ctx.SendUsage()
+		return
+	}
+
+	picker, args := playOrder(args)
+	if picker == nil || len(args) < 2 {
 		ctx.SendUsage()
 		return
 	}
 
-	timespec, tags := args[0], args[1:]
-	scheduleTags(ctx, timespec, tags, ScheduleOnceonly,
+	timespec := args[0]
+	tags, ok := scheduleArgTags(ctx, args[1:])
+	if !ok {
+		return
+	}
+	scheduleTags(ctx, lane, timespec, tags, except, picker, label,
 		"Sire, I don't seem to remember at least one of those tags.")
 }
 
-func cmdLs(ctx *CommandContext, args []string) {
+/* Render one page of the tag list as an embed, along with buttons for
+ * flipping pages. Pages start at 1, and out-of-range pages are clamped.
+ */
+func tagListPage(page int) (*discordgo.MessageEmbed, []discordgo.MessageComponent, error) {
 	taglist, err := allTags()
-	if handleCommandErrors(ctx, SqlError, err) {
-		return
+	if err != nil {
+		return nil, nil, err
 	}
 
-	page := 0
-	if len(args) != 0 {
-		page, err = strconv.Atoi(args[0])
-	} else {
+	perPage := Settings.TagsPerPage
+	pagect := (len(taglist) + perPage - 1) / perPage
+	if pagect == 0 {
+		pagect = 1
+	}
+
+	if page > pagect {
+		page = pagect
+	} else if page < 1 {
 		page = 1
 	}
 
-	if err != nil {
-		ctx.Reply(err.Error())
+	mintag := (page - 1) * perPage
+	maxtag := mintag + perPage
+	if maxtag > len(taglist) {
+		maxtag = len(taglist)
 	}
 
-	if page <= 0 {
-		ctx.Reply("Page numbers are positive, sire.")
+	buf := bytes.Buffer{}
+	buf.WriteString("```\n")
+	for _, tag := range taglist[mintag:maxtag] {
+		buf.WriteString(tag.Name + "\n")
+	}
+	buf.WriteString("```")
+
+	// A page of very long names can still run past what an embed
+	// holds; the rest are cut off rather than the page refused.
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Tags %d through %d, sire", mintag+1, maxtag),
+		Description: splitText(buf.String(), EmbedDescriptionLimit)[0],
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("Page %d of %d, %d tags in all",
+				page, pagect, len(taglist)),
+		},
+	}
+
+	buttons := []discordgo.MessageComponent{discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label:    "Previous",
+				Style:    discordgo.SecondaryButton,
+				CustomID: componentID("ls", strconv.Itoa(page-1)),
+				Disabled: page <= 1,
+			},
+			discordgo.Button{
+				Label:    "Next",
+				Style:    discordgo.SecondaryButton,
+				CustomID: componentID("ls", strconv.Itoa(page+1)),
+				Disabled: page >= pagect,
+			},
+		},
+	}}
+
+	return embed, buttons, nil
+}
+
+func cmdLs(ctx *CommandContext, args []string) {
+	if len(args) > 1 {
+		ctx.SendUsage()
 		return
 	}
 
-	page--
+	page := 1
+	if len(args) == 1 {
+		var err error
+		page, err = strconv.Atoi(args[0])
+		if err != nil || page <= 0 {
+			ctx.Reply("Page numbers are positive, sire.")
+			return
+		}
+	}
 
-	if page*20 >= len(taglist) {
-		pagect := int(math.Ceil(float64(len(taglist))/float64(20))) + 1
-		ctx.Reply(fmt.Sprintf("Sire, you only have %d pages of tags.", pagect))
+	exists, err := anyTags()
+	if handleCommandErrors(ctx, SqlError, err) {
 		return
 	}
 
-	if len(taglist) == 0 {
+	if !exists {
 		ctx.Reply("It doesn't look like you have any tags, sire.")
-	} else {
-		mintag := page * 20
-		maxtag := page*20 + 20
-		if maxtag > len(taglist) {
-			maxtag = len(taglist)
-		}
-		message := fmt.Sprintf("Tags %d through %d, sire:\n```", mintag+1, maxtag)
-		taglist = append([]Tag{taglist[0]}, taglist[mintag:maxtag]...)
-		// I honestly don't know why slicing has to be done like this, but this works where
-		// taglist[mintag:maxtag] by itself doesn't, even though the slice start is supposed to be included
+		return
+	}
 
-		for _, tag := range taglist {
-			message += fmt.Sprintf("%s\n", tag.Name)
-		}
-		message += "```"
+	embed, buttons, err := tagListPage(page)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	_, err = ctx.Session.ChannelMessageSendComplex(ctx.Event.ChannelID,
+		&discordgo.MessageSend{
+			Embeds:     []*discordgo.MessageEmbed{embed},
+			Components: buttons,
+		})
+	handleCommandErrors(ctx, DiscordError, err)
+}
+
+// Flip the page of a tag list sent by cmdLs.
+func componentLs(s *discordgo.Session, i *discordgo.InteractionCreate, arg string) {
+	page, err := strconv.Atoi(arg)
+	if err != nil {
+		logger.Debug("Bad tag list page", "page", arg)
+		return
+	}
 
-		ctx.Reply(message)
+	embed, buttons, err := tagListPage(page)
+	if handleErrors(s, i.ChannelID, SqlError, "ls", err) {
+		return
 	}
+
+	err = updateComponentMessage(s, i, &discordgo.InteractionResponseData{
+		Embeds:     []*discordgo.MessageEmbed{embed},
+		Components: buttons,
+	})
+	handleErrors(s, i.ChannelID, DiscordError, "ls", err)
 }
 
 func cmdShow(ctx *CommandContext, args []string) {
@@ -559,40 +1599,151 @@ func cmdShow(ctx *CommandContext, args []string) {
 		return
 	}
 
-	user, err := ctx.Session.User(tag.AuthorID)
-	if handleCommandErrors(ctx, GeneralError, err) {
+	// Show the image itself, so it can be looked over before it's set.
+	embed := &discordgo.MessageEmbed{
+		Title:       tag.Name,
+		URL:         tag.Url,
+		Description: tag.Description,
+		Image:       &discordgo.MessageEmbedImage{URL: tag.Url},
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Author", Value: "<@" + tag.AuthorID + ">", Inline: true},
+			{Name: "Made", Value: tag.CreatedAt.Format(DateFormat), Inline: true},
+			{Name: "Last changed", Value: tag.UpdatedAt.Format(DateFormat), Inline: true},
+		},
+		Timestamp: tag.CreatedAt.Format(time.RFC3339),
+	}
+
+	health, err := tagHealth(tag.Name)
+	if handleCommandErrors(ctx, SqlError, err) {
 		return
 	}
-	ctx.Reply(fmt.Sprintf("**%s** by %s#%s: %s",
-		tag.Name, user.Username, user.Discriminator, tag.Url))
+
+	if !health.Healthy {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "Unhealthy",
+			Value: health.Note + ", so I'm passing it over in schedules.",
+		})
+	}
+
+	_, err = ctx.Session.ChannelMessageSendEmbed(ctx.Event.ChannelID, embed)
+	handleCommandErrors(ctx, DiscordError, err)
 }
 
-func cmdPlaylistNew(ctx *CommandContext, args []string) {
+func cmdDescribe(ctx *CommandContext, args []string) {
 	if len(args) < 2 {
 		ctx.SendUsage()
 		return
 	}
 
+	tag, description := args[0], strings.Join(args[1:], " ")
+
+	ok, err := describeTag(tag, description)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !ok {
+		ctx.Reply("Sire, I don't recall any tags named `" + tag + "`.")
+		return
+	}
+
+	logger.Info("Described a tag", "tag", tag, "description", description)
+	ctx.Ack()
+}
+
+/* Read tag names out of an attached file, one per line. A csv from
+ * `export` works too, as only the first field of each line is read.
+ * Duplicates are dropped. Returns false if the user was already told
+ * what went wrong.
+ */
+func attachedTagNames(ctx *CommandContext) ([]string, bool) {
+	data, ok := attachmentData(ctx, 1024*1024) // 1 MB
+	if !ok {
+		return nil, false
+	}
+
+	tags := []string{}
+	dec := csv.NewReader(bytes.NewReader(data))
+	dec.FieldsPerRecord = -1
+	for {
+		record, err := dec.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if handleCommandErrors(ctx, GeneralError, err) {
+			return nil, false
+		}
+
+		tag := strings.TrimSpace(record[0])
+		if tag != "" && !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, true
+}
+
+func cmdPlaylistNew(ctx *CommandContext, args []string) {
+	attached := len(args) == 1 && len(ctx.Event.Attachments) > 0
+	if len(args) < 2 && !attached {
+		ctx.SendUsage()
+		return
+	}
+
 	playlist := args[0]
 	tags := args[1:]
 
 	exists, err := playlistExists(playlist)
 	if exists {
-		ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
+		ctx.Reply(fmt.Sprintf("Sire, I already remember a playlist titled **%s**.", playlist))
 		if err != nil {
-			fmt.Println(err.Error())
+			logger.Error("Couldn't look up a playlist", "playlist", playlist, "err", err)
 		}
 		return
 	}
 
+	if attached {
+		var ok bool
+		if tags, ok = attachedTagNames(ctx); !ok {
+			return
+		}
+
+		if len(tags) == 0 {
+			ctx.Reply("Sire, that file has no tags in it.")
+			return
+		}
+
+		// Name the missing tags, since they're harder to spot in a file.
+		missing := []string{}
+		for _, tag := range tags {
+			exists, err := tagExists(tag)
+			if handleCommandErrors(ctx, SqlError, err) {
+				return
+			}
+
+			if !exists {
+				missing = append(missing, tag)
+			}
+		}
+
+		if len(missing) > 0 {
+			ctx.Reply("Sire, I don't know these tags yet: **" +
+				strings.Join(missing, "**, **") + "**")
+			return
+		}
+	}
+
 	err = editPlaylist(playlist, tags)
 	if err != nil && err.Error() == SqlForeignKey {
 		ctx.Reply("Sire, I don't know all those tags yet...")
 		return
-	} else if handleCommandErrors(ctx, SqlError, err) {
+	} else if handleLockErrors(ctx, playlist, err) {
 		return
 	}
 
+	ctx.Audit("playlist new", playlist, auditList(tags, 20))
+	ctx.Journal("playlist new", playlist, undoSnapshot{NewPlaylists: []string{playlist}})
 	ctx.Reply("I'll remember **" + playlist + "** to be those tags from now on.")
 }
 
@@ -609,13 +1760,20 @@ func cmdPlaylistAdd(ctx *CommandContext, args []string) {
 	if !exists {
 		ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
 		if err != nil {
-			fmt.Println(err.Error())
+			logger.Error("Couldn't look up a playlist", "playlist", playlist, "err", err)
 		}
 		return
 	}
 
+	snapshot, err := takeSnapshot(nil, []string{playlist})
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
 	err = appendPlaylist(playlist, tags)
-	if !handleCommandErrors(ctx, SqlError, err) {
+	if !handleLockErrors(ctx, playlist, err) {
+		ctx.Audit("playlist add", playlist, auditList(tags, 20))
+		ctx.Journal("playlist add", playlist, snapshot)
 		ctx.Reply("I'll add those tags to " + playlist + ".")
 	}
 }
@@ -633,13 +1791,20 @@ func cmdPlaylistRm(ctx *CommandContext, args []string) {
 	if !exists {
 		ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
 		if err != nil {
-			fmt.Println(err.Error())
+			logger.Error("Couldn't look up a playlist", "playlist", playlist, "err", err)
 		}
 		return
 	}
 
+	snapshot, err := takeSnapshot(nil, []string{playlist})
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
 	err = reducePlaylist(playlist, tags)
-	if !handleCommandErrors(ctx, SqlError, err) {
+	if !handleLockErrors(ctx, playlist, err) {
+		ctx.Audit("playlist rm", playlist, auditList(tags, 20))
+		ctx.Journal("playlist rm", playlist, snapshot)
 		ctx.Reply("I'll remove those tags from " + playlist + ".")
 	}
 }
@@ -651,63 +1816,214 @@ func cmdPlaylistDel(ctx *CommandContext, args []string) {
 	}
 
 	playlist := args[0]
-	err := clearPlaylist(playlist)
-	if !handleCommandErrors(ctx, SqlError, err) {
-		ctx.Reply("I'll forget about " + playlist + " from now on.")
+	exists, err := playlistExists(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !exists {
+		ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
+		return
 	}
+
+	tags, err := playlistTags(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	confirmAction(ctx,
+		fmt.Sprintf("Sire, shall I forget **%s** and its %d tags?", playlist, len(tags)),
+		fmt.Sprintf("Sire, forgetting **%s**.", playlist),
+		func() {
+			snapshot, err := takeSnapshot(nil, []string{playlist})
+			if handleCommandErrors(ctx, SqlError, err) {
+				return
+			}
+
+			err = clearPlaylist(playlist)
+			if !handleLockErrors(ctx, playlist, err) {
+				ctx.Audit("playlist del", playlist, "")
+				ctx.Journal("playlist del", playlist, snapshot)
+				ctx.Reply("I'll forget about " + playlist + " from now on.")
+			}
+		})
 }
 
-func cmdPlaylistShuffle(ctx *CommandContext, args []string) {
+/*
+ * Add the tags of the playlists in srcs to dst, for `playlist copy` and
+ * `playlist merge`. The command's permissions were checked against the
+ * first playlist named, so dst's crew is checked here.
+ */
+func copyPlaylistsTo(ctx *CommandContext, dst string, srcs []string) {
+	if !userHasPerms(ctx, PermDefault|PermCrew, dst) {
+		ctx.Reply("Sire, **" + dst + "** belongs to a crew you aren't in.")
+		return
+	}
+
+	for _, src := range srcs {
+		exists, err := playlistExists(src)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if !exists {
+			ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", src))
+			return
+		}
+	}
+
+	snapshot, err := takeSnapshot(nil, []string{dst})
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	copied, err := copyPlaylists(dst, srcs)
+	if handleLockErrors(ctx, dst, err) {
+		return
+	}
+	logger.Info("Copied playlists", "from", srcs, "to", dst, "count", copied,
+		"user", ctx.Event.Author.ID)
+
+	if copied == 0 {
+		ctx.Reply("Sire, **" + dst + "** has all those tags already.")
+		return
+	}
+	ctx.Audit("playlist copy", dst, fmt.Sprintf("%d tags from %s", copied,
+		strings.Join(srcs, ", ")))
+	ctx.Journal("playlist copy", dst, snapshot)
+	ctx.Reply(fmt.Sprintf("I'll add %d tags to **%s**, from **%s**.", copied, dst,
+		strings.Join(srcs, "**, **")))
+}
+
+func cmdPlaylistCopy(ctx *CommandContext, args []string) {
 	if len(args) != 2 {
 		ctx.SendUsage()
 		return
+	} else if args[0] == args[1] {
+		ctx.Reply("Sire, that's the same playlist.")
+		return
+	}
+	copyPlaylistsTo(ctx, args[1], args[:1])
+}
+
+func cmdPlaylistMerge(ctx *CommandContext, args []string) {
+	// "into" before the last playlist is optional.
+	if len(args) > 2 && strings.ToLower(args[len(args)-2]) == "into" {
+		args = append(args[:len(args)-2:len(args)-2], args[len(args)-1])
+	}
+	if len(args) < 3 {
+		ctx.SendUsage()
+		return
+	}
+
+	dst := args[len(args)-1]
+	srcs := []string{}
+	for _, src := range args[:len(args)-1] {
+		if src != dst && !contains(srcs, src) {
+			srcs = append(srcs, src)
+		}
+	}
+	copyPlaylistsTo(ctx, dst, srcs)
+}
+
+func cmdPlaylistShuffle(ctx *CommandContext, args []string) {
+	except, args, ok := scheduleExcept(ctx, args)
+	if !ok {
+		return
+	}
+	lane, args, ok := scheduleLane(ctx, args)
+	if !ok {
+		return
+	}
+	label, args, ok := scheduleLabel(args)
+	if !ok || len(args) != 2 {
+		ctx.SendUsage()
+		return
 	}
 
 	timespec, playlist := args[0], args[1]
+	if label == "" {
+		label = playlist
+	}
 
-	// Grab tags
-	tags, err := playlistTags(playlist)
+	// Grab tags, or follow them, if the playlist takes tags in on its own.
+	tags, smart, err := resolvePlaylist(playlist)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
+	} else if smart {
+		scheduleSmart(ctx, lane, timespec, playlist, except, ScheduleShuffle, label)
+		return
 	}
 
-	scheduleTags(ctx, timespec, tags, ScheduleShuffle,
+	scheduleTags(ctx, lane, timespec, tags, except, ScheduleShuffle, label,
 		fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
 }
 
 func cmdPlaylistCycle(ctx *CommandContext, args []string) {
-	if len(args) != 2 {
+	except, args, ok := scheduleExcept(ctx, args)
+	if !ok {
+		return
+	}
+	lane, args, ok := scheduleLane(ctx, args)
+	if !ok {
+		return
+	}
+	label, args, ok := scheduleLabel(args)
+	if !ok || len(args) != 2 {
 		ctx.SendUsage()
 		return
 	}
 
 	timespec, playlist := args[0], args[1]
+	if label == "" {
+		label = playlist
+	}
 
-	// Grab tags
-	tags, err := playlistTags(playlist)
+	// Grab tags, or follow them, if the playlist takes tags in on its own.
+	tags, smart, err := resolvePlaylist(playlist)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
+	} else if smart {
+		scheduleSmart(ctx, lane, timespec, playlist, except, ScheduleCycle, label)
+		return
 	}
 
-	scheduleTags(ctx, timespec, tags, ScheduleCycle,
+	scheduleTags(ctx, lane, timespec, tags, except, ScheduleCycle, label,
 		fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
 }
 
 func cmdPlaylistPlay(ctx *CommandContext, args []string) {
-	if len(args) != 2 {
+	except, args, ok := scheduleExcept(ctx, args)
+	if !ok {
+		return
+	}
+	lane, args, ok := scheduleLane(ctx, args)
+	if !ok {
+		return
+	}
+	label, args, ok := scheduleLabel(args)
+	if !ok {
+		ctx.SendUsage()
+		return
+	}
+
+	picker, args := playOrder(args)
+	if picker == nil || len(args) != 2 {
 		ctx.SendUsage()
 		return
 	}
 
 	timespec, playlist := args[0], args[1]
+	if label == "" {
+		label = playlist
+	}
 
-	// Grab tags
-	tags, err := playlistTags(playlist)
+	// Grab tags, or follow them, if the playlist takes tags in on its own.
+	tags, smart, err := resolvePlaylist(playlist)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
+	} else if smart {
+		scheduleSmart(ctx, lane, timespec, playlist, except, picker, label)
+		return
 	}
 
-	scheduleTags(ctx, timespec, tags, ScheduleOnceonly,
+	scheduleTags(ctx, lane, timespec, tags, except, picker, label,
 		fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
 }
 
@@ -717,13 +2033,20 @@ func cmdPlaylistLs(ctx *CommandContext, args []string) {
 		return
 	}
 
-	buf := bytes.Buffer{}
-	buf.WriteString("Your playlists, sire:\n")
-	for _, playlist := range playlists {
-		buf.WriteString("\n**" + playlist + "**")
+	crews, err := playlistCrews()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
 	}
 
-	ctx.Reply(buf.String())
+	lines := make([]string, len(playlists))
+	for i, playlist := range playlists {
+		lines[i] = "**" + playlist + "**"
+		if crew, ok := crews[playlist]; ok {
+			lines[i] += ", kept by " + roleName(ctx.Session, crew)
+		}
+	}
+
+	ctx.ReplyList("Your playlists, sire:", lines, RenderPlain)
 }
 
 func cmdPlaylistShow(ctx *CommandContext, args []string) {
@@ -738,113 +2061,950 @@ func cmdPlaylistShow(ctx *CommandContext, args []string) {
 	if !exists {
 		ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
 		if err != nil {
-			fmt.Println(err.Error())
+			logger.Error("Couldn't look up a playlist", "playlist", playlist, "err", err)
 		}
 		return
 	}
 
-	tags, err := playlistTags(playlist)
+	tags, err := ownPlaylistTags(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	children, err := playlistChildren(playlist)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
 	}
 
-	buf := bytes.Buffer{}
-	buf.WriteString("`" + playlist + "`'s tags:\n")
-	for _, tag := range tags {
-		buf.WriteString("\n**" + tag + "**")
+	filter, smart, err := smartFilter(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
 	}
 
-	ctx.Reply(buf.String())
+	lines := make([]string, len(tags))
+	for i, tag := range tags {
+		lines[i] = "**" + tag + "**"
+	}
+	if smart {
+		lines = append(lines, "and "+filter.describe())
+	}
+	for _, child := range children {
+		childTags, err := playlistTags(child)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+		lines = append(lines, fmt.Sprintf("playlist **%s**, with %d tags", child,
+			len(childTags)))
+	}
+
+	ctx.ReplyList("`"+playlist+"`'s tags:", lines, RenderPlain)
 }
 
 // Scheduler Commands
 
 func cmdStop(ctx *CommandContext, args []string) {
-	wasActive := Scheduler.Stop()
-	if wasActive {
-		ctx.Reply(OkMessage)
+	if len(args) > 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	stopped := []string{}
+	if len(args) == 1 && strings.EqualFold(args[0], "all") {
+		stopped = Lanes.StopAll()
 	} else {
-		ctx.Reply(NoActiveScheduleMessage)
+		lane, rest, ok := scheduleLane(ctx, append([]string{"--lane"}, args...))
+		if !ok || len(rest) > 0 {
+			return
+		}
+		if lane.Stop() {
+			stopped = append(stopped, lane.lane)
+		}
 	}
-}
 
-func cmdNext(ctx *CommandContext, args []string) {
-	wasActive := Scheduler.Next()
-	if wasActive {
-		ctx.Reply(OkMessage)
+	if len(stopped) > 0 {
+		ctx.Audit("schedule stop", strings.Join(stopped, ", "), "")
+		ctx.Ack()
 	} else {
 		ctx.Reply(NoActiveScheduleMessage)
 	}
 }
 
-// Backup Commands
+// One line about a running schedule, for `schedules ls`.
+func scheduleSummary(info ScheduleInfo) string {
+	line := "• **" + info.Label + "**: " + info.Mode + " every " + info.Interval.String()
+	if info.Lane != LaneBanner {
+		line += " in the " + info.Lane + " lane"
+	}
+	if info.Source != "" {
+		return line + ", following the " + sourceDescription(info.Source)
+	}
+	return line + fmt.Sprintf(", %d tags", len(info.Tags))
+}
 
-func cmdExport(ctx *CommandContext, args []string) {
-	taglist, err := allTags()
+func cmdSchedulesLs(ctx *CommandContext, args []string) {
+	schedules := Lanes.Schedules()
+	if len(schedules) == 0 {
+		ctx.Reply(NoActiveScheduleMessage)
+		return
+	}
+
+	lines := make([]string, len(schedules))
+	for i, info := range schedules {
+		lines[i] = scheduleSummary(info)
+	}
+	ctx.ReplyList("The running schedules, sire:", lines, RenderPlain)
+}
+
+func cmdSchedulesShow(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	info, ok := Lanes.Schedule(args[0])
+	if !ok {
+		ctx.Reply("Sire, no schedule labelled **" + args[0] + "** is running.")
+		return
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("Sire, **" + info.Label + "** is a " + info.Mode +
+		" every " + info.Interval.String() + ", in the " + info.Lane + " lane.\n")
+	if info.Source != "" {
+		buf.WriteString("It takes its tags from the " + sourceDescription(info.Source) + ".\n")
+	} else {
+		buf.WriteString("Tags: " + strings.Join(info.Tags, ", ") + "\n")
+		if info.Next >= 0 && info.Next < len(info.Tags) {
+			buf.WriteString("Up next: **" + info.Tags[info.Next] + "**\n")
+		}
+	}
+	if len(info.Except) > 0 {
+		buf.WriteString("Leaving out: " + strings.Join(info.Except, ", ") + "\n")
+	}
+	if next := Status.nextChange(); !next.IsZero() && info.Lane == LaneBanner {
+		buf.WriteString("Next change: " + next.In(guildLocation()).Format(DateFormat) + "\n")
+	}
+	if !info.PassStart.IsZero() {
+		buf.WriteString(fmt.Sprintf("This pass: %d shown since %s\n", info.Shown,
+			info.PassStart.In(guildLocation()).Format(DateFormat)))
+	}
+	buf.WriteString("Catch-up: " + info.CatchUp)
+
+	ctx.Reply(buf.String())
+}
+
+func cmdSchedulesStop(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	if Lanes.StopLabel(args[0]) {
+		ctx.Audit("schedule stop", args[0], "")
+		ctx.Ack()
+	} else {
+		ctx.Reply("Sire, no schedule labelled **" + args[0] + "** is running.")
+	}
+}
+
+func cmdNext(ctx *CommandContext, args []string) {
+	if len(args) > 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	if len(args) == 1 {
+		count, err := strconv.Atoi(args[0])
+		if err != nil || count < 1 {
+			ctx.Reply("Sire, I can only skip ahead a whole number of tags.")
+			return
+		}
+
+		if !Scheduler.Skip(count - 1) {
+			ctx.Reply(NoActiveScheduleMessage)
+			return
+		}
+	}
+
+	wasActive := Scheduler.Forward()
+	if wasActive {
+		ctx.Ack()
+	} else {
+		ctx.Reply(NoActiveScheduleMessage)
+	}
+}
+
+func cmdInterval(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	interval, ok := parseInterval(ctx, args[0])
+	if !ok {
+		return
+	}
+
+	if !Scheduler.SetInterval(interval) {
+		ctx.Reply(NoActiveScheduleMessage)
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdDuration(ctx *CommandContext, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	name := args[0]
+	if len(args) == 1 {
+		duration, err := tagDuration(name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		if duration == 0 {
+			ctx.Reply("Sire, **" + name + "** stays up as long as the schedule says.")
+		} else {
+			ctx.Reply("Sire, **" + name + "** stays up for " + duration.String() + ".")
+		}
+		return
+	}
+
+	var duration time.Duration
+	if args[1] != "none" {
+		var ok bool
+		duration, ok = parseInterval(ctx, args[1])
+		if !ok {
+			return
+		}
+	}
+
+	ok, err := setTagDuration(name, duration)
 	if handleCommandErrors(ctx, SqlError, err) {
 		return
 	}
 
+	if !ok {
+		ctx.Reply("Sire, I don't recall any tags named `" + name + "`.")
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdCatchUp(ctx *CommandContext, args []string) {
+	switch {
+	case len(args) == 0:
+		policy, ok := Scheduler.CatchUp()
+		if !ok {
+			ctx.Reply(NoActiveScheduleMessage)
+			return
+		}
+
+		ctx.Reply("Sire, after time away I'll **" + policy + "**.")
+		return
+	case len(args) > 1 || !contains(CatchUpPolicies, args[0]):
+		ctx.SendUsage()
+		return
+	}
+
+	if !Scheduler.SetCatchUp(args[0]) {
+		ctx.Reply(NoActiveScheduleMessage)
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdCrop(ctx *CommandContext, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	name := args[0]
+	if len(args) == 1 {
+		mode, err := tagCrop(name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		if mode == "" {
+			mode = "none"
+		}
+		ctx.Reply("Sire, **" + name + "** is cropped: **" + mode + "**.")
+		return
+	}
+
+	if !contains(CropModes, args[1]) {
+		ctx.SendUsage()
+		return
+	}
+
+	ok, err := setTagCrop(name, args[1])
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !ok {
+		ctx.Reply("Sire, I don't recall any tags named `" + name + "`.")
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdJump(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	if handleQueueErrors(ctx, args[0], Scheduler.Seek(args[0])) {
+		return
+	}
+
+	if !Scheduler.Forward() {
+		ctx.Reply(NoActiveScheduleMessage)
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdQueueShow(ctx *CommandContext, args []string) {
+	tags, next, ok := Scheduler.Queue()
+	if !ok {
+		ctx.Reply(NoActiveScheduleMessage)
+		return
+	}
+
+	lines := make([]string, len(tags))
+	for i, tag := range tags {
+		if i == next {
+			lines[i] = "▶ **" + tag + "** (up next)"
+		} else {
+			lines[i] = "• " + tag
+		}
+	}
+
+	ctx.ReplyList("The banner queue, sire:", lines, RenderPlain)
+}
+
+// Reply to errors from the queue edits in scheduler.go; return whether there was one.
+func handleQueueErrors(ctx *CommandContext, tag string, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case ErrQueueInactive:
+		ctx.Reply(NoActiveScheduleMessage)
+	case ErrQueueSource:
+		ctx.Reply("Sire, the queue finds its own tags right now, from the seasons " +
+			"or a smart playlist.")
+	case ErrQueueHas:
+		ctx.Reply("Sire, **" + tag + "** is already in the queue.")
+	case ErrQueueExcept:
+		ctx.Reply("Sire, this schedule leaves **" + normTag(tag) + "** out, by its `--except`.")
+	case ErrQueueMissing:
+		ctx.Reply("Sire, **" + tag + "** isn't in the queue.")
+	case ErrQueueNoSeek:
+		ctx.Reply("Sire, I can't jump ahead in a shuffle.")
+	case ErrQueueLast:
+		ctx.Reply("Sire, **" + tag + "** is all that's left in the queue. " +
+			"Use `stop` instead.")
+	default:
+		handleCommandErrors(ctx, SqlError, err)
+	}
+
+	return true
+}
+
+func cmdQueueAdd(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	exists, err := tagExists(args[0])
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + args[0] + "`.")
+		return
+	}
+
+	if handleQueueErrors(ctx, args[0], Scheduler.QueueAdd(args[0])) {
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdQueueRm(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	if handleQueueErrors(ctx, args[0], Scheduler.QueueRemove(args[0])) {
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdTimezone(ctx *CommandContext, args []string) {
+	switch len(args) {
+	case 0:
+		ctx.Reply("Sire, I read times in **" + guildLocation().String() + "**.")
+		return
+	case 1:
+	default:
+		ctx.SendUsage()
+		return
+	}
+
+	if checkTimezone(args[0]) != nil {
+		ctx.Reply("Sire, I don't know the timezone **" + args[0] + "**. " +
+			"I know them by names like `America/New_York`.")
+		return
+	}
+
+	key, _ := findConfigKey("Timezone")
+	err := pinConfig(key, args[0])
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	logger.Info("Timezone set", "timezone", args[0])
+	ctx.Ack()
+}
+
+func cmdQuietAdd(ctx *CommandContext, args []string) {
+	if len(args) != 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	start, err1 := minuteOfDay(args[0])
+	end, err2 := minuteOfDay(args[1])
+	if err1 != nil || err2 != nil {
+		ctx.Reply("Sire, I need times like `01:00` and `07:00`.")
+		return
+	}
+
+	if start == end {
+		ctx.Reply("Sire, quiet hours need to last a while.")
+		return
+	}
+
+	// Zero-pad, so the windows sort properly.
+	startClock := fmt.Sprintf("%02d:%02d", start/60, start%60)
+	endClock := fmt.Sprintf("%02d:%02d", end/60, end%60)
+
+	id, err := insertQuietWindow(startClock, endClock)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	logger.Info("Added quiet hours", "id", id, "start", startClock, "end", endClock)
+	ctx.Reply(fmt.Sprintf("I'll keep quiet from %s to %s (%s) each day, sire.",
+		startClock, endClock, guildLocation()))
+}
+
+func cmdQuietRm(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		ctx.SendUsage()
+		return
+	}
+
+	ok, err := delQuietWindow(id)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !ok {
+		ctx.Reply("Sire, I have no quiet hours by that number.")
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdQuietLs(ctx *CommandContext, args []string) {
+	windows, err := allQuietWindows()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(windows) == 0 {
+		ctx.Reply("Sire, I have no quiet hours.")
+		return
+	}
+
+	lines := make([]string, len(windows))
+	for i, window := range windows {
+		lines[i] = fmt.Sprintf("`%d` %s to %s", window.ID, window.Start, window.End)
+	}
+
+	ctx.ReplyList(fmt.Sprintf("My quiet hours (%s), sire:", guildLocation()),
+		lines, RenderPlain)
+}
+
+func cmdAt(ctx *CommandContext, args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "ls":
+		atLs(ctx)
+	case len(args) == 2 && args[0] == "cancel":
+		atCancel(ctx, args[1])
+	case len(args) == 2 || len(args) == 3:
+		atNew(ctx, args)
+	default:
+		ctx.SendUsage()
+	}
+}
+
+func atNew(ctx *CommandContext, args []string) {
+	at, err := parseWallTime(args[0], time.Now())
+	if err != nil {
+		ctx.Reply("Sire, I can't understand the time **" + args[0] + "**.")
+		return
+	}
+
+	if at.Before(time.Now()) {
+		ctx.Reply("Sire, that time has come and gone.")
+		return
+	}
+
+	shot := OneShot{At: at, Tag: args[1], AuthorID: ctx.Event.Author.ID}
+
+	if len(args) == 3 {
+		shot.RevertAfter, err = parseTime(args[2])
+		if err != nil || shot.RevertAfter <= 0 {
+			ctx.Reply("Sire, I can't understand the time format **" +
+				args[2] + "**.")
+			return
+		}
+	}
+
+	exists, err := tagExists(shot.Tag)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + shot.Tag + "`.")
+		return
+	}
+
+	shot.ID, err = insertOneShot(shot)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	Scheduler.Rearm()
+
+	logger.Info("Planned a one-shot", "id", shot.ID, "tag", shot.Tag, "at", at)
+
+	message := fmt.Sprintf("I'll set **%s** at %s", shot.Tag,
+		at.In(guildLocation()).Format(DateFormat))
+	if shot.RevertAfter != 0 {
+		message += fmt.Sprintf(", and put things back after %s", shot.RevertAfter)
+	}
+	ctx.Reply(message + ", sire.")
+}
+
+func atLs(ctx *CommandContext) {
+	shots, err := allOneShots()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(shots) == 0 {
+		ctx.Reply("Sire, I have nothing planned.")
+		return
+	}
+
 	buf := bytes.Buffer{}
-	enc := csv.NewWriter(&buf)
+	buf.WriteString("What I have planned, sire:\n")
+	for _, shot := range shots {
+		when := shot.At.In(guildLocation()).Format(DateFormat)
+		switch {
+		case shot.IsRevert:
+			buf.WriteString(fmt.Sprintf("\n`%d` %s: put **%s** back",
+				shot.ID, when, shot.Tag))
+		case shot.RevertAfter != 0:
+			buf.WriteString(fmt.Sprintf("\n`%d` %s: **%s** for %s",
+				shot.ID, when, shot.Tag, shot.RevertAfter))
+		default:
+			buf.WriteString(fmt.Sprintf("\n`%d` %s: **%s**",
+				shot.ID, when, shot.Tag))
+		}
+	}
+
+	ctx.ReplyLong(buf.String())
+}
+
+func atCancel(ctx *CommandContext, rawID string) {
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		ctx.SendUsage()
+		return
+	}
+
+	ok, err := delOneShot(id)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !ok {
+		ctx.Reply("Sire, I have nothing planned by that number.")
+		return
+	}
+	Scheduler.Rearm()
+
+	ctx.Ack()
+}
+
+// Backup Commands
+
+// Write tags out as a version 1 export, a CSV, as `import` reads them back.
+func writeExport(w io.Writer, taglist []Tag) error {
+	enc := csv.NewWriter(w)
 	for _, tag := range taglist {
-		enc.Write([]string{tag.Name, tag.AuthorID, tag.Url})
+		enc.Write([]string{tag.Name, tag.AuthorID, tag.Url, tag.Description,
+			tag.CreatedAt.Format(ExportTimeFormat),
+			tag.UpdatedAt.Format(ExportTimeFormat)})
 	}
 	enc.Flush()
+	return enc.Error()
+}
+
+func cmdExport(ctx *CommandContext, args []string) {
+	full := false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "full":
+		full = true
+	case len(args) == 1 && args[0] == "csv":
+		taglist, err := allTags()
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		buf := bytes.Buffer{}
+		if handleCommandErrors(ctx, GeneralError, writeExport(&buf, taglist)) {
+			return
+		}
+
+		ctx.Session.ChannelFileSendWithMessage(ctx.Event.ChannelID,
+			"Your records, sire:", "bannerbard-export.csv", &buf)
+		logger.Info("Exported tags", "count", len(taglist))
+		return
+	default:
+		ctx.SendUsage()
+		return
+	}
+
+	var running *SavedSchedule
+	schedule, ok, err := Scheduler.Snapshot()
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	} else if ok {
+		running = &schedule
+	}
+
+	export, err := buildExport(running)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if full {
+		exportArchive(ctx, export)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	if handleCommandErrors(ctx, GeneralError, writeJSONExport(&buf, export)) {
+		return
+	}
 
 	ctx.Session.ChannelFileSendWithMessage(ctx.Event.ChannelID,
-		"Your records, sire:", "bannerbard-export.csv", &buf)
-	logger.Printf("Exported %d tags", len(taglist))
+		"Your records, sire:", "bannerbard-export.json", &buf)
+	logger.Info("Exported tags and playlists", "tags", len(export.Tags),
+		"playlists", len(export.Playlists), "schedule", ok)
 }
 
-func cmdImport(ctx *CommandContext, args []string) {
+// Upload an export as a zip, with every tag's image, for `export full`.
+func exportArchive(ctx *CommandContext, export Export) {
+	ctx.Reply(fmt.Sprintf("Sire, I'm gathering all %d images; this may take a while.",
+		len(export.Tags)))
+
+	buf := bytes.Buffer{}
+	missing, err := writeArchive(&buf, export)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	_, err = ctx.Session.ChannelFileSendWithMessage(ctx.Event.ChannelID,
+		"Your records, sire, images and all:", "bannerbard-export.zip", &buf)
+	if err != nil {
+		logger.Error("Couldn't upload a full export", "bytes", buf.Len(), "err", err)
+		ctx.Reply(fmt.Sprintf("Sire, Discord wouldn't take the export, at %s. `%s` "+
+			"from the command line makes one of any size.", formatBytes(int64(buf.Len())),
+			"banner-bard export FILE.zip"))
+		return
+	}
+	logger.Info("Exported tags and images", "tags", len(export.Tags),
+		"missing", len(missing), "bytes", buf.Len())
+
+	if len(missing) > 0 {
+		lines := make([]string, len(missing))
+		for i, err := range missing {
+			lines[i] = "- " + err.Error()
+		}
+		ctx.ReplyLong("Sire, I couldn't get these images, so they're left out:\n" +
+			strings.Join(lines, "\n"))
+	}
+}
+
+/* Turn a line of an exported csv back into a tag. Exports made before
+ * tags had metadata only have three fields; the rest is filled in as
+ * if the tag was made just now.
+ */
+func parseTagRecord(record []string) (tag Tag, err error) {
+	if len(record) != 3 && len(record) != 6 {
+		return tag, fmt.Errorf("expected 3 or 6 entries, but found %d",
+			len(record))
+	}
+
+	tag.Name = strings.TrimSpace(record[0])
+	tag.AuthorID = record[1]
+	tag.Url = record[2]
+	tag.CreatedAt = time.Now().UTC()
+	tag.UpdatedAt = tag.CreatedAt
+
+	if len(record) == 3 {
+		return tag, nil
+	}
+
+	tag.Description = record[3]
+	if tag.CreatedAt, err = time.Parse(ExportTimeFormat, record[4]); err != nil {
+		return tag, err
+	}
+	tag.UpdatedAt, err = time.Parse(ExportTimeFormat, record[5])
+	return tag, err
+}
+
+/* Download the single file attached to the command. Returns false if
+ * there isn't exactly one, it's bigger than maximumSize, or it couldn't
+ * be downloaded, after telling the user so.
+ */
+func attachmentData(ctx *CommandContext, maximumSize int64) ([]byte, bool) {
 	if len(ctx.Event.Attachments) != 1 {
 		ctx.Reply("Sire, I need a single file attatched to that command.")
-		return
+		return nil, false
 	}
 
 	resp, err := http.Get(ctx.Event.Attachments[0].URL)
 	if handleCommandErrors(ctx, GeneralError, err) {
-		return
+		return nil, false
 	}
 	defer resp.Body.Close()
 
-	var maximumSize int64 = 1024 * 1024 // 1 MB
-	if resp.ContentLength > maximumSize {
-		ctx.Reply("Sire, that is most certainly not one of my exported files.")
-		return
+	// An error page would otherwise be read as the file.
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		ctx.Reply("Sire, I couldn't fetch that file; Discord answered **" +
+			resp.Status + "**. Try attaching it again.")
+		return nil, false
 	}
 
-	errs := []error{}
+	// The length given can be missing, or wrong, so it's counted too.
+	var data []byte
+	if resp.ContentLength <= maximumSize {
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maximumSize+1))
+		if handleCommandErrors(ctx, GeneralError, err) {
+			return nil, false
+		}
+	}
+	if resp.ContentLength > maximumSize || int64(len(data)) > maximumSize {
+		ctx.Reply(fmt.Sprintf("Sire, that file is far too large for me; "+
+			"I can read up to %s.", formatBytes(maximumSize)))
+		return nil, false
+	}
 
-	err = clearTags()
-	errs = append(errs, err)
+	return data, true
+}
 
-	dec := csv.NewReader(resp.Body)
-	lineno := 1
-	for {
-		record, err := dec.Read()
-		if err == io.EOF {
-			break
-		}
+func cmdImport(ctx *CommandContext, args []string) {
+	if len(args) > 0 && args[0] == "code" {
+		cmdImportCode(ctx, args[1:])
+		return
+	}
 
-		if handleCommandErrors(ctx, GeneralError, err) {
+	merge, dryRun := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "merge" && !merge:
+			merge = true
+		case arg == "--dry-run" && !dryRun:
+			dryRun = true
+		default:
+			ctx.SendUsage()
 			return
 		}
+	}
 
-		if len(record) != 3 {
-			errs = append(errs, fmt.Errorf(
-				"expected 3 entries on line %d, but found %d",
-				lineno, len(record)))
-			continue
+	// A zip has images in it, so it may be a good deal bigger.
+	limit := int64(importMaxSize)
+	if len(ctx.Event.Attachments) == 1 &&
+		strings.HasSuffix(strings.ToLower(ctx.Event.Attachments[0].Filename), ".zip") {
+		limit = importArchiveMaxSize
+	}
+
+	data, ok := attachmentData(ctx, limit)
+	if !ok {
+		return
+	}
+
+	export, errs, err := readExport(data)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	plan, err := planImport(export, merge)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if dryRun {
+		// Only the lines of a CSV that would be skipped.
+		handleCommandErrors(ctx, GeneralError, errs...)
+		ctx.ReplyLong(plan.describe(true))
+		return
+	}
+
+	// Replacing my memory forgets what's here; ask first, unless it's all kept.
+	if merge || len(plan.Removed)+len(plan.Conflicts)+len(plan.PlaylistsRemoved) == 0 {
+		runImport(ctx, export, plan, merge, errs)
+		return
+	}
+	confirmAction(ctx,
+		fmt.Sprintf("Sire, that replaces my memory: %d tags would be forgotten, %d "+
+			"given another image, and %d playlists forgotten. Shall I?",
+			len(plan.Removed), len(plan.Conflicts), len(plan.PlaylistsRemoved)),
+		"Sire, importing your set.",
+		func() { runImport(ctx, export, plan, merge, errs) })
+}
+
+// Import the export as planned, and say how it went.
+func runImport(ctx *CommandContext, export Export, plan importPlan, merge bool,
+	errs []error) {
+
+	action := "import"
+	if merge {
+		action = "import merge"
+	}
+
+	// What it replaces, so `undo` can put it back.
+	var snapshot undoSnapshot
+	var err error
+	if merge {
+		tags, playlists := []string{}, []string{}
+		for _, tag := range export.Tags {
+			tags = append(tags, tag.Name)
+		}
+		for _, playlist := range export.Playlists {
+			playlists = append(playlists, playlist.Name)
 		}
+		snapshot, err = takeSnapshot(tags, playlists)
+	} else {
+		snapshot, err = takeWholeSnapshot()
+	}
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
 
-		tag, authorID, url := strings.TrimSpace(record[0]), record[1], record[2]
-		err = insertTag(tag, authorID, url)
+	errs = append(errs, importExport(export, merge)...)
+	ctx.Journal(action, "an export", snapshot)
+
+	// Put the exported schedule back, as it was when it was exported.
+	if plan.Schedule {
+		Scheduler.Stop()
+		err = saveSchedule(*export.Schedule)
+		if err == nil {
+			_, err = Scheduler.Restore()
+		}
 		errs = append(errs, err)
 	}
 
-	if !handleCommandErrors(ctx, GeneralError, errs...) {
-		ctx.Reply("My memory is replaced with your new set, sire.")
+	if handleCommandErrors(ctx, GeneralError, errs...) {
+		return
 	}
+
+	ctx.Audit(action, "an export", fmt.Sprintf(
+		"%d tags added, %d replaced, %d removed; %d playlists added, %d replaced, %d removed",
+		len(plan.Added), len(plan.Conflicts)+plan.Replaced, len(plan.Removed),
+		len(plan.PlaylistsAdded), len(plan.PlaylistsReplaced), len(plan.PlaylistsRemoved)))
+
+	if merge {
+		ctx.ReplyLong("Your set is merged into my memory, sire.\n" + plan.describe(false))
+	} else {
+		ctx.ReplyLong("My memory is replaced with your new set, sire.\n" +
+			plan.describe(false))
+	}
+}
+
+// Everything the bard remembers about one user, for data-access requests.
+type UserData struct {
+	UserID     string
+	ExportedAt time.Time
+	Tags       []Tag
+	// Their rows everywhere else, by what they are, see userRowQueries.
+	Rows map[string][]map[string]interface{}
+}
+
+func cmdUserData(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	userID := parseUserID(args[0])
+	if userID == "" {
+		ctx.Reply("Sire, I need a user ID or a mention.")
+		return
+	}
+
+	data := UserData{UserID: userID, ExportedAt: time.Now().UTC()}
+
+	var err error
+	data.Tags, err = authorTags(userID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	data.Rows, err = userRows(userID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(data)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	ctx.Session.ChannelFileSendWithMessage(ctx.Event.ChannelID,
+		"All I remember of them, sire:", "bannerbard-user-"+userID+".json", &buf)
+	logger.Info("Exported user data", "user", userID)
 }
@@ -0,0 +1,113 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * batch.go - Batched writes, for the many small, low-value rows that
+ * stats and history make. QueueWrite() hands a statement to a
+ * background writer and returns at once; the writer runs everything
+ * queued in one transaction every few seconds, or sooner if a lot has
+ * piled up, and once more on shutdown. Anything that has to be written
+ * before a command replies shouldn't go through here.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"time"
+)
+
+var batchLog = moduleLogger("batch")
+
+const (
+	batchQueueSize = 1024
+	batchMaxSize   = 256
+	batchInterval  = 5 * time.Second
+)
+
+type batchedWrite struct {
+	query string
+	args  []interface{}
+}
+
+var (
+	writeQueue = make(chan batchedWrite, batchQueueSize)
+	writeFlush = make(chan chan struct{})
+)
+
+/*
+ * Queue a statement to be run with the next batch. If the queue is
+ * full, the write is dropped rather than hold up the caller.
+ */
+func QueueWrite(query string, args ...interface{}) {
+	select {
+	case writeQueue <- batchedWrite{query, args}:
+	default:
+		batchLog.Info("Write queue full; dropping a write")
+	}
+}
+
+// Run everything queued so far, and wait for it to be written.
+func FlushWrites() {
+	done := make(chan struct{})
+	writeFlush <- done
+	<-done
+}
+
+// Run a batch in one transaction. A failed batch is logged and dropped.
+func writeBatch(batch []batchedWrite) {
+	if len(batch) == 0 {
+		return
+	}
+
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		batchLog.Error("Error while writing a batch", "err", err)
+		return
+	}
+
+	for _, write := range batch {
+		if _, err = tx.Exec(write.query, write.args...); err != nil {
+			tx.Rollback()
+			batchLog.Error("Error while writing a batch", "count", len(batch), "err", err)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		batchLog.Error("Error while writing a batch", "err", err)
+	}
+}
+
+/*
+ * Start the batch writer. This procedure lasts forever, so call it
+ * with `go`.
+ */
+func StartWriter() {
+	ticker := time.NewTicker(batchInterval)
+	batch := []batchedWrite{}
+
+	for {
+		select {
+		case write := <-writeQueue:
+			batch = append(batch, write)
+			if len(batch) >= batchMaxSize {
+				writeBatch(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			writeBatch(batch)
+			batch = batch[:0]
+		case done := <-writeFlush:
+			// Take in whatever's still queued first.
+			for len(writeQueue) > 0 {
+				batch = append(batch, <-writeQueue)
+			}
+
+			writeBatch(batch)
+			batch = batch[:0]
+			close(done)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * blob.go - The image cache. Each tag's image is saved to BlobDir when
+ * the tag is made, and banners are set from the saved copy, so a link
+ * that rots later doesn't take the tag with it. Images are saved under
+ * a hash of their URL; anything missing from the cache is downloaded
+ * (and saved) on the spot. Downloads are written to the cache as they
+ * come, rather than gathered in memory first. Thumbnails are kept beside
+ * the images, under the same name with .thumb on the end.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var blobLog = moduleLogger("blob")
+
+// Don't download anything bigger than this, banner or not.
+const maxDownloadBytes = 64 * 1024 * 1024
+
+func blobPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(Settings.BlobDir, hex.EncodeToString(sum[:]))
+}
+
+/*
+ * The most an image may weigh, as downloaded: maxDownloadBytes, or less
+ * if ImageMemoryMB is tighter.
+ */
+func downloadLimit() int64 {
+	limit := int64(maxDownloadBytes)
+	if ceiling := imageMemoryCeiling(); ceiling > 0 && ceiling < limit {
+		limit = ceiling
+	}
+	return limit
+}
+
+func errTooBig(limit int64) error {
+	return fmt.Errorf("the image is over %s", formatBytes(limit))
+}
+
+func getImage(url string) (*http.Response, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("the link answered %s", resp.Status)
+	} else if limit := downloadLimit(); resp.ContentLength > limit {
+		resp.Body.Close()
+		return nil, errTooBig(limit)
+	}
+	return resp, nil
+}
+
+/*
+ * Download an image, without the cache. The buffer's sized from the
+ * Content-Length when there is one, so it isn't grown (and copied) as
+ * the image comes in.
+ */
+func downloadImage(url string) ([]byte, error) {
+	resp, err := getImage(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	limit := downloadLimit()
+	buf := bytes.Buffer{}
+	if resp.ContentLength > 0 {
+		buf.Grow(int(resp.ContentLength) + bytes.MinRead)
+	}
+
+	n, err := buf.ReadFrom(io.LimitReader(resp.Body, limit+1))
+	if err == nil && n > limit {
+		err = errTooBig(limit)
+	}
+	return buf.Bytes(), err
+}
+
+/*
+ * Download an image and save it to the cache, replacing any copy
+ * already there. The download goes straight to a temporary file, a
+ * little at a time, and is read back whole once it's done; so a crash
+ * can't leave half an image behind, and the image is only in memory
+ * once. If the cache can't be written, the image is downloaded into
+ * memory instead, and returned with the error.
+ */
+func cacheImage(url string) ([]byte, error) {
+	if err := os.MkdirAll(Settings.BlobDir, 0755); err != nil {
+		data, dlErr := downloadImage(url)
+		if dlErr != nil {
+			return nil, dlErr
+		}
+		return data, err
+	}
+
+	path := blobPath(url)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		data, dlErr := downloadImage(url)
+		if dlErr != nil {
+			return nil, dlErr
+		}
+		return data, err
+	}
+
+	err = saveImage(file, url)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	// The image may have changed under the same URL.
+	os.Remove(path + ".thumb")
+	return data, os.Rename(path+".tmp", path)
+}
+
+/*
+ * Put an image in the cache as if it had been downloaded from url, for
+ * restoring exports whose links may be dead.
+ */
+func storeImage(url string, data []byte) error {
+	if err := os.MkdirAll(Settings.BlobDir, 0755); err != nil {
+		return err
+	}
+
+	path := blobPath(url)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	os.Remove(path + ".thumb")
+	return os.Rename(path+".tmp", path)
+}
+
+// Download an image into a file.
+func saveImage(file *os.File, url string) error {
+	resp, err := getImage(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	limit := downloadLimit()
+	n, err := io.Copy(file, io.LimitReader(resp.Body, limit+1))
+	if err == nil && n > limit {
+		err = errTooBig(limit)
+	}
+	return err
+}
+
+/*
+ * Get an image from the cache, or download it if it isn't there. A
+ * failure to save the download is only logged, since the image itself
+ * is fine.
+ */
+func fetchImage(url string) ([]byte, error) {
+	info, err := os.Stat(blobPath(url))
+	if err == nil && info.Size() > downloadLimit() {
+		return nil, errTooBig(downloadLimit())
+	}
+
+	data, err := os.ReadFile(blobPath(url))
+	if err == nil {
+		return data, nil
+	} else if !os.IsNotExist(err) {
+		blobLog.Error("Error while reading the image cache", "err", err)
+	}
+
+	data, err = cacheImage(url)
+	if err != nil && data != nil {
+		blobLog.Error("Error while saving to the image cache", "err", err)
+		err = nil
+	}
+	return data, err
+}
+
+// Get an image's thumbnail from the cache, making it if it isn't there.
+func fetchThumb(url string) ([]byte, error) {
+	path := blobPath(url) + ".thumb"
+	thumb, err := os.ReadFile(path)
+	if err == nil {
+		return thumb, nil
+	}
+
+	data, err := fetchImage(url)
+	if err != nil {
+		return nil, err
+	}
+
+	thumb, err = thumbnail(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.WriteFile(path, thumb, 0644); err != nil {
+		blobLog.Error("Error while saving a thumbnail", "err", err)
+	}
+	return thumb, nil
+}
@@ -0,0 +1,180 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * bulkdel.go - Deleting many tags at once. `del` takes any number of
+ * tags, and patterns among them, where * matches any run of characters,
+ * ? any one, and [abc] any of those listed (so `del halloween-*` deletes
+ * every tag starting with halloween-). Each tag is deleted or kept on
+ * its own, with the reason it was kept, should it be locked or someone
+ * else's.
+ *
+ * Deleting more than ConfirmDelOver tags waits for whoever asked to
+ * click a button first, see confirm.go.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// How many tags `del` may delete without asking first.
+	ConfirmDelOver = 5
+	// How many of them the question names, to keep it to one message.
+	confirmDelShows = 30
+)
+
+/*
+ * The tags named by args, with the patterns among them matched against
+ * every tag, in the order given and without repeats. unmatched are the
+ * args that named no tag.
+ */
+func expandTagArgs(args []string) (tags []string, unmatched []string, err error) {
+	names, err := allTagNames()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+
+	seen := map[string]bool{}
+	for _, arg := range args {
+		pattern := normTag(arg)
+		matched := []string{}
+		if strings.ContainsAny(pattern, "*?[") {
+			for _, name := range names {
+				ok, err := path.Match(pattern, name)
+				if err != nil {
+					return nil, nil, fmt.Errorf("`%s` isn't a pattern I understand: %w", arg, err)
+				} else if ok {
+					matched = append(matched, name)
+				}
+			}
+		} else if known[pattern] {
+			matched = append(matched, pattern)
+		}
+
+		if len(matched) == 0 {
+			unmatched = append(unmatched, arg)
+		}
+		for _, name := range matched {
+			if !seen[name] {
+				seen[name] = true
+				tags = append(tags, name)
+			}
+		}
+	}
+	return tags, unmatched, nil
+}
+
+/*
+ * Delete the tags, as the command's user, and say how it went: which
+ * were removed, and why the rest were kept.
+ */
+func delTags(ctx *CommandContext, tags []string, unmatched []string) {
+	snapshot, err := takeTagsSnapshot(tags)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	manager := userHasPerms(ctx, PermManageServer, "")
+	removed := []string{}
+	kept := []string{}
+	for _, arg := range unmatched {
+		kept = append(kept, fmt.Sprintf("**%s**: I don't remember a tag by that name", arg))
+	}
+
+	for _, tag := range tags {
+		if Settings.StrictOwnership && !manager {
+			author, err := otherTagAuthor(tag, ctx.Event.Author.ID)
+			if handleCommandErrors(ctx, SqlError, err) {
+				return
+			} else if author != "" {
+				kept = append(kept, fmt.Sprintf("**%s**: it isn't yours", tag))
+				continue
+			}
+		}
+
+		err := delTag(tag)
+		if err == ErrTagLocked {
+			kept = append(kept, fmt.Sprintf("**%s**: it's locked", tag))
+			continue
+		} else if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		logger.Info("Removed a tag", "tag", tag, "user", ctx.Event.Author.ID)
+		removed = append(removed, tag)
+	}
+
+	if len(removed) > 0 {
+		ctx.auditTags("tag del", removed, "")
+		ctx.journalTags("tag del", removed, snapshot)
+	}
+
+	buf := bytes.Buffer{}
+	switch len(removed) {
+	case 0:
+	case 1:
+		buf.WriteString(fmt.Sprintf("Removed the tag **%s**.", removed[0]))
+	default:
+		buf.WriteString(fmt.Sprintf("Removed %d tags: **%s**.", len(removed),
+			strings.Join(removed, "**, **")))
+	}
+
+	if len(kept) > 0 {
+		if len(removed) > 0 {
+			buf.WriteString("\n\n")
+		}
+		buf.WriteString("Sire, I kept these:\n- " + strings.Join(kept, "\n- "))
+	}
+	ctx.ReplyLong(buf.String())
+}
+
+func cmdDel(ctx *CommandContext, args []string) {
+	if len(args) == 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	tags, unmatched, err := expandTagArgs(args)
+	if errors.Is(err, path.ErrBadPattern) {
+		ctx.Reply("Sire, " + err.Error() + ".")
+		return
+	} else if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(tags) == 0 && len(args) == 1 {
+		ctx.Reply("Sire, I don't remember a tag named that anyways.")
+		return
+	}
+	if len(tags) <= ConfirmDelOver {
+		delTags(ctx, tags, unmatched)
+		return
+	}
+
+	// Ask first, since that's a lot to lose to a typo in a pattern.
+	shown := tags
+	more := ""
+	if len(shown) > confirmDelShows {
+		shown = shown[:confirmDelShows]
+		more = fmt.Sprintf(", and %d more", len(tags)-confirmDelShows)
+	}
+	confirmAction(ctx,
+		fmt.Sprintf("Sire, that's %d tags: **%s**%s. Shall I delete them all?",
+			len(tags), strings.Join(shown, "**, **"), more),
+		fmt.Sprintf("Sire, deleting %d tags.", len(tags)),
+		func() { delTags(ctx, tags, unmatched) })
+}
@@ -0,0 +1,98 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * bulknew.go - Making many tags at once. `new PREFIX` with several
+ * images attached makes PREFIX-1, PREFIX-2, and so on, in the order
+ * they're attached; `new` with images and no name names each after its
+ * file. Each image is checked on its own, and the bard sums up what it
+ * made and what it skipped, and why.
+ *
+ * Unlike `new TAG`, this never replaces a tag: a name that's taken is
+ * skipped, so a batch can't clobber tags by accident.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The name for the nth (from 1) of a batch of images, see cmdNewBulk().
+func bulkTagName(prefix string, n int, filename string) string {
+	if prefix != "" {
+		return fmt.Sprintf("%s-%d", prefix, n)
+	}
+	name := strings.TrimSuffix(filename, path.Ext(filename))
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "-")
+}
+
+// Make a tag of each attached image, named from prefix (or, if it's "", their files).
+func cmdNewBulk(ctx *CommandContext, prefix string) {
+	made := []string{}
+	skipped := []string{}
+	notes := []string{}
+	taken := map[string]bool{}
+
+	for n, attachment := range ctx.Event.Attachments {
+		name := bulkTagName(prefix, n+1, attachment.Filename)
+		skip := func(why string) {
+			skipped = append(skipped, fmt.Sprintf("%s: %s", attachment.Filename, why))
+		}
+
+		if imageTypeProblem(attachment.Filename) != "" {
+			skip("it isn't a JPEG, PNG, GIF, or WebP, or an AVIF I can read.")
+			continue
+		} else if name == "" {
+			skip("I couldn't make a name of it.")
+			continue
+		} else if taken[normTag(name)] {
+			skip(fmt.Sprintf("another image is named **%s** already.", name))
+			continue
+		}
+		taken[normTag(name)] = true
+
+		exists, err := tagExists(name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if exists {
+			skip(fmt.Sprintf("there's a tag named **%s** already.", normTag(name)))
+			continue
+		}
+
+		reply, err := rememberTag(name, ctx.Event.Author.ID, attachment.URL)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+		made = append(made, normTag(name))
+
+		// rememberTag() has more to say than the name when something's amiss.
+		if reply != fmt.Sprintf("I'll remember tag **%s**.", name) {
+			notes = append(notes, reply)
+		}
+	}
+
+	if len(made) > 0 {
+		ctx.auditTags("tag new", made, "")
+	}
+
+	buf := bytes.Buffer{}
+	if len(made) > 0 {
+		buf.WriteString(fmt.Sprintf("I'll remember %d tags: **%s**.", len(made),
+			strings.Join(made, "**, **")))
+	} else {
+		buf.WriteString("Sire, I made no tags.")
+	}
+	for _, note := range notes {
+		buf.WriteString("\n" + note)
+	}
+	if len(skipped) > 0 {
+		buf.WriteString("\n\nI skipped these:\n- " + strings.Join(skipped, "\n- "))
+	}
+	ctx.ReplyLong(buf.String())
+}
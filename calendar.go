@@ -0,0 +1,666 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * calendar.go - Banners from a calendar. With CalendarURL set to an
+ * iCalendar feed (a Google Calendar's "secret address in iCal format",
+ * say), the bard reads it every CalendarCheckMinutes, and while an entry
+ * titled after a tag is on, puts that tag up. An entry titled after a
+ * playlist puts up one of the playlist's tags, picked when it starts.
+ * Entries named for neither are passed over. Once the entry ends, what
+ * was up before it goes back, and the rotation is held meanwhile, as for
+ * event rules.
+ *
+ * Repeating entries are followed for RRULEs of FREQ=DAILY, WEEKLY (with
+ * or without BYDAY), MONTHLY, and YEARLY, with INTERVAL, COUNT, UNTIL,
+ * and EXDATE, and with moved or cancelled repeats (RECURRENCE-ID). Rules
+ * that pick days any other way only count their first entry.
+ *
+ * If entries overlap, the one that started last wins. Which entry has
+ * its tag up is kept under calendarEntryKey, and what it covered under
+ * calendarPreviousKey, so a restart mid entry still puts things back.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var calendarLog = moduleLogger("calendar")
+
+const (
+	// The entry whose tag is up, and the tag it went up over.
+	calendarEntryKey    = "calendar_entry"
+	calendarPreviousKey = "calendar_previous"
+
+	// The most of a calendar that's read.
+	calendarSizeLimit = 4 << 20
+
+	// How far ahead `calendar ls` looks.
+	calendarLookahead = 7 * 24 * time.Hour
+
+	// The most repeats of one entry that are worked out, so a rule
+	// without an end can't run away. Daily for a century is fewer.
+	calendarMaxRepeats = 50000
+)
+
+var calendarClient = &http.Client{Timeout: 30 * time.Second}
+
+// One occurrence of a calendar entry.
+type CalendarEntry struct {
+	UID   string
+	Title string
+	Start time.Time
+	End   time.Time
+}
+
+// What the entry is known by, among all the calendar's occurrences.
+func (entry CalendarEntry) key() string {
+	return entry.UID + "@" + entry.Start.UTC().Format(icalTimeFormat)
+}
+
+// An event as it's written in the calendar, before its repeats are worked out.
+type calendarEvent struct {
+	uid          string
+	title        string
+	start        time.Time
+	end          time.Time
+	allDay       bool
+	duration     time.Duration
+	hasEnd       bool
+	rrule        map[string]string
+	exdates      []time.Time
+	recurrenceID time.Time
+	cancelled    bool
+}
+
+// Parsing
+
+var icalUnescaper = strings.NewReplacer(
+	`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+/*
+ * Split a content line into its name, parameters, and value, as in
+ * DTSTART;TZID=Europe/Paris:20240101T090000.
+ */
+func icalProperty(line string) (name string, params map[string]string, value string) {
+	head, value, _ := strings.Cut(line, ":")
+	parts := strings.Split(head, ";")
+
+	params = map[string]string{}
+	for _, param := range parts[1:] {
+		key, val, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(key)] = strings.Trim(val, `"`)
+	}
+	return strings.ToUpper(parts[0]), params, value
+}
+
+/*
+ * Read a DATE or DATE-TIME value. Times without a zone (and dates) are
+ * taken in the guild's timezone. all is whether it was a date.
+ */
+func icalTime(value string, params map[string]string) (at time.Time, all bool, err error) {
+	loc := guildLocation()
+	if tzid, ok := params["TZID"]; ok {
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			loc = tz
+		}
+	}
+
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == len(icalDateFormat):
+		at, err = time.ParseInLocation(icalDateFormat, value, loc)
+		return at, true, err
+	case strings.HasSuffix(value, "Z"):
+		at, err = time.Parse(icalTimeFormat, value)
+		return at, false, err
+	default:
+		at, err = time.ParseInLocation(strings.TrimSuffix(icalTimeFormat, "Z"), value, loc)
+		return at, false, err
+	}
+}
+
+// Read a DURATION value, like PT1H30M or P2D.
+func icalDuration(value string) (time.Duration, error) {
+	raw := strings.TrimPrefix(strings.TrimPrefix(value, "+"), "P")
+	if raw == value || raw == "" {
+		return 0, fmt.Errorf("%q isn't a duration", value)
+	}
+
+	var total time.Duration
+	inTime := false
+	digits := ""
+	for _, chr := range raw {
+		if chr >= '0' && chr <= '9' {
+			digits += string(chr)
+			continue
+		} else if chr == 'T' {
+			inTime = true
+			continue
+		}
+
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return 0, fmt.Errorf("%q isn't a duration", value)
+		}
+		digits = ""
+
+		switch {
+		case chr == 'W':
+			total += time.Duration(n) * 7 * 24 * time.Hour
+		case chr == 'D':
+			total += time.Duration(n) * 24 * time.Hour
+		case chr == 'H' && inTime:
+			total += time.Duration(n) * time.Hour
+		case chr == 'M' && inTime:
+			total += time.Duration(n) * time.Minute
+		case chr == 'S' && inTime:
+			total += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("%q isn't a duration", value)
+		}
+	}
+	return total, nil
+}
+
+// Read the events out of an iCalendar file.
+func parseCalendar(r io.Reader) ([]calendarEvent, error) {
+	// Unfold the long lines first; continuations start with a space or tab.
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), calendarSizeLimit)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	events := []calendarEvent{}
+	var event *calendarEvent
+	for _, line := range lines {
+		name, params, value := icalProperty(line)
+		if name == "BEGIN" && value == "VEVENT" {
+			event = &calendarEvent{}
+			continue
+		} else if event == nil {
+			continue
+		}
+
+		var err error
+		switch name {
+		case "END":
+			if value == "VEVENT" {
+				if !event.start.IsZero() {
+					events = append(events, *event)
+				}
+				event = nil
+			}
+		case "UID":
+			event.uid = value
+		case "SUMMARY":
+			event.title = strings.TrimSpace(icalUnescaper.Replace(value))
+		case "STATUS":
+			event.cancelled = strings.EqualFold(value, "CANCELLED")
+		case "DTSTART":
+			event.start, event.allDay, err = icalTime(value, params)
+		case "DTEND":
+			event.end, _, err = icalTime(value, params)
+			event.hasEnd = true
+		case "DURATION":
+			event.duration, err = icalDuration(value)
+			event.hasEnd = true
+		case "RRULE":
+			event.rrule = map[string]string{}
+			for _, part := range strings.Split(value, ";") {
+				key, val, _ := strings.Cut(part, "=")
+				event.rrule[strings.ToUpper(key)] = strings.ToUpper(val)
+			}
+		case "EXDATE":
+			for _, date := range strings.Split(value, ",") {
+				var at time.Time
+				if at, _, err = icalTime(date, params); err == nil {
+					event.exdates = append(event.exdates, at)
+				}
+			}
+		case "RECURRENCE-ID":
+			event.recurrenceID, _, err = icalTime(value, params)
+		}
+		if err != nil {
+			calendarLog.Debug("Skipping a property that doesn't parse",
+				"property", name, "value", value, "err", err)
+		}
+	}
+
+	return events, nil
+}
+
+// Repeats
+
+var icalWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+/*
+ * The days of the week a WEEKLY rule repeats on, or nil if BYDAY picks
+ * days some other way (like 2TU, which is for MONTHLY rules).
+ */
+func icalByDay(value string, start time.Time) []time.Weekday {
+	if value == "" {
+		return []time.Weekday{start.Weekday()}
+	}
+
+	days := []time.Weekday{}
+	for _, day := range strings.Split(value, ",") {
+		weekday, ok := icalWeekdays[day]
+		if !ok {
+			return nil
+		}
+		days = append(days, weekday)
+	}
+	return days
+}
+
+// Whether the rule is one the bard can follow.
+func icalRuleFollowed(rule map[string]string) bool {
+	for part := range rule {
+		switch part {
+		case "FREQ", "INTERVAL", "COUNT", "UNTIL", "WKST":
+		case "BYDAY":
+			if rule["FREQ"] != "WEEKLY" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	switch rule["FREQ"] {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+		return true
+	}
+	return false
+}
+
+/*
+ * The start of each of the event's repeats that begin between after and
+ * until, in order. Repeats cut by EXDATE are left in; see
+ * calendarEntries().
+ */
+func (event calendarEvent) starts(after time.Time, until time.Time) []time.Time {
+	if event.rrule == nil || !icalRuleFollowed(event.rrule) {
+		return []time.Time{event.start}
+	}
+
+	rule := event.rrule
+	interval, err := strconv.Atoi(rule["INTERVAL"])
+	if err != nil || interval < 1 {
+		interval = 1
+	}
+	count, _ := strconv.Atoi(rule["COUNT"])
+	if value, ok := rule["UNTIL"]; ok {
+		if end, _, err := icalTime(value, nil); err == nil && end.Before(until) {
+			// UNTIL is inclusive.
+			until = end.Add(time.Second)
+		}
+	}
+
+	// Repeats before after still count towards COUNT.
+	start := event.start
+	starts := []time.Time{}
+	repeats := 0
+	add := func(at time.Time) bool {
+		if !at.Before(until) || (count > 0 && repeats == count) ||
+			repeats == calendarMaxRepeats {
+			return false
+		}
+		repeats++
+		if !at.Before(after) {
+			starts = append(starts, at)
+		}
+		return true
+	}
+
+	if rule["FREQ"] == "WEEKLY" {
+		days := icalByDay(rule["BYDAY"], start)
+		if days == nil {
+			return []time.Time{start}
+		}
+
+		// Go week by week from the Monday of the first, taking
+		// each day of the rule in turn.
+		monday := start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		for week := 0; ; week += interval {
+			weekStart := monday.AddDate(0, 0, 7*week)
+			if !weekStart.Before(until) {
+				return starts
+			}
+
+			offsets := []int{}
+			for _, day := range days {
+				offsets = append(offsets, (int(day)+6)%7)
+			}
+			sort.Ints(offsets)
+
+			for _, offset := range offsets {
+				at := weekStart.AddDate(0, 0, offset)
+				if at.Before(start) {
+					continue
+				}
+				if !add(at) {
+					return starts
+				}
+			}
+		}
+	}
+
+	for i := 0; ; i += interval {
+		var at time.Time
+		switch rule["FREQ"] {
+		case "DAILY":
+			at = start.AddDate(0, 0, i)
+		case "MONTHLY":
+			at = start.AddDate(0, i, 0)
+		case "YEARLY":
+			at = start.AddDate(i, 0, 0)
+		}
+
+		// The 31st of a month without one (or the 29th of February
+		// in another year) doesn't happen; Go would roll it over.
+		if rule["FREQ"] != "DAILY" && at.Day() != start.Day() {
+			if !at.Before(until) || i/interval >= calendarMaxRepeats {
+				return starts
+			}
+			continue
+		}
+		if !add(at) {
+			return starts
+		}
+	}
+}
+
+// How long each of the event's repeats lasts.
+func (event calendarEvent) length() time.Duration {
+	switch {
+	case !event.end.IsZero():
+		return event.end.Sub(event.start)
+	case event.hasEnd:
+		return event.duration
+	case event.allDay:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+/*
+ * Every occurrence of the events that's on at some point between from
+ * and until, in order of starting.
+ */
+func calendarEntries(events []calendarEvent, from time.Time, until time.Time) []CalendarEntry {
+	// Repeats moved or cancelled on their own, by UID.
+	moved := map[string][]time.Time{}
+	for _, event := range events {
+		if !event.recurrenceID.IsZero() {
+			moved[event.uid] = append(moved[event.uid], event.recurrenceID)
+		}
+	}
+
+	skipped := func(at time.Time, skips []time.Time) bool {
+		for _, skip := range skips {
+			if at.Equal(skip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	entries := []CalendarEntry{}
+	for _, event := range events {
+		if event.cancelled {
+			continue
+		}
+
+		length := event.length()
+		for _, start := range event.starts(from.Add(-length), until) {
+			if event.recurrenceID.IsZero() &&
+				(skipped(start, event.exdates) || skipped(start, moved[event.uid])) {
+				continue
+			}
+
+			end := start.Add(length)
+			if start.Before(until) && (end.After(from) || (length == 0 && !start.Before(from))) {
+				entries = append(entries, CalendarEntry{UID: event.uid,
+					Title: event.title, Start: start, End: end})
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Start.Before(entries[j].Start)
+	})
+	return entries
+}
+
+// Fetching
+
+// Fetch and read the calendar at CalendarURL.
+func fetchCalendar() ([]calendarEvent, error) {
+	url := Settings.CalendarURL
+	if strings.HasPrefix(url, "webcal://") {
+		url = "https://" + strings.TrimPrefix(url, "webcal://")
+	}
+
+	resp, err := calendarClient.Get(url)
+	if err != nil {
+		// The URL is a secret; don't let it into the logs.
+		return nil, fmt.Errorf("couldn't fetch the calendar")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the calendar answered %s", resp.Status)
+	}
+	return parseCalendar(io.LimitReader(resp.Body, calendarSizeLimit))
+}
+
+func checkCalendarURL(value string) error {
+	if value == "" || strings.HasPrefix(value, "https://") ||
+		strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "webcal://") {
+		return nil
+	}
+	return fmt.Errorf("the calendar should be an https:// or webcal:// address")
+}
+
+/*
+ * The tag a calendar entry or holiday puts up: the tag it names, or one
+ * of the playlist's. "" if it names neither.
+ */
+func tagOrPlaylistTag(name string) (string, error) {
+	exists, err := tagExists(name)
+	if err != nil || exists {
+		return name, err
+	}
+
+	tags, err := playlistTags(name)
+	if err != nil || len(tags) == 0 {
+		return "", err
+	}
+	return tags[rand.Intn(len(tags))], nil
+}
+
+// Whether an entry's tag is up, holding the rotation.
+func calendarHeld() (bool, error) {
+	entry, err := getSetting(calendarEntryKey)
+	return entry != "", err
+}
+
+/*
+ * The entry that should have its tag up now (the latest to start of
+ * those on now and titled after a tag or playlist), and its tag. ok is
+ * false if there isn't one.
+ */
+func currentCalendarEntry(entries []CalendarEntry, now time.Time) (entry CalendarEntry,
+	ok bool, err error) {
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry = entries[i]
+		if entry.Start.After(now) || !entry.End.After(now) {
+			continue
+		}
+
+		if exists, err := tagExists(entry.Title); err != nil || exists {
+			return entry, err == nil, err
+		}
+		tags, err := playlistTags(entry.Title)
+		if err != nil || len(tags) > 0 {
+			return entry, err == nil, err
+		}
+	}
+	return CalendarEntry{}, false, nil
+}
+
+/*
+ * Put up the tag for the entry on now, if it's not up already, or put
+ * back what was up before once no entry is on. Run from the scheduler.
+ */
+func (scheduler *BannerScheduler) checkCalendar() {
+	// Without a calendar (say it was unset), nothing's on.
+	events := []calendarEvent{}
+	if Settings.CalendarURL != "" {
+		var err error
+		if events, err = fetchCalendar(); err != nil {
+			calendarLog.Error("Error while reading the calendar", "err", err)
+			return
+		}
+	}
+
+	now := time.Now()
+	entry, on, err := currentCalendarEntry(calendarEntries(events, now, now.Add(time.Second)), now)
+	if err != nil {
+		calendarLog.Error("Error while reading the calendar", "err", err)
+		return
+	}
+
+	upKey, err := getSetting(calendarEntryKey)
+	if err != nil {
+		calendarLog.Error("Error while checking the calendar", "err", err)
+		return
+	}
+
+	switch {
+	case on && entry.key() != upKey:
+		// Only the first entry in a row covers the old banner.
+		if upKey == "" {
+			previous, err := currentBanner()
+			if err == nil {
+				err = putSetting(calendarPreviousKey, previous)
+			}
+			if err != nil {
+				calendarLog.Error("Error while starting an entry", "err", err)
+				return
+			}
+		}
+
+		tag, err := tagOrPlaylistTag(entry.Title)
+		if err != nil || tag == "" {
+			calendarLog.Error("Error while starting an entry", "entry", entry.Title,
+				"err", err)
+			return
+		}
+
+		calendarLog.Info("Calendar entry started; setting the banner",
+			"entry", entry.Title, "tag", tag)
+		if err = scheduler.setter(scheduler.session, tag, "calendar"); err != nil {
+			calendarLog.Error("Error while setting the banner", "err", err)
+			return
+		}
+		if err = putSetting(calendarEntryKey, entry.key()); err != nil {
+			calendarLog.Error("Error while starting an entry", "err", err)
+		}
+	case !on && upKey != "":
+		previous, err := getSetting(calendarPreviousKey)
+		if err != nil {
+			calendarLog.Error("Error while ending an entry", "err", err)
+			return
+		}
+
+		calendarLog.Info("Calendar entry ended", "previous", previous)
+		if previous != "" {
+			if err = scheduler.setter(scheduler.session, previous, "calendar"); err != nil {
+				calendarLog.Error("Error while setting the banner", "err", err)
+			}
+		}
+
+		if err = putSetting(calendarEntryKey, ""); err != nil {
+			calendarLog.Error("Error while ending an entry", "err", err)
+		}
+	}
+}
+
+func cmdCalendarLs(ctx *CommandContext, args []string) {
+	if Settings.CalendarURL == "" {
+		ctx.Reply("Sire, I haven't been given a calendar. Set `CalendarURL` to its iCal address.")
+		return
+	}
+
+	events, err := fetchCalendar()
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	now := time.Now()
+	entries := calendarEntries(events, now, now.Add(calendarLookahead))
+	upKey, err := getSetting(calendarEntryKey)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("The calendar for the week ahead, sire:\n")
+	if len(entries) == 0 {
+		buf.WriteString("\nNothing.")
+	}
+	for _, entry := range entries {
+		buf.WriteString(fmt.Sprintf("\n%s **%s**",
+			entry.Start.In(guildLocation()).Format(DateFormat), entry.Title))
+
+		exists, err := tagExists(entry.Title)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+		tags, err := playlistTags(entry.Title)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		switch {
+		case entry.key() == upKey:
+			buf.WriteString(" (up now)")
+		case exists:
+		case len(tags) > 0:
+			buf.WriteString(" (a playlist)")
+		default:
+			buf.WriteString(" (no such tag or playlist)")
+		}
+	}
+
+	ctx.ReplyLong(buf.String())
+}
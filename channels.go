@@ -0,0 +1,146 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * channels.go - Where my commands are taken. CommandChannels lists the
+ * channels, separated by commas, and `admin channels add` and `admin
+ * channels rm` pin it for the guild. Commands anywhere else are ignored
+ * without a word, and slash commands get a quiet reply saying where to
+ * go instead; threads count as their channel. With no channels listed,
+ * commands are taken anywhere, and owners may always run them anywhere,
+ * so they can't be shut out.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var channelsLog = moduleLogger("channels")
+
+// Read a channel mention (<#ID>) or a bare channel ID, or "" if it's neither.
+func parseChannelID(arg string) string {
+	if strings.HasPrefix(arg, "<#") && strings.HasSuffix(arg, ">") {
+		arg = arg[2 : len(arg)-1]
+	} else if strings.HasPrefix(arg, "<") {
+		return ""
+	}
+	return parseUserID(arg)
+}
+
+// Read CommandChannels, channel IDs or mentions separated by commas.
+func parseCommandChannels(value string) ([]string, error) {
+	channels := []string{}
+	for _, channel := range strings.Split(value, ",") {
+		channel = strings.TrimSpace(channel)
+		if channel == "" {
+			continue
+		}
+
+		id := parseChannelID(channel)
+		if id == "" {
+			return nil, fmt.Errorf("%q isn't a channel ID", channel)
+		}
+		channels = append(channels, id)
+	}
+	return channels, nil
+}
+
+func checkCommandChannels(value string) error {
+	_, err := parseCommandChannels(value)
+	return err
+}
+
+// The channels commands are taken in, or none if they're taken anywhere.
+func commandChannels() []string {
+	// Checked when set, so this can't fail
+	channels, _ := parseCommandChannels(Settings.CommandChannels)
+	return channels
+}
+
+// Whether a user's commands are taken in a channel (or a thread under it).
+func commandChannelAllowed(s *discordgo.Session, channelID string, userID string) bool {
+	channels := commandChannels()
+	if len(channels) == 0 || isOwner(userID) || contains(channels, channelID) {
+		return true
+	}
+
+	channel, err := s.State.Channel(channelID)
+	return err == nil && channel.IsThread() && contains(channels, channel.ParentID)
+}
+
+// The channels commands are taken in, as mentions, for replies.
+func commandChannelMentions() string {
+	mentions := []string{}
+	for _, channel := range commandChannels() {
+		mentions = append(mentions, "<#"+channel+">")
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// Ignore commands outside CommandChannels.
+func channelMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if !commandChannelAllowed(ctx.Session, ctx.Event.ChannelID, ctx.Event.Author.ID) {
+		channelsLog.Debug("Ignored a command outside the command channels",
+			"command", ctx.CommandName, "channel", ctx.Event.ChannelID,
+			"user", ctx.Event.Author.ID)
+		return
+	}
+	next(ctx, args)
+}
+
+func cmdAdminChannels(ctx *CommandContext, args []string) {
+	if len(args) == 0 {
+		if len(commandChannels()) == 0 {
+			ctx.Reply("Sire, I take commands in any channel.")
+		} else {
+			ctx.Reply("Sire, I take commands in " + commandChannelMentions() + ".")
+		}
+		return
+	}
+
+	if len(args) != 2 || (args[0] != "add" && args[0] != "rm") {
+		ctx.SendUsage()
+		return
+	}
+
+	channel := parseChannelID(args[1])
+	if channel == "" {
+		ctx.SendUsage()
+		return
+	}
+
+	channels := commandChannels()
+	switch {
+	case args[0] == "rm" && !contains(channels, channel):
+		ctx.Reply("Sire, <#" + channel + "> isn't one of my command channels.")
+		return
+	case args[0] == "rm":
+		channels = remove(channels, channel)
+	case contains(channels, channel):
+		ctx.Reply("Sire, <#" + channel + "> is already one of my command channels.")
+		return
+	default:
+		if _, err := ctx.Session.State.GuildChannel(Settings.GuildID, channel); err != nil {
+			ctx.Reply("Sire, I can't find that channel here.")
+			return
+		}
+		channels = append(channels, channel)
+	}
+
+	key, _ := findConfigKey("CommandChannels")
+	err := pinConfig(key, strings.Join(channels, ", "))
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	channelsLog.Info("Command channels changed", "channels", Settings.CommandChannels,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
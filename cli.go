@@ -0,0 +1,204 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * cli.go - One-off actions from the command line, for cron jobs and
+ * scripts that shouldn't have to talk to a running bard:
+ *
+ *   banner-bard set TAG         put a tag up as the banner
+ *   banner-bard export FILE     write everything out as `export` does (a
+ *                               FILE ending in .zip gets the images too, as
+ *                               `export full`, and .csv the tags alone)
+ *   banner-bard verify          check Discord shows the banner last put up
+ *
+ * Each reads settings.json and the database as the bard does, does its
+ * one thing over Discord's REST API (without going online), and exits:
+ * 0 if all went well, 1 if the action failed, and 2 if it couldn't be
+ * tried. A running bard's schedule carries on regardless, and may put
+ * its own tag up when it next changes the banner.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type cliAction struct {
+	usage string
+	run   func(s *discordgo.Session, args []string) int
+}
+
+var cliActions = map[string]cliAction{
+	"set":    {"set TAG", cliSet},
+	"export": {"export FILE", cliExport},
+	"verify": {"verify", cliVerify},
+}
+
+/*
+ * Run the action named on the command line, if there is one, and exit
+ * with its code. Returns if the arguments don't name an action.
+ */
+func cliMain(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	action, ok := cliActions[args[0]]
+	if !ok {
+		return
+	}
+
+	loadSettingsOrPanic()
+	// Keep stdout for what the action has to say.
+	setLogWriter(os.Stderr)
+
+	err := openDb()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err = loadGuildConfig(); err == nil {
+		err = reloadConfig()
+	}
+	if err != nil {
+		closeDbOrPanic()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	migrateTagNamesOrPanic()
+
+	go StartWriter()
+
+	discord, err := discordgo.New("Bot " + Settings.Token)
+	if err != nil {
+		closeDbOrPanic()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	code := action.run(discord, args[1:])
+	if code == 2 {
+		fmt.Fprintln(os.Stderr, "Usage: banner-bard "+action.usage)
+	}
+
+	FlushWrites()
+	closeDbOrPanic()
+	os.Exit(code)
+}
+
+func cliSet(s *discordgo.Session, args []string) int {
+	if len(args) != 1 {
+		return 2
+	}
+
+	// Without going online, the bard doesn't know who it is.
+	me, err := s.User("@me")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, explainDiscordError(err))
+		return 1
+	}
+	s.State.User = me
+
+	if err = setBanner(s, args[0], "cli"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if KillSwitch.Engaged() {
+		fmt.Println("The kill switch is on, so I only pretended to set", args[0])
+	} else {
+		fmt.Println("Set the banner to", args[0])
+	}
+	return 0
+}
+
+func cliExport(s *discordgo.Session, args []string) int {
+	if len(args) != 1 {
+		return 2
+	}
+
+	// The bard isn't running here, so the schedule is the one it saved, if any.
+	var saved *SavedSchedule
+	schedule, ok, err := loadSchedule()
+	if ok {
+		saved = &schedule
+	}
+
+	var export Export
+	if err == nil {
+		export, err = buildExport(saved)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// A .csv is the old export, of the tags alone, and a .zip has the images.
+	switch ext := filepath.Ext(args[0]); {
+	case strings.EqualFold(ext, ".csv"):
+		err = writeExport(file, export.Tags)
+	case strings.EqualFold(ext, ".zip"):
+		var missing []error
+		missing, err = writeArchive(file, export)
+		for _, problem := range missing {
+			fmt.Fprintln(os.Stderr, "Left out an image:", problem)
+		}
+	default:
+		err = writeJSONExport(file, export)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("Exported %d tags to %s\n", len(export.Tags), args[0])
+	return 0
+}
+
+func cliVerify(s *discordgo.Session, args []string) int {
+	if len(args) != 0 {
+		return 2
+	}
+
+	tag, err := currentBanner()
+	if err == nil && tag == "" {
+		fmt.Println("No banner of mine is up yet")
+		return 0
+	}
+
+	var expected, seen string
+	if err == nil {
+		expected, err = getSetting(bannerHashKey)
+	}
+	if err == nil {
+		seen, err = observedBanner(s)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, explainDiscordError(err))
+		return 1
+	}
+
+	if seen != expected {
+		fmt.Printf("Discord shows banner %q, not %s (%q)\n", seen, tag, expected)
+		return 1
+	}
+	fmt.Printf("Discord shows %s, as it should\n", tag)
+	return 0
+}
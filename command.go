@@ -23,6 +23,8 @@ import (
 	"github.com/bwmarrin/discordgo"
 )
 
+var commandLog = moduleLogger("command")
+
 /* The permission bits. When giving a command a permission, you pick
  * and choose which groups get to run the command, binary-or them
  * together, and that's it.
@@ -31,8 +33,21 @@ const (
 	PermEveryone byte = 1 << iota
 	PermManageServer
 	PermRole
+	PermCrew // the role owning the playlist named first, see crew.go
 )
 
+// With no bits set, only the owner gets to run the command.
+const PermOwner byte = 0
+
+// Who gets to run most commands that change things.
+const PermDefault = PermRole | PermManageServer
+
+/* Flags share the permission byte, but don't decide who can run the
+ * command. FlagReadOnly marks a command that doesn't change anything,
+ * so it can still be answered while the bard is draining.
+ */
+const FlagReadOnly byte = 1 << 7
+
 /*
  * When a command is called, it is provided with context of where the
  * command came from, which event was generated, the command struct
@@ -51,11 +66,24 @@ type CommandFunc func(ctx *CommandContext, args []string)
 
 type Command interface {
 	Apply(ctx *CommandContext, args []string)
-	Help(ctx *CommandContext) string
+	Help(ctx *CommandContext) []HelpEntry
 	Perms() byte
 	Usage() string
 }
 
+/*
+ * Help is gathered as entries rather than text, so that it can be
+ * searched and grouped before it's rendered. Each entry is one runnable
+ * command the user is permitted to use.
+ */
+type HelpEntry struct {
+	Group       string // heading from the builder's Group()
+	Name        string // full name with prefix, e.g. "bb, playlist new"
+	Usage       string
+	Description string
+	Examples    []string // full invocations with prefix
+}
+
 /*
  * A simple command applies its context and arguments to the command *
  * function given. You make a function, e.g. cmdHelp(), tack it to the
@@ -66,21 +94,28 @@ type SimpleCommand struct {
 	usage       string
 	perms       byte
 	description string
+	examples    []string // arguments only, e.g. "1h cat dog"
 }
 
 func (cmd *SimpleCommand) Apply(ctx *CommandContext, args []string) {
 	cmd.function(ctx, args)
 }
 
-func (cmd *SimpleCommand) Help(ctx *CommandContext) string {
-	switch {
-	case !userPermitted(ctx, cmd):
-		return ""
-	case cmd.usage == "":
-		return fmt.Sprintf("`%s`, %s\n", ctx.CommandName, cmd.description)
-	default:
-		return fmt.Sprintf("`%s %s`, %s\n", ctx.CommandName, cmd.usage, cmd.description)
+func (cmd *SimpleCommand) Help(ctx *CommandContext) []HelpEntry {
+	if !userPermitted(ctx, cmd, nil) {
+		return nil
 	}
+
+	entry := HelpEntry{
+		Name:        ctx.CommandName,
+		Usage:       cmd.usage,
+		Description: cmd.description}
+
+	for _, example := range cmd.examples {
+		entry.Examples = append(entry.Examples, ctx.CommandName+" "+example)
+	}
+
+	return []HelpEntry{entry}
 }
 
 func (cmd *SimpleCommand) Perms() byte   { return cmd.perms }
@@ -89,7 +124,10 @@ func (cmd *SimpleCommand) Usage() string { return cmd.usage }
 /*
  * A compound command combines multiple other commands in one
  * namespace. This feature is entirely used for the playlist commands so
- * that their names mirror the usual tag commands.
+ * that their names mirror the usual tag commands. A compound can also
+ * have a fallback, kept under the name "", which is run when no
+ * subcommand is named, so a simple command can grow subcommands
+ * without its old uses breaking.
  */
 type CompoundCommand struct {
 	commandMap map[string]Command
@@ -98,32 +136,42 @@ type CompoundCommand struct {
 }
 
 func (cmd *CompoundCommand) Apply(ctx *CommandContext, args []string) {
-	subCmd, ok := cmd.commandMap[args[0]]
-	if !ok {
-		// TODO: some type of explicit error here that the
-		// subcommand doesn't exist?
-		return
+	if len(args) > 0 && args[0] != "" {
+		if subCmd, ok := cmd.commandMap[args[0]]; ok {
+			runCommand(ctx, subCmd, ctx.CommandName+" "+args[0], args[1:])
+			return
+		}
 	}
 
-	if userPermitted(ctx, subCmd) {
-		ctx.Command = subCmd
-		ctx.CommandName += " " + args[0]
-		logger.Printf("Invoked subcommand '%s'\n", ctx.CommandName)
-		subCmd.Apply(ctx, args[1:])
+	fallback, ok := cmd.commandMap[""]
+	switch {
+	case ok:
+		runCommand(ctx, fallback, ctx.CommandName, args)
+	case len(args) == 0:
+		ctx.SendUsage()
+	default:
+		// TODO: some type of explicit error here that the
+		// subcommand doesn't exist?
 	}
 }
 
-func (cmd *CompoundCommand) Help(ctx *CommandContext) string {
-	buf := bytes.Buffer{}
+func (cmd *CompoundCommand) Help(ctx *CommandContext) []HelpEntry {
+	entries := []HelpEntry{}
 	parentCommandName := ctx.CommandName
 	defer func() { ctx.CommandName = parentCommandName }()
 
 	for _, cmdName := range cmd.helpList {
-		ctx.CommandName = parentCommandName + " " + cmdName
-		buf.WriteString(cmd.commandMap[cmdName].Help(ctx))
+		ctx.CommandName = parentCommandName
+		if cmdName != "" {
+			ctx.CommandName += " " + cmdName
+		}
+		if commandDisabled(strings.TrimPrefix(ctx.CommandName, ctx.Prefix)) {
+			continue
+		}
+		entries = append(entries, cmd.commandMap[cmdName].Help(ctx)...)
 	}
 
-	return buf.String()
+	return entries
 }
 
 func (cmd *CompoundCommand) Perms() byte   { return cmd.perms }
@@ -135,28 +183,96 @@ type CommandEvaluator struct {
 	helpText   []HelpNode
 }
 
+// Gather help for every command the user may run, in help order.
+func (eval *CommandEvaluator) HelpEntries(ctx *CommandContext) []HelpEntry {
+	entries := []HelpEntry{}
+	group := ""
+
+	for _, node := range eval.helpText {
+		if !node.isCommand {
+			group = node.text
+			continue
+		}
+
+		if commandDisabled(node.text) {
+			continue
+		}
+
+		ctx.CommandName = ctx.Prefix + node.text
+		for _, entry := range eval.commandMap[node.text].Help(ctx) {
+			entry.Group = group
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
 func (eval *CommandEvaluator) Help(ctx *CommandContext) string {
+	return eval.prelude + "\n\n" + renderHelp(eval.HelpEntries(ctx), false)
+}
+
+/*
+ * Return help for the commands whose name, description, or examples
+ * mention the query, ignoring case, or "" if nothing matched.
+ */
+func (eval *CommandEvaluator) Search(ctx *CommandContext, query string) string {
+	query = strings.ToLower(query)
+	matches := []HelpEntry{}
+
+	for _, entry := range eval.HelpEntries(ctx) {
+		haystack := []string{entry.Name, entry.Description}
+		haystack = append(haystack, entry.Examples...)
+
+		for _, text := range haystack {
+			if strings.Contains(strings.ToLower(text), query) {
+				matches = append(matches, entry)
+				break
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return ""
+	}
+	return renderHelp(matches, true)
+}
+
+// Render help entries under their group headings.
+func renderHelp(entries []HelpEntry, withExamples bool) string {
 	buf := bytes.Buffer{}
-	buf.WriteString(eval.prelude + "\n\n")
-
-	for i, node := range eval.helpText {
-		if node.isCommand {
-			// It's a command name
-			ctx.CommandName = ctx.Prefix + node.text
-			buf.WriteString(eval.commandMap[node.text].Help(ctx))
-		} else {
-			// It's a heading
+	group := ""
+
+	for i, entry := range entries {
+		if entry.Group != group {
+			// A new heading
 			if i > 0 {
 				// Give an extra space if we're not at the top of the list
 				buf.WriteRune('\n')
 			}
-			buf.WriteString("**" + node.text + "**\n")
+			group = entry.Group
+			buf.WriteString("**" + group + "**\n")
+		}
+
+		buf.WriteString(entry.String())
+
+		if withExamples {
+			for _, example := range entry.Examples {
+				buf.WriteString("  e.g. `" + example + "`\n")
+			}
 		}
 	}
 
 	return buf.String()
 }
 
+func (entry HelpEntry) String() string {
+	if entry.Usage == "" {
+		return fmt.Sprintf("`%s`, %s\n", entry.Name, entry.Description)
+	}
+	return fmt.Sprintf("`%s %s`, %s\n", entry.Name, entry.Usage, entry.Description)
+}
+
 type CompoundCommandBuilder struct{}
 
 type HelpNode struct {
@@ -164,42 +280,111 @@ type HelpNode struct {
 	text      string // command -> name, heading -> title
 }
 
-func userPermitted(ctx *CommandContext, cmd Command) bool {
-	cmdPerms := cmd.Perms()
+// Whether the user may run the command with the given arguments.
+func userPermitted(ctx *CommandContext, cmd Command, args []string) bool {
+	playlist := ""
+	if len(args) > 0 {
+		playlist = args[0]
+	}
+	ok, _ := tracePerms(ctx.Session, ctx.Event.Member, ctx.Event.Author.ID,
+		ctx.Event.ChannelID, cmd.Perms(), strings.TrimPrefix(ctx.CommandName, ctx.Prefix),
+		playlist)
+	return ok
+}
+
+/*
+ * Whether the user fits any of the permission bits given. The playlist
+ * is only looked at for PermCrew; with "", any crew will do.
+ */
+func userHasPerms(ctx *CommandContext, cmdPerms byte, playlist string) bool {
+	ok, _ := tracePerms(ctx.Session, ctx.Event.Member, ctx.Event.Author.ID,
+		ctx.Event.ChannelID, cmdPerms, "", playlist)
+	return ok
+}
+
+/*
+ * Decide whether a member fits any of the permission bits given, or has
+ * a role given the command (named without the prefix, or "" for none)
+ * with `perms set`, and say how, step by step. userHasPerms() decides;
+ * `perms test` explains.
+ */
+func tracePerms(s *discordgo.Session, member *discordgo.Member, userID string,
+	channelID string, cmdPerms byte, command string, playlist string) (bool, []string) {
+
+	steps := []string{}
+
 	if cmdPerms&PermEveryone == PermEveryone {
 		// Everyone can run it.
-		return true
+		return true, append(steps, "✓ Everyone may run it.")
 	}
+	steps = append(steps, "· Not everyone may run it.")
 
-	if ctx.Event.Author.ID == Settings.OwnerID {
+	if isOwner(userID) {
 		// The owner can run it.
-		return true
+		return true, append(steps, "✓ They're my owner, who may run anything.")
 	}
+	steps = append(steps, "· They aren't my owner.")
 
 	if cmdPerms&PermManageServer == PermManageServer {
 		// Does the user have ManagerServer permissions?
-		perms, err := ctx.Session.State.UserChannelPermissions(
-			ctx.Event.Author.ID, ctx.Event.ChannelID)
+		perms, err := s.State.UserChannelPermissions(userID, channelID)
 
 		var requiredPerm int64 = discordgo.PermissionManageServer
 		if err == nil && requiredPerm == perms&requiredPerm {
-			return true
+			return true, append(steps,
+				"✓ Members with Manage Server may run it, and they have it here.")
 		}
+		steps = append(steps,
+			"· Members with Manage Server may run it, but they don't have it here.")
+	} else {
+		steps = append(steps, "· Manage Server doesn't help with it.")
+	}
+
+	// A playlist with a crew is theirs to edit, not the allowed roles'.
+	crew := ""
+	if cmdPerms&PermCrew == PermCrew && playlist != "" {
+		crew = playlistCrewOrNone(playlist)
 	}
 
-	if cmdPerms&PermRole == PermRole {
+	if crew != "" {
+		steps = append(steps, fmt.Sprintf(
+			"· **%s** belongs to a crew, so my allowed roles don't help with it.",
+			playlist))
+	} else if cmdPerms&PermRole == PermRole {
 		// Does the user have one of the allowed roles?
 		for _, allowedRole := range Settings.AllowedRoles {
-			for _, authorRole := range ctx.Event.Member.Roles {
+			for _, authorRole := range member.Roles {
 				if allowedRole == authorRole {
-					return true
+					return true, append(steps, fmt.Sprintf(
+						"✓ Members with <@&%s> may run it, and they have it.",
+						allowedRole))
 				}
 			}
 		}
+		steps = append(steps,
+			"· Members with one of my allowed roles may run it, but they have none.")
+	} else {
+		steps = append(steps, "· My allowed roles don't help with it.")
+	}
+
+	if command != "" {
+		ok, step := traceCommandRoles(member, command)
+		steps = append(steps, step)
+		if ok {
+			return true, steps
+		}
+	}
+
+	if cmdPerms&PermCrew == PermCrew {
+		ok, step := traceCrew(member, playlist, crew)
+		steps = append(steps, step)
+		if ok {
+			return true, steps
+		}
 	}
 
 	// No conditions are met
-	return false
+	return false, append(steps, "✗ So they may not.")
 }
 
 // Context-sensitive helper functions
@@ -218,6 +403,22 @@ func (ctx *CommandContext) SendUsage() {
 
 // Command Evaluation
 
+/*
+ * Turn the command away if it's been disabled for the guild, with
+ * `config disable`. Returns whether it was.
+ */
+func refuseDisabled(ctx *CommandContext) bool {
+	command := strings.TrimPrefix(ctx.CommandName, ctx.Prefix)
+	if !commandDisabled(command) {
+		return false
+	}
+
+	commandLog.Info("Refused disabled command", "command", ctx.CommandName,
+		"user", ctx.Event.Author.ID)
+	ctx.Reply("Sire, `" + command + "` has been disabled here.")
+	return true
+}
+
 func evalCommand(s *discordgo.Session, m *discordgo.MessageCreate,
 	evaluator *CommandEvaluator, prefix string) {
 
@@ -233,15 +434,8 @@ func evalCommand(s *discordgo.Session, m *discordgo.MessageCreate,
 		return
 	}
 
-	if userPermitted(&ctx, cmd) {
-		ctx.Command = cmd
-		ctx.CommandName = prefix + args[0]
-		logger.Printf("Invoked command '%s' for user %s#%s %s\n",
-			ctx.CommandName, m.Author.Username,
-			m.Author.Discriminator, m.Author.Mention())
-
-		cmd.Apply(&ctx, args[1:])
-	}
+	// See middleware.go for what happens on the way.
+	runCommand(&ctx, cmd, prefix+args[0], args[1:])
 }
 
 // Command Evaluator Building
@@ -281,6 +475,13 @@ func (builder *CommandEvaluator) Compound(
 	return builder
 }
 
+// Give example arguments for the command added last.
+func (builder *CommandEvaluator) Examples(examples ...string) *CommandEvaluator {
+	last := builder.helpText[len(builder.helpText)-1].text
+	builder.commandMap[last].(*SimpleCommand).examples = examples
+	return builder
+}
+
 func (builder *CommandEvaluator) Group(title string) *CommandEvaluator {
 	builder.helpText = append(builder.helpText, HelpNode{
 		isCommand: false,
@@ -314,3 +515,20 @@ func (builder *CompoundCommand) Simple(name string, function CommandFunc,
 
 	return builder
 }
+
+/*
+ * Give the compound a fallback, run with all the arguments when none of
+ * its subcommands is named.
+ */
+func (builder *CompoundCommand) Fallback(function CommandFunc,
+	desc string, usage string, perms byte) *CompoundCommand {
+
+	return builder.Simple("", function, desc, usage, perms)
+}
+
+// Give example arguments for the subcommand added last.
+func (builder *CompoundCommand) Examples(examples ...string) *CompoundCommand {
+	last := builder.helpList[len(builder.helpList)-1]
+	builder.commandMap[last].(*SimpleCommand).examples = examples
+	return builder
+}
@@ -0,0 +1,556 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * config.go - Where each setting comes from. A setting can be given in
+ * up to five layers, and the highest one given wins:
+ *
+ *   default < settings.json < environment < guild < runtime
+ *
+ * Environment variables are named BANNER_BARD_ and the setting in
+ * capitals, e.g. BANNER_BARD_TAGSPERPAGE. A renamed setting is still
+ * read under its former name, in both. Guild overrides are kept in
+ * the database by `config pin` (and `timezone`), and runtime overrides
+ * by `config set`, which last until the bard restarts. Whatever wins is
+ * written into Settings, so the rest of the bard reads Settings as
+ * usual. `config effective` shows what won and why.
+ *
+ * Commands can be turned off for the guild too, with `config disable`,
+ * which pins them in DisabledCommands. The evaluator in command.go
+ * turns them away, and leaves them out of help.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var configLog = moduleLogger("config")
+
+type ConfigLayer int
+
+const (
+	LayerDefault ConfigLayer = iota
+	LayerFile
+	LayerEnv
+	LayerGuild
+	LayerRuntime
+)
+
+var configLayerNames = map[ConfigLayer]string{
+	LayerDefault: "default",
+	LayerFile:    "settings.json",
+	LayerEnv:     "environment",
+	LayerGuild:   "guild",
+	LayerRuntime: "runtime",
+}
+
+/*
+ * A setting that can be layered. Name is the field in SettingsStruct;
+ * only string, int, and bool fields can be layered.
+ */
+type ConfigKey struct {
+	Name     string
+	Default  string
+	Secret   bool   // never shown
+	Fixed    bool   // only from settings.json or the environment
+	GuildKey string // the key guild overrides are kept under, if not "config:NAME"
+	Check    func(value string) error
+	// A bool that's on unless it's plainly off, see truthy(); for safety switches.
+	Truthy bool
+	// The name it had, still read from settings.json and the environment.
+	Formerly string
+}
+
+var ConfigKeys = []ConfigKey{
+	{Name: "ClientID", Fixed: true},
+	{Name: "Token", Secret: true, Fixed: true},
+	{Name: "OwnerIDs", Fixed: true, Check: checkOwnerIDs, Formerly: "OwnerID"},
+	{Name: "GuildID", Fixed: true},
+	{Name: "LogChannelID"},
+	{Name: "StatusChannelID"},
+	{Name: "ArtForumChannelID"},
+	{Name: "SuggestChannelID"},
+	{Name: "SubmissionsChannelID"},
+	{Name: "SubmissionsConfirm", Default: "false"},
+	{Name: "StrictOwnership", Default: "true"},
+	{Name: "ElectionChannelID"},
+	{Name: "ElectionCloses", Default: "sun 18:00", Check: checkElectionCloses},
+	{Name: "ElectionVoteHours", Default: "24", Check: checkElectionVoteHours},
+	{Name: "Prefix", Default: "bb, "},
+	{Name: "TagsPerPage", Default: "20", Check: checkPositive},
+	{Name: "KillSwitch", Default: "false", Truthy: true},
+	{Name: "Timezone", GuildKey: timezoneKey, Check: checkTimezone},
+	{Name: "EventCheckMinutes", Default: "15", Check: checkPositive},
+	{Name: "RecheckDays", Default: "7"},
+	{Name: "GifFallbackFrame", Default: "0", Check: checkNonNegative},
+	{Name: "ImageMemoryMB", Default: "0", Check: checkNonNegative},
+	{Name: "AvifConverter", Default: "magick avif:- png:-", Fixed: true},
+	{Name: "BlobDir", Default: "./blobs", Fixed: true},
+	{Name: "TagFold", Default: "none", Fixed: true, Check: checkTagFold},
+	{Name: "AckMode", Default: "reply", Check: checkAckMode},
+	{Name: "AckOverrides", Check: checkAckOverrides},
+	{Name: "DisabledCommands", Check: checkDisabledCommands},
+	{Name: "CommandCooldowns", Default: "set=1m, audit=10m/guild", Check: checkCooldowns},
+	{Name: "CommandChannels", Check: checkCommandChannels},
+	{Name: "ConfirmDestructive", Default: "true"},
+	{Name: "RetryAttempts", Default: "4", Check: checkNonNegative},
+	{Name: "RetryBaseSeconds", Default: "15", Check: checkPositive},
+	{Name: "WatchdogSeconds", Default: "60", Check: checkNonNegative},
+	{Name: "UpdateCheck", Default: "false", Fixed: true},
+	{Name: "UpdateRepo", Default: "kaisomir/banner-bard-golang", Fixed: true},
+	{Name: "LogLevel", Default: "info", Check: checkLogLevel},
+	{Name: "LogFormat", Default: "text", Check: checkLogFormat},
+	{Name: "SentryDSN", Secret: true, Fixed: true, Check: checkSentryDSN},
+	{Name: "ErrorWebhook", Secret: true, Fixed: true, Check: checkErrorWebhook},
+	{Name: "ApiListen", Fixed: true},
+	{Name: "ApiToken", Secret: true, Fixed: true},
+	{Name: "ClientSecret", Secret: true, Fixed: true},
+	{Name: "DashboardURL", Fixed: true, Check: checkDashboardURL},
+	{Name: "TriggerSecret", Secret: true, Fixed: true},
+	{Name: "NotifyEmail", Secret: true, Fixed: true, Check: checkNotifyEmail},
+	{Name: "NotifyMatrix", Secret: true, Fixed: true, Check: checkNotifyMatrix},
+	{Name: "NotifyWebhook", Secret: true, Fixed: true, Check: checkErrorWebhook},
+	{Name: "NotifyRoutes", Check: checkNotifyRoutes},
+	{Name: "TwitchChannel", Fixed: true},
+	{Name: "TwitchLiveTag"},
+	{Name: "TwitchClientID", Fixed: true},
+	{Name: "TwitchClientSecret", Secret: true, Fixed: true},
+	{Name: "TwitchCheckMinutes", Default: "2", Fixed: true, Check: checkPositive},
+	{Name: "CalendarURL", Secret: true, Check: checkCalendarURL},
+	{Name: "CalendarCheckMinutes", Default: "15", Fixed: true, Check: checkPositive},
+	{Name: "HolidayCountry", Check: checkHolidayCountry},
+	{Name: "BackupHours", Default: "0", Fixed: true, Check: checkNonNegative},
+	{Name: "BackupDir", Fixed: true},
+	{Name: "BackupChannelID"},
+	{Name: "BackupKeep", Default: "7", Check: checkPositive},
+	{Name: "BackupFull", Default: "false"},
+}
+
+// The layers above the defaults, by setting name.
+var config struct {
+	mutex   sync.Mutex
+	file    map[string]string
+	guild   map[string]string
+	runtime map[string]string
+}
+
+func checkPositive(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+		return fmt.Errorf("%q isn't a positive number", value)
+	}
+	return nil
+}
+
+func checkNonNegative(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		return fmt.Errorf("%q isn't a number of zero or more", value)
+	}
+	return nil
+}
+
+func checkTimezone(value string) error {
+	if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+		return fmt.Errorf("%q isn't a timezone", value)
+	}
+	return nil
+}
+
+// Read a list of commands (without the prefix), separated by commas.
+func parseCommandList(value string) []string {
+	commands := []string{}
+	for _, command := range strings.Split(value, ",") {
+		command = strings.Join(strings.Fields(command), " ")
+		if command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// `config` can't be disabled, or it could never be enabled again.
+func checkDisabledCommands(value string) error {
+	for _, command := range parseCommandList(value) {
+		if strings.Fields(command)[0] == "config" {
+			return fmt.Errorf("`%s` can't be disabled", command)
+		}
+	}
+	return nil
+}
+
+// Whether a command (named without the prefix) is disabled for the guild.
+func commandDisabled(command string) bool {
+	return contains(parseCommandList(Settings.DisabledCommands), command)
+}
+
+func findConfigKey(name string) (ConfigKey, bool) {
+	for _, key := range ConfigKeys {
+		if strings.EqualFold(key.Name, name) {
+			return key, true
+		}
+	}
+	return ConfigKey{}, false
+}
+
+func (key ConfigKey) env() string {
+	return "BANNER_BARD_" + strings.ToUpper(key.Name)
+}
+
+// The environment variable the setting had under its former name, if any.
+func (key ConfigKey) formerEnv() string {
+	if key.Formerly == "" {
+		return ""
+	}
+	return "BANNER_BARD_" + strings.ToUpper(key.Formerly)
+}
+
+func (key ConfigKey) guildKey() string {
+	if key.GuildKey != "" {
+		return key.GuildKey
+	}
+	return "config:" + key.Name
+}
+
+// Whether the value would fit the setting's field, and pass its check.
+func (key ConfigKey) validate(value string) error {
+	var err error
+	switch reflect.ValueOf(Settings).FieldByName(key.Name).Kind() {
+	case reflect.Int:
+		_, err = strconv.Atoi(value)
+	case reflect.Bool:
+		if !key.Truthy {
+			_, err = strconv.ParseBool(value)
+		}
+	}
+
+	if err == nil && key.Check != nil {
+		err = key.Check(value)
+	}
+	return err
+}
+
+/*
+ * Whether a Truthy setting's on. Only "", "0", "off", "no", and what
+ * strconv.ParseBool() reads as false are off; anything else is on, as
+ * BANNER_BARD_KILLSWITCH always was, so a typo can't turn it off.
+ */
+func truthy(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "", "off", "no":
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	return err != nil || b
+}
+
+/*
+ * Find the value that wins for a setting, and the layer it came from.
+ * The environment can't be changed while we run, so it's read as is.
+ * Call with config.mutex held.
+ */
+func (key ConfigKey) resolve() (string, ConfigLayer) {
+	if value, ok := config.runtime[key.Name]; ok {
+		return value, LayerRuntime
+	}
+	if value, ok := config.guild[key.Name]; ok {
+		return value, LayerGuild
+	}
+	if value, ok := os.LookupEnv(key.env()); ok {
+		return value, LayerEnv
+	}
+	if value, ok := os.LookupEnv(key.formerEnv()); ok && key.Formerly != "" {
+		return value, LayerEnv
+	}
+	if value, ok := config.file[key.Name]; ok {
+		return value, LayerFile
+	}
+	return key.Default, LayerDefault
+}
+
+/*
+ * Write the winning value of every setting into Settings. A value that
+ * doesn't fit falls back to the default, so one bad override can't keep
+ * the bard from starting.
+ */
+func applyConfig() {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	settings := reflect.ValueOf(&Settings).Elem()
+	for _, key := range ConfigKeys {
+		value, layer := key.resolve()
+		if err := key.validate(value); err != nil {
+			configLog.Warn("Bad setting; using the default", "setting", key.Name,
+				"layer", configLayerNames[layer], "err", err)
+			value = key.Default
+		}
+
+		field := settings.FieldByName(key.Name)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, _ := strconv.Atoi(value)
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, _ := strconv.ParseBool(value)
+			if key.Truthy {
+				b = truthy(value)
+			}
+			field.SetBool(b)
+		}
+	}
+
+	setupLogging(Settings.LogLevel, Settings.LogFormat)
+}
+
+// Remember which settings the settings file gave, from its decoded JSON.
+func loadFileConfig(raw map[string]interface{}) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	config.file = map[string]string{}
+	for _, key := range ConfigKeys {
+		if value, ok := raw[key.Name]; ok {
+			config.file[key.Name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// Read the guild overrides from the database.
+func loadGuildConfig() error {
+	guild := map[string]string{}
+	for _, key := range ConfigKeys {
+		if key.Fixed {
+			continue
+		}
+
+		value, err := getSetting(key.guildKey())
+		if err != nil {
+			return err
+		}
+
+		if value != "" {
+			guild[key.Name] = value
+		}
+	}
+
+	config.mutex.Lock()
+	config.guild = guild
+	config.mutex.Unlock()
+	return nil
+}
+
+/*
+ * Apply everything that reads its setting once, rather than every time
+ * it's used.
+ */
+func reloadConfig() error {
+	applyConfig()
+
+	if err := KillSwitch.Load(); err != nil {
+		return err
+	}
+
+	// StatusChannelID may have moved
+	Status.Touch()
+	return loadTimezone()
+}
+
+// Set (or with value "", clear) a guild override, and apply it.
+func pinConfig(key ConfigKey, value string) error {
+	if err := putSetting(key.guildKey(), value); err != nil {
+		return err
+	}
+
+	if err := loadGuildConfig(); err != nil {
+		return err
+	}
+	return reloadConfig()
+}
+
+// Set (or with value "", clear) a runtime override, and apply it.
+func setRuntimeConfig(key ConfigKey, value string) error {
+	config.mutex.Lock()
+	if config.runtime == nil {
+		config.runtime = map[string]string{}
+	}
+	if value == "" {
+		delete(config.runtime, key.Name)
+	} else {
+		config.runtime[key.Name] = value
+	}
+	config.mutex.Unlock()
+
+	return reloadConfig()
+}
+
+// Look up the setting a command names, replying if there's no such thing.
+func commandConfigKey(ctx *CommandContext, name string) (ConfigKey, bool) {
+	key, ok := findConfigKey(name)
+	if !ok {
+		ctx.Reply("Sire, I have no setting named `" + name + "`. " +
+			"`config effective` lists them.")
+		return key, false
+	}
+
+	if key.Fixed {
+		ctx.Reply("Sire, **" + key.Name + "** can only be changed in my " +
+			"settings file or environment.")
+		return key, false
+	}
+
+	return key, true
+}
+
+func cmdConfigEffective(ctx *CommandContext, args []string) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	lines := make([]string, 0, len(ConfigKeys))
+	for _, key := range ConfigKeys {
+		value, layer := key.resolve()
+		if key.Secret {
+			value = "(hidden)"
+		} else if err := key.validate(value); err != nil {
+			value = fmt.Sprintf("%q (doesn't fit, so %q)", value, key.Default)
+		} else {
+			value = fmt.Sprintf("%q", value)
+		}
+
+		lines = append(lines, fmt.Sprintf("**%s** = %s, from %s",
+			key.Name, value, configLayerNames[layer]))
+	}
+
+	ctx.ReplyList("My settings, sire, and where they come from", lines, RenderEmbed)
+}
+
+// Shared by `config set` and `config pin`.
+func configChange(ctx *CommandContext, args []string,
+	change func(ConfigKey, string) error) {
+
+	if len(args) < 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	key, ok := commandConfigKey(ctx, args[0])
+	if !ok {
+		return
+	}
+
+	value := strings.Join(args[1:], " ")
+	if err := key.validate(value); err != nil {
+		ctx.Reply("Sire, that won't do for **" + key.Name + "**: " + err.Error() + ".")
+		return
+	}
+
+	if handleCommandErrors(ctx, SqlError, change(key, value)) {
+		return
+	}
+
+	configLog.Info("Setting changed", "setting", key.Name, "value", value,
+		"command", ctx.CommandName, "user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
+
+func cmdConfigSet(ctx *CommandContext, args []string) {
+	configChange(ctx, args, setRuntimeConfig)
+}
+
+func cmdConfigPin(ctx *CommandContext, args []string) {
+	configChange(ctx, args, pinConfig)
+}
+
+func cmdConfigUnset(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	key, ok := commandConfigKey(ctx, args[0])
+	if !ok {
+		return
+	}
+
+	err := setRuntimeConfig(key, "")
+	if err == nil {
+		err = pinConfig(key, "")
+	}
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	configLog.Info("Setting overrides cleared", "setting", key.Name,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
+
+// Change the disabled commands, replying if the command named won't do.
+func configDisable(ctx *CommandContext, args []string, disable bool) {
+	if len(args) == 0 || len(args) > 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	command := strings.Join(args, " ")
+	cmd, ok := BardEvaluator.commandMap[args[0]]
+	if len(args) == 2 {
+		compound, isCompound := cmd.(*CompoundCommand)
+		ok = isCompound
+		if ok {
+			_, ok = compound.commandMap[args[1]]
+		}
+	}
+	if !ok {
+		ctx.Reply("Sire, I have no command named `" + command + "`.")
+		return
+	}
+
+	key, _ := findConfigKey("DisabledCommands")
+	if err := key.validate(command); err != nil {
+		ctx.Reply("Sire, " + err.Error() + ".")
+		return
+	}
+
+	commands := parseCommandList(Settings.DisabledCommands)
+	switch {
+	case disable && contains(commands, command):
+		ctx.Reply("Sire, `" + command + "` is already disabled.")
+		return
+	case disable:
+		commands = append(commands, command)
+	case !contains(commands, command):
+		ctx.Reply("Sire, `" + command + "` isn't disabled.")
+		return
+	default:
+		commands = remove(commands, command)
+	}
+
+	err := pinConfig(key, strings.Join(commands, ", "))
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	configLog.Info("Disabled commands changed", "commands", Settings.DisabledCommands,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
+
+func cmdConfigDisable(ctx *CommandContext, args []string) {
+	configDisable(ctx, args, true)
+}
+
+func cmdConfigEnable(ctx *CommandContext, args []string) {
+	configDisable(ctx, args, false)
+}
@@ -0,0 +1,192 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * confirm.go - Asking before doing what can't be taken back: a plain
+ * `import`, which replaces every tag and playlist, `playlist del`, and
+ * `del` of more than ConfirmDelOver tags. confirmAction() asks with a
+ * pair of buttons, and only whoever ran the command may click them;
+ * after confirmWindow unanswered, the question's withdrawn and nothing
+ * happens. What's waiting is kept in memory, so a restart forgets it.
+ *
+ * Turning ConfirmDestructive off does it all straight away, for those
+ * who'd rather not be asked.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var confirmLog = moduleLogger("confirm")
+
+// How long a question waits for an answer.
+const confirmWindow = 30 * time.Second
+
+// A command waiting to be confirmed.
+type pendingConfirm struct {
+	ctx       *CommandContext // the command's, to carry on with
+	doing     string          // what to say once it's confirmed
+	run       func()
+	channelID string
+	messageID string // the question's
+}
+
+// Commands waiting to be confirmed, by the ID of the message that ran them.
+var pendingConfirms = struct {
+	sync.Mutex
+	confirms map[string]*pendingConfirm
+}{confirms: map[string]*pendingConfirm{}}
+
+// Take a command waiting to be confirmed, so only one click (or the clock) acts on it.
+func takeConfirm(key string) *pendingConfirm {
+	confirm, _ := takeConfirmFor(key, "")
+	return confirm
+}
+
+/*
+ * Take a command waiting to be confirmed, if userID ran it, or whoever
+ * did if userID is "". Looked up and taken under one lock, so a click
+ * can't act on what the clock or another click has already taken.
+ * allowed is false, and it's left waiting, if someone else ran it.
+ */
+func takeConfirmFor(key string, userID string) (confirm *pendingConfirm, allowed bool) {
+	pendingConfirms.Lock()
+	defer pendingConfirms.Unlock()
+
+	confirm = pendingConfirms.confirms[key]
+	if confirm != nil && userID != "" && confirm.ctx.Event.Author.ID != userID {
+		return nil, false
+	}
+	delete(pendingConfirms.confirms, key)
+	return confirm, true
+}
+
+/*
+ * Ask whoever ran the command the question, and carry on with run once
+ * they confirm, saying doing as it starts. With ConfirmDestructive off,
+ * run is carried on with straight away.
+ */
+func confirmAction(ctx *CommandContext, question string, doing string, run func()) {
+	if !Settings.ConfirmDestructive {
+		run()
+		return
+	}
+
+	key := ctx.Event.ID
+	message, err := ctx.Session.ChannelMessageSendComplex(ctx.Event.ChannelID,
+		&discordgo.MessageSend{
+			Content: question,
+			Components: []discordgo.MessageComponent{discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Do it",
+						Style:    discordgo.DangerButton,
+						CustomID: componentID("confirm", key),
+					},
+					discordgo.Button{
+						Label:    "Cancel",
+						Style:    discordgo.SecondaryButton,
+						CustomID: componentID("confirm-cancel", key),
+					},
+				},
+			}},
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+	if handleCommandErrors(ctx, DiscordError, explainDiscordError(err)) {
+		return
+	}
+
+	pendingConfirms.Lock()
+	pendingConfirms.confirms[key] = &pendingConfirm{ctx: ctx, doing: doing, run: run,
+		channelID: message.ChannelID, messageID: message.ID}
+	pendingConfirms.Unlock()
+	confirmLog.Info("Asked to confirm a command", "command", ctx.CommandName,
+		"message", message.ID, "user", ctx.Event.Author.ID)
+
+	time.AfterFunc(confirmWindow, func() { expireConfirm(ctx.Session, key) })
+}
+
+// Withdraw the question, if it's still waiting.
+func expireConfirm(s *discordgo.Session, key string) {
+	defer recoverEvent("expireConfirm")
+
+	confirm := takeConfirm(key)
+	if confirm == nil {
+		return
+	}
+
+	content := "Sire, nobody answered, so I've left it be."
+	_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		Channel:    confirm.channelID,
+		ID:         confirm.messageID,
+		Content:    &content,
+		Components: []discordgo.MessageComponent{},
+	})
+	if err != nil {
+		confirmLog.Warn("Couldn't withdraw a question", "message", confirm.messageID,
+			"err", err)
+	}
+}
+
+/*
+ * The command a button is for, if whoever clicked it may answer it.
+ * Only whoever ran it may.
+ */
+func clickedConfirm(s *discordgo.Session, i *discordgo.InteractionCreate, key string) *pendingConfirm {
+	confirm, allowed := takeConfirmFor(key, i.Member.User.ID)
+	switch {
+	case !allowed:
+		replyEphemeral(s, i, "Sire, only whoever asked may answer this.")
+		return nil
+	case confirm == nil:
+		err := updateComponentMessage(s, i, &discordgo.InteractionResponseData{
+			Content:    "Sire, I've forgotten what this was; run it again.",
+			Components: []discordgo.MessageComponent{},
+		})
+		handleCommandErrors(interactionContext(s, i), DiscordError, err)
+		return nil
+	}
+	return confirm
+}
+
+func componentConfirm(s *discordgo.Session, i *discordgo.InteractionCreate, key string) {
+	ctx := interactionContext(s, i)
+	if refuseChanges(ctx) {
+		return
+	}
+
+	confirm := clickedConfirm(s, i, key)
+	if confirm == nil {
+		return
+	}
+
+	err := updateComponentMessage(s, i, &discordgo.InteractionResponseData{
+		Content:    confirm.doing,
+		Components: []discordgo.MessageComponent{},
+	})
+	if handleCommandErrors(ctx, DiscordError, err) {
+		return
+	}
+	confirmLog.Info("Confirmed a command", "command", confirm.ctx.CommandName,
+		"user", i.Member.User.ID)
+	confirm.run()
+}
+
+func componentConfirmCancel(s *discordgo.Session, i *discordgo.InteractionCreate, key string) {
+	if clickedConfirm(s, i, key) == nil {
+		return
+	}
+
+	err := updateComponentMessage(s, i, &discordgo.InteractionResponseData{
+		Content:    "Sire, I'll leave it be.",
+		Components: []discordgo.MessageComponent{},
+	})
+	handleCommandErrors(interactionContext(s, i), DiscordError, err)
+}
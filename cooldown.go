@@ -0,0 +1,114 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * cooldown.go - Cooldowns, so nobody runs a command too often.
+ * CommandCooldowns lists them as COMMAND=WAIT, for each member on their
+ * own, or COMMAND=WAIT/guild, for everyone at once: the default,
+ * "set=1m, audit=10m/guild", lets each member set the banner once a
+ * minute, and anyone check every tag's link once every ten. Waits are
+ * written as for schedules, like 30s, 1m, or 2h.
+ *
+ * Owners are never kept waiting, and a command turned away doesn't
+ * start its cooldown over. Cooldowns are kept in memory, so a restart
+ * forgets them.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cooldownLog = moduleLogger("cooldown")
+
+type commandCooldown struct {
+	wait  time.Duration
+	guild bool // shared by everyone, rather than each member's own
+}
+
+// When each command was last run, by "COMMAND" or "COMMAND/USER".
+var cooldowns = struct {
+	mutex sync.Mutex
+	last  map[string]time.Time
+}{last: map[string]time.Time{}}
+
+func parseCooldowns(value string) (map[string]commandCooldown, error) {
+	all := map[string]commandCooldown{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		command, wait, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't COMMAND=WAIT", strings.TrimSpace(pair))
+		}
+
+		cooldown := commandCooldown{}
+		wait = strings.TrimSpace(wait)
+		if before, ok := strings.CutSuffix(wait, "/guild"); ok {
+			wait, cooldown.guild = before, true
+		}
+
+		var err error
+		if cooldown.wait, err = parseTime(wait); err != nil || cooldown.wait <= 0 {
+			return nil, fmt.Errorf("%q isn't a time to wait", wait)
+		}
+		all[strings.Join(strings.Fields(command), " ")] = cooldown
+	}
+
+	return all, nil
+}
+
+func checkCooldowns(value string) error {
+	_, err := parseCooldowns(value)
+	return err
+}
+
+// Turn the command away if it's cooling down, see CommandCooldowns.
+func cooldownMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if compoundCommand(ctx.Command) || isOwner(ctx.Event.Author.ID) {
+		next(ctx, args)
+		return
+	}
+
+	// Checked when set, so this can't fail
+	all, _ := parseCooldowns(Settings.CommandCooldowns)
+	command := strings.TrimPrefix(ctx.CommandName, ctx.Prefix)
+	cooldown, ok := all[command]
+	if !ok {
+		next(ctx, args)
+		return
+	}
+
+	key := command + "/" + ctx.Event.Author.ID
+	if cooldown.guild {
+		key = command
+	}
+
+	now := time.Now()
+	cooldowns.mutex.Lock()
+	left := cooldowns.last[key].Add(cooldown.wait).Sub(now)
+	if left <= 0 {
+		cooldowns.last[key] = now
+	}
+	cooldowns.mutex.Unlock()
+
+	if left > 0 {
+		cooldownLog.Info("Refused a command cooling down", "command", command,
+			"user", ctx.Event.Author.ID, "left", left)
+		left = left.Round(time.Second)
+		if left < time.Second {
+			left = time.Second
+		}
+		ctx.Reply(fmt.Sprintf("Patience, sire. `%s` may be run again in %s.", command, left))
+		return
+	}
+	next(ctx, args)
+}
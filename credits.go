@@ -0,0 +1,170 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * credits.go - Crediting the artists. If ArtForumChannelID names a forum
+ * channel, each tag that goes up as the banner gets a post there, with
+ * its image, its description, and who made it. A tag's post is
+ * remembered (in art_credit), so when the tag comes around again its
+ * post is bumped with a reply instead of a second post being made. If
+ * the post has been deleted, a new one is made.
+ *
+ * The artist is whoever made the tag, unless `credit TAG ARTIST` says
+ * otherwise. Posts don't ping anyone.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var creditsLog = moduleLogger("credits")
+
+// How long a credit post goes quiet before Discord archives it, in minutes.
+const creditArchiveMinutes = 10080
+
+/*
+ * A new forum post, which discordgo doesn't know how to make yet: a
+ * thread whose first message comes along with it.
+ */
+type forumPost struct {
+	Name                string          `json:"name"`
+	AutoArchiveDuration int             `json:"auto_archive_duration"`
+	Message             forumPostOpener `json:"message"`
+}
+
+type forumPostOpener struct {
+	Content         string                            `json:"content"`
+	Embeds          []*discordgo.MessageEmbed         `json:"embeds"`
+	AllowedMentions *discordgo.MessageAllowedMentions `json:"allowed_mentions"`
+}
+
+// Who to credit for a tag's art.
+func creditedArtist(tag Tag, credit ArtCredit) string {
+	if credit.Artist != "" {
+		return credit.Artist
+	}
+	return "<@" + tag.AuthorID + ">"
+}
+
+// Open a forum post crediting the tag's artist, returning its thread.
+func postArtCredit(s *discordgo.Session, tag Tag, credit ArtCredit) (string, error) {
+	embed := &discordgo.MessageEmbed{
+		Title:       tag.Name,
+		Description: tag.Description,
+		Image:       &discordgo.MessageEmbedImage{URL: tag.Url},
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Art by", Value: creditedArtist(tag, credit)},
+		},
+	}
+
+	post := forumPost{
+		Name:                tag.Name,
+		AutoArchiveDuration: creditArchiveMinutes,
+		Message: forumPostOpener{
+			Content: fmt.Sprintf("**%s** went up as the banner <t:%d:f>.",
+				tag.Name, time.Now().Unix()),
+			Embeds:          []*discordgo.MessageEmbed{embed},
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		},
+	}
+
+	endpoint := discordgo.EndpointChannelThreads(Settings.ArtForumChannelID)
+	body, err := s.RequestWithBucketID("POST", endpoint, post, endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	var thread discordgo.Channel
+	if err = json.Unmarshal(body, &thread); err != nil {
+		return "", err
+	}
+	return thread.ID, nil
+}
+
+/*
+ * Credit the artist of a tag that just went up: bump its forum post, or
+ * make one if it has none (or it's gone).
+ */
+func creditArt(s *discordgo.Session, tag Tag) error {
+	if Settings.ArtForumChannelID == "" {
+		return nil
+	}
+
+	credit, err := artCredit(tag.Name)
+	if err != nil {
+		return err
+	}
+
+	if credit.Thread != "" {
+		_, err = s.ChannelMessageSendComplex(credit.Thread, &discordgo.MessageSend{
+			Content: fmt.Sprintf("Up as the banner again <t:%d:f>.",
+				time.Now().Unix()),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err == nil {
+			return nil
+		} else if !messageGone(err) {
+			return explainDiscordError(err)
+		}
+		creditsLog.Info("A credit post is gone; making another", "tag", tag.Name,
+			"thread", credit.Thread)
+	}
+
+	thread, err := postArtCredit(s, tag, credit)
+	if err != nil {
+		return explainDiscordError(err)
+	}
+	return setArtThread(tag.Name, thread)
+}
+
+func cmdCredit(ctx *CommandContext, args []string) {
+	if len(args) < 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	tag, err := namedTag(args[0])
+	if err == sql.ErrNoRows {
+		ctx.Reply("Sire, I don't recall any tags named `" + args[0] + "`.")
+		return
+	} else if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(args) == 1 {
+		credit, err := artCredit(tag.Name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		ctx.Session.ChannelMessageSendComplex(ctx.Event.ChannelID, &discordgo.MessageSend{
+			Content: "Sire, **" + tag.Name + "** is the work of " +
+				creditedArtist(tag, credit) + ".",
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		return
+	}
+
+	artist := strings.Join(args[1:], " ")
+	if artist == "none" {
+		artist = ""
+	}
+
+	if handleCommandErrors(ctx, SqlError, setArtist(tag.Name, artist)) {
+		return
+	}
+
+	creditsLog.Info("Credited a tag", "tag", tag.Name, "artist", artist,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
@@ -0,0 +1,132 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * crew.go - Crew rotations: playlists owned by a role. Once a playlist
+ * is given to a role with `playlist crew PLAYLIST ROLE`, members with
+ * that role may edit it (new, add, rm, del, and curating it) without
+ * Manage Server, and the allowed roles may no longer; the owner and
+ * Manage Server still may. The playlist commands that edit carry
+ * PermCrew, which tracePerms() checks against the playlist named first.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var crewLog = moduleLogger("crew")
+
+// Read a role mention (<@&ID>) or a bare role ID, or "" if it's neither.
+func parseRoleID(arg string) string {
+	if strings.HasPrefix(arg, "<@&") && strings.HasSuffix(arg, ">") {
+		arg = arg[3 : len(arg)-1]
+	} else if strings.HasPrefix(arg, "<") {
+		return ""
+	}
+	return parseUserID(arg)
+}
+
+// A role's name, for replies that shouldn't ping the role.
+func roleName(s *discordgo.Session, roleID string) string {
+	role, err := s.State.Role(Settings.GuildID, roleID)
+	if err != nil {
+		return "<@&" + roleID + ">"
+	}
+	return "@" + role.Name
+}
+
+/*
+ * The crew of a playlist, for permission checks. A crew that can't be
+ * looked up is taken as none, which leaves the usual roles in charge.
+ */
+func playlistCrewOrNone(playlist string) string {
+	crew, err := playlistCrew(playlist)
+	if err != nil {
+		crewLog.Error("Couldn't look up a playlist's crew", "playlist", playlist,
+			"err", err)
+	}
+	return crew
+}
+
+/*
+ * Whether a member is in the crew of a playlist (whose crew is given),
+ * with the step for tracePerms(). With no playlist, any crew will do, so
+ * crews see the playlist commands in `help`.
+ */
+func traceCrew(member *discordgo.Member, playlist string, crew string) (bool, string) {
+	if playlist == "" {
+		crews, err := playlistCrews()
+		if err != nil {
+			crewLog.Error("Couldn't look up playlist crews", "err", err)
+		}
+
+		for _, role := range crews {
+			if contains(member.Roles, role) {
+				return true, "✓ They're in a playlist's crew, who may run it on their playlist."
+			}
+		}
+		return false, "· Playlist crews may run it on their playlists, but they're in none."
+	}
+
+	if crew == "" {
+		return false, fmt.Sprintf("· **%s** has no crew.", playlist)
+	} else if contains(member.Roles, crew) {
+		return true, fmt.Sprintf("✓ **%s** belongs to <@&%s>, and they have it.",
+			playlist, crew)
+	}
+	return false, fmt.Sprintf("· **%s** belongs to <@&%s>, but they don't have it.",
+		playlist, crew)
+}
+
+func cmdPlaylistCrew(ctx *CommandContext, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	playlist := args[0]
+	if len(args) == 1 {
+		crew, err := playlistCrew(playlist)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		if crew == "" {
+			ctx.Reply("Sire, **" + playlist + "** has no crew; the usual roles keep it.")
+		} else {
+			ctx.Reply("Sire, **" + playlist + "** is kept by " +
+				roleName(ctx.Session, crew) + ".")
+		}
+		return
+	}
+
+	role := ""
+	if args[1] != "none" {
+		role = parseRoleID(args[1])
+		if role == "" {
+			ctx.SendUsage()
+			return
+		}
+
+		if _, err := ctx.Session.State.Role(Settings.GuildID, role); err != nil {
+			ctx.Reply("Sire, I can't find that role here.")
+			return
+		}
+	}
+
+	err := setPlaylistCrew(playlist, role)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	crewLog.Info("Playlist crew changed", "playlist", playlist, "role", role,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
@@ -0,0 +1,266 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * curate.go - Curation threads. Typing fifty tag names into one
+ * command is miserable, so `curate PLAYLIST` opens a thread instead.
+ * Mods drop tag names and images into it, the bard keeps a running
+ * preview of what it's collected, and the Finalize button on the
+ * preview saves the playlist and archives the thread.
+ *
+ * Images dropped in become new tags, named by the message they came
+ * with ("snowy" plus an image makes the tag snowy), or by their file
+ * name if the message has no words.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var curateLog = moduleLogger("curate")
+
+// How long an idle curation thread stays open, in minutes.
+const CurationArchiveMinutes = 1440
+
+func cmdCurate(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	playlist := args[0]
+
+	thread, err := ctx.Session.MessageThreadStart(ctx.Event.ChannelID,
+		ctx.Event.ID, "Curating "+playlist, CurationArchiveMinutes)
+	if handleCommandErrors(ctx, DiscordError, explainDiscordError(err)) {
+		return
+	}
+
+	curation := Curation{
+		ThreadID: thread.ID,
+		Playlist: playlist,
+		AuthorID: ctx.Event.Author.ID,
+	}
+
+	err = insertCuration(curation)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	ctx.Session.ChannelMessageSend(thread.ID, fmt.Sprintf(
+		"Sire, drop tag names and images here for **%s**, and I'll gather "+
+			"them up. Press Finalize on my list when you're done.", playlist))
+
+	err = updateCurationPreview(ctx.Session, curation)
+	handleCommandErrors(ctx, DiscordError, err)
+	curateLog.Info("Curating a playlist", "playlist", playlist, "thread", thread.ID)
+}
+
+/*
+ * Collect a message posted in a curation thread. Return false if the
+ * message isn't in a curation thread, so it can be handled as usual.
+ */
+func curateMessage(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	channel, err := s.State.Channel(m.ChannelID)
+	if err != nil || !channel.IsThread() {
+		return false
+	}
+
+	curation, ok, err := threadCuration(m.ChannelID)
+	if err != nil {
+		curateLog.Error("Error while looking up a curation", "err", err)
+		return false
+	} else if !ok {
+		return false
+	}
+
+	ctx := &CommandContext{Session: s, Event: m, Prefix: Settings.Prefix,
+		CommandName: Settings.Prefix + "curate"}
+	if !userHasPerms(ctx, PermDefault|PermCrew, curation.Playlist) || refuseChanges(ctx) {
+		return true
+	}
+
+	words := strings.Fields(m.Content)
+	errs := []error{}
+	unknown := []string{}
+
+	// Images become new tags.
+	images := []*discordgo.MessageAttachment{}
+	for _, attachment := range m.Attachments {
+		if imageType(attachment.Filename) != "" {
+			images = append(images, attachment)
+		}
+	}
+
+	for _, image := range images {
+		name := strings.TrimSuffix(image.Filename, path.Ext(image.Filename))
+		if len(images) == 1 && len(words) == 1 {
+			name = words[0]
+		}
+		name = strings.ReplaceAll(strings.ToLower(name), " ", "-")
+
+		exists, err := tagExists(name)
+		if err == nil && exists {
+			ctx.Reply(fmt.Sprintf("Sire, I already have a tag named **%s**. "+
+				"Send the image again with a new name for it.", name))
+			continue
+		}
+
+		errs = append(errs, insertTag(name, m.Author.ID, image.URL),
+			addCurationItem(curation.ThreadID, name))
+	}
+
+	// Otherwise, words are the names of tags to add.
+	if len(images) == 0 {
+		for _, word := range words {
+			exists, err := tagExists(word)
+			if err == nil && !exists {
+				unknown = append(unknown, word)
+				continue
+			}
+
+			errs = append(errs, err, addCurationItem(curation.ThreadID, word))
+		}
+	}
+
+	if handleCommandErrors(ctx, SqlError, errs...) {
+		return true
+	}
+
+	if len(unknown) > 0 {
+		ctx.Reply("Sire, I don't know these tags: **" +
+			strings.Join(unknown, "**, **") + "**")
+	}
+
+	err = updateCurationPreview(s, curation)
+	handleCommandErrors(ctx, DiscordError, err)
+	return true
+}
+
+/*
+ * Post a fresh preview of the curation at the bottom of the thread,
+ * clearing the buttons off the old one so only the latest can be
+ * pressed.
+ */
+func updateCurationPreview(s *discordgo.Session, curation Curation) error {
+	tags, err := curationItems(curation.ThreadID)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("**%s** so far, sire:\n", curation.Playlist))
+	if len(tags) == 0 {
+		buf.WriteString("\nNothing yet.")
+	}
+	for _, tag := range tags {
+		buf.WriteString("\n" + tag)
+	}
+
+	buttons := []discordgo.MessageComponent{discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label:    "Finalize",
+				Style:    discordgo.SuccessButton,
+				CustomID: componentID("curate-done", curation.ThreadID),
+				Disabled: len(tags) == 0,
+			},
+			discordgo.Button{
+				Label:    "Cancel",
+				Style:    discordgo.DangerButton,
+				CustomID: componentID("curate-cancel", curation.ThreadID),
+			},
+		},
+	}}
+
+	if curation.PreviewID != "" {
+		empty := []discordgo.MessageComponent{}
+		s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:         curation.PreviewID,
+			Channel:    curation.ThreadID,
+			Components: empty,
+		})
+	}
+
+	preview, err := s.ChannelMessageSendComplex(curation.ThreadID,
+		&discordgo.MessageSend{Content: buf.String(), Components: buttons})
+	if err != nil {
+		return err
+	}
+
+	return setCurationPreview(curation.ThreadID, preview.ID)
+}
+
+// End a curation, and archive its thread.
+func closeCuration(s *discordgo.Session, i *discordgo.InteractionCreate,
+	threadID string, message string) {
+
+	ctx := interactionContext(s, i)
+	err := delCuration(threadID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	err = updateComponentMessage(s, i, &discordgo.InteractionResponseData{
+		Content:    message,
+		Components: []discordgo.MessageComponent{},
+	})
+	handleCommandErrors(ctx, DiscordError, err)
+
+	_, err = s.ChannelEditComplex(threadID,
+		&discordgo.ChannelEdit{Archived: true, Locked: true})
+	handleCommandErrors(ctx, DiscordError, err)
+}
+
+func componentCurateDone(s *discordgo.Session, i *discordgo.InteractionCreate, threadID string) {
+	ctx := interactionContext(s, i)
+	curation, ok, err := threadCuration(threadID)
+	if handleCommandErrors(ctx, SqlError, err) || !ok {
+		return
+	}
+
+	if !userHasPerms(ctx, PermDefault|PermCrew, curation.Playlist) || refuseChanges(ctx) {
+		return
+	}
+
+	tags, err := curationItems(threadID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	err = editPlaylist(curation.Playlist, tags)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	curateLog.Info("Curated a playlist", "playlist", curation.Playlist, "count", len(tags))
+	closeCuration(s, i, threadID, fmt.Sprintf(
+		"I'll remember **%s** to be those %d tags from now on, sire.",
+		curation.Playlist, len(tags)))
+}
+
+func componentCurateCancel(s *discordgo.Session, i *discordgo.InteractionCreate, threadID string) {
+	ctx := interactionContext(s, i)
+	curation, _, err := threadCuration(threadID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	// A curation that's already gone has no playlist, so any crew may
+	// clear its buttons away.
+	if !userHasPerms(ctx, PermDefault|PermCrew, curation.Playlist) {
+		return
+	}
+
+	closeCuration(s, i, threadID, "I've set this curation aside, sire. "+
+		"Any new tags made here are kept.")
+}
@@ -0,0 +1,362 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * dashboard.go - The web dashboard: a gallery of the tags, playlists to
+ * drag them into, and the schedule, for those who'd rather click than
+ * type. It's a page (under dashboard/, built into the binary) that works
+ * through the API in api.go, served alongside it on ApiListen.
+ *
+ * Users log in with Discord (OAuth2, asking only who they are), which
+ * needs ClientSecret, and DashboardURL set to where the dashboard's
+ * reached from, e.g. https://bard.example.com; Discord must know
+ * DashboardURL/auth/callback as a redirect. Once logged in, a user has
+ * a session cookie, which the API takes in place of ApiToken, and may do
+ * whatever the same commands would let them do in Discord: my allowed
+ * roles, Manage Server, and playlist crews all count, as tracePerms()
+ * decides. Those who could run none of the commands can't log in.
+ *
+ * Sessions are kept in memory, so a restart logs everyone out. Members'
+ * roles are looked up again every dashboardRecheck, so taking a role
+ * away takes the dashboard with it.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var dashboardLog = moduleLogger("dashboard")
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	dashboardCookie      = "bb_session"
+	dashboardStateCookie = "bb_oauth_state"
+
+	// How long a login lasts, and how often its roles are looked up again.
+	dashboardLifetime = 7 * 24 * time.Hour
+	dashboardRecheck  = 5 * time.Minute
+
+	// Changes made with a session cookie must carry this header, which
+	// other sites' pages can't add; it keeps them from acting for users.
+	dashboardHeader = "X-Bard-Dashboard"
+)
+
+// Who the dashboard lets in: anyone who could run a command that changes things.
+const dashboardPerms = PermDefault | PermCrew
+
+type dashboardSession struct {
+	UserID  string
+	Name    string
+	expires time.Time
+
+	mutex   sync.Mutex
+	checked time.Time
+	member  *discordgo.Member
+	channel string // to check Manage Server in, see dashboardChannel()
+}
+
+var dashboardSessions = struct {
+	sync.Mutex
+	byID map[string]*dashboardSession
+}{byID: map[string]*dashboardSession{}}
+
+var oauthClient = &http.Client{Timeout: 15 * time.Second}
+
+func dashboardOn() bool {
+	return Settings.ClientSecret != "" && Settings.DashboardURL != ""
+}
+
+func checkDashboardURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+		err = fmt.Errorf("%q isn't an http(s) URL", value)
+	}
+	return err
+}
+
+func dashboardRedirect() string {
+	return strings.TrimSuffix(Settings.DashboardURL, "/") + "/auth/callback"
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func dashboardCookieFor(name, value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(Settings.DashboardURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+/*
+ * A channel of the guild to check Manage Server in, since tracePerms()
+ * works by channel: the system channel, or failing that any at all.
+ */
+func dashboardChannel(s *discordgo.Session) string {
+	guild, err := s.State.Guild(Settings.GuildID)
+	if err != nil {
+		return ""
+	} else if guild.SystemChannelID != "" {
+		return guild.SystemChannelID
+	} else if len(guild.Channels) > 0 {
+		return guild.Channels[0].ID
+	}
+	return ""
+}
+
+// Look up a user in the guild, from the state if it's there.
+func dashboardMember(s *discordgo.Session, userID string) (*discordgo.Member, error) {
+	member, err := s.State.Member(Settings.GuildID, userID)
+	if err == nil {
+		return member, nil
+	}
+	return s.GuildMember(Settings.GuildID, userID)
+}
+
+/*
+ * Whether the session's user may do what a command with these perms
+ * does (on the playlist, if there is one), looking up their roles again
+ * if it's been a while.
+ */
+func (session *dashboardSession) permitted(s *discordgo.Session, perms byte, playlist string) bool {
+	// Barred members are turned away whatever roles they hold, as in chat.
+	if userBanned(session.UserID) {
+		return false
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if time.Since(session.checked) > dashboardRecheck {
+		member, err := dashboardMember(s, session.UserID)
+		if err != nil {
+			dashboardLog.Info("Couldn't find a dashboard user in the guild",
+				"user", session.UserID, "err", err)
+			return false
+		}
+		session.member = member
+		session.channel = dashboardChannel(s)
+		session.checked = time.Now()
+	}
+
+	ok, _ := tracePerms(s, session.member, session.UserID, session.channel,
+		perms, "", playlist)
+	return ok
+}
+
+// The logged-in session a request carries, if any.
+func dashboardSessionOf(r *http.Request) *dashboardSession {
+	cookie, err := r.Cookie(dashboardCookie)
+	if err != nil {
+		return nil
+	}
+
+	dashboardSessions.Lock()
+	defer dashboardSessions.Unlock()
+	session, ok := dashboardSessions.byID[cookie.Value]
+	if !ok {
+		return nil
+	} else if time.Now().After(session.expires) {
+		delete(dashboardSessions.byID, cookie.Value)
+		return nil
+	}
+	return session
+}
+
+// The OAuth2 token exchange, with only the part that's used.
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// Trade a login's code for who logged in.
+func oauthUser(code string) (*discordgo.User, error) {
+	form := url.Values{
+		"client_id":     {Settings.ClientID},
+		"client_secret": {Settings.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {dashboardRedirect()},
+	}
+
+	resp, err := oauthClient.PostForm(discordgo.EndpointOAuth2+"token", form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, apiBodyLimit))
+		return nil, fmt.Errorf("Discord answered the login with %s: %s", resp.Status, body)
+	}
+
+	var token oauthToken
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, discordgo.EndpointUser("@me"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err = oauthClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Discord wouldn't say who logged in: %s", resp.Status)
+	}
+
+	var user discordgo.User
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	return &user, err
+}
+
+type dashboardServer struct {
+	session *discordgo.Session
+	files   http.Handler
+}
+
+func newDashboardServer(s *discordgo.Session) *dashboardServer {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	return &dashboardServer{session: s, files: http.FileServer(http.FS(files))}
+}
+
+func (dash *dashboardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/login":
+		dash.login(w, r)
+	case "/auth/callback":
+		dash.callback(w, r)
+	case "/logout":
+		dash.logout(w, r)
+	default:
+		dash.files.ServeHTTP(w, r)
+	}
+}
+
+// Send the user off to Discord to log in.
+func (dash *dashboardServer) login(w http.ResponseWriter, r *http.Request) {
+	state := randomHex(16)
+	http.SetCookie(w, dashboardCookieFor(dashboardStateCookie, state, 10*time.Minute))
+
+	query := url.Values{
+		"client_id":     {Settings.ClientID},
+		"redirect_uri":  {dashboardRedirect()},
+		"response_type": {"code"},
+		"scope":         {"identify"},
+		"state":         {state},
+		"prompt":        {"none"},
+	}
+	http.Redirect(w, r, "https://discord.com/oauth2/authorize?"+query.Encode(),
+		http.StatusFound)
+}
+
+// Discord sends the user back here after they log in.
+func (dash *dashboardServer) callback(w http.ResponseWriter, r *http.Request) {
+	state, err := r.Cookie(dashboardStateCookie)
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		http.Error(w, "Sire, that login didn't start here. Try again.", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, dashboardCookieFor(dashboardStateCookie, "", -1))
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := oauthUser(code)
+	if err != nil {
+		dashboardLog.Error("Error while logging someone in", "err", err)
+		http.Error(w, "Sire, Discord wouldn't tell me who you are. Try again.",
+			http.StatusBadGateway)
+		return
+	}
+
+	if userBanned(user.ID) {
+		dashboardLog.Info("Turned away a barred user's dashboard login", "user", user.ID)
+		http.Error(w, "Sire, you're barred from commanding me.", http.StatusForbidden)
+		return
+	}
+
+	session := &dashboardSession{UserID: user.ID, Name: user.Username,
+		expires: time.Now().Add(dashboardLifetime)}
+	if !session.permitted(dash.session, dashboardPerms, "") {
+		dashboardLog.Info("Turned away a dashboard login", "user", user.ID)
+		http.Error(w, "Sire, you may not command me here.", http.StatusForbidden)
+		return
+	}
+
+	id := randomHex(32)
+	dashboardSessions.Lock()
+	dashboardSessions.byID[id] = session
+	dashboardSessions.Unlock()
+
+	dashboardLog.Info("Logged in to the dashboard", "user", user.ID)
+	http.SetCookie(w, dashboardCookieFor(dashboardCookie, id, dashboardLifetime))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (dash *dashboardServer) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Sire, log out with the button.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(dashboardCookie); err == nil {
+		dashboardSessions.Lock()
+		delete(dashboardSessions.byID, cookie.Value)
+		dashboardSessions.Unlock()
+	}
+	http.SetCookie(w, dashboardCookieFor(dashboardCookie, "", -1))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Forget logins that have run out, every so often. Call it with `go`.
+func sweepDashboardSessions() {
+	for range time.Tick(time.Hour) {
+		dashboardSessions.Lock()
+		for id, session := range dashboardSessions.byID {
+			if time.Now().After(session.expires) {
+				delete(dashboardSessions.byID, id)
+			}
+		}
+		dashboardSessions.Unlock()
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * dashboard/dashboard.js - The web dashboard's workings. Everything goes
+ * through the API (see api.go), with the session cookie; changes carry
+ * the X-Bard-Dashboard header the API asks of them.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+"use strict";
+
+const state = {
+  tags: [],
+  playlists: [], // {name, tags, crew}, and dirty or unsaved if they're being edited
+  schedule: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, props, ...children) {
+  const node = Object.assign(document.createElement(tag), props);
+  node.append(...children);
+  return node;
+}
+
+async function api(method, path, body) {
+  const options = {method, credentials: "same-origin", headers: {}};
+  if (method !== "GET") {
+    options.headers["X-Bard-Dashboard"] = "1";
+  }
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+
+  const resp = await fetch("/api" + path, options);
+  if (resp.status === 204) {
+    return null;
+  }
+  const answer = await resp.json();
+  if (!resp.ok) {
+    const err = new Error(answer.error || resp.statusText);
+    err.status = resp.status;
+    throw err;
+  }
+  return answer;
+}
+
+function notify(message) {
+  const notice = $("notice");
+  notice.textContent = message;
+  notice.hidden = !message;
+}
+
+// Run a change, showing what went wrong if it does, and refresh.
+async function change(fn) {
+  try {
+    await fn();
+    notify("");
+  } catch (err) {
+    notify("Sire, " + err.message + ".");
+  }
+  await load();
+}
+
+async function load() {
+  let tags, playlists, schedule;
+  try {
+    [tags, playlists, schedule] = await Promise.all([
+      api("GET", "/tags"), api("GET", "/playlists"), api("GET", "/schedule"),
+    ]);
+  } catch (err) {
+    notify("Sire, " + err.message + ".");
+    return;
+  }
+
+  // Keep playlists being edited as they are.
+  const dirty = new Map(state.playlists.filter((p) => p.dirty).map((p) => [p.name, p]));
+  state.tags = tags.sort((a, b) => a.name.localeCompare(b.name));
+  state.playlists = playlists.map((p) => dirty.get(p.name) || p);
+  for (const p of dirty.values()) {
+    if (!state.playlists.includes(p)) {
+      state.playlists.push(p);
+    }
+  }
+  state.schedule = schedule;
+
+  renderSchedule();
+  renderPlaylists();
+  renderGallery();
+}
+
+// The schedule
+
+function renderSchedule() {
+  const s = state.schedule;
+  const up = s.banner ? s.banner : "nothing of mine";
+  let text = "Up now: " + up + ". ";
+  if (!s.active) {
+    text += "No schedule is running.";
+  } else if (s.next_change) {
+    text += "Next change: " + new Date(s.next_change).toLocaleString() + ".";
+  }
+  $("schedule-state").textContent = text;
+
+  $("schedule-queue").replaceChildren(...(s.active ? s.tags : []).map((tag, i) =>
+    el("li", {textContent: tag, className: i === s.next ? "next" : ""})));
+  $("schedule-stop").disabled = !s.active;
+
+  const select = $("schedule-playlist");
+  const chosen = select.value;
+  select.replaceChildren(...state.playlists.filter((p) => !p.unsaved)
+    .map((p) => el("option", {value: p.name, textContent: p.name})));
+  select.value = chosen || select.value;
+}
+
+$("schedule-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  change(() => api("PUT", "/schedule", {
+    mode: $("schedule-mode").value,
+    interval: $("schedule-interval").value,
+    playlist: $("schedule-playlist").value,
+  }));
+});
+
+$("schedule-stop").addEventListener("click", () => change(() => api("DELETE", "/schedule")));
+
+// Playlists
+
+// Where a dragged tag came from: the gallery, or a place in a playlist.
+let dragging = null;
+
+function renderPlaylists() {
+  $("playlist-list").replaceChildren(...state.playlists.map(renderPlaylist));
+}
+
+function renderPlaylist(playlist) {
+  const chips = el("div", {className: "chips"}, ...playlist.tags.map((tag, i) => {
+    const remove = el("button", {textContent: "×", title: "Take it out"});
+    remove.addEventListener("click", () => {
+      playlist.tags.splice(i, 1);
+      playlist.dirty = true;
+      renderPlaylists();
+    });
+
+    const chip = el("span", {className: "chip", draggable: true, textContent: tag}, remove);
+    chip.addEventListener("dragstart", (event) => {
+      dragging = {tag, from: playlist, index: i};
+      event.dataTransfer.setData("text/plain", tag);
+    });
+    chip.addEventListener("drop", (event) => {
+      event.preventDefault();
+      event.stopPropagation();
+      dropInto(playlist, i);
+    });
+    return chip;
+  }));
+
+  const save = el("button", {textContent: "Save", disabled: !playlist.dirty});
+  save.addEventListener("click", () => change(async () => {
+    await api("PUT", "/playlists/" + encodeURIComponent(playlist.name), {tags: playlist.tags});
+    playlist.dirty = false;
+  }));
+
+  const del = el("button", {textContent: "Delete"});
+  del.addEventListener("click", () => {
+    if (!confirm("Forget the playlist " + playlist.name + "?")) {
+      return;
+    }
+    state.playlists = state.playlists.filter((p) => p !== playlist);
+    if (playlist.unsaved) {
+      renderPlaylists();
+      return;
+    }
+    change(() => api("DELETE", "/playlists/" + encodeURIComponent(playlist.name)));
+  });
+
+  const title = el("h3", {}, playlist.name, save, del);
+  if (playlist.crew) {
+    title.append(el("span", {className: "hint", textContent: "(kept by a crew)"}));
+  }
+
+  const card = el("div", {className: "playlist" + (playlist.dirty ? " dirty" : "")},
+    title, chips);
+  card.addEventListener("dragover", (event) => {
+    event.preventDefault();
+    card.classList.add("over");
+  });
+  card.addEventListener("dragleave", () => card.classList.remove("over"));
+  card.addEventListener("drop", (event) => {
+    event.preventDefault();
+    dropInto(playlist, playlist.tags.length);
+  });
+  return card;
+}
+
+// Put the tag being dragged into a playlist, before the tag at index.
+function dropInto(playlist, index) {
+  if (!dragging) {
+    return;
+  }
+
+  if (dragging.from === playlist) {
+    playlist.tags.splice(dragging.index, 1);
+    if (dragging.index < index) {
+      index--;
+    }
+  }
+  playlist.tags.splice(index, 0, dragging.tag);
+  playlist.dirty = true;
+  dragging = null;
+  renderPlaylists();
+}
+
+$("playlist-new").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const name = $("playlist-new-name").value.trim();
+  if (!name || state.playlists.some((p) => p.name === name)) {
+    return;
+  }
+  state.playlists.push({name, tags: [], dirty: true, unsaved: true});
+  $("playlist-new-name").value = "";
+  renderPlaylists();
+});
+
+// The gallery
+
+function renderGallery() {
+  const filter = $("gallery-filter").value.toLowerCase();
+  const banner = state.schedule ? state.schedule.banner : "";
+
+  $("gallery-grid").replaceChildren(...state.tags
+    .filter((tag) => tag.name.toLowerCase().includes(filter) ||
+      tag.description.toLowerCase().includes(filter))
+    .map((tag) => {
+      const set = el("button", {textContent: "Set", title: "Put it up now, stopping any schedule"});
+      set.addEventListener("click", () => change(() => api("PUT", "/banner", {tag: tag.name})));
+
+      const tile = el("div", {
+        className: "tile" + (tag.name === banner ? " current" : ""),
+        draggable: true,
+        title: tag.description,
+      },
+      el("img", {src: "/api/tags/" + encodeURIComponent(tag.name) + "/thumb",
+        alt: tag.name, loading: "lazy", draggable: false}),
+      el("div", {}, tag.name, set));
+      tile.addEventListener("dragstart", (event) => {
+        dragging = {tag: tag.name, from: null};
+        event.dataTransfer.setData("text/plain", tag.name);
+      });
+      return tile;
+    }));
+}
+
+$("gallery-filter").addEventListener("input", renderGallery);
+
+// Starting up
+
+async function start() {
+  let me;
+  try {
+    me = await api("GET", "/me");
+  } catch (err) {
+    if (err.status === 401) {
+      $("login").hidden = false;
+    } else {
+      notify("Sire, " + err.message + ".");
+    }
+    return;
+  }
+
+  $("who-name").textContent = me.name || "";
+  $("who").hidden = false;
+  $("main").hidden = false;
+  $("schedule-mode").replaceChildren(...me.modes.map((mode) =>
+    el("option", {value: mode, textContent: mode})));
+
+  await load();
+  setInterval(load, 60 * 1000);
+}
+
+start();
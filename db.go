@@ -5,7 +5,8 @@
  * SQLite3 database and the rest of the bot (specifically,
  * banner-bard.go and scheduler.go). If you're adding new information
  * for banner bard to remember, try to make a nice wrapper function
- * here.
+ * here. It's SQLite only; see HACKING.md for why there's no other
+ * backend.
  *
  *
  * This program uses the BSD 3-Clause license. You can find details under
@@ -14,251 +15,3078 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var sqlDb *sql.DB
+var dbLog = moduleLogger("db")
+
+var sqlDb timedDB
+
+const (
+	SqlNoRows     = "no rows in result set"
+	SqlForeignKey = "FOREIGN KEY constraint failed"
+	DatabaseFile  = "./banner-bard.db"
+	// How long a query, or a transaction all told, may take.
+	dbTimeout = 30 * time.Second
+)
+
+// A schedule saved to be resumed after a restart, see scheduler.go:Save().
+type SavedSchedule struct {
+	Mode     string
+	Picker   string // JSON of the picker's exported fields
+	Interval time.Duration
+	Tags     []string
+	Source   string   // see scheduler.go:tagSource()
+	CatchUp  string   // see scheduler.go:CatchUpPolicies
+	Label    string   // see scheduler.go:Label()
+	Except   []string // see except.go
+	SavedAt  time.Time
+}
+
+// A playlist that's in season between two dates each year.
+type Season struct {
+	Playlist string
+	Start    string // "01-02"
+	End      string
+}
+
+// How a tag's link fared when it was last checked, see health.go.
+type TagHealth struct {
+	Healthy   bool
+	CheckedAt sql.NullTime
+	Note      string // why it's unhealthy
+}
+
+// A banner set once at a given time, see scheduler.go:fireOneShots().
+type OneShot struct {
+	ID          int64
+	At          time.Time
+	Tag         string
+	RevertAfter time.Duration // 0 to leave the tag up
+	IsRevert    bool          // put back what was up before an override
+	AuthorID    string
+}
+
+// A daily window during which the scheduler leaves the banner alone.
+type QuietWindow struct {
+	ID    int64
+	Start string // "15:04" in the guild's timezone
+	End   string
+}
+
+// A thread where a playlist is being put together, see curate.go.
+type Curation struct {
+	ThreadID  string
+	Playlist  string
+	AuthorID  string
+	PreviewID string // the message showing what's been collected
+}
+
+/*
+ * Put up a tag for a while when the guild reaches a member count, or
+ * its boost level goes up or down, see milestone.go. Fired says whether
+ * a member count's been reached already, so it only fires once.
+ */
+type Milestone struct {
+	ID    int64
+	Kind  string // "members", "boost-up", or "boost-down"
+	Count int    // the member count, for "members"
+	Tag   string
+	For   time.Duration
+	Fired bool
+}
+
+/*
+ * A tag a member has suggested, waiting on the staff, see suggest.go.
+ * MessageID is the message it's approved or rejected on: the one with
+ * the buttons, or the image posted to the submissions channel.
+ */
+type Suggestion struct {
+	ID        int64
+	Tag       string
+	URL       string
+	AuthorID  string
+	ChannelID string
+	MessageID string
+}
+
+/*
+ * A vote on which tag goes up next, see poll.go. Tags are the
+ * candidates, in the order they're shown.
+ */
+type Poll struct {
+	ID        int64
+	Kind      string // "vote", or "election" for the weekly one, see election.go
+	ChannelID string
+	MessageID string // the message with the candidates and buttons
+	AuthorID  string
+	ClosesAt  time.Time
+	Tags      []string
+}
+
+// A tag that won a weekly election, see election.go.
+type ElectionWinner struct {
+	ClosedAt time.Time
+	Tag      string
+	AuthorID string // who made the tag, when it won
+	Votes    int
+}
+
+// A time a tag went up as the banner, see stats.go.
+type Usage struct {
+	At     time.Time
+	Tag    string
+	Source string // what put it up: "set", "schedule", "twitch", and so on
+}
+
+// A tag or playlist to put up on holidays, see holiday.go.
+type HolidayMap struct {
+	Holiday string // a holiday's name, as holidaySlug() gives it, or the start of one
+	Target  string // a tag or playlist
+}
+
+/*
+ * Put up a tag while a scheduled event has enough RSVPs, see
+ * events.go. Previous is the tag that was up before the rule applied,
+ * to put back afterwards; Applied says whether it's up now.
+ */
+type EventRule struct {
+	ID        int64
+	EventID   string
+	Tag       string
+	Threshold int
+	Applied   bool
+	Previous  string
+}
+
+// A change someone made, see auditlog.go. UserID is "" for the API token.
+type AuditEntry struct {
+	At     time.Time
+	UserID string
+	Action string // e.g. "tag del", "playlist add", "schedule start"
+	Target string // the tag, playlist, or schedule changed
+	Detail string
+}
+
+// A user barred from my commands, see owners.go.
+type Ban struct {
+	UserID string
+	Reason string
+	By     string // the owner who barred them
+	At     time.Time
+}
+
+/*
+ * A change kept in the undo journal, see undo.go. Snapshot is what it
+ * replaced, as JSON, to put back.
+ */
+type UndoEntry struct {
+	ID       int64
+	At       time.Time
+	UserID   string
+	Action   string // as in the audit log
+	Target   string
+	Snapshot string
+}
+
+// A smart playlist's filter, see smart.go. An empty field matches any tag.
+type SmartFilter struct {
+	Pattern  string
+	AuthorID string
+}
+
+type Tag struct {
+	Name        string
+	AuthorID    string
+	Url         string
+	Description string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// The columns scanned by scanTag(), in order.
+const tagColumns = "name, authorID, url, description, created_at, updated_at"
+
+func openDb() error {
+	return openDbAt(DatabaseFile)
+}
+
+/*
+ * Pragmas every connection is opened with, since a PRAGMA only lasts for
+ * the connection it's run on. Foreign keys are on, and the database
+ * keeps a write-ahead log, so reads don't wait on writes. Writes wait
+ * for each other (up to busy_timeout, in milliseconds) rather than fail
+ * with SQLITE_BUSY when the scheduler and a command write at once.
+ */
+const sqliteOptions = "_foreign_keys=on&_journal_mode=WAL&_busy_timeout=10000"
+
+// Open (and set up) the database at the given path, or ":memory:".
+func openDbAt(path string) error {
+	if strings.Contains(path, "?") {
+		path += "&" + sqliteOptions
+	} else {
+		path += "?" + sqliteOptions
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	sqlDb = timedDB{db}
+	// Nothing cached is from this database.
+	forgetTags()
+	if err == nil && strings.HasPrefix(path, ":memory:") {
+		// Every connection would get its own empty database
+		sqlDb.SetMaxOpenConns(1)
+	}
+
+	// Table initialization
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS tag (
+  name TEXT PRIMARY KEY,
+  authorID TEXT NOT NULL,
+  url TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`)
+	}
+
+	// Migrations for databases made before a column existed. SQLite
+	// can't ALTER TABLE ADD COLUMN with a non-constant default, so
+	// the timestamps are backfilled afterwards.
+
+	if err == nil {
+		err = addColumnIfMissing("tag", "description",
+			"TEXT NOT NULL DEFAULT ''")
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("tag", "created_at", "DATETIME")
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("tag", "updated_at", "DATETIME")
+	}
+
+	if err == nil {
+		// How long the tag stays up in a schedule, in nanoseconds;
+		// 0 for the schedule's interval.
+		err = addColumnIfMissing("tag", "duration", "INTEGER NOT NULL DEFAULT 0")
+	}
+
+	if err == nil {
+		// How to crop the tag's image to a banner's shape, see
+		// image.go:CropModes.
+		err = addColumnIfMissing("tag", "crop", "TEXT NOT NULL DEFAULT ''")
+	}
+
+	// Link health, kept up by health.go.
+
+	if err == nil {
+		err = addColumnIfMissing("tag", "healthy", "BOOLEAN NOT NULL DEFAULT 1")
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("tag", "checked_at", "DATETIME")
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("tag", "health_note", "TEXT NOT NULL DEFAULT ''")
+	}
+
+	if err == nil {
+		// The image's perceptual hash, see dupe.go. NULL until
+		// it's been worked out.
+		err = addColumnIfMissing("tag", "phash", "INTEGER")
+	}
+
+	if err == nil {
+		// Locked tags can't be replaced or deleted, see lock.go.
+		err = addColumnIfMissing("tag", "locked", "BOOLEAN NOT NULL DEFAULT 0")
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+UPDATE tag SET
+  created_at = COALESCE(created_at, CURRENT_TIMESTAMP),
+  updated_at = COALESCE(updated_at, created_at, CURRENT_TIMESTAMP)
+WHERE created_at IS NULL OR updated_at IS NULL`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS playlist (
+  name TEXT NOT NULL,
+  tag TEXT NOT NULL REFERENCES tag(name) ON DELETE CASCADE,
+  timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (name, tag)
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS oneshot (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  at DATETIME NOT NULL,
+  tag TEXT NOT NULL,
+  revert_after INTEGER NOT NULL DEFAULT 0,
+  is_revert BOOLEAN NOT NULL DEFAULT 0,
+  authorID TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS quiet_hours (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  start TEXT NOT NULL,
+  end TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS curation (
+  threadID TEXT PRIMARY KEY,
+  playlist TEXT NOT NULL,
+  authorID TEXT NOT NULL,
+  previewID TEXT NOT NULL DEFAULT '',
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS curation_item (
+  threadID TEXT NOT NULL REFERENCES curation(threadID) ON DELETE CASCADE,
+  tag TEXT NOT NULL,
+  position INTEGER NOT NULL,
+  PRIMARY KEY (threadID, tag)
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS event_rule (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  eventID TEXT NOT NULL,
+  tag TEXT NOT NULL REFERENCES tag(name) ON DELETE CASCADE,
+  threshold INTEGER NOT NULL,
+  applied BOOLEAN NOT NULL DEFAULT 0,
+  previous TEXT NOT NULL DEFAULT ''
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS setting (
+  key TEXT PRIMARY KEY,
+  value TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS schedule (
+  id INTEGER PRIMARY KEY CHECK (id = 1),
+  mode TEXT NOT NULL,
+  picker TEXT NOT NULL,
+  interval INTEGER NOT NULL,
+  tags TEXT NOT NULL,
+  saved_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`)
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("schedule", "source", "TEXT NOT NULL DEFAULT ''")
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("schedule", "catchup", "TEXT NOT NULL DEFAULT ''")
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("schedule", "label", "TEXT NOT NULL DEFAULT ''")
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("schedule", "excluded", "TEXT NOT NULL DEFAULT '[]'")
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS season (
+  playlist TEXT PRIMARY KEY,
+  start TEXT NOT NULL,
+  end TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS playlist_owner (
+  playlist TEXT PRIMARY KEY,
+  role TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS playlist_lock (
+  playlist TEXT PRIMARY KEY
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS playlist_include (
+  name TEXT NOT NULL,
+  child TEXT NOT NULL,
+  timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (name, child)
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS smart_playlist (
+  name TEXT PRIMARY KEY,
+  pattern TEXT NOT NULL DEFAULT '',
+  author TEXT NOT NULL DEFAULT ''
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS milestone (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  kind TEXT NOT NULL,
+  count INTEGER NOT NULL DEFAULT 0,
+  tag TEXT NOT NULL REFERENCES tag(name) ON DELETE CASCADE,
+  duration INTEGER NOT NULL,
+  fired BOOLEAN NOT NULL DEFAULT 0
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS holiday_map (
+  holiday TEXT PRIMARY KEY,
+  target TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS art_credit (
+  tag TEXT PRIMARY KEY REFERENCES tag(name) ON DELETE CASCADE,
+  artist TEXT NOT NULL DEFAULT '',
+  thread TEXT NOT NULL DEFAULT ''
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS suggestion (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tag TEXT NOT NULL,
+  url TEXT NOT NULL,
+  authorID TEXT NOT NULL,
+  messageID TEXT NOT NULL DEFAULT ''
+)`)
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("suggestion", "channelID", "TEXT NOT NULL DEFAULT ''")
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS poll (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  channelID TEXT NOT NULL,
+  messageID TEXT NOT NULL DEFAULT '',
+  authorID TEXT NOT NULL,
+  closes_at DATETIME NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS poll_option (
+  pollID INTEGER NOT NULL REFERENCES poll(id) ON DELETE CASCADE,
+  position INTEGER NOT NULL,
+  tag TEXT NOT NULL,
+  PRIMARY KEY (pollID, position)
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS poll_vote (
+  pollID INTEGER NOT NULL REFERENCES poll(id) ON DELETE CASCADE,
+  userID TEXT NOT NULL,
+  tag TEXT NOT NULL,
+  PRIMARY KEY (pollID, userID)
+)`)
+	}
+
+	if err == nil {
+		err = addColumnIfMissing("poll", "kind", "TEXT NOT NULL DEFAULT 'vote'")
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS nomination (
+  tag TEXT PRIMARY KEY REFERENCES tag(name) ON DELETE CASCADE,
+  userID TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS election_winner (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  closed_at DATETIME NOT NULL,
+  tag TEXT NOT NULL,
+  authorID TEXT NOT NULL,
+  votes INTEGER NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS usage (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  at DATETIME NOT NULL,
+  tag TEXT NOT NULL REFERENCES tag(name) ON DELETE CASCADE,
+  source TEXT NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS command_permissions (
+  command TEXT NOT NULL,
+  role TEXT NOT NULL,
+  PRIMARY KEY (command, role)
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS blacklist (
+  userID TEXT PRIMARY KEY,
+  reason TEXT NOT NULL DEFAULT '',
+  byID TEXT NOT NULL,
+  at DATETIME NOT NULL
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS audit_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  at DATETIME NOT NULL,
+  userID TEXT NOT NULL,
+  action TEXT NOT NULL,
+  target TEXT NOT NULL,
+  detail TEXT NOT NULL DEFAULT ''
+)`)
+	}
+
+	if err == nil {
+		_, err = sqlDb.Exec(`
+CREATE TABLE IF NOT EXISTS undo_journal (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  at DATETIME NOT NULL,
+  userID TEXT NOT NULL,
+  action TEXT NOT NULL,
+  target TEXT NOT NULL,
+  snapshot TEXT NOT NULL
+)`)
+	}
+
+	return err
+}
+
+func closeDbOrPanic() {
+	err := sqlDb.Close()
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Sql utils
+
+/*
+ * The database, running every query with a dbTimeout context, so a long
+ * scan or a database locked for too long can't wedge whatever waits on
+ * it. What's returned keeps its context until it's done with: rows until
+ * they're closed, a row until it's scanned, and a transaction until it's
+ * committed or rolled back.
+ */
+type timedDB struct {
+	*sql.DB
+}
+
+type timedRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+type timedRow struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+type timedTx struct {
+	*sql.Tx
+	cancel context.CancelFunc
+}
+
+func (db timedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	return db.ExecContext(ctx, query, args...)
+}
+
+func (db timedDB) Query(query string, args ...interface{}) (timedRows, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+	}
+	return timedRows{rows, cancel}, err
+}
+
+func (db timedDB) QueryRow(query string, args ...interface{}) timedRow {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	return timedRow{db.QueryRowContext(ctx, query, args...), cancel}
+}
+
+func (db timedDB) Begin() (timedTx, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		cancel()
+	}
+	return timedTx{tx, cancel}, err
+}
+
+func (rows timedRows) Close() error {
+	defer rows.cancel()
+	return rows.Rows.Close()
+}
+
+func (row timedRow) Scan(dest ...interface{}) error {
+	defer row.cancel()
+	return row.Row.Scan(dest...)
+}
+
+func (tx timedTx) Commit() error {
+	defer tx.cancel()
+	return tx.Tx.Commit()
+}
+
+func (tx timedTx) Rollback() error {
+	defer tx.cancel()
+	return tx.Tx.Rollback()
+}
+
+func rollbackOrDie(tx timedTx, name string) {
+	if rollbackErr := tx.Rollback(); rollbackErr != nil {
+		dbLog.Error("Unable to roll back", "transaction", name, "err", rollbackErr)
+		os.Exit(1)
+	}
+}
+
+/* Add a column to a table if it doesn't have it yet. SQLite doesn't
+ * have ADD COLUMN IF NOT EXISTS, so we look through the table info
+ * ourselves.
+ */
+func addColumnIfMissing(table string, column string, decl string) error {
+	rows, err := sqlDb.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if name == column {
+			found = true
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+
+	if err != nil || found {
+		return err
+	}
+
+	_, err = sqlDb.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
+
+// Tags
+
+// Anything with a Scan method, i.e. *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTag(row scanner) (tag Tag, err error) {
+	err = row.Scan(&tag.Name, &tag.AuthorID, &tag.Url, &tag.Description,
+		&tag.CreatedAt, &tag.UpdatedAt)
+	return tag, err
+}
+
+// Look a tag up, through the cache (see tagcache.go).
+func namedTag(name string) (tag Tag, err error) {
+	return cachedNamedTag(normTag(name))
+}
+
+// Returned instead of changing what's locked, see lock.go.
+var (
+	ErrTagLocked      = errors.New("the tag is locked")
+	ErrPlaylistLocked = errors.New("the playlist is locked")
+)
+
+/* Make a new tag, or point a preexisting tag at a new URL. Replacing a
+ * tag keeps its description and creation date, but not its link health
+ * or image hash. A locked tag isn't replaced; ErrTagLocked is returned.
+ */
+func insertTag(name string, authorID string, url string) (err error) {
+	name = normTag(name)
+	if locked, err := tagLocked(name); err != nil || locked {
+		return lockedOr(ErrTagLocked, locked, err)
+	}
+
+	_, err = sqlDb.Exec(`
+INSERT INTO tag (name, authorID, url) VALUES (?,?,?)
+ON CONFLICT(name) DO UPDATE SET
+  authorID = excluded.authorID,
+  url = excluded.url,
+  updated_at = CURRENT_TIMESTAMP,
+  healthy = 1,
+  checked_at = NULL,
+  health_note = '',
+  phash = NULL`,
+		name, authorID, url)
+	forgetTag(name)
+	return err
+}
+
+/* Insert a whole tag as-is, metadata included, or replace a tag of the
+ * same name, keeping it in its playlists. Used for importing backups.
+ */
+func restoreTag(tag Tag) (err error) {
+	tag.Name = normTag(tag.Name)
+	if locked, err := tagLocked(tag.Name); err != nil || locked {
+		return lockedOr(ErrTagLocked, locked, err)
+	}
+
+	_, err = sqlDb.Exec(restoreTagQuery, tag.Name, tag.AuthorID, tag.Url,
+		tag.Description, tag.CreatedAt, tag.UpdatedAt)
+	forgetTag(tag.Name)
+	return err
+}
+
+/*
+ * Put a tag back as it was, replacing it in place if it's there, so its
+ * playlists and stats stay. The link's health and image hash only hold
+ * for the same link. Takes the tagColumns, in order.
+ */
+const restoreTagQuery = `
+INSERT INTO tag (` + tagColumns + `) VALUES (?,?,?,?,?,?)
+ON CONFLICT(name) DO UPDATE SET
+  authorID = excluded.authorID,
+  description = excluded.description,
+  created_at = excluded.created_at,
+  updated_at = excluded.updated_at,
+  healthy = CASE WHEN url = excluded.url THEN healthy ELSE 1 END,
+  checked_at = CASE WHEN url = excluded.url THEN checked_at ELSE NULL END,
+  health_note = CASE WHEN url = excluded.url THEN health_note ELSE '' END,
+  phash = CASE WHEN url = excluded.url THEN phash ELSE NULL END,
+  url = excluded.url`
+
+// Set a tag's description. Returns false if there's no such tag.
+// Give a tag to another member. Returns false if there's no such tag.
+func setTagAuthor(name string, authorID string) (bool, error) {
+	name = normTag(name)
+	res, err := sqlDb.Exec(
+		"UPDATE tag SET authorID=?, updated_at=CURRENT_TIMESTAMP WHERE name=?",
+		authorID, name)
+	forgetTag(name)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func describeTag(name string, description string) (bool, error) {
+	name = normTag(name)
+	res, err := sqlDb.Exec(
+		"UPDATE tag SET description=?, updated_at=CURRENT_TIMESTAMP WHERE name=?",
+		description, name)
+	forgetTag(name)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// Delete a tag, unless it's locked, when ErrTagLocked is returned.
+func delTag(name string) (err error) {
+	name = normTag(name)
+	if locked, err := tagLocked(name); err != nil || locked {
+		return lockedOr(ErrTagLocked, locked, err)
+	}
+
+	_, err = sqlDb.Exec("DELETE FROM tag WHERE name=?", name)
+	forgetTag(name)
+	return err
+}
+
+// The names of every tag, exactly as stored.
+func allTagNames() (names []string, err error) {
+	rows, err := sqlDb.Query("SELECT name FROM tag ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			break
+		}
+
+		names = append(names, name)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return names, err
+}
+
+/*
+ * Rename a tag everywhere it's used. The names are taken as-is, without
+ * normalizing them.
+ */
+func renameTag(from string, to string) error {
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return err
+	}
+
+	// The playlist and event rule references would fail their foreign
+	// key checks between the statements otherwise.
+	statements := []string{
+		"PRAGMA defer_foreign_keys = ON",
+		"UPDATE tag SET name=? WHERE name=?",
+		"UPDATE playlist SET tag=? WHERE tag=?",
+		"UPDATE event_rule SET tag=? WHERE tag=?",
+		"UPDATE event_rule SET previous=? WHERE previous=?",
+		"UPDATE oneshot SET tag=? WHERE tag=?",
+		"UPDATE curation_item SET tag=? WHERE tag=?",
+		"UPDATE art_credit SET tag=? WHERE tag=?",
+		"UPDATE nomination SET tag=? WHERE tag=?",
+		"UPDATE usage SET tag=? WHERE tag=?",
+		"UPDATE milestone SET tag=? WHERE tag=?",
+		"UPDATE poll_option SET tag=? WHERE tag=?",
+		"UPDATE poll_vote SET tag=? WHERE tag=?",
+		// A holiday's target is a playlist, if there's one by the name.
+		"UPDATE holiday_map SET target=? WHERE target=? AND target NOT IN " +
+			"(SELECT name FROM playlist UNION SELECT name FROM playlist_include " +
+			"UNION SELECT name FROM smart_playlist)",
+		"UPDATE setting SET value=? WHERE value=? AND key='" + currentBannerKey + "'",
+	}
+
+	for i, statement := range statements {
+		if i == 0 {
+			_, err = tx.Exec(statement)
+		} else {
+			_, err = tx.Exec(statement, to, from)
+		}
+
+		if err != nil {
+			rollbackOrDie(tx, "renameTag")
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	forgetTags()
+	return err
+}
+
+func tagExists(name string) (bool, error) {
+	_, err := cachedNamedTag(normTag(name))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func anyTags() (bool, error) {
+	var count int
+	err := sqlDb.QueryRow("SELECT COUNT(*) FROM tag").Scan(&count)
+	return count > 0, err
+}
+
+func allTags() (taglist []Tag, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query("SELECT " + tagColumns + " FROM tag ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag Tag
+		tag, err = scanTag(rows)
+		if err != nil {
+			break
+		}
+
+		taglist = append(taglist, tag)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return taglist, err
+}
+
+func authorTags(authorID string) (taglist []Tag, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT "+tagColumns+" FROM tag WHERE authorID=? ORDER BY name", authorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag Tag
+		tag, err = scanTag(rows)
+		if err != nil {
+			break
+		}
+
+		taglist = append(taglist, tag)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return taglist, err
+}
+
+// Playlists
+
+/*
+ * The playlist edits below return ErrPlaylistLocked, and change nothing,
+ * if the playlist is locked.
+ */
+
+// Delete a playlist, taking it out of the playlists it's nested in.
+func clearPlaylist(playlist string) error {
+	err := emptyPlaylist(playlist)
+	if err == nil {
+		_, err = sqlDb.Exec("DELETE FROM playlist_include WHERE child=?", playlist)
+	}
+	if err == nil {
+		err = setPlaylistCrew(playlist, "")
+	}
+	return err
+}
+
+/*
+ * Take everything out of a playlist: its tags, the playlists nested in
+ * it, and its smart filter. It stays nested where it is, with its crew.
+ */
+func emptyPlaylist(playlist string) error {
+	if locked, err := playlistLocked(playlist); err != nil || locked {
+		return lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	_, err := sqlDb.Exec("DELETE FROM playlist WHERE name=?", playlist)
+	if err == nil {
+		_, err = sqlDb.Exec("DELETE FROM playlist_include WHERE name=?", playlist)
+	}
+	if err == nil {
+		_, err = sqlDb.Exec("DELETE FROM smart_playlist WHERE name=?", playlist)
+	}
+	return err
+}
+
+func appendPlaylist(playlist string, tags []string) error {
+	if locked, err := playlistLocked(playlist); err != nil || locked {
+		return lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	tags = normTags(tags)
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err := tx.Exec("INSERT INTO playlist (name, tag) VALUES (?,?)",
+			playlist, tag)
+
+		if err != nil {
+			rollbackOrDie(tx, "appendPlaylist")
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func editPlaylist(playlist string, tags []string) error {
+	if locked, err := playlistLocked(playlist); err != nil || locked {
+		return lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	tags = normTags(tags)
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM playlist WHERE name=?", playlist)
+	if err != nil {
+		rollbackOrDie(tx, "editPlaylist")
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT INTO playlist (name, tag) VALUES (?, ?)",
+			playlist, tag)
+
+		if err != nil {
+			rollbackOrDie(tx, "editPlaylist")
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func reducePlaylist(playlist string, tags []string) error {
+	if locked, err := playlistLocked(playlist); err != nil || locked {
+		return lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	tags = normTags(tags)
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err := tx.Exec("DELETE FROM playlist WHERE name=? AND tag=?",
+			playlist, tag)
+		if err != nil {
+			rollbackOrDie(tx, "reducePlaylist")
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+ * Add the tags of each playlist in srcs, in order, to the end of dst,
+ * making it if need be. Tags dst has already are skipped, and nested
+ * playlists are copied as their tags. Returns how many tags were added.
+ */
+func copyPlaylists(dst string, srcs []string) (copied int, err error) {
+	if locked, err := playlistLocked(dst); err != nil || locked {
+		return 0, lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	// Gathered first, since there's only the one connection for the transaction.
+	srcTags := make([][]string, len(srcs))
+	for i, src := range srcs {
+		if srcTags[i], err = playlistTags(src); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, tags := range srcTags {
+		for _, tag := range tags {
+			res, err := tx.Exec("INSERT OR IGNORE INTO playlist (name, tag) VALUES (?,?)",
+				dst, tag)
+			var count int64
+			if err == nil {
+				count, err = res.RowsAffected()
+			}
+			if err != nil {
+				rollbackOrDie(tx, "copyPlaylists")
+				return 0, err
+			}
+			copied += int(count)
+		}
+	}
+
+	return copied, tx.Commit()
+}
+
+func allPlaylists() (playlists []string, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT name FROM playlist UNION SELECT name FROM playlist_include " +
+			"UNION SELECT name FROM smart_playlist")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var playlist string
+		err = rows.Scan(&playlist)
+		if err != nil {
+			break
+		}
+
+		playlists = append(playlists, playlist)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return playlists, err
+}
+
+/*
+ * A playlist's tags, with those its smart filter matches after its own,
+ * then those of the playlists nested in it, in the order they were
+ * nested, each tag once. A playlist nested in itself, however deeply, is
+ * only gone through the first time.
+ */
+func playlistTags(playlist string) (tags []string, err error) {
+	tags, _, err = resolvePlaylist(playlist)
+	return tags, err
+}
+
+/*
+ * playlistTags(), and whether any of the tags came from a smart filter,
+ * so they might be different next time.
+ */
+func resolvePlaylist(playlist string) (tags []string, smart bool, err error) {
+	seen := map[string]bool{}
+	visited := map[string]bool{}
+	var all []Tag
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	var resolve func(playlist string) error
+	resolve = func(playlist string) error {
+		if visited[playlist] {
+			return nil
+		}
+		visited[playlist] = true
+
+		own, err := ownPlaylistTags(playlist)
+		if err != nil {
+			return err
+		}
+		for _, tag := range own {
+			add(tag)
+		}
+
+		filter, ok, err := smartFilter(playlist)
+		if err != nil {
+			return err
+		} else if ok {
+			smart = true
+			if all == nil {
+				if all, err = allTags(); err != nil {
+					return err
+				}
+			}
+			for _, tag := range all {
+				if filter.matches(tag) {
+					add(tag.Name)
+				}
+			}
+		}
+
+		children, err := playlistChildren(playlist)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err = resolve(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err = resolve(playlist); err != nil {
+		return nil, false, err
+	}
+	return tags, smart, nil
+}
+
+// A playlist's own tags, without those of the playlists nested in it.
+func ownPlaylistTags(playlist string) (tags []string, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT tag FROM playlist WHERE name=? ORDER BY timestamp, rowid", playlist)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			break
+		}
+
+		tags = append(tags, tag)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return tags, err
+}
+
+func playlistExists(name string) (bool, error) {
+	var count int
+	err := sqlDb.
+		QueryRow("SELECT (SELECT COUNT(*) FROM playlist WHERE name=?) + "+
+			"(SELECT COUNT(*) FROM playlist_include WHERE name=?) + "+
+			"(SELECT COUNT(*) FROM smart_playlist WHERE name=?)",
+			name, name, name).
+		Scan(&count)
+	return count > 0, err
+}
+
+// Nested playlists, see nest.go
+
+// The playlists nested in a playlist, in the order they were nested.
+func playlistChildren(playlist string) (children []string, err error) {
+	rows, err := sqlDb.Query(
+		"SELECT child FROM playlist_include WHERE name=? ORDER BY timestamp, rowid",
+		playlist)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var child string
+		if err = rows.Scan(&child); err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
+
+// Nest playlists in a playlist. Returns how many weren't nested in it already.
+func nestPlaylists(playlist string, children []string) (nested int, err error) {
+	if locked, err := playlistLocked(playlist); err != nil || locked {
+		return 0, lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, child := range children {
+		res, err := tx.Exec(
+			"INSERT OR IGNORE INTO playlist_include (name, child) VALUES (?,?)",
+			playlist, child)
+		var count int64
+		if err == nil {
+			count, err = res.RowsAffected()
+		}
+		if err != nil {
+			rollbackOrDie(tx, "nestPlaylists")
+			return 0, err
+		}
+		nested += int(count)
+	}
+
+	return nested, tx.Commit()
+}
+
+// Take playlists out of a playlist. Returns how many were nested in it.
+func unnestPlaylists(playlist string, children []string) (unnested int, err error) {
+	if locked, err := playlistLocked(playlist); err != nil || locked {
+		return 0, lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, child := range children {
+		res, err := tx.Exec("DELETE FROM playlist_include WHERE name=? AND child=?",
+			playlist, child)
+		var count int64
+		if err == nil {
+			count, err = res.RowsAffected()
+		}
+		if err != nil {
+			rollbackOrDie(tx, "unnestPlaylists")
+			return 0, err
+		}
+		unnested += int(count)
+	}
+
+	return unnested, tx.Commit()
+}
+
+// Smart playlists, see smart.go
+
+// A playlist's smart filter. ok is false if it hasn't one.
+func smartFilter(playlist string) (filter SmartFilter, ok bool, err error) {
+	err = sqlDb.QueryRow("SELECT pattern, author FROM smart_playlist WHERE name=?",
+		playlist).Scan(&filter.Pattern, &filter.AuthorID)
+	if err == sql.ErrNoRows {
+		return filter, false, nil
+	}
+	return filter, err == nil, err
+}
+
+// Give a playlist a smart filter, or with filter nil, take it away.
+func setSmartFilter(playlist string, filter *SmartFilter) error {
+	if locked, err := playlistLocked(playlist); err != nil || locked {
+		return lockedOr(ErrPlaylistLocked, locked, err)
+	}
+
+	var err error
+	if filter == nil {
+		_, err = sqlDb.Exec("DELETE FROM smart_playlist WHERE name=?", playlist)
+	} else {
+		_, err = sqlDb.Exec(
+			"INSERT OR REPLACE INTO smart_playlist (name, pattern, author) VALUES (?,?,?)",
+			playlist, filter.Pattern, filter.AuthorID)
+	}
+	return err
+}
+
+// The role that owns a playlist, or "" if none does. See crew.go.
+func playlistCrew(playlist string) (string, error) {
+	var role string
+	err := sqlDb.QueryRow("SELECT role FROM playlist_owner WHERE playlist=?",
+		playlist).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// Give a playlist to a role, or with role "", take it back.
+func setPlaylistCrew(playlist string, role string) error {
+	var err error
+	if role == "" {
+		_, err = sqlDb.Exec("DELETE FROM playlist_owner WHERE playlist=?", playlist)
+	} else {
+		_, err = sqlDb.Exec("INSERT OR REPLACE INTO playlist_owner (playlist, role) VALUES (?,?)",
+			playlist, role)
+	}
+	return err
+}
+
+// Every playlist with a crew, by playlist.
+func playlistCrews() (map[string]string, error) {
+	rows, err := sqlDb.Query("SELECT playlist, role FROM playlist_owner")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	crews := map[string]string{}
+	for rows.Next() {
+		var playlist, role string
+		if err = rows.Scan(&playlist, &role); err != nil {
+			return nil, err
+		}
+		crews[playlist] = role
+	}
+	return crews, rows.Err()
+}
+
+// Locks, see lock.go
+
+// The error for something that's locked, if it is, or else err.
+func lockedOr(lockedErr error, locked bool, err error) error {
+	if locked {
+		return lockedErr
+	}
+	return err
+}
+
+// Whether a tag is locked. A tag that doesn't exist isn't.
+func tagLocked(name string) (bool, error) {
+	var locked bool
+	err := sqlDb.QueryRow("SELECT locked FROM tag WHERE name=?", normTag(name)).
+		Scan(&locked)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return locked, err
+}
+
+// Lock or unlock a tag. Returns false if there's no such tag.
+func setTagLocked(name string, locked bool) (bool, error) {
+	res, err := sqlDb.Exec("UPDATE tag SET locked=? WHERE name=?", locked, normTag(name))
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func playlistLocked(playlist string) (bool, error) {
+	var count int
+	err := sqlDb.QueryRow("SELECT COUNT(*) FROM playlist_lock WHERE playlist=?",
+		playlist).Scan(&count)
+	return count > 0, err
+}
+
+func setPlaylistLocked(playlist string, locked bool) error {
+	var err error
+	if locked {
+		_, err = sqlDb.Exec("INSERT OR IGNORE INTO playlist_lock (playlist) VALUES (?)",
+			playlist)
+	} else {
+		_, err = sqlDb.Exec("DELETE FROM playlist_lock WHERE playlist=?", playlist)
+	}
+	return err
+}
+
+// The locked tags and playlists, by name.
+func allLocks() (tags []string, playlists []string, err error) {
+	rows, err := sqlDb.Query("SELECT name FROM tag WHERE locked ORDER BY name")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = sqlDb.Query("SELECT playlist FROM playlist_lock ORDER BY playlist")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var playlist string
+		if err = rows.Scan(&playlist); err != nil {
+			return nil, nil, err
+		}
+		playlists = append(playlists, playlist)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return tags, playlists, err
+}
+
+// Art credits
+
+// Who made a tag's art, and its forum post. See credits.go.
+type ArtCredit struct {
+	Tag    string
+	Artist string // "" to credit whoever made the tag
+	Thread string // the forum post, or "" if there's none yet
+}
+
+// The credit for a tag; one that was never given is blank.
+func artCredit(tag string) (ArtCredit, error) {
+	credit := ArtCredit{Tag: normTag(tag)}
+	err := sqlDb.QueryRow("SELECT artist, thread FROM art_credit WHERE tag=?",
+		credit.Tag).Scan(&credit.Artist, &credit.Thread)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return credit, err
+}
+
+func setArtist(tag string, artist string) error {
+	_, err := sqlDb.Exec(`
+INSERT INTO art_credit (tag, artist) VALUES (?,?)
+ON CONFLICT(tag) DO UPDATE SET artist = excluded.artist`, normTag(tag), artist)
+	return err
+}
+
+func setArtThread(tag string, thread string) error {
+	_, err := sqlDb.Exec(`
+INSERT INTO art_credit (tag, thread) VALUES (?,?)
+ON CONFLICT(tag) DO UPDATE SET thread = excluded.thread`, normTag(tag), thread)
+	return err
+}
+
+// Saved schedule. There's only ever one, so it always lives at id 1.
+
+func saveSchedule(schedule SavedSchedule) error {
+	tags, err := json.Marshal(schedule.Tags)
+	if err != nil {
+		return err
+	}
+	excluded, err := json.Marshal(schedule.Except)
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlDb.Exec(`
+INSERT OR REPLACE INTO schedule (id, mode, picker, interval, tags, source, catchup, label,
+  excluded)
+VALUES (1,?,?,?,?,?,?,?,?)`,
+		schedule.Mode, schedule.Picker, int64(schedule.Interval), string(tags),
+		schedule.Source, schedule.CatchUp, schedule.Label, string(excluded))
+	return err
+}
+
+func loadSchedule() (schedule SavedSchedule, ok bool, err error) {
+	var interval int64
+	var tags, excluded string
+
+	err = sqlDb.
+		QueryRow("SELECT mode, picker, interval, tags, source, catchup, label, excluded, "+
+			"saved_at FROM schedule WHERE id=1").
+		Scan(&schedule.Mode, &schedule.Picker, &interval, &tags, &schedule.Source,
+			&schedule.CatchUp, &schedule.Label, &excluded, &schedule.SavedAt)
+	if err == sql.ErrNoRows {
+		return schedule, false, nil
+	} else if err != nil {
+		return schedule, false, err
+	}
+
+	schedule.Interval = time.Duration(interval)
+	err = json.Unmarshal([]byte(tags), &schedule.Tags)
+	if err == nil {
+		err = json.Unmarshal([]byte(excluded), &schedule.Except)
+	}
+	return schedule, err == nil, err
+}
+
+func clearSchedule() error {
+	_, err := sqlDb.Exec("DELETE FROM schedule")
+	return err
+}
+
+// Settings changed at runtime, which outlive restarts. See also
+// banner-bard.go:Settings for the ones from the settings file.
+
+// Return the value stored under key, or "" if there isn't one.
+func getSetting(key string) (value string, err error) {
+	err = sqlDb.QueryRow("SELECT value FROM setting WHERE key=?", key).
+		Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func putSetting(key string, value string) error {
+	_, err := sqlDb.Exec("INSERT OR REPLACE INTO setting (key, value) VALUES (?,?)",
+		key, value)
+	return err
+}
+
+// One-shots. Times are always stored in UTC so that they sort as text.
+
+const oneShotColumns = "id, at, tag, revert_after, is_revert, authorID"
+
+func scanOneShot(row scanner) (shot OneShot, err error) {
+	var revertAfter int64
+	err = row.Scan(&shot.ID, &shot.At, &shot.Tag, &revertAfter,
+		&shot.IsRevert, &shot.AuthorID)
+	shot.RevertAfter = time.Duration(revertAfter)
+	return shot, err
+}
+
+func insertOneShot(shot OneShot) (id int64, err error) {
+	shot.Tag = normTag(shot.Tag)
+	res, err := sqlDb.Exec(
+		"INSERT INTO oneshot (at, tag, revert_after, is_revert, authorID) VALUES (?,?,?,?,?)",
+		shot.At.UTC(), shot.Tag, int64(shot.RevertAfter), shot.IsRevert, shot.AuthorID)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func delOneShot(id int64) (bool, error) {
+	res, err := sqlDb.Exec("DELETE FROM oneshot WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func allOneShots() (shots []OneShot, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query("SELECT " + oneShotColumns + " FROM oneshot ORDER BY at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shot OneShot
+		shot, err = scanOneShot(rows)
+		if err != nil {
+			break
+		}
+
+		shots = append(shots, shot)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return shots, err
+}
+
+// Return the soonest one-shot, if there are any.
+func nextOneShot() (shot OneShot, ok bool, err error) {
+	shot, err = scanOneShot(sqlDb.QueryRow(
+		"SELECT " + oneShotColumns + " FROM oneshot ORDER BY at LIMIT 1"))
+	if err == sql.ErrNoRows {
+		return shot, false, nil
+	}
+	return shot, err == nil, err
+}
+
+// Whether an override is up and waiting to be reverted.
+func revertPending() (bool, error) {
+	var count int
+	err := sqlDb.QueryRow("SELECT COUNT(*) FROM oneshot WHERE is_revert").
+		Scan(&count)
+	return count > 0, err
+}
+
+// Quiet hours
+
+func insertQuietWindow(start string, end string) (id int64, err error) {
+	res, err := sqlDb.Exec("INSERT INTO quiet_hours (start, end) VALUES (?,?)",
+		start, end)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func delQuietWindow(id int64) (bool, error) {
+	res, err := sqlDb.Exec("DELETE FROM quiet_hours WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func allQuietWindows() (windows []QuietWindow, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query("SELECT id, start, end FROM quiet_hours ORDER BY start")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var window QuietWindow
+		err = rows.Scan(&window.ID, &window.Start, &window.End)
+		if err != nil {
+			break
+		}
+
+		windows = append(windows, window)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return windows, err
+}
+
+// Curation threads
+
+func insertCuration(curation Curation) error {
+	_, err := sqlDb.Exec(
+		"INSERT INTO curation (threadID, playlist, authorID, previewID) VALUES (?,?,?,?)",
+		curation.ThreadID, curation.Playlist, curation.AuthorID, curation.PreviewID)
+	return err
+}
+
+func threadCuration(threadID string) (curation Curation, ok bool, err error) {
+	err = sqlDb.
+		QueryRow("SELECT threadID, playlist, authorID, previewID FROM curation WHERE threadID=?",
+			threadID).
+		Scan(&curation.ThreadID, &curation.Playlist, &curation.AuthorID, &curation.PreviewID)
+	if err == sql.ErrNoRows {
+		return curation, false, nil
+	}
+	return curation, err == nil, err
+}
+
+func setCurationPreview(threadID string, previewID string) error {
+	_, err := sqlDb.Exec("UPDATE curation SET previewID=? WHERE threadID=?",
+		previewID, threadID)
+	return err
+}
+
+func delCuration(threadID string) error {
+	_, err := sqlDb.Exec("DELETE FROM curation WHERE threadID=?", threadID)
+	return err
+}
+
+// Add a tag to the end of a curation, unless it's already in it.
+func addCurationItem(threadID string, tag string) error {
+	tag = normTag(tag)
+	_, err := sqlDb.Exec(`
+INSERT OR IGNORE INTO curation_item (threadID, tag, position)
+SELECT ?, ?, COALESCE(MAX(position), 0) + 1 FROM curation_item WHERE threadID=?`,
+		threadID, tag, threadID)
+	return err
+}
+
+func curationItems(threadID string) (tags []string, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT tag FROM curation_item WHERE threadID=? ORDER BY position", threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			break
+		}
+
+		tags = append(tags, tag)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return tags, err
+}
+
+// Seasons
+
+func insertSeason(season Season) error {
+	_, err := sqlDb.Exec("INSERT OR REPLACE INTO season (playlist, start, end) VALUES (?,?,?)",
+		season.Playlist, season.Start, season.End)
+	return err
+}
+
+func delSeason(playlist string) (bool, error) {
+	res, err := sqlDb.Exec("DELETE FROM season WHERE playlist=?", playlist)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func allSeasons() (seasons []Season, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query("SELECT playlist, start, end FROM season ORDER BY start")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var season Season
+		err = rows.Scan(&season.Playlist, &season.Start, &season.End)
+		if err != nil {
+			break
+		}
+
+		seasons = append(seasons, season)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return seasons, err
+}
+
+// Holidays
+
+func insertHolidayMap(holiday HolidayMap) error {
+	_, err := sqlDb.Exec("INSERT OR REPLACE INTO holiday_map (holiday, target) VALUES (?,?)",
+		holiday.Holiday, holiday.Target)
+	return err
+}
+
+func delHolidayMap(holiday string) (bool, error) {
+	res, err := sqlDb.Exec("DELETE FROM holiday_map WHERE holiday=?", holiday)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func allHolidayMaps() (maps []HolidayMap, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query("SELECT holiday, target FROM holiday_map ORDER BY holiday")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var holiday HolidayMap
+		err = rows.Scan(&holiday.Holiday, &holiday.Target)
+		if err != nil {
+			break
+		}
+
+		maps = append(maps, holiday)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return maps, err
+}
+
+// Milestones
+
+func insertMilestone(milestone Milestone) (id int64, err error) {
+	res, err := sqlDb.Exec(
+		"INSERT INTO milestone (kind, count, tag, duration, fired) VALUES (?,?,?,?,?)",
+		milestone.Kind, milestone.Count, normTag(milestone.Tag), int64(milestone.For),
+		milestone.Fired)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func delMilestone(id int64) (bool, error) {
+	res, err := sqlDb.Exec("DELETE FROM milestone WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func allMilestones() (milestones []Milestone, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT id, kind, count, tag, duration, fired FROM milestone ORDER BY kind, count")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var milestone Milestone
+		var duration int64
+		err = rows.Scan(&milestone.ID, &milestone.Kind, &milestone.Count,
+			&milestone.Tag, &duration, &milestone.Fired)
+		if err != nil {
+			break
+		}
+
+		milestone.For = time.Duration(duration)
+		milestones = append(milestones, milestone)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return milestones, err
+}
+
+func setMilestoneFired(id int64) error {
+	_, err := sqlDb.Exec("UPDATE milestone SET fired=1 WHERE id=?", id)
+	return err
+}
+
+// Suggestions
+
+const suggestionColumns = "id, tag, url, authorID, channelID, messageID"
+
+func scanSuggestion(row scanner) (suggestion Suggestion, err error) {
+	err = row.Scan(&suggestion.ID, &suggestion.Tag, &suggestion.URL, &suggestion.AuthorID,
+		&suggestion.ChannelID, &suggestion.MessageID)
+	return suggestion, err
+}
+
+func insertSuggestion(suggestion Suggestion) (id int64, err error) {
+	res, err := sqlDb.Exec(
+		"INSERT INTO suggestion (tag, url, authorID, channelID, messageID) VALUES (?,?,?,?,?)",
+		normTag(suggestion.Tag), suggestion.URL, suggestion.AuthorID, suggestion.ChannelID,
+		suggestion.MessageID)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func suggestionByID(id int64) (suggestion Suggestion, ok bool, err error) {
+	suggestion, err = scanSuggestion(sqlDb.QueryRow(
+		"SELECT "+suggestionColumns+" FROM suggestion WHERE id=?", id))
+	if err == sql.ErrNoRows {
+		return suggestion, false, nil
+	}
+	return suggestion, err == nil, err
+}
+
+func setSuggestionMessage(id int64, channelID string, messageID string) error {
+	_, err := sqlDb.Exec("UPDATE suggestion SET channelID=?, messageID=? WHERE id=?",
+		channelID, messageID, id)
+	return err
+}
+
+func delSuggestion(id int64) (bool, error) {
+	res, err := sqlDb.Exec("DELETE FROM suggestion WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func querySuggestions(query string, args ...interface{}) (suggestions []Suggestion, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query("SELECT "+suggestionColumns+" FROM suggestion "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var suggestion Suggestion
+		suggestion, err = scanSuggestion(rows)
+		if err != nil {
+			break
+		}
+
+		suggestions = append(suggestions, suggestion)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return suggestions, err
+}
+
+func allSuggestions() ([]Suggestion, error) {
+	return querySuggestions("ORDER BY id")
+}
+
+// The suggestions made by a message, which may have several images.
+func messageSuggestions(messageID string) ([]Suggestion, error) {
+	return querySuggestions("WHERE messageID=? ORDER BY id", messageID)
+}
+
+// Polls
+
+const pollColumns = "id, kind, channelID, messageID, authorID, closes_at"
+
+func scanPoll(row scanner) (poll Poll, err error) {
+	err = row.Scan(&poll.ID, &poll.Kind, &poll.ChannelID, &poll.MessageID, &poll.AuthorID,
+		&poll.ClosesAt)
+	return poll, err
+}
+
+func insertPoll(poll Poll) (id int64, err error) {
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO poll (kind, channelID, messageID, authorID, closes_at) VALUES (?,?,?,?,?)",
+		poll.Kind, poll.ChannelID, poll.MessageID, poll.AuthorID, poll.ClosesAt.UTC())
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	if err != nil {
+		rollbackOrDie(tx, "insertPoll")
+		return 0, err
+	}
+
+	for position, tag := range normTags(poll.Tags) {
+		_, err = tx.Exec("INSERT INTO poll_option (pollID, position, tag) VALUES (?,?,?)",
+			id, position, tag)
+		if err != nil {
+			rollbackOrDie(tx, "insertPoll")
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+func setPollMessage(id int64, messageID string) error {
+	_, err := sqlDb.Exec("UPDATE poll SET messageID=? WHERE id=?", messageID, id)
+	return err
+}
+
+func delPoll(id int64) (bool, error) {
+	res, err := sqlDb.Exec("DELETE FROM poll WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// The candidates of a poll, in order.
+func pollTags(id int64) (tags []string, err error) {
+	rows, err := sqlDb.Query("SELECT tag FROM poll_option WHERE pollID=? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			break
+		}
+		tags = append(tags, tag)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return tags, err
+}
+
+func allPolls() (polls []Poll, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT " + pollColumns + " FROM poll ORDER BY closes_at")
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var poll Poll
+		poll, err = scanPoll(rows)
+		if err != nil {
+			break
+		}
+
+		polls = append(polls, poll)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	// Closed before pollTags() queries, in case there's one connection.
+	rows.Close()
+
+	for i := range polls {
+		if err == nil {
+			polls[i].Tags, err = pollTags(polls[i].ID)
+		}
+	}
+
+	return polls, err
+}
+
+func pollByID(id int64) (poll Poll, ok bool, err error) {
+	poll, err = scanPoll(sqlDb.QueryRow("SELECT "+pollColumns+" FROM poll WHERE id=?", id))
+	if err == sql.ErrNoRows {
+		return poll, false, nil
+	} else if err != nil {
+		return poll, false, err
+	}
+
+	poll.Tags, err = pollTags(id)
+	return poll, err == nil, err
+}
+
+// Cast a member's vote, replacing the one they cast before, if any.
+func castVote(pollID int64, userID string, tag string) error {
+	_, err := sqlDb.Exec(`
+INSERT INTO poll_vote (pollID, userID, tag) VALUES (?,?,?)
+ON CONFLICT(pollID, userID) DO UPDATE SET tag = excluded.tag`,
+		pollID, userID, normTag(tag))
+	return err
+}
+
+// The votes for each tag in a poll.
+func pollTally(id int64) (tally map[string]int, err error) {
+	rows, err := sqlDb.Query("SELECT tag, COUNT(*) FROM poll_vote WHERE pollID=? GROUP BY tag", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tally = map[string]int{}
+	for rows.Next() {
+		var tag string
+		var count int
+		if err = rows.Scan(&tag, &count); err != nil {
+			break
+		}
+		tally[tag] = count
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return tally, err
+}
+
+// Elections
+
+// Nominate a tag for the next election. Returns false if it was already.
+func insertNomination(tag string, userID string) (bool, error) {
+	res, err := sqlDb.Exec("INSERT OR IGNORE INTO nomination (tag, userID) VALUES (?,?)",
+		normTag(tag), userID)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// The nominated tags, and who nominated each, oldest first.
+func allNominations() (tags []string, users []string, err error) {
+	rows, err := sqlDb.Query("SELECT tag, userID FROM nomination ORDER BY rowid")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag, user string
+		if err = rows.Scan(&tag, &user); err != nil {
+			break
+		}
+		tags = append(tags, tag)
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return tags, users, err
+}
+
+func clearNominations() error {
+	_, err := sqlDb.Exec("DELETE FROM nomination")
+	return err
+}
+
+func insertElectionWinner(winner ElectionWinner) error {
+	_, err := sqlDb.Exec(
+		"INSERT INTO election_winner (closed_at, tag, authorID, votes) VALUES (?,?,?,?)",
+		winner.ClosedAt.UTC(), winner.Tag, winner.AuthorID, winner.Votes)
+	return err
+}
+
+// Past election winners, newest first.
+func allElectionWinners() (winners []ElectionWinner, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT closed_at, tag, authorID, votes FROM election_winner ORDER BY closed_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var winner ElectionWinner
+		err = rows.Scan(&winner.ClosedAt, &winner.Tag, &winner.AuthorID, &winner.Votes)
+		if err != nil {
+			break
+		}
+
+		winners = append(winners, winner)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return winners, err
+}
+
+// Usage
+
+// Record a tag going up, with the next batch (see batch.go).
+func queueUsage(tag string, source string, at time.Time) {
+	QueueWrite("INSERT INTO usage (at, tag, source) VALUES (?,?,?)",
+		at.UTC(), normTag(tag), source)
+}
+
+// Every time a tag went up, oldest first.
+func allUsage() (usage []Usage, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query("SELECT at, tag, source FROM usage ORDER BY at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var use Usage
+		if err = rows.Scan(&use.At, &use.Tag, &use.Source); err != nil {
+			break
+		}
+
+		usage = append(usage, use)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return usage, err
+}
+
+// Event rules
+
+func insertEventRule(rule EventRule) (id int64, err error) {
+	rule.Tag = normTag(rule.Tag)
+	res, err := sqlDb.Exec(
+		"INSERT INTO event_rule (eventID, tag, threshold) VALUES (?,?,?)",
+		rule.EventID, rule.Tag, rule.Threshold)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Delete an event rule, returning it as it was. ok is false if there's no such rule.
+func delEventRule(id int64) (rule EventRule, ok bool, err error) {
+	err = sqlDb.QueryRow(
+		"DELETE FROM event_rule WHERE id=? "+
+			"RETURNING id, eventID, tag, threshold, applied, previous", id).
+		Scan(&rule.ID, &rule.EventID, &rule.Tag, &rule.Threshold, &rule.Applied,
+			&rule.Previous)
+	if err == sql.ErrNoRows {
+		return rule, false, nil
+	}
+	return rule, err == nil, err
+}
+
+func allEventRules() (rules []EventRule, err error) {
+	var rows timedRows
+
+	rows, err = sqlDb.Query(
+		"SELECT id, eventID, tag, threshold, applied, previous FROM event_rule ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rule EventRule
+		err = rows.Scan(&rule.ID, &rule.EventID, &rule.Tag, &rule.Threshold,
+			&rule.Applied, &rule.Previous)
+		if err != nil {
+			break
+		}
+
+		rules = append(rules, rule)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return rules, err
+}
+
+func setEventRuleApplied(id int64, applied bool, previous string) error {
+	_, err := sqlDb.Exec("UPDATE event_rule SET applied=?, previous=? WHERE id=?",
+		applied, previous, id)
+	return err
+}
+
+// Whether an event rule has its tag up now.
+func eventRuleApplied() (bool, error) {
+	var count int
+	err := sqlDb.QueryRow("SELECT COUNT(*) FROM event_rule WHERE applied").
+		Scan(&count)
+	return count > 0, err
+}
+
+// Tag durations
+
+func tagDuration(name string) (time.Duration, error) {
+	name = normTag(name)
+	var duration int64
+	err := sqlDb.QueryRow("SELECT duration FROM tag WHERE name=?", name).
+		Scan(&duration)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return time.Duration(duration), err
+}
+
+func setTagDuration(name string, duration time.Duration) (bool, error) {
+	name = normTag(name)
+	res, err := sqlDb.Exec("UPDATE tag SET duration=? WHERE name=?",
+		int64(duration), name)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// Tag crop modes
+
+func tagCrop(name string) (mode string, err error) {
+	name = normTag(name)
+	err = sqlDb.QueryRow("SELECT crop FROM tag WHERE name=?", name).Scan(&mode)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return mode, err
+}
 
-const (
-	SqlNoRows     = "no rows in result set"
-	SqlForeignKey = "FOREIGN KEY constraint failed"
-	DatabaseFile  = "./banner-bard.db"
-)
+func setTagCrop(name string, mode string) (bool, error) {
+	name = normTag(name)
+	res, err := sqlDb.Exec("UPDATE tag SET crop=? WHERE name=?", mode, name)
+	if err != nil {
+		return false, err
+	}
 
-type Tag struct {
-	Name     string
-	AuthorID string
-	Url      string
+	count, err := res.RowsAffected()
+	return count > 0, err
 }
 
-func openDb() error {
-	var err error
-	sqlDb, err = sql.Open("sqlite3", DatabaseFile)
+// Tag health
 
-	// Pragmas
+func tagHealth(name string) (health TagHealth, err error) {
+	name = normTag(name)
+	err = sqlDb.QueryRow(
+		"SELECT healthy, checked_at, health_note FROM tag WHERE name=?", name).
+		Scan(&health.Healthy, &health.CheckedAt, &health.Note)
+	return health, err
+}
 
-	if err == nil {
-		_, err = sqlDb.Exec("PRAGMA foreign_keys = true")
+func setTagHealth(name string, healthy bool, note string) error {
+	name = normTag(name)
+	_, err := sqlDb.Exec(`
+UPDATE tag SET healthy=?, health_note=?, checked_at=CURRENT_TIMESTAMP
+WHERE name=?`,
+		healthy, note, name)
+	return err
+}
+
+// Count a tag as checked without changing its health.
+func touchTagHealth(name string) error {
+	name = normTag(name)
+	_, err := sqlDb.Exec("UPDATE tag SET checked_at=CURRENT_TIMESTAMP WHERE name=?", name)
+	return err
+}
+
+// The tag whose link has gone the longest without a check.
+func stalestTag() (tag Tag, ok bool, err error) {
+	tag, err = scanTag(sqlDb.QueryRow(
+		"SELECT " + tagColumns + " FROM tag " +
+			"ORDER BY checked_at IS NOT NULL, checked_at LIMIT 1"))
+	if err == sql.ErrNoRows {
+		return tag, false, nil
 	}
+	return tag, err == nil, err
+}
 
-	// Table initialization
+// Image hashes
 
-	if err == nil {
-		_, err = sqlDb.Exec(`
-CREATE TABLE IF NOT EXISTS tag (
-  name TEXT PRIMARY KEY,
-  authorID TEXT NOT NULL,
-  url TEXT NOT NULL
-)`)
+// Hashes are unsigned, but SQLite only stores signed integers.
+func setTagHash(name string, hash uint64) error {
+	name = normTag(name)
+	_, err := sqlDb.Exec("UPDATE tag SET phash=? WHERE name=?", int64(hash), name)
+	return err
+}
+
+// The hash of every tag that has one, by name.
+func tagHashes() (hashes map[string]uint64, err error) {
+	rows, err := sqlDb.Query("SELECT name, phash FROM tag WHERE phash IS NOT NULL")
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	hashes = map[string]uint64{}
+	for rows.Next() {
+		var name string
+		var hash int64
+		if err = rows.Scan(&name, &hash); err != nil {
+			break
+		}
 
+		hashes[name] = uint64(hash)
+	}
 	if err == nil {
-		_, err = sqlDb.Exec(`
-CREATE TABLE IF NOT EXISTS playlist (
-  name TEXT NOT NULL,
-  tag TEXT NOT NULL REFERENCES tag(name) ON DELETE CASCADE,
-  timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-  PRIMARY KEY (name, tag)
-)`)
+		err = rows.Err()
 	}
 
-	return err
+	return hashes, err
 }
 
-func closeDbOrPanic() {
-	err := sqlDb.Close()
+func tagCount() (count int, err error) {
+	err = sqlDb.QueryRow("SELECT COUNT(*) FROM tag").Scan(&count)
+	return count, err
+}
+
+// Command permissions, see perms.go
 
+// Let a role run a command, named without the prefix.
+func grantCommandRole(command string, role string) error {
+	_, err := sqlDb.Exec(
+		"INSERT OR IGNORE INTO command_permissions (command, role) VALUES (?,?)",
+		command, role)
+	return err
+}
+
+// Take a command back from a role, returning whether it had been given it.
+func revokeCommandRole(command string, role string) (bool, error) {
+	result, err := sqlDb.Exec(
+		"DELETE FROM command_permissions WHERE command=? AND role=?", command, role)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
+	count, err := result.RowsAffected()
+	return count > 0, err
 }
 
-// Sql utils
+/*
+ * The roles given a command, or any command in it if it's a compound
+ * one, since they have to get through the compound on their way there.
+ */
+func commandRoles(command string) (roles []string, err error) {
+	rows, err := sqlDb.Query(
+		"SELECT DISTINCT role FROM command_permissions "+
+			"WHERE command=? OR substr(command, 1, ?)=?",
+		command, len(command)+1, command+" ")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-func rollbackOrDie(tx *sql.Tx, name string) {
-	if rollbackErr := tx.Rollback(); rollbackErr != nil {
-		logger.Fatalf("%s: unable to rollback: %s",
-			name, rollbackErr.Error())
+	for rows.Next() {
+		var role string
+		if err = rows.Scan(&role); err != nil {
+			break
+		}
+
+		roles = append(roles, role)
+	}
+	if err == nil {
+		err = rows.Err()
 	}
-}
 
-// Tags
+	return roles, err
+}
 
-func namedTag(name string) (tag Tag, err error) {
-	tag.Name = name
-	err = sqlDb.
-		QueryRow("SELECT url, authorID FROM tag WHERE name=?",
-			name).
-		Scan(&tag.Url, &tag.AuthorID)
+// Every role given a command, by command.
+func commandPermissions() (map[string][]string, error) {
+	rows, err := sqlDb.Query(
+		"SELECT command, role FROM command_permissions ORDER BY command")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return tag, err
+	perms := map[string][]string{}
+	for rows.Next() {
+		var command, role string
+		if err = rows.Scan(&command, &role); err != nil {
+			return nil, err
+		}
+		perms[command] = append(perms[command], role)
+	}
+	return perms, rows.Err()
 }
 
-func insertTag(name string, authorID string, url string) (err error) {
-	_, err = sqlDb.
-		Exec("INSERT OR REPLACE INTO tag (name, authorID, url) VALUES (?,?,?)",
-			name, authorID, url)
+// The blacklist, see owners.go
+
+// Bar a user, or change why they're barred if they already are.
+func blacklistUser(userID string, reason string, by string) error {
+	_, err := sqlDb.Exec(
+		"INSERT OR REPLACE INTO blacklist (userID, reason, byID, at) VALUES (?,?,?,?)",
+		userID, reason, by, time.Now().UTC())
 	return err
 }
 
-func delTag(name string) (err error) {
-	_, err = sqlDb.Exec("DELETE FROM tag WHERE name=?", name)
-	return err
+// Lift a user's bar, returning whether they were barred.
+func unblacklistUser(userID string) (bool, error) {
+	result, err := sqlDb.Exec("DELETE FROM blacklist WHERE userID=?", userID)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
 }
 
-func tagExists(name string) (bool, error) {
+func blacklisted(userID string) (banned bool, err error) {
 	var count int
-	err := sqlDb.
-		QueryRow("SELECT COUNT(*) FROM tag WHERE name=?",
-			name).
-		Scan(&count)
+	err = sqlDb.QueryRow("SELECT COUNT(*) FROM blacklist WHERE userID=?",
+		userID).Scan(&count)
 	return count > 0, err
 }
 
-func allTags() (taglist []Tag, err error) {
-	var rows *sql.Rows
+// Everyone barred, longest first.
+func blacklist() (bans []Ban, err error) {
+	rows, err := sqlDb.Query("SELECT userID, reason, byID, at FROM blacklist ORDER BY at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ban Ban
+		if err = rows.Scan(&ban.UserID, &ban.Reason, &ban.By, &ban.At); err != nil {
+			break
+		}
+
+		bans = append(bans, ban)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return bans, err
+}
+
+// The audit log, see auditlog.go
 
-	rows, err = sqlDb.Query("SELECT name, authorID, url FROM tag ORDER BY name")
+// Keep a change, with the next batch (see batch.go).
+func queueAuditEntry(entry AuditEntry) {
+	QueueWrite(
+		"INSERT INTO audit_log (at, userID, action, target, detail) VALUES (?,?,?,?,?)",
+		entry.At.UTC(), entry.UserID, entry.Action, entry.Target, entry.Detail)
+}
+
+// The last count changes, newest first.
+func recentAuditEntries(count int) (entries []AuditEntry, err error) {
+	rows, err := sqlDb.Query(
+		"SELECT at, userID, action, target, detail FROM audit_log ORDER BY id DESC LIMIT ?",
+		count)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var tag Tag
-		err = rows.Scan(&tag.Name, &tag.AuthorID, &tag.Url)
+		var entry AuditEntry
+		err = rows.Scan(&entry.At, &entry.UserID, &entry.Action, &entry.Target, &entry.Detail)
 		if err != nil {
 			break
 		}
 
-		taglist = append(taglist, tag)
+		entries = append(entries, entry)
+	}
+	if err == nil {
+		err = rows.Err()
 	}
 
-	return taglist, err
+	return entries, err
 }
 
-func clearTags() error {
-	_, err := sqlDb.Exec("DELETE FROM tag")
+// The undo journal, see undo.go
+
+// Keep a change, forgetting all but the newest keep.
+func insertUndoEntry(entry UndoEntry, keep int) error {
+	_, err := sqlDb.Exec(
+		"INSERT INTO undo_journal (at, userID, action, target, snapshot) VALUES (?,?,?,?,?)",
+		entry.At.UTC(), entry.UserID, entry.Action, entry.Target, entry.Snapshot)
+	if err == nil {
+		_, err = sqlDb.Exec(
+			"DELETE FROM undo_journal WHERE id NOT IN "+
+				"(SELECT id FROM undo_journal ORDER BY id DESC LIMIT ?)", keep)
+	}
 	return err
 }
 
-// Playlists
+// A user's latest change still kept. ok is false if there's none.
+func lastUndoEntry(userID string) (entry UndoEntry, ok bool, err error) {
+	err = sqlDb.QueryRow(
+		"SELECT id, at, userID, action, target, snapshot FROM undo_journal "+
+			"WHERE userID=? ORDER BY id DESC LIMIT 1", userID).
+		Scan(&entry.ID, &entry.At, &entry.UserID, &entry.Action, &entry.Target,
+			&entry.Snapshot)
+	if err == sql.ErrNoRows {
+		return entry, false, nil
+	}
+	return entry, err == nil, err
+}
 
-func clearPlaylist(playlist string) error {
-	_, err := sqlDb.Exec("DELETE FROM playlist WHERE name=?", playlist)
+func delUndoEntry(id int64) error {
+	_, err := sqlDb.Exec("DELETE FROM undo_journal WHERE id=?", id)
 	return err
 }
 
-func appendPlaylist(playlist string, tags []string) error {
+/*
+ * The tables whose rows go with a tag when it's deleted, through ON
+ * DELETE CASCADE, besides its playlists. One-shots, curations and polls
+ * only keep the tag's name, so they're still there when it's put back.
+ */
+var tagCascades = []string{"art_credit", "event_rule", "milestone", "nomination", "usage"}
+
+// A tag's own row, under "tag", and its rows in tagCascades, by table.
+type TagRows map[string][]map[string]interface{}
+
+func tagRows(name string) (TagRows, error) {
+	name = normTag(name)
+	found := TagRows{}
+	rows, err := selectRows("SELECT * FROM tag WHERE name=?", name)
+	if len(rows) > 0 {
+		found["tag"] = rows
+	}
+	for _, table := range tagCascades {
+		if err != nil {
+			break
+		}
+		rows, err = selectRows("SELECT * FROM "+table+" WHERE tag=?", name)
+		if len(rows) > 0 {
+			found[table] = rows
+		}
+	}
+	return found, err
+}
+
+/*
+ * Put back what tagRows() found, once restoreTag() has put the tag back:
+ * the columns Tag leaves out, and the rows that went with it. Rows still
+ * there are left as they are. The link's health and image hash only
+ * hold for the same link.
+ */
+func restoreTagRows(name string, found TagRows) error {
+	name = normTag(name)
 	tx, err := sqlDb.Begin()
 	if err != nil {
 		return err
 	}
 
-	for _, tag := range tags {
-		_, err := tx.Exec("INSERT INTO playlist (name, tag) VALUES (?,?)",
-			playlist, tag)
-
+	for _, row := range found["tag"] {
+		_, err = tx.Exec("UPDATE tag SET duration=?, crop=? WHERE name=?",
+			sqlValue(row["duration"]), sqlValue(row["crop"]), name)
+		if err == nil {
+			_, err = tx.Exec(
+				"UPDATE tag SET healthy=?, checked_at=?, health_note=?, phash=? "+
+					"WHERE name=? AND url=?",
+				sqlValue(row["healthy"]), sqlValue(row["checked_at"]),
+				sqlValue(row["health_note"]), sqlValue(row["phash"]), name,
+				sqlValue(row["url"]))
+		}
 		if err != nil {
-			rollbackOrDie(tx, "appendPlaylist")
+			tx.Rollback()
 			return err
 		}
 	}
 
+	for _, table := range tagCascades {
+		for _, row := range found[table] {
+			columns := make([]string, 0, len(row))
+			for column := range row {
+				columns = append(columns, column)
+			}
+			sort.Strings(columns)
+
+			values := make([]interface{}, len(columns))
+			for i, column := range columns {
+				values[i] = sqlValue(row[column])
+			}
+			_, err = tx.Exec("INSERT OR IGNORE INTO "+table+" ("+
+				strings.Join(columns, ", ")+") VALUES (?"+
+				strings.Repeat(",?", len(columns)-1)+")", values...)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	forgetTag(name)
 	return tx.Commit()
 }
 
-func editPlaylist(playlist string, tags []string) error {
-	tx, err := sqlDb.Begin()
+// A value from selectRows(), back from JSON read with UseNumber, for the database.
+func sqlValue(value interface{}) interface{} {
+	if number, ok := value.(json.Number); ok {
+		if n, err := number.Int64(); err == nil {
+			return n
+		}
+		n, _ := number.Float64()
+		return n
+	}
+	return value
+}
+
+// Imports, see import.go
+
+/*
+ * Put an import's tags and playlists in, in one transaction, so one that
+ * fails partway changes nothing. With replaceTags, the unlocked tags not
+ * among them are deleted; the rest are replaced in place, keeping their
+ * playlists, stats and credits. With replacePlaylists, the unlocked
+ * playlists not among them are deleted too. Locked tags and playlists
+ * are left as they are.
+ */
+func importRows(tags []Tag, playlists []ExportedPlaylist, replaceTags bool,
+	replacePlaylists bool) error {
+
+	lockedTags, lockedPlaylists, err := allLocks()
+	if err != nil {
+		return err
+	}
+	existingTags, err := allTagNames()
+	if err != nil {
+		return err
+	}
+	existingPlaylists, err := allPlaylists()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM playlist WHERE name=?", playlist)
+	importedTags := map[string]bool{}
+	for _, tag := range tags {
+		importedTags[normTag(tag.Name)] = true
+	}
+	importedPlaylists := map[string]bool{}
+	for _, playlist := range playlists {
+		importedPlaylists[playlist.Name] = true
+	}
+
+	tx, err := sqlDb.Begin()
 	if err != nil {
-		rollbackOrDie(tx, "editPlaylist")
 		return err
 	}
+	defer forgetTags()
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+	}
 
+	for _, name := range existingTags {
+		if replaceTags && !importedTags[name] && !contains(lockedTags, name) {
+			exec("DELETE FROM tag WHERE name=?", name)
+		}
+	}
 	for _, tag := range tags {
-		_, err = tx.Exec("INSERT INTO playlist (name, tag) VALUES (?, ?)",
-			playlist, tag)
+		name := normTag(tag.Name)
+		if !contains(lockedTags, name) {
+			exec(restoreTagQuery, name, tag.AuthorID, tag.Url, tag.Description,
+				tag.CreatedAt, tag.UpdatedAt)
+		}
+	}
 
+	// As clearPlaylist() and emptyPlaylist() do.
+	for _, playlist := range existingPlaylists {
+		if replacePlaylists && !importedPlaylists[playlist] &&
+			!contains(lockedPlaylists, playlist) {
+			exec("DELETE FROM playlist WHERE name=?", playlist)
+			exec("DELETE FROM playlist_include WHERE name=? OR child=?", playlist, playlist)
+			exec("DELETE FROM smart_playlist WHERE name=?", playlist)
+			exec("DELETE FROM playlist_owner WHERE playlist=?", playlist)
+		}
+	}
+	// As restorePlaylist() does.
+	for _, playlist := range playlists {
+		if contains(lockedPlaylists, playlist.Name) {
+			continue
+		}
+		exec("DELETE FROM playlist WHERE name=?", playlist.Name)
+		exec("DELETE FROM playlist_include WHERE name=?", playlist.Name)
+		exec("DELETE FROM smart_playlist WHERE name=?", playlist.Name)
+		for _, tag := range normTags(playlist.Tags) {
+			exec("INSERT INTO playlist (name, tag) VALUES (?, ?)", playlist.Name, tag)
+		}
+		for _, child := range playlist.Nested {
+			exec("INSERT OR IGNORE INTO playlist_include (name, child) VALUES (?,?)",
+				playlist.Name, child)
+		}
+		if playlist.Smart != nil {
+			exec("INSERT INTO smart_playlist (name, pattern, author) VALUES (?,?,?)",
+				playlist.Name, playlist.Smart.Pattern, playlist.Smart.AuthorID)
+		}
+		if playlist.Crew == "" {
+			exec("DELETE FROM playlist_owner WHERE playlist=?", playlist.Name)
+		} else {
+			exec("INSERT OR REPLACE INTO playlist_owner (playlist, role) VALUES (?,?)",
+				playlist.Name, playlist.Crew)
+		}
 		if err != nil {
-			rollbackOrDie(tx, "editPlaylist")
-			return err
+			err = fmt.Errorf("the playlist **%s**: %w", playlist.Name, err)
 		}
 	}
 
-	return tx.Commit()
-}
-
-func reducePlaylist(playlist string, tags []string) error {
-	tx, err := sqlDb.Begin()
 	if err != nil {
+		rollbackOrDie(tx, "importRows")
 		return err
 	}
+	return tx.Commit()
+}
 
-	for _, tag := range tags {
-		_, err := tx.Exec("DELETE FROM playlist WHERE name=? AND tag=?",
-			playlist, tag)
+// The playlists with any of the tags as their own, in no order.
+func playlistsWithTags(tags []string) (playlists []string, err error) {
+	seen := map[string]bool{}
+	for _, tag := range normTags(tags) {
+		rows, err := sqlDb.Query("SELECT DISTINCT name FROM playlist WHERE tag=?", tag)
 		if err != nil {
-			rollbackOrDie(tx, "reducePlaylist")
-			return err
+			return nil, err
+		}
+
+		for rows.Next() {
+			var playlist string
+			if err = rows.Scan(&playlist); err != nil {
+				break
+			}
+
+			if !seen[playlist] {
+				seen[playlist] = true
+				playlists = append(playlists, playlist)
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
 		}
 	}
+	return playlists, nil
+}
 
-	return nil
+// Data-access requests, see cmdUserData()
+
+/*
+ * Every row that names a user, by what it is, and the condition that
+ * finds a user's (with the user's ID as its one parameter). A table
+ * that gains a user's ID belongs here too, so `userdata` keeps telling
+ * the whole story. Tags are left out, since UserData has them already.
+ */
+var userRowQueries = []struct {
+	Name  string
+	Table string
+	Where string
+}{
+	{"one-shots", "oneshot", "authorID=?"},
+	{"curations", "curation", "authorID=?"},
+	{"smart playlists", "smart_playlist", "author=?"},
+	{"art credits", "art_credit", "instr(artist, ?) > 0"},
+	{"suggestions", "suggestion", "authorID=?"},
+	{"polls", "poll", "authorID=?"},
+	{"votes", "poll_vote", "userID=?"},
+	{"nominations", "nomination", "userID=?"},
+	{"election wins", "election_winner", "authorID=?"},
+	{"bar", "blacklist", "userID=?"},
+	{"bars made", "blacklist", "byID=?"},
+	{"audit log", "audit_log", "userID=?"},
+	{"undo journal", "undo_journal", "userID=?"},
 }
 
-func allPlaylists() (playlists []string, err error) {
-	var rows *sql.Rows
+// A user's rows in every table that names them (see userRowQueries), by name.
+func userRows(userID string) (map[string][]map[string]interface{}, error) {
+	found := map[string][]map[string]interface{}{}
+	for _, query := range userRowQueries {
+		rows, err := selectRows(
+			"SELECT * FROM "+query.Table+" WHERE "+query.Where, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 {
+			found[query.Name] = rows
+		}
+	}
+	return found, nil
+}
 
-	rows, err = sqlDb.Query("SELECT DISTINCT name FROM playlist")
+// Every row a query finds, each by column.
+func selectRows(query string, args ...interface{}) (found []map[string]interface{}, err error) {
+	rows, err := sqlDb.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	for rows.Next() {
-		var playlist string
-		err = rows.Scan(&playlist)
-		if err != nil {
+	columns, err := rows.Columns()
+	for err == nil && rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
 			break
 		}
 
-		playlists = append(playlists, playlist)
+		row := map[string]interface{}{}
+		for i, column := range columns {
+			// Text comes back as bytes, which JSON would write as base64.
+			if bytes, ok := values[i].([]byte); ok {
+				values[i] = string(bytes)
+			}
+			row[column] = values[i]
+		}
+		found = append(found, row)
+	}
+	if err == nil {
+		err = rows.Err()
 	}
 
-	return playlists, err
+	return found, err
 }
 
-func playlistTags(playlist string) (tags []string, err error) {
-	var rows *sql.Rows
+// Introspection, for `admin db`
 
-	rows, err = sqlDb.Query(
-		"SELECT tag FROM playlist WHERE name=? ORDER BY timestamp", playlist)
+/*
+ * What `admin db` asks of the database. Only SQLite's answers exist,
+ * from sqlite_master and its page counts, since SQLite is the only
+ * database I run on (see HACKING.md); admin.go goes through dbInspector
+ * so the SQLite-specific bits stay here with the rest of the SQL.
+ */
+type DbInspector interface {
+	Tables() ([]string, error)
+	// Rows in a table; ok is false if there's no such table.
+	Count(table string) (count int, ok bool, err error)
+	// Compact the database, giving back the room deleted rows took.
+	Vacuum() error
+	// The database's size in bytes.
+	Size() (int64, error)
+}
+
+type sqliteInspector struct{}
+
+var dbInspector DbInspector = sqliteInspector{}
+
+func (sqliteInspector) Tables() (tables []string, err error) {
+	rows, err := sqlDb.Query(
+		"SELECT name FROM sqlite_master WHERE type='table' " +
+			"AND name NOT LIKE 'sqlite_%' ORDER BY name")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var tag string
-		err = rows.Scan(&tag)
-		if err != nil {
+		var table string
+		if err = rows.Scan(&table); err != nil {
 			break
 		}
 
-		tags = append(tags, tag)
+		tables = append(tables, table)
+	}
+	if err == nil {
+		err = rows.Err()
 	}
 
-	return tags, err
+	return tables, err
 }
 
-func playlistExists(name string) (bool, error) {
-	var count int
-	err := sqlDb.
-		QueryRow("SELECT COUNT(*) FROM playlist WHERE name=?",
-			name).
-		Scan(&count)
-	return count > 0, err
+/*
+ * Count the rows in a table. The name can't be a query parameter, so
+ * it's checked against the tables that exist instead.
+ */
+func (inspector sqliteInspector) Count(table string) (count int, ok bool, err error) {
+	tables, err := inspector.Tables()
+	if err != nil || !contains(tables, table) {
+		return 0, false, err
+	}
+
+	err = sqlDb.QueryRow(`SELECT COUNT(*) FROM "` + table + `"`).Scan(&count)
+	return count, err == nil, err
+}
+
+func (sqliteInspector) Vacuum() error {
+	// VACUUM rewrites the whole file, which can take longer than dbTimeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	_, err := sqlDb.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// The size of the database in bytes, as SQLite counts it.
+func (sqliteInspector) Size() (size int64, err error) {
+	var pages, pageSize int64
+	err = sqlDb.QueryRow("PRAGMA page_count").Scan(&pages)
+	if err == nil {
+		err = sqlDb.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	}
+	return pages * pageSize, err
 }
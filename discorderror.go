@@ -0,0 +1,195 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * discorderror.go - Making sense of Discord's errors. A raw discordgo
+ * error is a status line and a blob of JSON, which tells an admin
+ * nothing about what to fix. explainDiscordError() recognizes the
+ * common ways setting a banner goes wrong and wraps the error with
+ * advice. If you run into a new one, add it to the switch.
+ *
+ * Some of them can be seen coming: preflightBanner() checks the bard's
+ * permissions and the guild's boost level before a banner is uploaded,
+ * and gives the same advice without the round trip.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var discorderrorLog = moduleLogger("discorderror")
+
+const (
+	guidanceManageServer = "Sire, I lack the permission to change the banner. " +
+		"Give my role **Manage Server** in the server settings, and ask again."
+	guidanceBoosts = "Sire, this server needs more boosts before it may have " +
+		"a banner. Banners need boost level 2."
+)
+
+// An error along with what the admin should do about it.
+type GuidedError struct {
+	Guidance string
+	Err      error
+}
+
+func (e *GuidedError) Error() string {
+	return e.Guidance + "\n(" + e.Err.Error() + ")"
+}
+
+func (e *GuidedError) Unwrap() error {
+	return e.Err
+}
+
+/*
+ * Wrap an error from the Discord API with advice on fixing it. Errors
+ * we don't recognize are returned as-is.
+ */
+func explainDiscordError(err error) error {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Response == nil {
+		return err
+	}
+
+	code := 0
+	if restErr.Message != nil {
+		code = restErr.Message.Code
+	}
+	body := strings.ToLower(string(restErr.ResponseBody))
+
+	var guidance string
+	switch {
+	case code == discordgo.ErrCodeMissingPermissions ||
+		code == discordgo.ErrCodeMissingAccess ||
+		restErr.Response.StatusCode == http.StatusForbidden:
+		guidance = guidanceManageServer
+
+	case code == discordgo.ErrCodeThisServerNeedsMoreBoostsToPerformThisAction ||
+		strings.Contains(body, "premium") || strings.Contains(body, "boost"):
+		guidance = guidanceBoosts
+
+	case code == discordgo.ErrCodeRequestEntityTooLarge ||
+		code == discordgo.ErrCodeFileUploadedExceedsTheMaximumSize ||
+		restErr.Response.StatusCode == http.StatusRequestEntityTooLarge:
+		guidance = "Sire, that image is too heavy for Discord to carry. " +
+			"Point the tag at a smaller version of it."
+
+	case restErr.Response.StatusCode == http.StatusTooManyRequests:
+		guidance = "Sire, Discord bids me slow down. " + retryAfter(restErr.ResponseBody)
+
+	case code == discordgo.ErrCodeInvalidFileUploaded ||
+		code == discordgo.ErrCodeInvalidFormBody:
+		guidance = "Sire, Discord won't take that image. Make sure the tag's " +
+			"URL still points at a png or jpg, and not a webpage."
+
+	case restErr.Response.StatusCode >= 500:
+		guidance = "Sire, Discord itself is ailing. " +
+			"Mayhaps try again once it's recovered."
+
+	default:
+		return err
+	}
+
+	return &GuidedError{Guidance: guidance, Err: err}
+}
+
+// How long a 429's body asks us to wait, or 0 if it doesn't say.
+func retryAfterDuration(body []byte) time.Duration {
+	var limit struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+
+	if json.Unmarshal(body, &limit) != nil || limit.RetryAfter <= 0 {
+		return 0
+	}
+	return time.Duration(limit.RetryAfter * float64(time.Second))
+}
+
+// Say when to try again, from a 429's body.
+func retryAfter(body []byte) string {
+	wait := retryAfterDuration(body)
+	if wait == 0 {
+		return "Try again in a little while."
+	}
+	return fmt.Sprintf("Try again in %s.", wait.Round(time.Second))
+}
+
+// The guild, from the cache if it's there, or else from Discord.
+func cachedGuild(s *discordgo.Session) (*discordgo.Guild, error) {
+	guild, err := s.State.Guild(Settings.GuildID)
+	if err != nil {
+		// Not cached; ask Discord.
+		guild, err = s.Guild(Settings.GuildID)
+	}
+	return guild, err
+}
+
+// The bard's own permissions across the guild, from its roles.
+func botGuildPermissions(s *discordgo.Session, guild *discordgo.Guild) (int64, error) {
+	botID := s.State.User.ID
+	if guild.OwnerID == botID {
+		return discordgo.PermissionAll, nil
+	}
+
+	member, err := s.State.Member(guild.ID, botID)
+	if err != nil {
+		member, err = s.GuildMember(guild.ID, botID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// @everyone's role shares the guild's ID.
+	var perms int64
+	for _, role := range guild.Roles {
+		if role.ID == guild.ID || contains(member.Roles, role.ID) {
+			perms |= role.Permissions
+		}
+	}
+
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return discordgo.PermissionAll, nil
+	}
+	return perms, nil
+}
+
+/*
+ * Check that Discord would take a banner from the bard at all, before
+ * uploading one. Problems come back as a GuidedError. A failure to look
+ * anything up is only logged, and left for the upload to find out.
+ */
+func preflightBanner(s *discordgo.Session) error {
+	guild, err := cachedGuild(s)
+	if err != nil {
+		discorderrorLog.Warn("Couldn't look up the guild before setting the banner", "err", err)
+		return nil
+	}
+
+	perms, err := botGuildPermissions(s, guild)
+	if err != nil {
+		discorderrorLog.Warn("Couldn't look up my permissions before setting the banner",
+			"err", err)
+	} else if perms&discordgo.PermissionManageServer == 0 {
+		return &GuidedError{Guidance: guidanceManageServer,
+			Err: errors.New("missing Manage Server")}
+	}
+
+	// Some guilds (partnered and verified ones) have banners whatever
+	// their boosts.
+	if guild.PremiumTier < discordgo.PremiumTier2 && !contains(guild.Features, "BANNER") {
+		return &GuidedError{Guidance: guidanceBoosts,
+			Err: fmt.Errorf("boost level %d", guild.PremiumTier)}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * drain.go - Drain mode, for deploying without surprises. `drain`
+ * lets the banner being set finish, saves the schedules so the next run
+ * can resume them, and then has main() exit. In the meantime, anything
+ * that would change something is politely turned away, commands,
+ * buttons and API requests alike, and the API stops serving once the
+ * requests under way are done. A SIGINT or SIGTERM drains the same way
+ * before exiting, and either way the log channel hears that the bard
+ * is going down.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var drainLog = moduleLogger("drain")
+
+type DrainState struct {
+	mutex  sync.Mutex
+	active bool
+	since  time.Time
+	eta    time.Duration // 0 if the owner didn't say
+}
+
+var Drain DrainState
+
+// Closed once draining is over, which lets main() return.
+var drained = make(chan struct{})
+
+// Begin draining. Returns false if we were already draining.
+func (drain *DrainState) Begin(eta time.Duration) bool {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
+
+	if drain.active {
+		return false
+	}
+
+	drain.active = true
+	drain.since = time.Now()
+	drain.eta = eta
+	return true
+}
+
+func (drain *DrainState) Active() bool {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
+	return drain.active
+}
+
+// A human-readable guess at when we'll be back.
+func (drain *DrainState) Eta() string {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
+
+	if drain.eta == 0 {
+		return "shortly"
+	}
+
+	left := time.Until(drain.since.Add(drain.eta)).Round(time.Minute)
+	if left < time.Minute {
+		return "any moment now"
+	}
+	return "in about " + left.String()
+}
+
+/*
+ * Turn away commands that would change something while draining, and
+ * tell the user when to try again. Return whether the command was
+ * refused.
+ */
+func refuseWhileDraining(ctx *CommandContext, cmd Command) bool {
+	if cmd.Perms()&FlagReadOnly == FlagReadOnly {
+		return false
+	}
+
+	return refuseChanges(ctx)
+}
+
+// Like refuseWhileDraining(), for changes that don't come from a command.
+func refuseChanges(ctx *CommandContext) bool {
+	if !Drain.Active() {
+		return false
+	}
+
+	ctx.Reply(drainNotice())
+	return true
+}
+
+// What to tell anyone who'd change something while draining.
+func drainNotice() string {
+	return fmt.Sprintf("Sire, I'm packing up for a journey and can't "+
+		"change anything right now. I should be back %s.", Drain.Eta())
+}
+
+/*
+ * Stop serving the API, stop the schedules and save them so the next
+ * run can resume them, then wait for any banner being set to finish.
+ * Stopping the schedulers waits for them to finish the banners they're
+ * on, and holding the banner lock, which is never let go, waits for
+ * everyone else.
+ */
+func packUp() error {
+	stopAPI()
+	active := Lanes.StopAll()
+	err := Lanes.Save(active)
+	Lanes.Shutdown()
+	bannerMutex.Lock()
+	return err
+}
+
+/*
+ * Shut down on a signal as `drain` would, unless it's already under
+ * way, in which case wait for it.
+ */
+func drainOnSignal(s *discordgo.Session) {
+	if !Drain.Begin(0) {
+		<-drained
+		return
+	}
+
+	drainLog.Info("Draining on a signal")
+	if handleErrors(s, "", SqlError, "shutdown", packUp()) {
+		drainLog.Info("Couldn't save the schedule, exiting anyways")
+	}
+	drainLog.Info("Drained")
+}
+
+// Tell the log channel the bard's going away, if there is one.
+func announceShutdown(s *discordgo.Session) {
+	if Settings.LogChannelID == "" {
+		return
+	}
+
+	_, err := s.ChannelMessageSend(Settings.LogChannelID,
+		"Sire, I'm going down for maintenance. I'll pick up where I left off once I'm back.")
+	if err != nil {
+		drainLog.Error("Couldn't say I'm going down", "err", err)
+	}
+}
+
+func cmdDrain(ctx *CommandContext, args []string) {
+	if len(args) > 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	var eta time.Duration
+	if len(args) == 1 {
+		var err error
+		eta, err = parseTime(args[0])
+		if err != nil {
+			ctx.Reply("Sire, I can't understand the time format **" +
+				args[0] + "**.")
+			return
+		}
+	}
+
+	if !Drain.Begin(eta) {
+		ctx.Reply("Sire, I'm already packing up.")
+		return
+	}
+
+	drainLog.Info("Draining")
+	ctx.Reply("Packing up, sire. I'll finish what I'm doing first.")
+
+	if handleCommandErrors(ctx, SqlError, packUp()) {
+		drainLog.Info("Couldn't save the schedule, exiting anyways")
+	}
+
+	drainLog.Info("Drained")
+	ctx.Reply("All packed up, sire. Farewell for now.")
+	close(drained)
+}
@@ -0,0 +1,178 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * dupe.go - Spotting the same picture under two tags. Each tag's image
+ * gets a perceptual hash (a difference hash: shrink to 9x8 in gray, and
+ * note whether each pixel is brighter than its right-hand neighbor), so
+ * a resized, recompressed, or lightly touched-up copy hashes the same,
+ * or nearly. `new` warns when a new tag looks like an old one, and
+ * `dupes` lists every pair that does.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// How many of the 64 bits two images may differ by and still be called alike.
+const dupeDistance = 6
+
+// Work out an image's difference hash.
+func imageHash(data []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash, nil
+}
+
+func hashDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// The tags other than name whose hash is close to the one given, by name.
+func lookalikes(name string, hash uint64, hashes map[string]uint64) []string {
+	name = normTag(name)
+	alike := []string{}
+	for other, otherHash := range hashes {
+		if other != name && hashDistance(hash, otherHash) <= dupeDistance {
+			alike = append(alike, other)
+		}
+	}
+
+	sort.Strings(alike)
+	return alike
+}
+
+/*
+ * Hash a new tag's image and save the hash, returning the tags that
+ * look like it.
+ */
+func hashNewTag(name string, data []byte) ([]string, error) {
+	hash, err := imageHash(data)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := tagHashes()
+	if err == nil {
+		err = setTagHash(name, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return lookalikes(name, hash, hashes), nil
+}
+
+/*
+ * Fill in the hashes of tags that don't have one yet, such as those
+ * made before hashing or brought in by `import`. Tags whose image
+ * can't be had are left out, and counted.
+ */
+func backfillTagHashes(hashes map[string]uint64) (int, error) {
+	tags, err := allTags()
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, tag := range tags {
+		if _, ok := hashes[tag.Name]; ok {
+			continue
+		}
+
+		data, err := fetchImage(tag.Url)
+		if err != nil {
+			failed++
+			continue
+		}
+
+		hash, err := imageHash(data)
+		if err != nil {
+			failed++
+			continue
+		}
+
+		if err = setTagHash(tag.Name, hash); err != nil {
+			return failed, err
+		}
+		hashes[tag.Name] = hash
+	}
+
+	return failed, nil
+}
+
+func cmdDupes(ctx *CommandContext, args []string) {
+	if len(args) != 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	hashes, err := tagHashes()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	ctx.Session.ChannelTyping(ctx.Event.ChannelID)
+	failed, err := backfillTagHashes(hashes)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for i, name := range names {
+		for _, other := range names[i+1:] {
+			distance := hashDistance(hashes[name], hashes[other])
+			switch {
+			case distance == 0:
+				lines = append(lines, fmt.Sprintf("**%s** and **%s**, alike", name, other))
+			case distance <= dupeDistance:
+				lines = append(lines, fmt.Sprintf("**%s** and **%s**, nearly alike",
+					name, other))
+			}
+		}
+	}
+
+	note := ""
+	if failed > 0 {
+		note = fmt.Sprintf(" (I couldn't see %d of them, so they're left out)", failed)
+	}
+
+	if len(lines) == 0 {
+		ctx.Reply("Sire, I see no two tags with the same picture" + note + ".")
+		return
+	}
+
+	ctx.ReplyList("These tags look like one another, sire"+note+":", lines, RenderPlain)
+}
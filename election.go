@@ -0,0 +1,301 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * election.go - The banner of the week. With ElectionChannelID set, the
+ * bard holds an election every week: members `election nominate TAG`
+ * (one tag each a week, up to MaxPollTags), and ElectionVoteHours before
+ * ElectionCloses (a weekday and time in the guild's timezone, like
+ * "sun 18:00") the nominations go up for a vote, as `vote` would put
+ * them. When voting closes, the winner is the banner until the next
+ * election, and goes on the leaderboard `election winners` shows.
+ *
+ * Nominations made while voting is on go to the next week's ballot.
+ * Whether this week's vote has opened is kept under electionOpenKey, as
+ * the time it closes, so a restart doesn't open it twice.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var electionLog = moduleLogger("election")
+
+// The close time of the election whose voting has opened, as RFC 3339.
+const electionOpenKey = "election:open"
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Read ElectionCloses: a weekday, by at least its first three letters, and a "15:04" time.
+func parseElectionCloses(value string) (day time.Weekday, minute int, err error) {
+	fields := strings.Fields(strings.ToLower(value))
+	if len(fields) != 2 || len(fields[0]) < 3 {
+		return 0, 0, fmt.Errorf("%q isn't a weekday and time, like \"sun 18:00\"", value)
+	}
+
+	day, ok := weekdayNames[fields[0][:3]]
+	if !ok || !strings.HasPrefix(strings.ToLower(day.String()), fields[0]) {
+		return 0, 0, fmt.Errorf("%q isn't a weekday", fields[0])
+	}
+	if minute, err = minuteOfDay(fields[1]); err != nil {
+		return 0, 0, fmt.Errorf("%q isn't a time, like 18:00", fields[1])
+	}
+	return day, minute, nil
+}
+
+func checkElectionCloses(value string) error {
+	_, _, err := parseElectionCloses(value)
+	return err
+}
+
+func checkElectionVoteHours(value string) error {
+	if err := checkPositive(value); err != nil {
+		return err
+	}
+	if hours, _ := strconv.Atoi(value); hours >= 7*24 {
+		return fmt.Errorf("%q is a week or more; voting must open after the last election", value)
+	}
+	return nil
+}
+
+// When the next election after now closes.
+func nextElectionClose(now time.Time) (time.Time, error) {
+	day, minute, err := parseElectionCloses(Settings.ElectionCloses)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now = now.In(guildLocation())
+	closes := time.Date(now.Year(), now.Month(), now.Day(), minute/60, minute%60, 0, 0,
+		now.Location())
+	closes = closes.AddDate(0, 0, (int(day)-int(now.Weekday())+7)%7)
+	if !closes.After(now) {
+		closes = closes.AddDate(0, 0, 7)
+	}
+	return closes, nil
+}
+
+// When voting opens for the election that closes at closes.
+func electionVoteOpens(closes time.Time) time.Time {
+	return closes.Add(-time.Duration(Settings.ElectionVoteHours) * time.Hour)
+}
+
+/*
+ * Open this week's vote, if it's time and it isn't open already. Called
+ * every pollCheckEvery, from StartPolls().
+ */
+func checkElection(s *discordgo.Session) error {
+	if Settings.ElectionChannelID == "" {
+		return nil
+	}
+
+	now := time.Now()
+	closes, err := nextElectionClose(now)
+	if err != nil || now.Before(electionVoteOpens(closes)) {
+		return err
+	}
+
+	opened, err := getSetting(electionOpenKey)
+	if err != nil || opened == closes.UTC().Format(time.RFC3339) {
+		return err
+	}
+
+	tags, _, err := allNominations()
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		electionLog.Info("No nominations for the election", "closes", closes)
+		_, err = s.ChannelMessageSend(Settings.ElectionChannelID, "Sire, nobody "+
+			"nominated a tag this week, so there's no election. Nominate one for "+
+			"next week with `"+Settings.Prefix+"election nominate TAG`.")
+		if err != nil {
+			electionLog.Warn("Couldn't say there's no election", "err", err)
+		}
+	} else {
+		if len(tags) > MaxPollTags {
+			tags = tags[:MaxPollTags]
+		}
+		_, err = openPoll(s, Poll{Kind: "election", ChannelID: Settings.ElectionChannelID,
+			AuthorID: s.State.User.ID, ClosesAt: closes, Tags: tags})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = clearNominations(); err != nil {
+		return err
+	}
+	return putSetting(electionOpenKey, closes.UTC().Format(time.RFC3339))
+}
+
+// Put an election's winner on the leaderboard, crediting whoever made the tag.
+func recordElectionWinner(poll Poll, winner string, votes int) error {
+	tag, err := namedTag(winner)
+	if err != nil {
+		return err
+	}
+
+	electionLog.Info("Elected the banner of the week", "tag", winner, "votes", votes)
+	return insertElectionWinner(ElectionWinner{ClosedAt: poll.ClosesAt, Tag: tag.Name,
+		AuthorID: tag.AuthorID, Votes: votes})
+}
+
+// Say so, if elections are off.
+func refuseElectionsOff(ctx *CommandContext) bool {
+	if Settings.ElectionChannelID == "" {
+		ctx.Reply("Sire, there are no elections here; ask the staff to set " +
+			"`ElectionChannelID`.")
+		return true
+	}
+	return false
+}
+
+func cmdElectionNominate(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+	if refuseElectionsOff(ctx) {
+		return
+	}
+
+	exists, err := tagExists(args[0])
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + args[0] + "`.")
+		return
+	}
+
+	tags, users, err := allNominations()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	for i, user := range users {
+		if user == ctx.Event.Author.ID {
+			ctx.Reply(fmt.Sprintf("Sire, you've nominated **%s** this week already.",
+				tags[i]))
+			return
+		}
+	}
+	if len(tags) >= MaxPollTags {
+		ctx.Reply(fmt.Sprintf("Sire, the ballot's full; %d tags are nominated already.",
+			MaxPollTags))
+		return
+	}
+
+	added, err := insertNomination(args[0], ctx.Event.Author.ID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !added {
+		ctx.Reply("Sire, **" + normTag(args[0]) + "** is nominated already.")
+		return
+	}
+	electionLog.Info("Nominated a tag", "tag", normTag(args[0]), "user", ctx.Event.Author.ID)
+
+	closes, err := nextElectionClose(time.Now())
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+	// Voting's on, so this is for next week's ballot.
+	if !time.Now().Before(electionVoteOpens(closes)) {
+		closes = closes.AddDate(0, 0, 7)
+	}
+	ctx.Reply(fmt.Sprintf("Sire, **%s** is on the ballot. Voting opens <t:%d:R>.",
+		normTag(args[0]), electionVoteOpens(closes).Unix()))
+}
+
+func cmdElectionLs(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+	if refuseElectionsOff(ctx) {
+		return
+	}
+
+	closes, err := nextElectionClose(time.Now())
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+	tags, users, err := allNominations()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	opens := electionVoteOpens(closes)
+	if time.Now().Before(opens) {
+		buf.WriteString(fmt.Sprintf("Sire, voting opens <t:%d:F> and closes <t:%d:F>.",
+			opens.Unix(), closes.Unix()))
+	} else {
+		buf.WriteString(fmt.Sprintf("Sire, voting's on until <t:%d:F>; see `%svotes`. "+
+			"These are nominated for the week after:", closes.Unix(), Settings.Prefix))
+	}
+
+	if len(tags) == 0 {
+		buf.WriteString("\nNothing's nominated yet.")
+	}
+	for i, tag := range tags {
+		buf.WriteString(fmt.Sprintf("\n**%s**, nominated by <@%s>", tag, users[i]))
+	}
+
+	ctx.ReplyLong(buf.String())
+}
+
+func cmdElectionWinners(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	winners, err := allElectionWinners()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	if len(winners) == 0 {
+		ctx.Reply("Sire, no tag has won an election yet.")
+		return
+	}
+
+	wins := map[string]int{}
+	authors := []string{}
+	buf := bytes.Buffer{}
+	buf.WriteString("The banners of the week, sire:\n")
+	for _, winner := range winners {
+		buf.WriteString(fmt.Sprintf("\n%s **%s** by <@%s>, with %d votes",
+			winner.ClosedAt.In(guildLocation()).Format(DateFormat), winner.Tag,
+			winner.AuthorID, winner.Votes))
+		if wins[winner.AuthorID] == 0 {
+			authors = append(authors, winner.AuthorID)
+		}
+		wins[winner.AuthorID]++
+	}
+
+	sort.SliceStable(authors, func(a, b int) bool {
+		return wins[authors[a]] > wins[authors[b]]
+	})
+	buf.WriteString("\n\nMost wins:\n")
+	for i, author := range authors {
+		buf.WriteString(fmt.Sprintf("\n%d. <@%s>: %d", i+1, author, wins[author]))
+	}
+
+	ctx.ReplyLong(buf.String())
+}
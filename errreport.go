@@ -0,0 +1,279 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * errreport.go - Sending errors somewhere someone will read them. The
+ * log and the log channel scroll away, so if SentryDSN or ErrorWebhook
+ * is set, SQL errors, Discord API failures, and panics are also sent
+ * there, with what was going on at the time (command, user, channel,
+ * tag). SentryDSN takes the DSN from a Sentry project's settings;
+ * ErrorWebhook takes any URL, which is sent each report as JSON:
+ *
+ *   {"kind": "sql", "message": "...", "command": "bb, new",
+ *    "user": "1234", "channel": "5678", "guild": "9012",
+ *    "version": "v1.2.0", "time": "2022-03-01T12:00:00Z"}
+ *
+ * Reports are sent in the background, and one that can't be sent is
+ * only logged; reporting never gets in the way of the bard.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+var errreportLog = moduleLogger("errreport")
+
+const reportTimeout = 10 * time.Second
+
+// What went wrong, and where.
+type ErrorReport struct {
+	Kind    string `json:"kind"` // sql, discord, general, or panic
+	Message string `json:"message"`
+	Command string `json:"command,omitempty"`
+	User    string `json:"user,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+	Stack   string `json:"stack,omitempty"`
+	Guild   string `json:"guild"`
+	Version string `json:"version"`
+	Time    string `json:"time"`
+}
+
+// The kind of report for the flavor text an error was handled with.
+func errorKind(flavor string) string {
+	switch flavor {
+	case SqlError:
+		return "sql"
+	case DiscordError:
+		return "discord"
+	}
+	return "general"
+}
+
+/*
+ * Where a Sentry DSN (https://KEY@HOST/PROJECT) says to send events,
+ * and the key to send them with.
+ */
+func sentryEndpoint(dsn string) (endpoint string, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+
+	project := path.Base(u.Path)
+	if u.User == nil || u.User.Username() == "" || project == "." || project == "/" {
+		return "", "", fmt.Errorf("%q isn't a Sentry DSN", dsn)
+	}
+
+	prefix := strings.TrimSuffix(path.Dir(u.Path), "/")
+	endpoint = u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/store/"
+	return endpoint, u.User.Username(), nil
+}
+
+func checkSentryDSN(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, _, err := sentryEndpoint(value)
+	return err
+}
+
+func checkErrorWebhook(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("%q isn't an http(s) URL", value)
+	}
+	return err
+}
+
+// Whether there's anywhere to send reports.
+func reportingOn() bool {
+	return Settings.SentryDSN != "" || Settings.ErrorWebhook != ""
+}
+
+// Post a JSON body, with any extra headers, expecting a 2xx answer.
+func postReport(to string, body interface{}, headers map[string]string) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, to, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	client := http.Client{Timeout: reportTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Send a report to Sentry, as an event through the store endpoint.
+func sendSentry(report ErrorReport) error {
+	endpoint, key, err := sentryEndpoint(Settings.SentryDSN)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	level := "error"
+	if report.Kind == "panic" {
+		level = "fatal"
+	}
+
+	event := map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": report.Time,
+		"level":     level,
+		"platform":  "go",
+		"logger":    "banner-bard",
+		"release":   report.Version,
+		"message":   report.Message,
+		"tags": map[string]string{
+			"kind":    report.Kind,
+			"command": report.Command,
+			"guild":   report.Guild,
+		},
+		"extra": map[string]string{
+			"user":    report.User,
+			"channel": report.Channel,
+			"tag":     report.Tag,
+			"stack":   report.Stack,
+		},
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=banner-bard/%s, "+
+		"sentry_key=%s", Version, key)
+	return postReport(endpoint, event, map[string]string{"X-Sentry-Auth": auth})
+}
+
+// Send a report everywhere it's meant to go, waiting until it's sent.
+func sendReport(report ErrorReport) {
+	report.Guild = Settings.GuildID
+	report.Version = Version
+	report.Time = time.Now().UTC().Format(time.RFC3339)
+
+	if Settings.SentryDSN != "" {
+		if err := sendSentry(report); err != nil {
+			errreportLog.Warn("Couldn't report an error to Sentry", "err", err)
+		}
+	}
+	if Settings.ErrorWebhook != "" {
+		if err := postReport(Settings.ErrorWebhook, report, nil); err != nil {
+			errreportLog.Warn("Couldn't report an error to the webhook", "err", err)
+		}
+	}
+}
+
+// Report an error in the background, if reporting is on.
+func reportError(report ErrorReport) {
+	message := "A " + report.Kind + " error"
+	if report.Command != "" {
+		message += " in " + report.Command
+	}
+	notify("error", message+": "+report.Message)
+
+	if !reportingOn() {
+		return
+	}
+	go sendReport(report)
+}
+
+/*
+ * Report a panic in a command, and tell whoever ran it something went
+ * wrong, rather than let it take the bard down. Defer it at the top of
+ * whatever runs commands.
+ */
+func recoverCommand(ctx *CommandContext) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	stack := string(debug.Stack())
+	errreportLog.Error("Recovered from a panic", "command", ctx.CommandName,
+		"user", ctx.Event.Author.ID, "panic", recovered, "stack", stack)
+	reportError(ErrorReport{
+		Kind:    "panic",
+		Message: fmt.Sprint(recovered),
+		Command: ctx.CommandName,
+		User:    ctx.Event.Author.ID,
+		Channel: ctx.Event.ChannelID,
+		Stack:   stack,
+	})
+	ctx.Reply(PanicError)
+}
+
+/*
+ * Report a panic in a Discord event handler, and carry on, rather than
+ * let it take the bard and its gateway connection down. Defer it at
+ * the top of every handler.
+ */
+func recoverEvent(source string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	stack := string(debug.Stack())
+	errreportLog.Error("Recovered from a panic", "source", source, "panic", recovered,
+		"stack", stack)
+	reportError(ErrorReport{
+		Kind:    "panic",
+		Message: fmt.Sprint(recovered),
+		Command: source,
+		Stack:   stack,
+	})
+}
+
+/*
+ * Report a panic that's about to take the bard down, then go on
+ * panicking. Defer it at the top of long-lived goroutines.
+ */
+func reportPanic(source string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	if reportingOn() {
+		sendReport(ErrorReport{
+			Kind:    "panic",
+			Message: fmt.Sprint(recovered),
+			Command: source,
+			Stack:   string(debug.Stack()),
+		})
+	}
+	panic(recovered)
+}
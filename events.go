@@ -0,0 +1,222 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * events.go - Banners for Discord's scheduled events. An event rule
+ * puts a tag up while an event (one that hasn't ended) has at least so
+ * many RSVPs, and puts the old banner back once it doesn't. Rules are
+ * checked every EventCheckMinutes by the scheduler, which holds the
+ * rotation while a rule has its tag up. Removing a rule whose tag is up
+ * puts the old banner back too.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var eventsLog = moduleLogger("events")
+
+// Whether an event still counts as happening, i.e. it hasn't ended.
+func eventUpcoming(event *discordgo.GuildScheduledEvent) bool {
+	return event.Status == discordgo.GuildScheduledEventStatusScheduled ||
+		event.Status == discordgo.GuildScheduledEventStatusActive
+}
+
+/*
+ * Check every event rule against its event's RSVPs, putting up or
+ * taking down tags as needed. Only one rule's tag can be up at a time;
+ * the first to apply wins until it stops applying.
+ */
+func (scheduler *BannerScheduler) evaluateEventRules() {
+	rules, err := allEventRules()
+	if err != nil {
+		eventsLog.Error("Error while checking event rules", "err", err)
+		return
+	}
+
+	if len(rules) == 0 {
+		return
+	}
+
+	events, err := scheduler.session.GuildScheduledEvents(Settings.GuildID, true)
+	if err != nil {
+		eventsLog.Error("Error while fetching events", "err", err)
+		return
+	}
+
+	eventMap := map[string]*discordgo.GuildScheduledEvent{}
+	for _, event := range events {
+		eventMap[event.ID] = event
+	}
+
+	anyApplied := false
+	for _, rule := range rules {
+		event, ok := eventMap[rule.EventID]
+		applies := ok && eventUpcoming(event) && event.UserCount >= rule.Threshold
+
+		switch {
+		case applies && !rule.Applied && !anyApplied:
+			previous, err := currentBanner()
+			if err != nil {
+				eventsLog.Error("Error while applying event rule", "err", err)
+				continue
+			}
+
+			eventsLog.Info("Event rule applies; setting the banner", "rule", rule.ID,
+				"event", event.Name, "rsvps", event.UserCount, "tag", rule.Tag)
+			if err = scheduler.setter(scheduler.session, rule.Tag, "event"); err != nil {
+				eventsLog.Error("Error while setting the banner", "err", err)
+				continue
+			}
+
+			err = setEventRuleApplied(rule.ID, true, previous)
+			anyApplied = true
+		case !applies && rule.Applied:
+			eventsLog.Info("Event rule no longer applies", "rule", rule.ID)
+			if rule.Previous != "" {
+				err = scheduler.setter(scheduler.session, rule.Previous, "event")
+				if err != nil {
+					eventsLog.Error("Error while setting the banner", "err", err)
+				}
+			}
+
+			err = setEventRuleApplied(rule.ID, false, "")
+		case rule.Applied:
+			anyApplied = true
+		}
+
+		if err != nil {
+			eventsLog.Error("Error while updating event rule", "err", err)
+		}
+	}
+}
+
+func cmdEventAdd(ctx *CommandContext, args []string) {
+	if len(args) != 3 {
+		ctx.SendUsage()
+		return
+	}
+
+	rule := EventRule{EventID: args[0], Tag: args[1]}
+
+	var err error
+	rule.Threshold, err = strconv.Atoi(args[2])
+	if err != nil || rule.Threshold < 0 {
+		ctx.Reply("Sire, the RSVP count should be a number.")
+		return
+	}
+
+	event, err := ctx.Session.GuildScheduledEvent(Settings.GuildID, rule.EventID, false)
+	if err != nil {
+		ctx.Reply("Sire, I can't find that event. `event ls` shows the ones I can see.")
+		return
+	}
+
+	exists, err := tagExists(rule.Tag)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + rule.Tag + "`.")
+		return
+	}
+
+	rule.ID, err = insertEventRule(rule)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	eventsLog.Info("Added an event rule", "rule", rule.ID, "tag", rule.Tag,
+		"rsvps", rule.Threshold, "event", event.Name)
+	ctx.Reply(fmt.Sprintf("Once **%s** has %d RSVPs, I'll put up **%s**, sire.",
+		event.Name, rule.Threshold, rule.Tag))
+}
+
+func cmdEventRm(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		ctx.SendUsage()
+		return
+	}
+
+	rule, ok, err := delEventRule(id)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !ok {
+		ctx.Reply("Sire, I have no event rule by that number.")
+		return
+	}
+
+	// Its tag's up, so put back what it replaced, unless the banner's changed since.
+	if rule.Applied && rule.Previous != "" {
+		current, err := currentBanner()
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		if current == rule.Tag {
+			eventsLog.Info("Removed an applied event rule; putting back the banner",
+				"rule", rule.ID, "tag", rule.Previous)
+			err = setBanner(ctx.Session, rule.Previous, "event")
+			if handleCommandErrors(ctx, GeneralError, err) {
+				return
+			}
+		}
+	}
+
+	ctx.Ack()
+}
+
+func cmdEventLs(ctx *CommandContext, args []string) {
+	events, err := ctx.Session.GuildScheduledEvents(Settings.GuildID, true)
+	if handleCommandErrors(ctx, DiscordError, err) {
+		return
+	}
+
+	rules, err := allEventRules()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("The events I can see, sire:\n")
+	for _, event := range events {
+		if !eventUpcoming(event) {
+			continue
+		}
+
+		buf.WriteString(fmt.Sprintf("\n`%s` **%s**, %s, %d RSVPs",
+			event.ID, event.Name,
+			event.ScheduledStartTime.In(guildLocation()).Format(DateFormat),
+			event.UserCount))
+	}
+
+	if len(rules) > 0 {
+		buf.WriteString("\n\nAnd my rules for them:\n")
+	}
+	for _, rule := range rules {
+		buf.WriteString(fmt.Sprintf("\n`%d` **%s** once `%s` has %d RSVPs",
+			rule.ID, rule.Tag, rule.EventID, rule.Threshold))
+		if rule.Applied {
+			buf.WriteString(" (up now)")
+		}
+	}
+
+	ctx.ReplyLong(buf.String())
+}
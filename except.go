@@ -0,0 +1,77 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * except.go - Leaving tags out of a schedule. `shuffle 1h pl:winter
+ * --except halloween-*` goes through winter's tags but those matching
+ * the pattern, which takes * for any run of characters, ? for any one,
+ * and [abc] for any of those listed, as `del` does. Any schedule
+ * command takes any number of `--except PATTERN`s, anywhere after its
+ * name.
+ *
+ * The patterns are applied when the schedule is set, and kept with it,
+ * so tags added to it later (with `queue add`, or by its tag source)
+ * are held to them too.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"path"
+)
+
+// Whether a tag matches any of the patterns. They're checked by scheduleExcept().
+func excludedTag(patterns []string, tag string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, normTag(tag)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The tags that match none of the patterns.
+func exceptTags(tags []string, patterns []string) []string {
+	if len(patterns) == 0 {
+		return tags
+	}
+
+	kept := []string{}
+	for _, tag := range tags {
+		if !excludedTag(patterns, tag) {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+/*
+ * Take the `--except PATTERN`s out of a schedule command's arguments.
+ * Replies and returns false if a pattern is missing or won't do.
+ */
+func scheduleExcept(ctx *CommandContext, args []string) (patterns []string,
+	rest []string, ok bool) {
+
+	rest = []string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--except" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 == len(args) {
+			ctx.SendUsage()
+			return nil, nil, false
+		}
+
+		pattern := normTag(args[i+1])
+		if _, err := path.Match(pattern, ""); err != nil {
+			ctx.Reply("Sire, `" + args[i+1] + "` isn't a pattern I understand.")
+			return nil, nil, false
+		}
+		patterns = append(patterns, pattern)
+		i++
+	}
+	return patterns, rest, true
+}
@@ -0,0 +1,248 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * export.go - Exports, version 2. `export` uploads a JSON file with
+ * every tag (with its description and dates), every playlist (its own
+ * tags in order, the playlists nested in it, its smart filter and its
+ * crew), and the running schedule, which `import` reads back.
+ *
+ * `export full` makes a zip of the same, with every tag's image beside
+ * it, from the cache or downloaded afresh; importing it puts the images
+ * back in the cache, so the tags work even if every link has died.
+ *
+ * `import` still reads the CSVs older bards exported, and `export csv`
+ * still writes one, of the tags alone. readExport() tells them all
+ * apart, and brings a CSV up to the current version, as one with no
+ * playlists.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// The version export writes. A CSV is version 1.
+const ExportVersion = 2
+
+// How big an export `import` reads, and how big a zip of one.
+const (
+	importMaxSize        = 8 * 1024 * 1024
+	importArchiveMaxSize = 256 * 1024 * 1024
+)
+
+// Where a zip export keeps the export, and the images.
+const (
+	archiveManifest = "export.json"
+	archiveImages   = "images/"
+)
+
+// Everything `export` writes.
+type Export struct {
+	Version    int
+	ExportedAt time.Time
+	Tags       []Tag
+	Playlists  []ExportedPlaylist
+	Schedule   *SavedSchedule `json:",omitempty"`
+	// In a zip, where each tag's image is in it, by tag.
+	Images map[string]string `json:",omitempty"`
+
+	migrated bool              // from a CSV, which has no playlists to replace
+	images   map[string][]byte // read from a zip, by tag
+}
+
+type ExportedPlaylist struct {
+	Name   string
+	Tags   []string     // its own, in order
+	Nested []string     `json:",omitempty"`
+	Smart  *SmartFilter `json:",omitempty"`
+	Crew   string       `json:",omitempty"`
+}
+
+/*
+ * Gather everything into an export. schedule is the running schedule,
+ * if there is one, see Scheduler.Snapshot().
+ */
+func buildExport(schedule *SavedSchedule) (export Export, err error) {
+	export = Export{Version: ExportVersion, ExportedAt: time.Now().UTC(),
+		Schedule: schedule}
+
+	if export.Tags, err = allTags(); err != nil {
+		return export, err
+	}
+
+	names, err := allPlaylists()
+	if err != nil {
+		return export, err
+	}
+	crews, err := playlistCrews()
+	if err != nil {
+		return export, err
+	}
+
+	for _, name := range names {
+		playlist, err := exportPlaylist(name, crews[name])
+		if err != nil {
+			return export, err
+		}
+		export.Playlists = append(export.Playlists, playlist)
+	}
+	return export, nil
+}
+
+// A playlist as an export has it, with crew as its crew.
+func exportPlaylist(name string, crew string) (playlist ExportedPlaylist, err error) {
+	playlist = ExportedPlaylist{Name: name, Tags: []string{}, Crew: crew}
+	if tags, err := ownPlaylistTags(name); err != nil {
+		return playlist, err
+	} else if tags != nil {
+		playlist.Tags = tags
+	}
+	if playlist.Nested, err = playlistChildren(name); err != nil {
+		return playlist, err
+	}
+
+	filter, ok, err := smartFilter(name)
+	if err != nil {
+		return playlist, err
+	} else if ok {
+		playlist.Smart = &filter
+	}
+	return playlist, nil
+}
+
+func writeJSONExport(w io.Writer, export Export) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+/*
+ * Write an export as a zip, with every tag's image. Images that can't be
+ * had are left out, and returned as errs; err is for the zip.
+ */
+func writeArchive(w io.Writer, export Export) (errs []error, err error) {
+	archive := zip.NewWriter(w)
+	export.Images = map[string]string{}
+	for _, tag := range export.Tags {
+		data, err := fetchImage(tag.Url)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tag.Name, err))
+			continue
+		}
+
+		name := archiveImages + url.PathEscape(tag.Name)
+		if ext := imageType(tag.Url); ext != "" {
+			name += "." + ext
+		}
+		// Images are compressed already.
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store,
+			Modified: tag.UpdatedAt})
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			return errs, err
+		}
+		export.Images[tag.Name] = name
+	}
+
+	file, err := archive.Create(archiveManifest)
+	if err == nil {
+		err = writeJSONExport(file, export)
+	}
+	if err != nil {
+		return errs, err
+	}
+	return errs, archive.Close()
+}
+
+// Read a zip export, and the images in it.
+func readArchive(data []byte) (export Export, err error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return export, err
+	}
+
+	read := func(name string) ([]byte, error) {
+		file, err := archive.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+
+	manifest, err := read(archiveManifest)
+	if err != nil {
+		return export, fmt.Errorf("that zip has no %s: %w", archiveManifest, err)
+	}
+	if export, _, err = readExport(manifest); err != nil {
+		return export, err
+	} else if export.migrated {
+		return export, fmt.Errorf("that zip's %s isn't an export", archiveManifest)
+	}
+
+	export.images = map[string][]byte{}
+	for tag, name := range export.Images {
+		if export.images[tag], err = read(name); err != nil {
+			return export, fmt.Errorf("**%s**'s image: %w", tag, err)
+		}
+	}
+	return export, nil
+}
+
+/*
+ * Read an export of any version, bringing it up to this one. errs are
+ * the lines of a CSV that had to be skipped; err is for an export that
+ * can't be read at all.
+ */
+func readExport(data []byte) (export Export, errs []error, err error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		export, err = readArchive(data)
+		return export, nil, err
+	}
+
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err = json.Unmarshal(trimmed, &export); err != nil {
+			return export, nil, err
+		} else if export.Version < 2 || export.Version > ExportVersion {
+			return export, nil, fmt.Errorf("that's a version %d export, and I only "+
+				"know up to version %d", export.Version, ExportVersion)
+		}
+		return export, nil, nil
+	}
+
+	// Version 1: a CSV of tags.
+	export = Export{Version: ExportVersion, ExportedAt: time.Now().UTC(), migrated: true}
+	dec := csv.NewReader(bytes.NewReader(data))
+	// Older exports only have the name, author and URL.
+	dec.FieldsPerRecord = -1
+	for lineno := 1; ; lineno++ {
+		record, err := dec.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return export, errs, err
+		}
+
+		tag, err := parseTagRecord(record)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %s", lineno, err.Error()))
+			continue
+		}
+		export.Tags = append(export.Tags, tag)
+	}
+	return export, errs, nil
+}
@@ -0,0 +1,58 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * gif.go - Animated banners. Only guilds at boost level 3 can have
+ * one; for the rest, setBanner() puts up a single frame of the GIF
+ * instead, picked by the GifFallbackFrame setting.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Whether the guild's boost level allows an animated banner right now.
+func guildAnimates(s *discordgo.Session) (bool, error) {
+	guild, err := cachedGuild(s)
+	if err != nil {
+		return false, err
+	}
+
+	return guild.PremiumTier >= discordgo.PremiumTier3, nil
+}
+
+/*
+ * Flatten one frame of a GIF into a PNG. Frames after the first may
+ * only hold what changed, so every frame up to it is drawn in turn. A
+ * frame past the end gives the last one.
+ */
+func gifFrame(data []byte, frame int) ([]byte, error) {
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if frame >= len(anim.Image) {
+		frame = len(anim.Image) - 1
+	}
+
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	for _, img := range anim.Image[:frame+1] {
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+	}
+
+	buf := bytes.Buffer{}
+	err = png.Encode(&buf, canvas)
+	return buf.Bytes(), err
+}
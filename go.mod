@@ -1,14 +1,16 @@
 module banner-bard
 
-go 1.17
+go 1.21
 
 require (
 	github.com/bwmarrin/discordgo v0.24.0
 	github.com/mattn/go-sqlite3 v1.14.12
+	golang.org/x/image v0.5.0
+	golang.org/x/text v0.7.0
 )
 
 require (
 	github.com/gorilla/websocket v1.4.2 // indirect
-	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
-	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68 // indirect
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
+	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
 )
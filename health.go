@@ -0,0 +1,320 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * health.go - Link health. Image hosts take banners down, so a slow
+ * crawler goes over every tag's URL once every RecheckDays, one tag at
+ * a time and evenly spaced so no host sees a burst; every other check
+ * samples the running rotation instead, and the staff are told if a
+ * tag in it has broken. A tag whose link answers with an error or
+ * something that isn't an image is marked unhealthy, and the scheduler
+ * passes it over until a later check (or a new URL) clears it. `audit`
+ * checks every link at once, for when waiting a week won't do.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var healthLog = moduleLogger("health")
+
+// No matter how many tags there are, don't check more often than this.
+const recheckMinGap = time.Minute
+
+// How many links `audit` checks at once.
+const auditWorkers = 4
+
+var healthClient = &http.Client{Timeout: 30 * time.Second}
+
+/*
+ * Ask a link whether it's still an image. The error is nil if it is;
+ * reachable is false if the host couldn't be asked at all, which says
+ * more about our network than about the link.
+ */
+func checkLink(url string) (reachable bool, err error) {
+	resp, err := healthClient.Head(url)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed ||
+		resp.StatusCode == http.StatusNotImplemented) {
+		// Some hosts only answer GET.
+		resp.Body.Close()
+		resp, err = healthClient.Get(url)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return true, fmt.Errorf("the link answered %s", resp.Status)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return true, fmt.Errorf("the link isn't an image (%s)", contentType)
+	}
+
+	return true, nil
+}
+
+// Whether the scheduler should pass a tag over for now.
+func tagQuarantined(name string) bool {
+	health, err := tagHealth(name)
+	if err != nil {
+		healthLog.Error("Error while checking tag health", "err", err)
+		return false
+	}
+	return !health.Healthy
+}
+
+// How long to wait between checks to get through every tag in time.
+func recheckGap() (time.Duration, error) {
+	count, err := tagCount()
+	if err != nil || count == 0 {
+		return time.Hour, err
+	}
+
+	// Every other check is a sample of the rotation, hence twice
+	// as many checks as tags.
+	gap := time.Duration(Settings.RecheckDays) * 24 * time.Hour / time.Duration(2*count)
+	if gap < recheckMinGap {
+		gap = recheckMinGap
+	}
+	return gap, nil
+}
+
+/*
+ * Pick the next tag to recheck: every other time, a random tag from the
+ * running rotation, since those are the ones that can break a banner
+ * change; otherwise the tag that's gone the longest without a check.
+ */
+func recheckPick(turn int) (tag Tag, ok bool, err error) {
+	if turn%2 == 1 {
+		if tags, _, running := Scheduler.Queue(); running && len(tags) > 0 {
+			tag, err = namedTag(tags[rand.Intn(len(tags))])
+			if err == nil {
+				return tag, true, nil
+			} else if err != sql.ErrNoRows {
+				return tag, false, err
+			}
+		}
+	}
+
+	return stalestTag()
+}
+
+/*
+ * Check a tag's link and record how it went. If a tag in the running
+ * rotation has just broken, let the staff know.
+ */
+func recheckTag(s *discordgo.Session, tag Tag) error {
+	reachable, linkErr := checkLink(tag.Url)
+	switch {
+	case !reachable:
+		// Leave its health be and try again next time around,
+		// rather than blame the tag.
+		healthLog.Warn("Couldn't check a tag", "tag", tag.Name, "err", linkErr)
+		return touchTagHealth(tag.Name)
+	case linkErr == nil:
+		return setTagHealth(tag.Name, true, "")
+	}
+
+	healthLog.Warn("Tag is unhealthy", "tag", tag.Name, "err", linkErr)
+	health, err := tagHealth(tag.Name)
+	if err != nil {
+		return err
+	}
+
+	if err = setTagHealth(tag.Name, false, linkErr.Error()); err != nil {
+		return err
+	}
+
+	if tags, _, running := Scheduler.Queue(); health.Healthy && running &&
+		contains(tags, tag.Name) {
+
+		notifyStaff(s, "health", fmt.Sprintf("Sire, **%s** is in the rotation, but its "+
+			"link has broken: %s. I'll pass it over until it's fixed.",
+			tag.Name, linkErr))
+	}
+	return nil
+}
+
+/*
+ * Run the crawler. Like Scheduler.StartJob(), this lasts forever, so
+ * call it with `go`.
+ */
+func StartRecheck(s *discordgo.Session) {
+	if Settings.RecheckDays < 0 {
+		healthLog.Info("Link rechecks are off")
+		return
+	}
+
+	for turn := 0; ; turn++ {
+		gap, err := recheckGap()
+		if err != nil {
+			healthLog.Error("Error while pacing link rechecks", "err", err)
+		}
+		time.Sleep(gap)
+
+		tag, ok, err := recheckPick(turn)
+		if ok {
+			err = recheckTag(s, tag)
+		}
+		if err != nil {
+			healthLog.Error("Error while rechecking a link", "err", err)
+		}
+	}
+}
+
+// How one tag's link fared in an audit.
+type auditResult struct {
+	tag       Tag
+	reachable bool
+	err       error
+}
+
+// Check every tag's link, a few at a time.
+func auditTags(tags []Tag) []auditResult {
+	results := make([]auditResult, len(tags))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < auditWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				reachable, err := checkLink(tags[i].Url)
+				results[i] = auditResult{tags[i], reachable, err}
+			}
+		}()
+	}
+
+	for i := range tags {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func cmdAudit(ctx *CommandContext, args []string) {
+	action := ""
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && (args[0] == "--delete" || args[0] == "--quarantine"):
+		action = args[0]
+	default:
+		ctx.SendUsage()
+		return
+	}
+
+	if action != "" && refuseChanges(ctx) {
+		return
+	}
+
+	tags, err := allTags()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	ctx.Reply(fmt.Sprintf("Looking over %d tags, sire. This may take a while.",
+		len(tags)))
+
+	broken, unreachable := bytes.Buffer{}, bytes.Buffer{}
+	brokenCount, unreachableCount := 0, 0
+	deleted := []string{}
+	results := auditTags(tags)
+
+	// What --delete may delete, so `undo` can put it back.
+	var snapshot undoSnapshot
+	if action == "--delete" {
+		names := []string{}
+		for _, result := range results {
+			if result.reachable && result.err != nil {
+				names = append(names, result.tag.Name)
+			}
+		}
+		if snapshot, err = takeTagsSnapshot(names); handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+	}
+
+	for _, result := range results {
+		name := result.tag.Name
+		switch {
+		case !result.reachable:
+			unreachableCount++
+			unreachable.WriteString(fmt.Sprintf("\n**%s**: %s", name, result.err))
+			continue
+		case result.err == nil:
+			continue
+		}
+
+		brokenCount++
+		broken.WriteString(fmt.Sprintf("\n**%s**: %s", name, result.err))
+
+		switch action {
+		case "--delete":
+			if err = delTag(name); err == ErrTagLocked {
+				broken.WriteString(" (locked, so kept)")
+				err = nil
+			} else if err == nil {
+				deleted = append(deleted, name)
+			}
+		case "--quarantine":
+			err = setTagHealth(name, false, result.err.Error())
+		}
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+	}
+
+	healthLog.Info("Audited tags", "count", len(tags), "broken", brokenCount,
+		"unreachable", unreachableCount)
+	if len(deleted) > 0 {
+		ctx.auditTags("tag del", deleted, "broken links")
+		ctx.journalTags("tag del", deleted, snapshot)
+	}
+
+	if brokenCount == 0 && unreachableCount == 0 {
+		ctx.Reply("Every link is sound, sire.")
+		return
+	}
+
+	buf := bytes.Buffer{}
+	if brokenCount > 0 {
+		switch action {
+		case "--delete":
+			buf.WriteString("These tags were broken, so I've forgotten them:")
+		case "--quarantine":
+			buf.WriteString("These tags are broken, so I'll pass them over in schedules:")
+		default:
+			buf.WriteString("These tags are broken, sire:")
+		}
+		buf.WriteString(broken.String())
+	}
+
+	if unreachableCount > 0 {
+		if buf.Len() > 0 {
+			buf.WriteString("\n\n")
+		}
+		buf.WriteString("And I couldn't reach these at all:")
+		buf.WriteString(unreachable.String())
+	}
+
+	ctx.ReplyLong(buf.String())
+}
@@ -0,0 +1,370 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * holiday.go - Banners for public holidays. With HolidayCountry set (an
+ * ISO 3166 code, like US or DE), the bard knows that country's holidays
+ * from the Nager.Date dataset (https://date.nager.at), and admins can map
+ * them to tags or playlists:
+ *
+ *   holiday map christmas xmas-playlist
+ *
+ * Holidays go by their English names, lowercased with dashes (so
+ * "Christmas Day" is christmas-day), and a mapping covers every holiday
+ * whose name is it or starts with it and a dash: christmas covers
+ * christmas-day and christmas-eve, where a country has both. The longest
+ * mapping that covers a holiday wins.
+ *
+ * On a mapped holiday (its date in the guild's timezone, checked
+ * hourly), the bard puts the tag up, or one of the playlist's, holds the
+ * rotation, and puts back what was up once the day is done, as for
+ * calendar entries. Each year's holidays are fetched once and kept in
+ * the database, under holidaysKey().
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var holidayLog = moduleLogger("holiday")
+
+const (
+	// The holiday whose tag is up (as SLUG@DATE), and the tag it went up over.
+	holidayUpKey       = "holiday_up"
+	holidayPreviousKey = "holiday_previous"
+
+	holidayURL        = "https://date.nager.at/api/v3/PublicHolidays/%d/%s"
+	holidayCheckEvery = time.Hour
+	holidayDateFormat = "2006-01-02"
+)
+
+var holidayClient = &http.Client{Timeout: 30 * time.Second}
+
+// A public holiday, as Nager.Date gives it.
+type Holiday struct {
+	Date      string `json:"date"` // holidayDateFormat
+	Name      string `json:"name"`
+	LocalName string `json:"localName"`
+}
+
+// A holiday's name as mappings go by it: "Christmas Day" is christmas-day.
+func holidaySlug(name string) string {
+	buf := strings.Builder{}
+	dash := false
+	for _, chr := range strings.ToLower(name) {
+		if unicode.IsLetter(chr) || unicode.IsDigit(chr) {
+			if dash && buf.Len() > 0 {
+				buf.WriteRune('-')
+			}
+			buf.WriteRune(chr)
+			dash = false
+		} else if chr != '\'' {
+			dash = true
+		}
+	}
+	return buf.String()
+}
+
+// Whether the mapping covers the holiday.
+func (holiday HolidayMap) covers(name string) bool {
+	slug := holidaySlug(name)
+	return slug == holiday.Holiday || strings.HasPrefix(slug, holiday.Holiday+"-")
+}
+
+func checkHolidayCountry(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) != 2 || strings.ToUpper(value) != value ||
+		!unicode.IsLetter(rune(value[0])) || !unicode.IsLetter(rune(value[1])) {
+		return fmt.Errorf("%q isn't a two-letter country code, like US", value)
+	}
+	return nil
+}
+
+func holidaysKey(year int) string {
+	return fmt.Sprintf("holidays:%s:%d", Settings.HolidayCountry, year)
+}
+
+// The HolidayCountry's holidays in the year, fetched if they aren't kept yet.
+func holidays(year int) ([]Holiday, error) {
+	var list []Holiday
+
+	kept, err := getSetting(holidaysKey(year))
+	if err != nil {
+		return nil, err
+	} else if kept != "" {
+		err = json.Unmarshal([]byte(kept), &list)
+		return list, err
+	}
+
+	resp, err := holidayClient.Get(fmt.Sprintf(holidayURL, year, Settings.HolidayCountry))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Nager.Date answered %s for %s's holidays",
+			resp.Status, Settings.HolidayCountry)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	holidayLog.Info("Fetched holidays", "country", Settings.HolidayCountry,
+		"year", year, "count", len(list))
+	return list, putSetting(holidaysKey(year), string(data))
+}
+
+// The mapping that covers the holiday, if any: the longest.
+func holidayMapFor(maps []HolidayMap, holiday Holiday) (HolidayMap, bool) {
+	best, found := HolidayMap{}, false
+	for _, mapping := range maps {
+		if (mapping.covers(holiday.Name) || mapping.covers(holiday.LocalName)) &&
+			len(mapping.Holiday) > len(best.Holiday) {
+			best, found = mapping, true
+		}
+	}
+	return best, found
+}
+
+/*
+ * The mapped holiday today in the guild's timezone, and its mapping. ok
+ * is false if there isn't one.
+ */
+func holidayToday() (holiday Holiday, mapping HolidayMap, ok bool, err error) {
+	if Settings.HolidayCountry == "" {
+		return holiday, mapping, false, nil
+	}
+
+	maps, err := allHolidayMaps()
+	if err != nil || len(maps) == 0 {
+		return holiday, mapping, false, err
+	}
+
+	today := time.Now().In(guildLocation())
+	list, err := holidays(today.Year())
+	if err != nil {
+		return holiday, mapping, false, err
+	}
+
+	date := today.Format(holidayDateFormat)
+	for _, holiday = range list {
+		if holiday.Date != date {
+			continue
+		}
+		if mapping, ok = holidayMapFor(maps, holiday); ok {
+			return holiday, mapping, true, nil
+		}
+	}
+	return Holiday{}, HolidayMap{}, false, nil
+}
+
+// Whether a holiday's tag is up, holding the rotation.
+func holidayHeld() (bool, error) {
+	up, err := getSetting(holidayUpKey)
+	return up != "", err
+}
+
+/*
+ * Put up the tag for today's holiday, if it's not up already, or put
+ * back what was up before once the holiday's over. Run from the
+ * scheduler.
+ */
+func (scheduler *BannerScheduler) checkHolidays() {
+	holiday, mapping, on, err := holidayToday()
+	if err != nil {
+		holidayLog.Error("Error while checking holidays", "err", err)
+		return
+	}
+
+	upKey, err := getSetting(holidayUpKey)
+	if err != nil {
+		holidayLog.Error("Error while checking holidays", "err", err)
+		return
+	}
+	key := holidaySlug(holiday.Name) + "@" + holiday.Date
+
+	switch {
+	case on && key != upKey:
+		// Only the first holiday in a row covers the old banner.
+		if upKey == "" {
+			previous, err := currentBanner()
+			if err == nil {
+				err = putSetting(holidayPreviousKey, previous)
+			}
+			if err != nil {
+				holidayLog.Error("Error while starting a holiday", "err", err)
+				return
+			}
+		}
+
+		tag, err := tagOrPlaylistTag(mapping.Target)
+		if err != nil || tag == "" {
+			holidayLog.Error("Error while starting a holiday", "holiday", holiday.Name,
+				"target", mapping.Target, "err", err)
+			return
+		}
+
+		holidayLog.Info("It's a holiday; setting the banner", "holiday", holiday.Name,
+			"tag", tag)
+		if err = scheduler.setter(scheduler.session, tag, "holiday"); err != nil {
+			holidayLog.Error("Error while setting the banner", "err", err)
+			return
+		}
+		if err = putSetting(holidayUpKey, key); err != nil {
+			holidayLog.Error("Error while starting a holiday", "err", err)
+		}
+	case !on && upKey != "":
+		previous, err := getSetting(holidayPreviousKey)
+		if err != nil {
+			holidayLog.Error("Error while ending a holiday", "err", err)
+			return
+		}
+
+		holidayLog.Info("Holiday's over", "holiday", upKey, "previous", previous)
+		if previous != "" {
+			if err = scheduler.setter(scheduler.session, previous, "holiday"); err != nil {
+				holidayLog.Error("Error while setting the banner", "err", err)
+			}
+		}
+
+		if err = putSetting(holidayUpKey, ""); err != nil {
+			holidayLog.Error("Error while ending a holiday", "err", err)
+		}
+	}
+}
+
+func cmdHolidayMap(ctx *CommandContext, args []string) {
+	if len(args) != 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	mapping := HolidayMap{Holiday: holidaySlug(args[0]), Target: args[1]}
+	if mapping.Holiday == "" {
+		ctx.SendUsage()
+		return
+	}
+
+	tag, err := tagOrPlaylistTag(mapping.Target)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if tag == "" {
+		ctx.Reply("Sire, I know no tag or playlist named **" + mapping.Target + "**.")
+		return
+	}
+
+	if handleCommandErrors(ctx, SqlError, insertHolidayMap(mapping)) {
+		return
+	}
+	holidayLog.Info("Mapped a holiday", "holiday", mapping.Holiday, "target", mapping.Target)
+
+	if Settings.HolidayCountry == "" {
+		ctx.Reply("Sire, I'll remember that, but I don't know whose holidays to " +
+			"keep until `HolidayCountry` is set.")
+		return
+	}
+
+	// Say which holidays it covers, so a typo doesn't go unnoticed.
+	list, err := holidays(time.Now().In(guildLocation()).Year())
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+	covered := []string{}
+	for _, holiday := range list {
+		if mapping.covers(holiday.Name) || mapping.covers(holiday.LocalName) {
+			covered = append(covered, holiday.Name+" ("+holiday.Date+")")
+		}
+	}
+
+	if len(covered) == 0 {
+		ctx.Reply("Sire, I'll remember that, but **" + mapping.Holiday + "** isn't " +
+			"one of this year's holidays. `holiday ls` shows them.")
+		return
+	}
+	ctx.Reply("Sire, **" + mapping.Target + "** will go up on " +
+		strings.Join(covered, ", ") + ".")
+}
+
+func cmdHolidayUnmap(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	ok, err := delHolidayMap(holidaySlug(args[0]))
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	if !ok {
+		ctx.Reply("Sire, I have nothing mapped to **" + holidaySlug(args[0]) + "**.")
+		return
+	}
+	ctx.Ack()
+}
+
+func cmdHolidayLs(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	maps, err := allHolidayMaps()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	if Settings.HolidayCountry == "" {
+		buf.WriteString("Sire, I don't know whose holidays to keep until " +
+			"`HolidayCountry` is set.\n")
+	} else {
+		now := time.Now().In(guildLocation())
+		list, err := holidays(now.Year())
+		if handleCommandErrors(ctx, GeneralError, err) {
+			return
+		}
+
+		buf.WriteString(fmt.Sprintf("%s's holidays this year, sire:\n",
+			Settings.HolidayCountry))
+		today := now.Format(holidayDateFormat)
+		for _, holiday := range list {
+			if holiday.Date < today {
+				continue
+			}
+
+			buf.WriteString(fmt.Sprintf("\n%s **%s** `%s`", holiday.Date,
+				holiday.Name, holidaySlug(holiday.Name)))
+			if mapping, ok := holidayMapFor(maps, holiday); ok {
+				buf.WriteString(" → **" + mapping.Target + "**")
+			}
+		}
+	}
+
+	if len(maps) > 0 {
+		buf.WriteString("\n\nAnd what I'll put up for them:\n")
+	}
+	for _, mapping := range maps {
+		buf.WriteString(fmt.Sprintf("\n`%s` → **%s**", mapping.Holiday, mapping.Target))
+	}
+
+	ctx.ReplyLong(buf.String())
+}
@@ -0,0 +1,197 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * ical.go - `schedule export ics`, which writes what's planned for the
+ * banner as an iCalendar file (RFC 5545) that staff can import into
+ * their own calendars: one-shots from `at`, seasons, and event rules.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	icalTimeFormat = "20060102T150405Z"
+	icalDateFormat = "20060102"
+)
+
+var icalEscaper = strings.NewReplacer(
+	`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// Accumulates an iCalendar file, taking care of escaping and line endings.
+type icalWriter struct {
+	buf   bytes.Buffer
+	stamp string
+}
+
+/*
+ * Write a content line, folded to 75 octets as the RFC asks. Folding
+ * may split a multi-byte character, which calendar apps put back
+ * together when unfolding.
+ */
+func (w *icalWriter) line(name string, value string) {
+	line := name + ":" + value
+	for len(line) > 75 {
+		w.buf.WriteString(line[:75] + "\r\n ")
+		line = line[75:]
+	}
+	w.buf.WriteString(line + "\r\n")
+}
+
+func (w *icalWriter) text(name string, value string) {
+	w.line(name, icalEscaper.Replace(value))
+}
+
+// Write an event. A zero end leaves the event without a length.
+func (w *icalWriter) event(uid string, start time.Time, end time.Time,
+	summary string) {
+
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", uid)
+	w.line("DTSTAMP", w.stamp)
+	w.line("DTSTART", start.UTC().Format(icalTimeFormat))
+	if !end.IsZero() {
+		w.line("DTEND", end.UTC().Format(icalTimeFormat))
+	}
+	w.text("SUMMARY", summary)
+	w.line("END", "VEVENT")
+}
+
+// Write one-shots from `at`.
+func (w *icalWriter) oneShots() error {
+	shots, err := allOneShots()
+	if err != nil {
+		return err
+	}
+
+	for _, shot := range shots {
+		uid := fmt.Sprintf("oneshot-%d@banner-bard", shot.ID)
+		switch {
+		case shot.IsRevert:
+			w.event(uid, shot.At, time.Time{}, "Banner: put "+shot.Tag+" back")
+		case shot.RevertAfter != 0:
+			w.event(uid, shot.At, shot.At.Add(shot.RevertAfter), "Banner: "+shot.Tag)
+		default:
+			w.event(uid, shot.At, time.Time{}, "Banner: "+shot.Tag)
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Write seasons as all-day events that recur every year, starting with
+ * this year's.
+ */
+func (w *icalWriter) seasons() error {
+	seasons, err := allSeasons()
+	if err != nil {
+		return err
+	}
+
+	year := time.Now().In(guildLocation()).Year()
+	for _, season := range seasons {
+		_, start, err := parseSeasonDate(season.Start)
+		if err != nil {
+			return err
+		}
+
+		_, end, err := parseSeasonDate(season.End)
+		if err != nil {
+			return err
+		}
+
+		endYear := year
+		if end < start {
+			// Wraps past new year
+			endYear++
+		}
+
+		// DTEND is exclusive for all-day events, hence the +1.
+		startDate := time.Date(year, time.Month(start/100), start%100, 0, 0, 0, 0, time.UTC)
+		endDate := time.Date(endYear, time.Month(end/100), end%100+1, 0, 0, 0, 0, time.UTC)
+
+		w.line("BEGIN", "VEVENT")
+		w.text("UID", "season-"+season.Playlist+"@banner-bard")
+		w.line("DTSTAMP", w.stamp)
+		w.line("DTSTART;VALUE=DATE", startDate.Format(icalDateFormat))
+		w.line("DTEND;VALUE=DATE", endDate.Format(icalDateFormat))
+		w.line("RRULE", "FREQ=YEARLY")
+		w.text("SUMMARY", "Banner season: "+season.Playlist)
+		w.line("END", "VEVENT")
+	}
+
+	return nil
+}
+
+// Write event rules at the start of their events, if they're upcoming.
+func (w *icalWriter) eventRules(ctx *CommandContext) error {
+	rules, err := allEventRules()
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+
+	events, err := ctx.Session.GuildScheduledEvents(Settings.GuildID, true)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		for _, event := range events {
+			if event.ID != rule.EventID || !eventUpcoming(event) {
+				continue
+			}
+
+			var end time.Time
+			if event.ScheduledEndTime != nil {
+				end = *event.ScheduledEndTime
+			}
+
+			w.event(fmt.Sprintf("eventrule-%d@banner-bard", rule.ID),
+				event.ScheduledStartTime, end,
+				fmt.Sprintf("Banner: %s, if %s has %d RSVPs",
+					rule.Tag, event.Name, rule.Threshold))
+		}
+	}
+
+	return nil
+}
+
+func cmdScheduleExport(ctx *CommandContext, args []string) {
+	if len(args) != 1 || args[0] != "ics" {
+		ctx.SendUsage()
+		return
+	}
+
+	w := icalWriter{stamp: time.Now().UTC().Format(icalTimeFormat)}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//Banner Bard//Banner Plan//EN")
+	w.text("X-WR-CALNAME", "Banner Bard")
+
+	err := w.oneShots()
+	if err == nil {
+		err = w.seasons()
+	}
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	err = w.eventRules(ctx)
+	if handleCommandErrors(ctx, DiscordError, err) {
+		return
+	}
+
+	w.line("END", "VCALENDAR")
+
+	ctx.Session.ChannelFileSendWithMessage(ctx.Event.ChannelID,
+		"The banner plan, sire:", "bannerbard-schedule.ics", &w.buf)
+}
@@ -0,0 +1,323 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * image.go - Getting images into a shape Discord takes. Discord only
+ * takes JPEG, PNG, and GIF banners, but plenty of hosts serve WebP and
+ * AVIF (see avif.go), so those are turned into PNGs when the banner is
+ * set. Tags can ask to be
+ * cropped to a banner's shape, so Discord doesn't squash them, and
+ * images too big to upload are scaled down and recompressed as JPEG
+ * until they fit. Tags keep their original URL either way. On small
+ * hosts, ImageMemoryMB refuses images too big to decode in the memory
+ * there is.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/image/draw"
+	// Registers WebP with image.Decode().
+	_ "golang.org/x/image/webp"
+)
+
+var imageLog = moduleLogger("image")
+
+// The largest banner Discord takes.
+const maxBannerBytes = 10 * 1024 * 1024
+
+/*
+ * How fitBanner() shrinks an image: each JPEG quality in turn, then
+ * scale down and go again.
+ */
+var (
+	fitQualities = []int{90, 80, 70}
+	fitScale     = 0.75
+	fitMinWidth  = 480
+)
+
+const guidanceImageMemory = "Sire, that image is too grand for the memory " +
+	"I'm allowed. Use a smaller picture, or raise ImageMemoryMB."
+
+// The most memory a banner change may take, in bytes, or 0 if there's no limit.
+func imageMemoryCeiling() int64 {
+	return int64(Settings.ImageMemoryMB) * 1024 * 1024
+}
+
+/*
+ * Refuse images that would take more memory than ImageMemoryMB allows,
+ * before any are decoded. The estimate's the file, plus two copies of
+ * its pixels at four bytes each: the decoded image and the one it's
+ * cropped, converted, or scaled into.
+ */
+func checkImageMemory(data []byte) error {
+	ceiling := imageMemoryCeiling()
+	if ceiling == 0 {
+		return nil
+	}
+
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	need := int64(len(data)) + 2*4*int64(conf.Width)*int64(conf.Height)
+	if need > ceiling {
+		return &GuidedError{Guidance: guidanceImageMemory,
+			Err: fmt.Errorf("a %dx%d image needs about %s, over the %s allowed",
+				conf.Width, conf.Height, formatBytes(need), formatBytes(ceiling))}
+	}
+	return nil
+}
+
+// A link's path, without its query or fragment, or the link itself if it isn't a URL.
+func linkPath(link string) string {
+	if parsed, err := url.Parse(link); err == nil && parsed.Path != "" {
+		return parsed.Path
+	}
+	return link
+}
+
+/*
+ * Make sure Discord can take the image, converting it to PNG if need
+ * be. The file type is sniffed from the data, since hosts often serve
+ * WebP from URLs that say otherwise, and some URLs don't say at all;
+ * filetype is only used if the data's type can't be told. Returns the
+ * data and its type as imageType() names them.
+ */
+func bannerImage(data []byte, filetype string) ([]byte, string, error) {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return data, "png", nil
+	case "image/jpeg":
+		return data, "jpg", nil
+	case "image/gif":
+		return data, "gif", nil
+	case "image/webp":
+	default:
+		if !isAvif(data) {
+			return data, filetype, nil
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	buf := bytes.Buffer{}
+	err = png.Encode(&buf, img)
+	return buf.Bytes(), "png", err
+}
+
+// How wide thumbnails are, e.g. for the dashboard's gallery.
+const thumbWidth = 320
+
+/*
+ * Make a small JPEG of an image, thumbWidth wide. GIFs only show their
+ * first frame.
+ */
+func thumbnail(data []byte) ([]byte, error) {
+	if err := checkImageMemory(data); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 {
+		return nil, fmt.Errorf("the image is empty")
+	}
+	width, height := thumbWidth, bounds.Dy()*thumbWidth/bounds.Dx()
+	if bounds.Dx() < thumbWidth {
+		width, height = bounds.Dx(), bounds.Dy()
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, max(height, 1)))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+
+	buf := bytes.Buffer{}
+	err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 75})
+	return buf.Bytes(), err
+}
+
+/*
+ * Scale down and recompress an image until it's small enough for
+ * Discord. Images that fit, and GIFs (which would lose their
+ * animation), are left alone.
+ */
+func fitBanner(data []byte, filetype string) ([]byte, string, error) {
+	if len(data) <= maxBannerBytes || filetype == "gif" {
+		return data, filetype, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	original := len(data)
+	for {
+		for _, quality := range fitQualities {
+			buf := bytes.Buffer{}
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+			if err != nil {
+				return nil, "", err
+			}
+
+			if buf.Len() <= maxBannerBytes {
+				bounds := img.Bounds()
+				imageLog.Debug("Shrank banner", "from", original, "to", buf.Len(),
+					"width", bounds.Dx(), "height", bounds.Dy(), "quality", quality)
+				return buf.Bytes(), "jpg", nil
+			}
+		}
+
+		bounds := img.Bounds()
+		width := int(float64(bounds.Dx()) * fitScale)
+		height := int(float64(bounds.Dy()) * fitScale)
+		if width < fitMinWidth {
+			return nil, "", fmt.Errorf("the image is still over %s at %dx%d",
+				formatBytes(maxBannerBytes), bounds.Dx(), bounds.Dy())
+		}
+
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+}
+
+// Banners are 16:9.
+const bannerAspect = 16.0 / 9.0
+
+/*
+ * How a tag's image is cropped to 16:9:
+ *
+ *   none     it isn't; Discord fits it however it likes
+ *   center   keep the middle
+ *   entropy  keep the busiest part, which is usually the subject
+ */
+var CropModes = []string{"none", "center", "entropy"}
+
+/*
+ * Crop an image to 16:9 as the mode says, returning it as PNG. GIFs and
+ * images with no crop mode are left alone.
+ */
+func cropBanner(data []byte, filetype string, mode string) ([]byte, string, error) {
+	if mode == "" || mode == "none" || filetype == "gif" {
+		return data, filetype, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	crop := image.Rect(0, 0, width, height)
+	var slack int // how far the crop can slide
+	wide := float64(width)/float64(height) > bannerAspect
+	if wide {
+		crop.Max.X = int(float64(height) * bannerAspect)
+		slack = width - crop.Dx()
+	} else {
+		crop.Max.Y = int(float64(width) / bannerAspect)
+		slack = height - crop.Dy()
+	}
+
+	offset := slack / 2
+	if mode == "entropy" {
+		offset = busiestOffset(img, crop, slack, wide)
+	}
+
+	if wide {
+		crop = crop.Add(image.Pt(offset, 0))
+	} else {
+		crop = crop.Add(image.Pt(0, offset))
+	}
+	crop = crop.Add(bounds.Min)
+
+	cropped := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, crop.Min, draw.Src)
+
+	buf := bytes.Buffer{}
+	err = png.Encode(&buf, cropped)
+	return buf.Bytes(), "png", err
+}
+
+/*
+ * Find where to slide a crop so it holds the most detail, going by the
+ * entropy of its brightness. Only a few offsets are tried, on a small
+ * copy of the image, which is plenty to find the subject.
+ */
+func busiestOffset(img image.Image, crop image.Rectangle, slack int, wide bool) int {
+	const steps = 16
+	const sampleWidth = 256
+
+	bounds := img.Bounds()
+	scale := float64(sampleWidth) / float64(bounds.Dx())
+	if scale > 1 {
+		scale = 1
+	}
+
+	small := image.NewGray(image.Rect(0, 0,
+		int(float64(bounds.Dx())*scale)+1, int(float64(bounds.Dy())*scale)+1))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, bounds, draw.Src, nil)
+
+	best, bestEntropy := slack/2, -1.0
+	for step := 0; step <= steps; step++ {
+		offset := slack * step / steps
+		window := crop
+		if wide {
+			window = window.Add(image.Pt(offset, 0))
+		} else {
+			window = window.Add(image.Pt(0, offset))
+		}
+
+		sample := image.Rect(
+			int(float64(window.Min.X)*scale), int(float64(window.Min.Y)*scale),
+			int(float64(window.Max.X)*scale), int(float64(window.Max.Y)*scale))
+		if entropy := grayEntropy(small, sample); entropy > bestEntropy {
+			best, bestEntropy = offset, entropy
+		}
+	}
+
+	return best
+}
+
+// The Shannon entropy of the brightness in part of a gray image.
+func grayEntropy(img *image.Gray, rect image.Rectangle) float64 {
+	var histogram [256]int
+	total := 0
+	rect = rect.Intersect(img.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			histogram[img.GrayAt(x, y).Y]++
+			total++
+		}
+	}
+
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
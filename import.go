@@ -0,0 +1,261 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * import.go - Importing exports (see export.go). A plain `import`
+ * replaces every tag and playlist with the export's, and puts back its
+ * schedule; `import merge` only adds the export's tags and playlists,
+ * replacing those of the same name, and leaves the rest and the
+ * schedule be. Either way, locked tags and playlists are kept as they
+ * are, tags of the same name are replaced in place, keeping their
+ * playlists and stats, and it's all done in one transaction, so an
+ * import that fails partway changes nothing. An old CSV has no
+ * playlists, so they're left be, but for the tags it removes.
+ *
+ * `--dry-run` says what an import would do, changing nothing: what it
+ * would add, remove, and replace, and which tags of the same name have
+ * a different image, so a collision can be caught before it's made.
+ * The same is said after a real import.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// How many names each line of an import's summary lists.
+const importListShows = 20
+
+// A tag in an import with the same name as one already here, but another image.
+type importConflict struct {
+	Name   string
+	OldUrl string
+	NewUrl string
+}
+
+// What an import changes, see planImport().
+type importPlan struct {
+	Added     []string
+	Conflicts []importConflict // replaced, with another image
+	Replaced  int              // replaced, with the same image
+	Removed   []string         // only without merge
+	Locked    []string         // kept as they are
+
+	PlaylistsAdded    []string
+	PlaylistsReplaced []string
+	PlaylistsRemoved  []string
+	PlaylistsLocked   []string
+
+	Schedule bool // the export's schedule is put back
+}
+
+// Work out what importing the export would change, without changing anything.
+func planImport(export Export, merge bool) (plan importPlan, err error) {
+	tags, err := allTags()
+	if err != nil {
+		return plan, err
+	}
+	lockedTags, lockedPlaylists, err := allLocks()
+	if err != nil {
+		return plan, err
+	}
+
+	existing := map[string]Tag{}
+	for _, tag := range tags {
+		existing[tag.Name] = tag
+	}
+	imported := map[string]bool{}
+	for _, tag := range export.Tags {
+		name := normTag(tag.Name)
+		imported[name] = true
+		old, ok := existing[name]
+		switch {
+		case contains(lockedTags, name):
+			plan.Locked = append(plan.Locked, name)
+		case !ok:
+			plan.Added = append(plan.Added, name)
+		case old.Url != tag.Url:
+			plan.Conflicts = append(plan.Conflicts, importConflict{Name: name,
+				OldUrl: old.Url, NewUrl: tag.Url})
+		default:
+			plan.Replaced++
+		}
+	}
+	for _, tag := range tags {
+		switch {
+		case imported[tag.Name] || merge:
+		case contains(lockedTags, tag.Name):
+			plan.Locked = append(plan.Locked, tag.Name)
+		default:
+			plan.Removed = append(plan.Removed, tag.Name)
+		}
+	}
+
+	// An old CSV has no playlists, and leaves them be, but for the tags it removes.
+	if export.migrated {
+		return plan, nil
+	}
+	plan.Schedule = export.Schedule != nil && !merge
+
+	playlists, err := allPlaylists()
+	if err != nil {
+		return plan, err
+	}
+	importedPlaylists := map[string]bool{}
+	for _, playlist := range export.Playlists {
+		importedPlaylists[playlist.Name] = true
+		switch {
+		case contains(lockedPlaylists, playlist.Name):
+			plan.PlaylistsLocked = append(plan.PlaylistsLocked, playlist.Name)
+		case contains(playlists, playlist.Name):
+			plan.PlaylistsReplaced = append(plan.PlaylistsReplaced, playlist.Name)
+		default:
+			plan.PlaylistsAdded = append(plan.PlaylistsAdded, playlist.Name)
+		}
+	}
+	for _, playlist := range playlists {
+		switch {
+		case importedPlaylists[playlist] || merge:
+		case contains(lockedPlaylists, playlist):
+			plan.PlaylistsLocked = append(plan.PlaylistsLocked, playlist)
+		default:
+			plan.PlaylistsRemoved = append(plan.PlaylistsRemoved, playlist)
+		}
+	}
+	return plan, nil
+}
+
+// Names for a summary, as "**a**, **b**", and how many more there are.
+func importNames(names []string) string {
+	shown := names
+	more := ""
+	if len(shown) > importListShows {
+		shown = shown[:importListShows]
+		more = fmt.Sprintf(", and %d more", len(names)-importListShows)
+	}
+	return "**" + strings.Join(shown, "**, **") + "**" + more
+}
+
+/*
+ * Say what the import did, or with dryRun, what it would do, one change
+ * a line.
+ */
+func (plan importPlan) describe(dryRun bool) string {
+	verb := func(did string, would string) string {
+		if dryRun {
+			return "- " + would
+		}
+		return "- " + did
+	}
+
+	buf := bytes.Buffer{}
+	if dryRun {
+		buf.WriteString("Sire, this import would:")
+	} else {
+		buf.WriteString("Sire, I've:")
+	}
+	line := func(did string, would string, names []string, what string) {
+		if len(names) > 0 {
+			buf.WriteString(fmt.Sprintf("\n%s %d %s: %s", verb(did, would), len(names),
+				what, importNames(names)))
+		}
+	}
+
+	line("added", "add", plan.Added, "tags")
+	if len(plan.Conflicts) > 0 {
+		buf.WriteString(fmt.Sprintf("\n%s %d tags of the same name with another image:",
+			verb("replaced", "replace"), len(plan.Conflicts)))
+		for i, conflict := range plan.Conflicts {
+			if i == importListShows {
+				buf.WriteString(fmt.Sprintf("\n  - and %d more",
+					len(plan.Conflicts)-importListShows))
+				break
+			}
+			buf.WriteString(fmt.Sprintf("\n  - **%s**: <%s> with <%s>", conflict.Name,
+				conflict.OldUrl, conflict.NewUrl))
+		}
+	}
+	if plan.Replaced > 0 {
+		buf.WriteString(fmt.Sprintf("\n%s %d tags that have the same image",
+			verb("refreshed", "refresh"), plan.Replaced))
+	}
+	line("removed", "remove", plan.Removed, "tags not in the file")
+	line("kept", "keep", plan.Locked, "locked tags as they are")
+	line("added", "add", plan.PlaylistsAdded, "playlists")
+	line("replaced", "replace", plan.PlaylistsReplaced, "playlists")
+	line("removed", "remove", plan.PlaylistsRemoved, "playlists not in the file")
+	line("kept", "keep", plan.PlaylistsLocked, "locked playlists as they are")
+	if plan.Schedule {
+		buf.WriteString("\n" + verb("put back the schedule it was exported with",
+			"put back the schedule it was exported with"))
+	}
+	if !strings.Contains(buf.String(), "\n") {
+		buf.WriteString("\n" + verb("changed nothing; it's all here already",
+			"change nothing; it's all here already"))
+	}
+
+	if dryRun {
+		buf.WriteString("\n\nNothing's changed yet; import it again without `--dry-run` " +
+			"to do it.")
+	}
+	return buf.String()
+}
+
+/*
+ * Import the export's tags and, unless it's an old CSV, its playlists,
+ * all at once (see importRows()), so one that fails changes nothing.
+ * Without merge, every other tag is deleted, and unless it's an old CSV
+ * every other playlist; with it, only those of the same name are
+ * replaced. Tags of the same name are replaced in place, so they stay
+ * in their playlists. Locked ones are kept as they are. Returns what
+ * went wrong, for handleCommandErrors(); the schedule is left to the
+ * caller.
+ */
+func importExport(export Export, merge bool) (errs []error) {
+	playlists := export.Playlists
+	if export.migrated {
+		playlists = nil
+	}
+	err := importRows(export.Tags, playlists, !merge, !merge && !export.migrated)
+	if err != nil {
+		return []error{err}
+	}
+
+	lockedTags, _, err := allLocks()
+	if err != nil {
+		return []error{err}
+	}
+	for _, tag := range export.Tags {
+		data, ok := export.images[tag.Name]
+		if ok && !contains(lockedTags, normTag(tag.Name)) {
+			errs = append(errs, storeImage(tag.Url, data))
+		}
+	}
+	return errs
+}
+
+/*
+ * Put a playlist back as an export has it, replacing what's there, or
+ * return ErrPlaylistLocked if it's locked.
+ */
+func restorePlaylist(playlist ExportedPlaylist) error {
+	err := emptyPlaylist(playlist.Name)
+	if err == nil && len(playlist.Tags) > 0 {
+		err = editPlaylist(playlist.Name, playlist.Tags)
+	}
+	if err == nil && len(playlist.Nested) > 0 {
+		_, err = nestPlaylists(playlist.Name, playlist.Nested)
+	}
+	if err == nil && playlist.Smart != nil {
+		err = setSmartFilter(playlist.Name, playlist.Smart)
+	}
+	if err == nil {
+		err = setPlaylistCrew(playlist.Name, playlist.Crew)
+	}
+	return err
+}
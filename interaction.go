@@ -0,0 +1,217 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * interaction.go - Routing for message components, i.e. buttons. When
+ * the bard sends a button, its custom ID is "NAME:ARG"; when someone
+ * clicks it, the handler registered under NAME gets called with ARG.
+ * Handlers are registered in banner-bard.go:init() next to the
+ * commands that send the buttons. Modals go by the same scheme: their
+ * submissions are routed by custom ID like clicks. While the bard is
+ * draining, only buttons registered as read-only get through.
+ *
+ * Application commands -- on a message's context menu (right-click,
+ * Apps), or slash commands -- are registered with Discord for the guild
+ * at startup. Context-menu commands call their handler with the ID of
+ * the message they were used on; slash commands read their options
+ * from the interaction.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var interactionLog = moduleLogger("interaction")
+
+type ComponentFunc func(s *discordgo.Session, i *discordgo.InteractionCreate, arg string)
+
+var componentHandlers = map[string]ComponentFunc{}
+
+// Components that change nothing, and so still work while draining.
+var readOnlyComponents = map[string]bool{}
+
+func RegisterComponent(name string, handler ComponentFunc) {
+	componentHandlers[name] = handler
+}
+
+// Like RegisterComponent(), for buttons that only look at things.
+func RegisterReadOnlyComponent(name string, handler ComponentFunc) {
+	RegisterComponent(name, handler)
+	readOnlyComponents[name] = true
+}
+
+// Make the custom ID for a button that calls the handler NAME with ARG.
+func componentID(name string, arg string) string {
+	return name + ":" + arg
+}
+
+// A command registered with Discord: on a context menu, or a slash command.
+type AppCommand struct {
+	Command *discordgo.ApplicationCommand
+	Handler ComponentFunc
+}
+
+// Application commands, by the name shown in Discord.
+var appCommands = map[string]AppCommand{}
+
+func RegisterMenuCommand(name string, handler ComponentFunc) {
+	appCommands[name] = AppCommand{
+		Command: &discordgo.ApplicationCommand{
+			Name: name,
+			Type: discordgo.MessageApplicationCommand,
+		},
+		Handler: handler,
+	}
+}
+
+func RegisterSlashCommand(command *discordgo.ApplicationCommand, handler ComponentFunc) {
+	command.Type = discordgo.ChatApplicationCommand
+	appCommands[command.Name] = AppCommand{Command: command, Handler: handler}
+}
+
+/*
+ * Tell Discord about the application commands, replacing whatever the
+ * guild had from us before. This needs the applications.commands scope,
+ * which older invites didn't ask for, so failing is only logged.
+ */
+func StartAppCommands(s *discordgo.Session) {
+	commands := []*discordgo.ApplicationCommand{}
+	for _, command := range appCommands {
+		commands = append(commands, command.Command)
+	}
+
+	_, err := s.ApplicationCommandBulkOverwrite(Settings.ClientID, Settings.GuildID, commands)
+	if err != nil {
+		interactionLog.Warn("Couldn't register application commands; the bard may "+
+			"need inviting again with the applications.commands scope", "err", err)
+	}
+}
+
+func interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	defer recoverEvent("interactionCreate")
+
+	if i.GuildID != Settings.GuildID {
+		return
+	}
+
+	var name, arg string
+	var handler ComponentFunc
+	var ok bool
+	switch i.Type {
+	case discordgo.InteractionMessageComponent, discordgo.InteractionModalSubmit:
+		if i.Type == discordgo.InteractionMessageComponent {
+			name = i.MessageComponentData().CustomID
+		} else {
+			name = i.ModalSubmitData().CustomID
+		}
+		if sep := strings.Index(name, ":"); sep >= 0 {
+			name, arg = name[:sep], name[sep+1:]
+		}
+
+		if handler, ok = componentHandlers[name]; !ok {
+			interactionLog.Warn("Unknown component", "component", name)
+			return
+		}
+	case discordgo.InteractionApplicationCommand:
+		// Context-menu commands get the message they were used on.
+		data := i.ApplicationCommandData()
+		name, arg = data.Name, data.TargetID
+
+		var command AppCommand
+		if command, ok = appCommands[name]; !ok {
+			interactionLog.Warn("Unknown application command", "command", name)
+			return
+		}
+		handler = command.Handler
+	default:
+		return
+	}
+
+	ctx := interactionContext(s, i)
+	ctx.CommandName = name
+	defer recoverCommand(ctx)
+
+	if userBanned(ctx.Event.Author.ID) {
+		interactionLog.Info("Ignored an interaction from a barred user", "interaction", name,
+			"user", ctx.Event.Author.ID)
+		replyEphemeral(s, i, "Sire, you've been barred from my commands.")
+		return
+	}
+
+	// Nothing gets written while draining; see drain.go.
+	readOnly := i.Type == discordgo.InteractionMessageComponent && readOnlyComponents[name]
+	if Drain.Active() && !readOnly {
+		replyEphemeral(s, i, drainNotice())
+		return
+	}
+
+	// Buttons live wherever I put them, but commands keep to their channels.
+	if i.Type == discordgo.InteractionApplicationCommand &&
+		!commandChannelAllowed(s, i.ChannelID, ctx.Event.Author.ID) {
+		replyEphemeral(s, i, "Sire, I take commands in "+commandChannelMentions()+".")
+		return
+	}
+
+	handler(s, i, arg)
+}
+
+/*
+ * Dress up a component click as a command context, so handlers can use
+ * the same permission checks and replies that commands do.
+ */
+func interactionContext(s *discordgo.Session, i *discordgo.InteractionCreate) *CommandContext {
+	return &CommandContext{
+		Session: s,
+		Event: &discordgo.MessageCreate{Message: &discordgo.Message{
+			ChannelID: i.ChannelID,
+			GuildID:   i.GuildID,
+			Author:    i.Member.User,
+			Member:    i.Member,
+		}},
+		Prefix: Settings.Prefix,
+	}
+}
+
+// Replace the message the clicked component is on.
+func updateComponentMessage(s *discordgo.Session, i *discordgo.InteractionCreate,
+	data *discordgo.InteractionResponseData) error {
+
+	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: data,
+	})
+}
+
+// Answer an interaction with a message only whoever used it can see.
+func replyEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, message string) error {
+	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: message,
+			Flags:   uint64(discordgo.MessageFlagsEphemeral),
+		},
+	})
+}
+
+// The values typed into a submitted modal's text inputs, by custom ID.
+func modalValues(i *discordgo.InteractionCreate) map[string]string {
+	values := map[string]string{}
+	for _, row := range i.ModalSubmitData().Components {
+		actions, ok := row.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, component := range actions.Components {
+			if input, ok := component.(*discordgo.TextInput); ok {
+				values[input.CustomID] = input.Value
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,109 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * killswitch.go - The kill switch. While it's on, the bard goes through
+ * the motions of setting banners -- fetching images, picking tags,
+ * logging -- but never actually calls GuildEdit. It's for when Discord
+ * is having an incident, or the guild is under review and shouldn't
+ * change.
+ *
+ * It can be forced on with the KillSwitch setting or the
+ * BANNER_BARD_KILLSWITCH environment variable, or flipped at runtime
+ * with `killswitch on|off`, which is remembered in the database. The
+ * setting's on unless it's plainly off (see truthy()), so a value that
+ * doesn't parse never leaves the switch off.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"sync"
+)
+
+var killswitchLog = moduleLogger("killswitch")
+
+const killSwitchKey = "killswitch"
+
+type KillSwitchState struct {
+	mutex   sync.Mutex
+	forced  bool // by the KillSwitch setting, see config.go
+	flipped bool // by the killswitch command
+}
+
+var KillSwitch KillSwitchState
+
+// Read the kill switch from the settings and database.
+func (ks *KillSwitchState) Load() error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	ks.forced = Settings.KillSwitch
+
+	value, err := getSetting(killSwitchKey)
+	ks.flipped = value == "on"
+	return err
+}
+
+func (ks *KillSwitchState) Engaged() bool {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	return ks.forced || ks.flipped
+}
+
+func (ks *KillSwitchState) Forced() bool {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	return ks.forced
+}
+
+func (ks *KillSwitchState) Flip(on bool) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	value := "off"
+	if on {
+		value = "on"
+	}
+
+	if err := putSetting(killSwitchKey, value); err != nil {
+		return err
+	}
+
+	ks.flipped = on
+	return nil
+}
+
+func cmdKillSwitch(ctx *CommandContext, args []string) {
+	if len(args) == 0 {
+		if KillSwitch.Engaged() {
+			ctx.Reply("Sire, the kill switch is on. I'm only pretending to change banners.")
+		} else {
+			ctx.Reply("Sire, the kill switch is off.")
+		}
+		return
+	}
+
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		ctx.SendUsage()
+		return
+	}
+
+	on := args[0] == "on"
+	err := KillSwitch.Flip(on)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	killswitchLog.Warn("Kill switch flipped", "state", args[0], "user", ctx.Event.Author.ID)
+
+	if !on && KillSwitch.Forced() {
+		ctx.Reply("Sire, the kill switch is forced on by my settings, " +
+			"so it'll stay on until those are changed.")
+		return
+	}
+
+	ctx.Ack()
+}
@@ -0,0 +1,303 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * lanes.go - Schedule lanes, so more than one schedule can run at once.
+ * Each lane is a BannerScheduler of its own, with its own picker and
+ * ticker, and puts its tags up in its own place: the banner lane and
+ * the override lane as the banner, the icon lane as the server icon,
+ * and the splash lane as the invite splash. While the override lane is
+ * running, the banner lane holds off, so a rotation can be laid over
+ * the usual one and the usual one picks back up once it's stopped.
+ *
+ * The banner lane is the one Scheduler points to. Only it minds
+ * one-shots, event rules, Twitch, the calendar, and holidays, and most
+ * schedule commands work on it alone; `shuffle`, `cycle`, and `play`
+ * take `--lane LANE` to run on another, `stop LANE` stops one, and
+ * `schedules` lists them all. The banner lane's schedule is saved in
+ * the schedule table, as ever, and the others' as settings.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var laneLog = moduleLogger("lanes")
+
+const (
+	LaneBanner   = "banner"
+	LaneIcon     = "icon"
+	LaneSplash   = "splash"
+	LaneOverride = "override"
+)
+
+// The lanes, in the order they're listed.
+var LaneNames = []string{LaneBanner, LaneIcon, LaneSplash, LaneOverride}
+
+// The setting a lane's saved schedule is kept under, with the lane's name after.
+const laneScheduleKey = "schedule:"
+
+type ScheduleManager struct {
+	lanes map[string]*BannerScheduler
+}
+
+var Lanes *ScheduleManager
+
+func NewScheduleManager(s *discordgo.Session) *ScheduleManager {
+	manager := &ScheduleManager{lanes: map[string]*BannerScheduler{}}
+	for _, name := range LaneNames {
+		lane := NewScheduler(s)
+		lane.lane = name
+		switch name {
+		case LaneIcon:
+			lane.setter = setIcon
+		case LaneSplash:
+			lane.setter = setSplash
+		}
+		manager.lanes[name] = lane
+	}
+	return manager
+}
+
+// A lane by name, ignoring case. An empty name is the banner lane.
+func (manager *ScheduleManager) Lane(name string) (*BannerScheduler, bool) {
+	if name == "" {
+		name = LaneBanner
+	}
+	lane, ok := manager.lanes[strings.ToLower(name)]
+	return lane, ok
+}
+
+// Start every lane's scheduler in the background.
+func (manager *ScheduleManager) Start(s *discordgo.Session) {
+	for _, name := range LaneNames {
+		go manager.lanes[name].StartJob(s)
+	}
+}
+
+// Stop every lane for good; see BannerScheduler.Shutdown().
+func (manager *ScheduleManager) Shutdown() {
+	for _, name := range LaneNames {
+		manager.lanes[name].Shutdown()
+	}
+}
+
+// Resume each lane's saved schedule, returning the lanes that had one.
+func (manager *ScheduleManager) Restore() (restored []string, errs []error) {
+	for _, name := range LaneNames {
+		ok, err := manager.lanes[name].Restore()
+		if ok {
+			restored = append(restored, name)
+		}
+		errs = append(errs, err)
+	}
+	return restored, errs
+}
+
+// Stop every lane, returning those that were running.
+func (manager *ScheduleManager) StopAll() (stopped []string) {
+	for _, name := range LaneNames {
+		if manager.lanes[name].Stop() {
+			stopped = append(stopped, name)
+		}
+	}
+	return stopped
+}
+
+/*
+ * Save the schedules of the given lanes, for Restore() after a restart,
+ * and forget those of the rest.
+ */
+func (manager *ScheduleManager) Save(lanes []string) error {
+	for _, name := range LaneNames {
+		var err error
+		if contains(lanes, name) {
+			err = manager.lanes[name].Save()
+		} else {
+			err = clearLaneSchedule(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The running schedules of every lane.
+func (manager *ScheduleManager) Schedules() (schedules []ScheduleInfo) {
+	for _, name := range LaneNames {
+		schedules = append(schedules, manager.lanes[name].Schedules()...)
+	}
+	return schedules
+}
+
+// Find a running schedule by label, ignoring case, in whichever lane it's in.
+func (manager *ScheduleManager) Schedule(label string) (ScheduleInfo, bool) {
+	for _, name := range LaneNames {
+		if info, ok := manager.lanes[name].Schedule(label); ok {
+			return info, true
+		}
+	}
+	return ScheduleInfo{}, false
+}
+
+// Stop the running schedule with the label. Returns false if there isn't one.
+func (manager *ScheduleManager) StopLabel(label string) bool {
+	info, ok := manager.Schedule(label)
+	if !ok {
+		return false
+	}
+	return manager.lanes[info.Lane].Stop()
+}
+
+// Whether the override lane is running, and so the banner lane holds off.
+func (manager *ScheduleManager) overriding() bool {
+	if manager == nil {
+		return false
+	}
+	return manager.lanes[LaneOverride].Active()
+}
+
+/*
+ * Take a `--lane LANE` out of a schedule command's arguments, giving the
+ * lane it names, or the banner lane if there's none. Replies and returns
+ * false if the lane is missing or unknown.
+ */
+func scheduleLane(ctx *CommandContext, args []string) (lane *BannerScheduler,
+	rest []string, ok bool) {
+
+	name := ""
+	rest = []string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--lane" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 == len(args) {
+			ctx.SendUsage()
+			return nil, nil, false
+		}
+		name = args[i+1]
+		i++
+	}
+
+	if lane, ok = Lanes.Lane(name); !ok {
+		ctx.Reply("Sire, I have no lane called **" + name + "**; there's " +
+			strings.Join(LaneNames, ", ") + ".")
+		return nil, nil, false
+	}
+	return lane, rest, true
+}
+
+// Saved schedules
+
+func saveLaneSchedule(lane string, schedule SavedSchedule) error {
+	if lane == LaneBanner {
+		return saveSchedule(schedule)
+	}
+
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return putSetting(laneScheduleKey+lane, string(data))
+}
+
+func loadLaneSchedule(lane string) (schedule SavedSchedule, ok bool, err error) {
+	if lane == LaneBanner {
+		return loadSchedule()
+	}
+
+	data, err := getSetting(laneScheduleKey + lane)
+	if err != nil || data == "" {
+		return schedule, false, err
+	}
+	err = json.Unmarshal([]byte(data), &schedule)
+	return schedule, err == nil, err
+}
+
+func clearLaneSchedule(lane string) error {
+	if lane == LaneBanner {
+		return clearSchedule()
+	}
+	return putSetting(laneScheduleKey+lane, "")
+}
+
+// Setters
+
+// Put a tag up as the server icon. GIFs stay animated if the guild can animate its icon.
+func setIcon(s *discordgo.Session, name string, source string) error {
+	return setGuildImage(s, name, "icon")
+}
+
+// Put a tag up as the invite splash, which never animates.
+func setSplash(s *discordgo.Session, name string, source string) error {
+	return setGuildImage(s, name, "splash")
+}
+
+/*
+ * Put a tag up as one of the guild's images other than the banner,
+ * "icon" or "splash". Unlike setBanner(), the image isn't cropped or
+ * fitted, since Discord takes icons and splashes of most shapes, and
+ * the tag's showing isn't counted in its stats.
+ */
+func setGuildImage(s *discordgo.Session, name string, field string) error {
+	bannerMutex.Lock()
+	defer bannerMutex.Unlock()
+
+	tag, err := namedTag(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := fetchImage(tag.Url)
+	if err != nil {
+		return err
+	}
+
+	if err = checkImageMemory(data); err != nil {
+		return err
+	}
+
+	data, filetype, err := bannerImage(data, imageType(tag.Url))
+	if err != nil {
+		return err
+	}
+
+	if filetype == "gif" {
+		animates := false
+		if field == "icon" {
+			guild, err := cachedGuild(s)
+			if err != nil {
+				return err
+			}
+			animates = guild.PremiumTier >= discordgo.PremiumTier1 ||
+				contains(guild.Features, "ANIMATED_ICON")
+		}
+
+		if !animates {
+			if data, err = gifFrame(data, Settings.GifFallbackFrame); err != nil {
+				return err
+			}
+			filetype = "png"
+		}
+	}
+
+	if KillSwitch.Engaged() {
+		laneLog.Info("Kill switch is on; would have set the "+field, "tag", tag.Name)
+		return nil
+	}
+
+	if _, err = streamGuildEdit(s, field, data, filetype); err != nil {
+		return explainDiscordError(err)
+	}
+	laneLog.Info("Set the "+field, "tag", tag.Name)
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * lock.go - Locked tags and playlists. `lock TAG` keeps a tag from being
+ * replaced or deleted, by anyone, until it's unlocked with `unlock
+ * TAG`; `playlist lock PLAYLIST` keeps a playlist from being changed.
+ * It's for the banners that matter, like the default one, or those
+ * events put up, which nobody should lose by a slip of the keyboard.
+ *
+ * Locks are kept in the database and checked there, by insertTag(),
+ * delTag(), and the playlist edits, so nothing gets around them; they
+ * return ErrTagLocked or ErrPlaylistLocked, which handleLockErrors()
+ * explains. Deleting a tag still takes it out of a locked playlist, so
+ * lock its tags too, if they matter as much.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+var lockLog = moduleLogger("lock")
+
+/*
+ * Reply to an error from changing a tag or playlist named name, saying
+ * so if it's locked; return whether there was an error.
+ */
+func handleLockErrors(ctx *CommandContext, name string, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrTagLocked):
+		ctx.Reply("Sire, **" + normTag(name) + "** is locked. `" + Settings.Prefix +
+			"unlock` it first, if you're sure.")
+	case errors.Is(err, ErrPlaylistLocked):
+		ctx.Reply("Sire, the playlist **" + name + "** is locked. `" + Settings.Prefix +
+			"playlist unlock` it first, if you're sure.")
+	default:
+		return handleCommandErrors(ctx, SqlError, err)
+	}
+	return true
+}
+
+func cmdLock(ctx *CommandContext, args []string) {
+	switch len(args) {
+	case 0:
+		tags, playlists, err := allLocks()
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+		if len(tags) == 0 && len(playlists) == 0 {
+			ctx.Reply("Sire, nothing's locked.")
+			return
+		}
+
+		buf := bytes.Buffer{}
+		buf.WriteString("What's locked, sire:")
+		for _, tag := range tags {
+			buf.WriteString("\ntag **" + tag + "**")
+		}
+		for _, playlist := range playlists {
+			buf.WriteString("\nplaylist **" + playlist + "**")
+		}
+		ctx.ReplyLong(buf.String())
+	case 1:
+		lockTag(ctx, args[0], true)
+	default:
+		ctx.SendUsage()
+	}
+}
+
+func cmdUnlock(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+	lockTag(ctx, args[0], false)
+}
+
+func lockTag(ctx *CommandContext, name string, locked bool) {
+	found, err := setTagLocked(name, locked)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !found {
+		ctx.Reply("Sire, I don't recall any tags named `" + name + "`.")
+		return
+	}
+
+	lockLog.Info("Changed a tag's lock", "tag", normTag(name), "locked", locked,
+		"user", ctx.Event.Author.ID)
+	if locked {
+		ctx.Reply("Sire, **" + normTag(name) + "** is locked; nobody may replace or " +
+			"delete it until it's unlocked.")
+	} else {
+		ctx.Reply("Sire, **" + normTag(name) + "** is unlocked.")
+	}
+}
+
+func cmdPlaylistLock(ctx *CommandContext, args []string) {
+	lockPlaylist(ctx, args, true)
+}
+
+func cmdPlaylistUnlock(ctx *CommandContext, args []string) {
+	lockPlaylist(ctx, args, false)
+}
+
+func lockPlaylist(ctx *CommandContext, args []string, locked bool) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+	playlist := args[0]
+
+	exists, err := playlistExists(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !exists {
+		ctx.Reply("Sire, I don't remember a playlist titled **" + playlist + "**.")
+		return
+	}
+
+	if handleCommandErrors(ctx, SqlError, setPlaylistLocked(playlist, locked)) {
+		return
+	}
+
+	lockLog.Info("Changed a playlist's lock", "playlist", playlist, "locked", locked,
+		"user", ctx.Event.Author.ID)
+	if locked {
+		ctx.Reply("Sire, the playlist **" + playlist + "** is locked; nobody may change " +
+			"it until it's unlocked.")
+	} else {
+		ctx.Reply("Sire, the playlist **" + playlist + "** is unlocked.")
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * logging.go - Leveled, structured logs. Each module logs through its
+ * own logger from moduleLogger(), which tags every line with the module
+ * and the guild, and takes fields for what the line is about:
+ *
+ *   schedulerLog.Info("Set the banner", "tag", tag)
+ *   commandLog.Warn("Refused disabled command", "command", name, "user", id)
+ *
+ * Keep field names to the usual ones (guild, module, command, tag,
+ * user, playlist, err) so the logs can be searched by them. LogLevel
+ * picks the least severe level written (debug, info, warn, or error),
+ * and LogFormat picks text or JSON (for log collectors). Both can be
+ * changed while the bard runs, since module loggers look the output up
+ * on every line rather than when they're made.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var LogFormats = []string{"text", "json"}
+
+// Where logs go, as LogLevel and LogFormat last set it up.
+var logOutput struct {
+	mutex   sync.RWMutex
+	writer  io.Writer
+	handler slog.Handler
+}
+
+var logLevel = new(slog.LevelVar)
+
+/*
+ * A handler that hands each record on to whatever logOutput holds at
+ * the time, with the attributes and groups it was made with.
+ */
+type switchHandler struct {
+	wraps []func(slog.Handler) slog.Handler
+}
+
+func (h *switchHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *switchHandler) Handle(ctx context.Context, record slog.Record) error {
+	logOutput.mutex.RLock()
+	handler := logOutput.handler
+	logOutput.mutex.RUnlock()
+
+	for _, wrap := range h.wraps {
+		handler = wrap(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *switchHandler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	wraps := append(append([]func(slog.Handler) slog.Handler{}, h.wraps...), wrap)
+	return &switchHandler{wraps: wraps}
+}
+
+func (h *switchHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithAttrs(attrs) })
+}
+
+func (h *switchHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithGroup(name) })
+}
+
+// The bard's root logger, for lines that don't belong to a module.
+var logger = slog.New(&switchHandler{})
+
+// The logger for one module, named after its file.
+func moduleLogger(module string) *slog.Logger {
+	return logger.With("module", module)
+}
+
+func init() {
+	logOutput.writer = os.Stdout
+	setupLogging("info", "text")
+}
+
+func checkLogLevel(value string) error {
+	var level slog.Level
+	return level.UnmarshalText([]byte(value))
+}
+
+func checkLogFormat(value string) error {
+	if !contains(LogFormats, value) {
+		return fmt.Errorf("%q isn't one of %s", value, strings.Join(LogFormats, ", "))
+	}
+	return nil
+}
+
+/*
+ * Point the logs at the given level and format. Values are checked
+ * when they're set, so bad ones fall back to info and text.
+ */
+func setupLogging(level string, format string) {
+	var lvl slog.Level
+	if lvl.UnmarshalText([]byte(level)) != nil {
+		lvl = slog.LevelInfo
+	}
+	logLevel.Set(lvl)
+
+	logOutput.mutex.Lock()
+	defer logOutput.mutex.Unlock()
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(logOutput.writer, options)
+	} else {
+		handler = slog.NewTextHandler(logOutput.writer, options)
+	}
+
+	if Settings.GuildID != "" {
+		handler = handler.WithAttrs([]slog.Attr{slog.String("guild", Settings.GuildID)})
+	}
+	logOutput.handler = handler
+}
+
+// Send the logs somewhere else, such as io.Discard.
+func setLogWriter(writer io.Writer) {
+	logOutput.mutex.Lock()
+	logOutput.writer = writer
+	logOutput.mutex.Unlock()
+
+	setupLogging(Settings.LogLevel, Settings.LogFormat)
+}
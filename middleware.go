@@ -0,0 +1,176 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * middleware.go - What every command goes through on its way to being
+ * run. evalCommand() and compound commands hand each command to
+ * runCommand(), which passes it along CommandMiddleware in order. Each
+ * step either calls next to carry on, or stops the command there,
+ * having replied if need be. Anything that should happen around every
+ * command belongs here, rather than in each command's body.
+ *
+ * Compound commands go through the steps too, with their own
+ * permissions, before their subcommand does; logging and timing only
+ * count the subcommand that's finally run.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A step a command goes through, see CommandMiddleware.
+type Middleware func(ctx *CommandContext, args []string, next CommandFunc)
+
+// The steps, outermost first.
+var CommandMiddleware = []Middleware{
+	recoverMiddleware,  // a panic is reported, not fatal
+	banMiddleware,      // the user isn't barred, see owners.go
+	channelMiddleware,  // it's in a command channel, see channels.go
+	permitMiddleware,   // the user may run it
+	drainMiddleware,    // nothing's changed while draining
+	disabledMiddleware, // it hasn't been turned off with `config disable`
+	cooldownMiddleware, // it isn't run too often, see cooldown.go
+	logMiddleware,      // it's logged
+	statsMiddleware,    // it's counted and timed, see `admin commands`
+}
+
+/*
+ * Run a command, by the name it was called by, through the middleware
+ * and then its Apply().
+ */
+func runCommand(ctx *CommandContext, cmd Command, name string, args []string) {
+	ctx.Command = cmd
+	ctx.CommandName = name
+
+	run := cmd.Apply
+	for i := len(CommandMiddleware) - 1; i >= 0; i-- {
+		step, next := CommandMiddleware[i], run
+		run = func(ctx *CommandContext, args []string) { step(ctx, args, next) }
+	}
+	run(ctx, args)
+}
+
+// Whether the command is a compound one, which only hands off to another.
+func compoundCommand(cmd Command) bool {
+	_, ok := cmd.(*CompoundCommand)
+	return ok
+}
+
+func recoverMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	defer recoverCommand(ctx)
+	next(ctx, args)
+}
+
+func permitMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if userPermitted(ctx, ctx.Command, args) {
+		next(ctx, args)
+	}
+}
+
+func drainMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if !refuseWhileDraining(ctx, ctx.Command) {
+		next(ctx, args)
+	}
+}
+
+func disabledMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if !refuseDisabled(ctx) {
+		next(ctx, args)
+	}
+}
+
+func logMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if !compoundCommand(ctx.Command) {
+		author := ctx.Event.Author
+		commandLog.Info("Invoked command", "command", ctx.CommandName,
+			"user", author.ID, "username", author.Username+"#"+author.Discriminator)
+	}
+	next(ctx, args)
+}
+
+// Metrics
+
+// How often a command has been run, and how long it's taken.
+type commandTiming struct {
+	runs    int64
+	total   time.Duration
+	longest time.Duration
+}
+
+var commandStats = struct {
+	mutex    sync.Mutex
+	commands map[string]*commandTiming
+}{commands: map[string]*commandTiming{}}
+
+func statsMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if compoundCommand(ctx.Command) {
+		next(ctx, args)
+		return
+	}
+
+	// Counted even if it panics, on the way back up to recoverMiddleware.
+	start := time.Now()
+	defer func() {
+		took := time.Since(start)
+		name := strings.TrimPrefix(ctx.CommandName, ctx.Prefix)
+
+		commandStats.mutex.Lock()
+		defer commandStats.mutex.Unlock()
+		timing, ok := commandStats.commands[name]
+		if !ok {
+			timing = &commandTiming{}
+			commandStats.commands[name] = timing
+		}
+		timing.runs++
+		timing.total += took
+		if took > timing.longest {
+			timing.longest = took
+		}
+	}()
+	next(ctx, args)
+}
+
+func cmdAdminCommands(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	type namedTiming struct {
+		name string
+		commandTiming
+	}
+	timings := []namedTiming{}
+	commandStats.mutex.Lock()
+	for name, timing := range commandStats.commands {
+		timings = append(timings, namedTiming{name, *timing})
+	}
+	commandStats.mutex.Unlock()
+
+	if len(timings) == 0 {
+		ctx.Reply("Sire, nobody's run a command since I woke.")
+		return
+	}
+
+	sort.Slice(timings, func(i, j int) bool {
+		if timings[i].runs != timings[j].runs {
+			return timings[i].runs > timings[j].runs
+		}
+		return timings[i].name < timings[j].name
+	})
+	lines := make([]string, len(timings))
+	for i, timing := range timings {
+		average := timing.total / time.Duration(timing.runs)
+		lines[i] = fmt.Sprintf("• `%s`: %d runs, %s on average, %s at most", timing.name,
+			timing.runs, average.Round(time.Millisecond), timing.longest.Round(time.Millisecond))
+	}
+	ctx.ReplyList("The commands run since I woke, sire:", lines, RenderPlain)
+}
@@ -0,0 +1,306 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * milestone.go - Banners for the guild's milestones. A milestone puts a
+ * tag up for a while, as `at` would (it's a one-shot that's due at
+ * once), when the guild
+ *
+ *   members      reaches a member count, once
+ *   boost-up     goes up a boost level
+ *   boost-down   goes down one
+ *
+ * Member counts follow GuildMemberAdd, which needs the Server Members
+ * intent: the bard asks for it when it starts, if there are member
+ * milestones, so it must be turned on in the Developer Portal. Boost
+ * levels follow GuildUpdate. The last boost level seen is kept under
+ * boostLevelKey, so changes made while the bard was down still count
+ * once it's back (GuildCreate is checked as well).
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var milestoneLog = moduleLogger("milestone")
+
+const boostLevelKey = "boost_level"
+
+// Events come in on their own goroutines; one check at a time.
+var milestoneMutex sync.Mutex
+
+// Whether any member milestones are waiting, so the intent's needed.
+func memberMilestonesWaiting() (bool, error) {
+	milestones, err := allMilestones()
+	for _, milestone := range milestones {
+		if milestone.Kind == "members" && !milestone.Fired {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// Put the milestone's tag up now, for as long as it says.
+func fireMilestone(milestone Milestone, why string) error {
+	shot := OneShot{At: time.Now(), Tag: milestone.Tag, RevertAfter: milestone.For,
+		AuthorID: firstOwner()}
+
+	id, err := insertOneShot(shot)
+	if err != nil {
+		return err
+	}
+	milestoneLog.Info("Milestone reached; setting the banner", "milestone", milestone.ID,
+		"why", why, "tag", milestone.Tag, "for", milestone.For, "oneshot", id)
+
+	// Before the scheduler starts, it'll find the one-shot by itself.
+	if Scheduler != nil {
+		Scheduler.Rearm()
+	}
+	return nil
+}
+
+/*
+ * Fire the member milestones the count has reached. Only the highest
+ * goes up, if several are reached at once; they're all spent.
+ */
+func checkMemberMilestones(count int) error {
+	milestones, err := allMilestones()
+	if err != nil {
+		return err
+	}
+
+	var highest *Milestone
+	for i, milestone := range milestones {
+		if milestone.Kind != "members" || milestone.Fired || count < milestone.Count {
+			continue
+		}
+
+		if err = setMilestoneFired(milestone.ID); err != nil {
+			return err
+		}
+		if highest == nil || milestone.Count > highest.Count {
+			highest = &milestones[i]
+		}
+	}
+
+	if highest == nil {
+		return nil
+	}
+	return fireMilestone(*highest, fmt.Sprintf("%d members", count))
+}
+
+// Fire the boost milestones for a change of level, if it's changed.
+func checkBoostMilestones(level discordgo.PremiumTier) error {
+	last, err := getSetting(boostLevelKey)
+	if err != nil {
+		return err
+	}
+
+	current := strconv.Itoa(int(level))
+	if last == current {
+		return nil
+	} else if err = putSetting(boostLevelKey, current); err != nil || last == "" {
+		// The first level seen is where things start.
+		return err
+	}
+
+	kind := "boost-up"
+	if previous, _ := strconv.Atoi(last); int(level) < previous {
+		kind = "boost-down"
+	}
+
+	milestones, err := allMilestones()
+	if err != nil {
+		return err
+	}
+	for _, milestone := range milestones {
+		if milestone.Kind == kind {
+			why := fmt.Sprintf("boost level %s to %s", last, current)
+			return fireMilestone(milestone, why)
+		}
+	}
+	return nil
+}
+
+func milestoneGuild(guild *discordgo.Guild) {
+	if guild.ID != Settings.GuildID {
+		return
+	}
+
+	milestoneMutex.Lock()
+	defer milestoneMutex.Unlock()
+
+	err := checkBoostMilestones(guild.PremiumTier)
+	if err == nil && guild.MemberCount > 0 {
+		err = checkMemberMilestones(guild.MemberCount)
+	}
+	if err != nil {
+		milestoneLog.Error("Error while checking milestones", "err", err)
+	}
+}
+
+func milestoneGuildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
+	defer recoverEvent("milestoneGuildCreate")
+	milestoneGuild(event.Guild)
+}
+
+func milestoneGuildUpdate(s *discordgo.Session, event *discordgo.GuildUpdate) {
+	defer recoverEvent("milestoneGuildUpdate")
+	milestoneGuild(event.Guild)
+}
+
+func milestoneMemberAdd(s *discordgo.Session, event *discordgo.GuildMemberAdd) {
+	defer recoverEvent("milestoneMemberAdd")
+
+	if event.GuildID != Settings.GuildID {
+		return
+	}
+
+	// The state's counted the new member already.
+	guild, err := s.State.Guild(event.GuildID)
+	if err != nil {
+		return
+	}
+
+	milestoneMutex.Lock()
+	defer milestoneMutex.Unlock()
+	if err = checkMemberMilestones(guild.MemberCount); err != nil {
+		milestoneLog.Error("Error while checking milestones", "err", err)
+	}
+}
+
+func cmdMilestoneAdd(ctx *CommandContext, args []string) {
+	if len(args) < 3 {
+		ctx.SendUsage()
+		return
+	}
+
+	milestone := Milestone{Kind: args[0]}
+	switch {
+	case milestone.Kind == "members" && len(args) == 4:
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 1 {
+			ctx.Reply("Sire, the member count should be a number.")
+			return
+		}
+		milestone.Count = count
+		args = args[2:]
+	case (milestone.Kind == "boost-up" || milestone.Kind == "boost-down") && len(args) == 3:
+		args = args[1:]
+	default:
+		ctx.SendUsage()
+		return
+	}
+
+	var err error
+	milestone.Tag = args[0]
+	milestone.For, err = parseTime(args[1])
+	if err != nil || milestone.For <= 0 {
+		ctx.Reply("Sire, I can't understand the time format **" + args[1] + "**.")
+		return
+	}
+
+	exists, err := tagExists(milestone.Tag)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + milestone.Tag + "`.")
+		return
+	}
+
+	// A count that's been passed already would go off at once.
+	guild, err := ctx.Session.State.Guild(Settings.GuildID)
+	passed := milestone.Kind == "members" && err == nil &&
+		guild.MemberCount >= milestone.Count
+	milestone.Fired = passed
+
+	milestone.ID, err = insertMilestone(milestone)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	milestoneLog.Info("Added a milestone", "milestone", milestone.ID, "kind", milestone.Kind,
+		"count", milestone.Count, "tag", milestone.Tag)
+
+	switch {
+	case passed:
+		ctx.Reply(fmt.Sprintf("Sire, we're %d strong already, so that one's been "+
+			"reached. I'll keep it, but it won't go off.", guild.MemberCount))
+	case milestone.Kind == "members" &&
+		ctx.Session.Identify.Intents&discordgo.IntentsGuildMembers == 0:
+		ctx.Reply(fmt.Sprintf("Sire, at %d members, I'll put up **%s** for %s. "+
+			"I'll need the Server Members intent, and a restart, to count them.",
+			milestone.Count, milestone.Tag, milestone.For))
+	default:
+		ctx.Ack()
+	}
+}
+
+func cmdMilestoneRm(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		ctx.SendUsage()
+		return
+	}
+
+	ok, err := delMilestone(id)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	if !ok {
+		ctx.Reply("Sire, I have no milestone by that number.")
+		return
+	}
+	ctx.Ack()
+}
+
+func cmdMilestoneLs(ctx *CommandContext, args []string) {
+	milestones, err := allMilestones()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	if len(milestones) == 0 {
+		ctx.Reply("Sire, I'm not waiting on any milestones.")
+		return
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("The milestones I'm waiting on, sire:\n")
+	if guild, err := ctx.Session.State.Guild(Settings.GuildID); err == nil {
+		buf.WriteString(fmt.Sprintf("(We're %d strong, at boost level %d.)\n",
+			guild.MemberCount, guild.PremiumTier))
+	}
+
+	for _, milestone := range milestones {
+		switch milestone.Kind {
+		case "members":
+			buf.WriteString(fmt.Sprintf("\n`%d` **%s** for %s at %d members",
+				milestone.ID, milestone.Tag, milestone.For, milestone.Count))
+			if milestone.Fired {
+				buf.WriteString(" (reached)")
+			}
+		case "boost-up":
+			buf.WriteString(fmt.Sprintf("\n`%d` **%s** for %s when the boost level goes up",
+				milestone.ID, milestone.Tag, milestone.For))
+		case "boost-down":
+			buf.WriteString(fmt.Sprintf("\n`%d` **%s** for %s when the boost level goes down",
+				milestone.ID, milestone.Tag, milestone.For))
+		}
+	}
+
+	ctx.ReplyLong(buf.String())
+}
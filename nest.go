@@ -0,0 +1,125 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * nest.go - Playlists of playlists. `playlist nest winter christmas
+ * newyear` includes christmas and newyear in winter, so winter plays
+ * their tags after its own, and changes to them show up in winter
+ * without being copied over. Nested playlists may have their own nested
+ * in turn.
+ *
+ * playlistTags() does the nesting, so everything that goes through a
+ * playlist (the schedule, seasons, holidays, the calendar) follows it.
+ * A playlist can't be nested inside itself, however deeply, and should
+ * one be anyway, it's gone through only once.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var nestLog = moduleLogger("nest")
+
+// Whether to is from, or nested in it, however deeply.
+func playlistReaches(from string, to string) (bool, error) {
+	visited := map[string]bool{}
+	next := []string{from}
+	for len(next) > 0 {
+		playlist := next[0]
+		next = next[1:]
+		if playlist == to {
+			return true, nil
+		} else if visited[playlist] {
+			continue
+		}
+		visited[playlist] = true
+
+		children, err := playlistChildren(playlist)
+		if err != nil {
+			return false, err
+		}
+		next = append(next, children...)
+	}
+	return false, nil
+}
+
+func cmdPlaylistNest(ctx *CommandContext, args []string) {
+	if len(args) < 2 {
+		ctx.SendUsage()
+		return
+	}
+	playlist, children := args[0], args[1:]
+
+	for _, child := range children {
+		exists, err := playlistExists(child)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if !exists {
+			ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", child))
+			return
+		}
+
+		loops, err := playlistReaches(child, playlist)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if loops {
+			ctx.Reply(fmt.Sprintf("Sire, **%s** is **%s** or has it nested inside; "+
+				"nesting it would go round in circles.", child, playlist))
+			return
+		}
+	}
+
+	snapshot, err := takeSnapshot(nil, []string{playlist})
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	nested, err := nestPlaylists(playlist, children)
+	if handleLockErrors(ctx, playlist, err) {
+		return
+	}
+	nestLog.Info("Nested playlists", "playlist", playlist, "children", children,
+		"count", nested, "user", ctx.Event.Author.ID)
+
+	if nested == 0 {
+		ctx.Reply("Sire, **" + playlist + "** has those nested already.")
+		return
+	}
+	ctx.Audit("playlist nest", playlist, strings.Join(children, ", "))
+	ctx.Journal("playlist nest", playlist, snapshot)
+	ctx.Reply(fmt.Sprintf("I'll play **%s** in **%s** from now on.",
+		strings.Join(children, "**, **"), playlist))
+}
+
+func cmdPlaylistUnnest(ctx *CommandContext, args []string) {
+	if len(args) < 2 {
+		ctx.SendUsage()
+		return
+	}
+	playlist, children := args[0], args[1:]
+
+	snapshot, err := takeSnapshot(nil, []string{playlist})
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	unnested, err := unnestPlaylists(playlist, children)
+	if handleLockErrors(ctx, playlist, err) {
+		return
+	}
+	nestLog.Info("Unnested playlists", "playlist", playlist, "children", children,
+		"count", unnested, "user", ctx.Event.Author.ID)
+
+	if unnested == 0 {
+		ctx.Reply("Sire, none of those are nested in **" + playlist + "**.")
+		return
+	}
+	ctx.Audit("playlist unnest", playlist, strings.Join(children, ", "))
+	ctx.Journal("playlist unnest", playlist, snapshot)
+	ctx.Reply(fmt.Sprintf("I'll take %d playlists out of **%s**.", unnested, playlist))
+}
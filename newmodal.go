@@ -0,0 +1,295 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * newmodal.go - `/new`, the slash-command way to make a tag. It opens a
+ * form asking for the tag's name, its image's URL, and a description,
+ * so nobody has to remember what order `new` wants them in. An image
+ * can be attached to the command instead of a URL.
+ *
+ * If something's wrong with what was filled in, the bard says what,
+ * with a button to open the form again as it was left. Forms are kept
+ * in memory until they're done, or for formKeepFor; a restart loses
+ * them, and `/new` has to be run again.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var newModalLog = moduleLogger("newmodal")
+
+// How long a form that's been opened is kept for.
+const formKeepFor = time.Hour
+
+// What's been filled in on a `/new` form so far.
+type newTagForm struct {
+	Name        string
+	URL         string
+	Description string
+	Attachment  string // the attached image's URL, if there is one
+	FileName    string // and its file name
+	opened      time.Time
+}
+
+// Forms that are open, by the ID of the interaction that opened them.
+var newTagForms = struct {
+	sync.Mutex
+	forms map[string]*newTagForm
+}{forms: map[string]*newTagForm{}}
+
+var NewSlashCommand = &discordgo.ApplicationCommand{
+	Name:        "new",
+	Description: "Make a new tag, or replace a preexisting tag",
+	Options: []*discordgo.ApplicationCommandOption{{
+		Type:        discordgo.ApplicationCommandOptionAttachment,
+		Name:        "image",
+		Description: "The tag's image, if it isn't at a URL",
+	}},
+}
+
+func keepForm(key string, form *newTagForm) {
+	newTagForms.Lock()
+	defer newTagForms.Unlock()
+
+	// Forget the forms nobody finished.
+	for old, kept := range newTagForms.forms {
+		if time.Since(kept.opened) > formKeepFor {
+			delete(newTagForms.forms, old)
+		}
+	}
+
+	form.opened = time.Now()
+	newTagForms.forms[key] = form
+}
+
+func keptForm(key string) *newTagForm {
+	newTagForms.Lock()
+	defer newTagForms.Unlock()
+	return newTagForms.forms[key]
+}
+
+func dropForm(key string) {
+	newTagForms.Lock()
+	defer newTagForms.Unlock()
+	delete(newTagForms.forms, key)
+}
+
+// The form, as a modal filled in as it was left.
+func newTagModal(key string, form *newTagForm) *discordgo.InteractionResponse {
+	urlLabel := "Image URL"
+	if form.Attachment != "" {
+		urlLabel = "Image URL (empty for the attachment)"
+	}
+
+	row := func(input discordgo.TextInput) discordgo.MessageComponent {
+		return discordgo.ActionsRow{Components: []discordgo.MessageComponent{input}}
+	}
+
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: componentID("new-tag", key),
+			Title:    "New tag",
+			Components: []discordgo.MessageComponent{
+				row(discordgo.TextInput{
+					CustomID:    "name",
+					Label:       "Tag name",
+					Style:       discordgo.TextInputShort,
+					Placeholder: "snowy",
+					Value:       form.Name,
+					Required:    true,
+					MaxLength:   100,
+				}),
+				row(discordgo.TextInput{
+					CustomID:    "url",
+					Label:       urlLabel,
+					Style:       discordgo.TextInputShort,
+					Placeholder: "https://example.com/snow.png",
+					Value:       form.URL,
+					Required:    form.Attachment == "",
+				}),
+				row(discordgo.TextInput{
+					CustomID:  "description",
+					Label:     "Description",
+					Style:     discordgo.TextInputParagraph,
+					Value:     form.Description,
+					MaxLength: 1000,
+				}),
+			},
+		},
+	}
+}
+
+// Whether whoever used the interaction may make tags, telling them if not.
+func refuseNewTag(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	ctx := interactionContext(s, i)
+	switch {
+	case commandDisabled("new"):
+		replyEphemeral(s, i, "Sire, making tags is turned off for now.")
+		return true
+	case !userHasPerms(ctx, PermDefault, ""):
+		replyEphemeral(s, i, "Sire, only those who may make tags can use this.")
+		return true
+	}
+	return refuseChanges(ctx)
+}
+
+func slashNew(s *discordgo.Session, i *discordgo.InteractionCreate, arg string) {
+	if refuseNewTag(s, i) {
+		return
+	}
+
+	form := &newTagForm{}
+	data := i.ApplicationCommandData()
+	for _, option := range data.Options {
+		id, _ := option.Value.(string)
+		if option.Name != "image" || data.Resolved == nil ||
+			data.Resolved.Attachments[id] == nil {
+			continue
+		}
+
+		attachment := data.Resolved.Attachments[id]
+		form.Attachment, form.FileName = attachment.URL, attachment.Filename
+		form.Name = strings.ToLower(strings.TrimSuffix(attachment.Filename,
+			path.Ext(attachment.Filename)))
+	}
+
+	keepForm(i.ID, form)
+	err := s.InteractionRespond(i.Interaction, newTagModal(i.ID, form))
+	handleCommandErrors(interactionContext(s, i), DiscordError, err)
+}
+
+// What's wrong with a filled-in form, if anything.
+func (form *newTagForm) problems() []string {
+	problems := []string{}
+	if form.Name == "" || strings.ContainsAny(form.Name, " \t\n") {
+		problems = append(problems, "A tag's name must be one word, like `snowy`.")
+	}
+
+	switch {
+	case form.URL != "":
+		if problem := imageTypeProblem(form.URL); problem != "" {
+			problems = append(problems, problem)
+		} else if !strings.HasPrefix(form.URL, "http://") &&
+			!strings.HasPrefix(form.URL, "https://") {
+			problems = append(problems, "The image URL should start with https://.")
+		}
+	case form.Attachment != "":
+		if problem := imageTypeProblem(form.FileName); problem != "" {
+			problems = append(problems, problem)
+		}
+	default:
+		problems = append(problems, "I need the image's URL, or an image attached to `/new`.")
+	}
+	return problems
+}
+
+func componentNewTag(s *discordgo.Session, i *discordgo.InteractionCreate, key string) {
+	if refuseNewTag(s, i) {
+		return
+	}
+
+	form := keptForm(key)
+	if form == nil {
+		replyEphemeral(s, i, "Sire, I've lost that form; run `/new` again.")
+		return
+	}
+
+	values := modalValues(i)
+	form.Name = strings.TrimSpace(values["name"])
+	form.URL = strings.TrimSpace(values["url"])
+	form.Description = strings.TrimSpace(values["description"])
+
+	if problems := form.problems(); len(problems) > 0 {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Sire, I can't make that tag yet:\n- " +
+					strings.Join(problems, "\n- "),
+				Flags: uint64(discordgo.MessageFlagsEphemeral),
+				Components: []discordgo.MessageComponent{discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{discordgo.Button{
+						Label:    "Fix it",
+						Style:    discordgo.PrimaryButton,
+						CustomID: componentID("new-tag-edit", key),
+					}},
+				}},
+			},
+		})
+		handleCommandErrors(interactionContext(s, i), DiscordError, err)
+		return
+	}
+
+	ctx := interactionContext(s, i)
+	locked, err := tagLocked(form.Name)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if locked {
+		replyEphemeral(s, i, "Sire, **"+normTag(form.Name)+"** is locked. `"+
+			Settings.Prefix+"unlock` it first, if you're sure.")
+		return
+	}
+	if Settings.StrictOwnership {
+		author, err := otherTagAuthor(form.Name, i.Member.User.ID)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if author != "" && !userHasPerms(ctx, PermManageServer, "") {
+			replyEphemeral(s, i, othersTagMessage(form.Name, author))
+			return
+		}
+	}
+	dropForm(key)
+
+	url := form.URL
+	if url == "" {
+		url = form.Attachment
+	}
+
+	// Downloading the image can take longer than Discord waits for an answer.
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if handleCommandErrors(ctx, DiscordError, err) {
+		return
+	}
+
+	reply, err := rememberTag(form.Name, i.Member.User.ID, url)
+	if err == nil && form.Description != "" {
+		_, err = describeTag(form.Name, form.Description)
+	}
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	newModalLog.Info("Made a tag from the form", "tag", form.Name, "user", i.Member.User.ID)
+	ctx.Audit("tag new", normTag(form.Name), url)
+
+	_, err = s.InteractionResponseEdit(Settings.ClientID, i.Interaction,
+		&discordgo.WebhookEdit{Content: reply})
+	handleCommandErrors(ctx, DiscordError, err)
+}
+
+// Open the form again, as it was left, to fix what was wrong.
+func componentNewTagEdit(s *discordgo.Session, i *discordgo.InteractionCreate, key string) {
+	if refuseNewTag(s, i) {
+		return
+	}
+
+	form := keptForm(key)
+	if form == nil {
+		replyEphemeral(s, i, "Sire, I've lost that form; run `/new` again.")
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, newTagModal(key, form))
+	handleCommandErrors(interactionContext(s, i), DiscordError, err)
+}
@@ -0,0 +1,178 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * owners.go - Who may run anything, and who may run nothing. OwnerIDs
+ * lists my owners, separated by commas, who get past every permission
+ * check; an old settings file's OwnerID, or BANNER_BARD_OWNERID, is
+ * read as the only one. I won't start without one. The first owner is
+ * the one credited with what I put up on my own.
+ *
+ * `admin ban USER` bars a member from my commands, whatever roles they
+ * hold, until `admin unban USER`. The barred are kept in the blacklist
+ * table, and banMiddleware turns their commands away without a word, so
+ * there's nothing to spam; their clicks and slash commands get a quiet
+ * reply only they can see. The dashboard and API turn them away too,
+ * at login and on every request. Owners can't be barred.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ownersLog = moduleLogger("owners")
+
+// Read OwnerIDs, user IDs or mentions separated by commas.
+func parseOwnerIDs(value string) ([]string, error) {
+	owners := []string{}
+	for _, owner := range strings.Split(value, ",") {
+		owner = strings.TrimSpace(owner)
+		if owner == "" {
+			continue
+		}
+
+		id := parseUserID(owner)
+		if id == "" {
+			return nil, fmt.Errorf("%q isn't a user ID", owner)
+		}
+		owners = append(owners, id)
+	}
+	return owners, nil
+}
+
+func checkOwnerIDs(value string) error {
+	_, err := parseOwnerIDs(value)
+	return err
+}
+
+// My owners, see OwnerIDs.
+func ownerIDs() []string {
+	// Checked when loaded, so this can't fail
+	owners, _ := parseOwnerIDs(Settings.OwnerIDs)
+	return owners
+}
+
+func isOwner(userID string) bool {
+	return contains(ownerIDs(), userID)
+}
+
+// The owner credited with what I do on my own, or "" if I have none.
+func firstOwner() string {
+	if owners := ownerIDs(); len(owners) > 0 {
+		return owners[0]
+	}
+	return ""
+}
+
+/*
+ * Whether a user's barred from my commands. A blacklist that can't be
+ * looked up bars nobody, so a database hiccup can't lock everyone out.
+ */
+func userBanned(userID string) bool {
+	if isOwner(userID) {
+		return false
+	}
+
+	banned, err := blacklisted(userID)
+	if err != nil {
+		ownersLog.Error("Couldn't look up the blacklist", "user", userID, "err", err)
+	}
+	return banned
+}
+
+// Ignore commands from barred users, see `admin ban`.
+func banMiddleware(ctx *CommandContext, args []string, next CommandFunc) {
+	if userBanned(ctx.Event.Author.ID) {
+		ownersLog.Info("Ignored a command from a barred user", "command", ctx.CommandName,
+			"user", ctx.Event.Author.ID)
+		return
+	}
+	next(ctx, args)
+}
+
+func cmdAdminBan(ctx *CommandContext, args []string) {
+	if len(args) < 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	userID := parseUserID(args[0])
+	if userID == "" {
+		ctx.SendUsage()
+		return
+	}
+
+	if isOwner(userID) {
+		ctx.Reply("Sire, I can't bar one of my owners.")
+		return
+	}
+
+	reason := strings.Join(args[1:], " ")
+	err := blacklistUser(userID, reason, ctx.Event.Author.ID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	ownersLog.Info("Barred a user", "target", userID, "reason", reason,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
+
+func cmdAdminUnban(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	userID := parseUserID(args[0])
+	if userID == "" {
+		ctx.SendUsage()
+		return
+	}
+
+	removed, err := unblacklistUser(userID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !removed {
+		ctx.Reply("Sire, that user isn't barred.")
+		return
+	}
+
+	ownersLog.Info("Unbarred a user", "target", userID, "user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
+
+func cmdAdminBans(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	bans, err := blacklist()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(bans) == 0 {
+		ctx.Reply("Sire, nobody's barred from my commands.")
+		return
+	}
+
+	lines := make([]string, len(bans))
+	for i, ban := range bans {
+		lines[i] = fmt.Sprintf("• <@%s>, by <@%s> on %s", ban.UserID, ban.By,
+			ban.At.In(guildLocation()).Format("2006-01-02"))
+		if ban.Reason != "" {
+			lines[i] += ": " + ban.Reason
+		}
+	}
+	// In embeds, so the barred aren't pinged.
+	ctx.ReplyList("Barred from my commands", lines, RenderEmbed)
+}
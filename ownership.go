@@ -0,0 +1,106 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * ownership.go - Who a tag belongs to. A tag is its author's: with
+ * StrictOwnership on, only they, the owner, and members with Manage
+ * Server may replace it (with `new` or `/new`) or delete it, rather
+ * than anyone who may make tags. `transfer TAG USER` hands a tag to
+ * someone else, and is theirs to use whatever StrictOwnership says.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var ownershipLog = moduleLogger("ownership")
+
+/*
+ * The author of the tag, if it's someone other than userID, or "" if
+ * userID is its author or there's no such tag. Whether that keeps
+ * userID from changing it is up to Manage Server, and StrictOwnership.
+ */
+func otherTagAuthor(name string, userID string) (string, error) {
+	tag, err := namedTag(name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if tag.AuthorID == userID {
+		return "", nil
+	}
+	return tag.AuthorID, nil
+}
+
+func othersTagMessage(name string, author string) string {
+	return fmt.Sprintf("Sire, **%s** is <@%s>'s tag. Only they, my owner, or those "+
+		"with Manage Server may change it.", normTag(name), author)
+}
+
+// Whether someone else's tag is off limits to the command's user, telling them if so.
+func refuseOthersTag(ctx *CommandContext, name string) bool {
+	author, err := otherTagAuthor(name, ctx.Event.Author.ID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return true
+	} else if author == "" || userHasPerms(ctx, PermManageServer, "") {
+		return false
+	}
+
+	ctx.Session.ChannelMessageSendComplex(ctx.Event.ChannelID, &discordgo.MessageSend{
+		Content:         othersTagMessage(name, author),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	return true
+}
+
+// Like refuseOthersTag(), for replacing or deleting a tag, so only with StrictOwnership on.
+func refuseTagChange(ctx *CommandContext, name string) bool {
+	return Settings.StrictOwnership && refuseOthersTag(ctx, name)
+}
+
+func cmdTransfer(ctx *CommandContext, args []string) {
+	if len(args) != 2 {
+		ctx.SendUsage()
+		return
+	}
+
+	userID := parseUserID(args[1])
+	if userID == "" {
+		ctx.Reply("Sire, I need a member to give it to, as a mention or an ID.")
+		return
+	}
+
+	exists, err := tagExists(args[0])
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !exists {
+		ctx.Reply("Sire, I don't recall any tags named `" + args[0] + "`.")
+		return
+	}
+
+	if refuseOthersTag(ctx, args[0]) {
+		return
+	}
+
+	_, err = setTagAuthor(args[0], userID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	ownershipLog.Info("Transferred a tag", "tag", normTag(args[0]), "to", userID,
+		"user", ctx.Event.Author.ID)
+	ctx.Audit("tag transfer", normTag(args[0]), "to <@"+userID+">")
+
+	ctx.Session.ChannelMessageSendComplex(ctx.Event.ChannelID, &discordgo.MessageSend{
+		Content:         fmt.Sprintf("Sire, **%s** is <@%s>'s now.", normTag(args[0]), userID),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+}
@@ -0,0 +1,254 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * perms.go - `perms test`, which walks through whether someone may run
+ * a command and why, using the same checks the commands themselves do
+ * (see command.go:tracePerms()).
+ *
+ * Which commands a role may run is otherwise decided by the permission
+ * bits each command is built with in banner-bard.go:init(). `perms set`
+ * lets the owner give a command to more roles than those, without
+ * rebuilding me; the roles are kept in the command_permissions table,
+ * and `perms unset` takes a command back. A role given a subcommand
+ * may get through its compound command too, to reach it.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var permsLog = moduleLogger("perms")
+
+func cmdPermsTest(ctx *CommandContext, args []string) {
+	if len(args) < 2 || len(args) > 4 {
+		ctx.SendUsage()
+		return
+	}
+
+	userID := parseUserID(args[0])
+	if userID == "" {
+		ctx.SendUsage()
+		return
+	}
+
+	member, err := ctx.Session.GuildMember(Settings.GuildID, userID)
+	if err != nil {
+		ctx.Reply("Sire, I can't find that member here.")
+		return
+	}
+
+	// Channel permissions are worked out from the state, which may
+	// not have heard of them yet.
+	ctx.Session.State.MemberAdd(member)
+
+	cmd, ok := BardEvaluator.commandMap[args[1]]
+	if !ok {
+		ctx.Reply("Sire, I have no command named `" + args[1] + "`.")
+		return
+	}
+
+	// Anything after the command (and subcommand) is the playlist it's
+	// run on, for playlist crews.
+	_, isCompound := cmd.(*CompoundCommand)
+	playlist := ""
+	if len(args) == 4 || (len(args) == 3 && !isCompound) {
+		playlist = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+
+	name := strings.Join(args[1:], " ")
+
+	// Commands in a compound are checked twice: once for the compound,
+	// and once for the command in it.
+	checks := []Command{cmd}
+	names := []string{args[1]}
+	if compound, isCompound := cmd.(*CompoundCommand); isCompound && len(args) >= 3 {
+		sub, ok := compound.commandMap[args[2]]
+		if !ok {
+			ctx.Reply("Sire, I have no command named `" + name + "`.")
+			return
+		}
+		checks = append(checks, sub)
+		names = append(names, name)
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("Whether " + member.User.Mention() + " may run `" +
+		ctx.Prefix + name + "` in this channel:\n")
+
+	permitted := true
+	for i, check := range checks {
+		if len(checks) > 1 {
+			if i == 0 {
+				buf.WriteString("\n**" + args[1] + "**\n")
+			} else {
+				buf.WriteString("\n**" + name + "**\n")
+			}
+		}
+
+		ok, steps := tracePerms(ctx.Session, member, userID,
+			ctx.Event.ChannelID, check.Perms(), names[i], playlist)
+		buf.WriteString(strings.Join(steps, "\n") + "\n")
+		permitted = permitted && ok
+	}
+
+	last := checks[len(checks)-1]
+	if permitted && (commandDisabled(args[1]) || commandDisabled(name)) {
+		buf.WriteString("\nBut it's been disabled here, so I'd turn it away.")
+	} else if permitted && Drain.Active() && last.Perms()&FlagReadOnly == 0 {
+		buf.WriteString("\nBut I'm draining, so I'd turn it away for now.")
+	} else if permitted {
+		buf.WriteString("\nSo yes, they may.")
+	} else {
+		buf.WriteString("\nSo no, they may not.")
+	}
+
+	ctx.ReplyLong(buf.String())
+}
+
+/*
+ * Whether a member has a role given the command with `perms set`, with
+ * the step for tracePerms().
+ */
+func traceCommandRoles(member *discordgo.Member, command string) (bool, string) {
+	roles, err := commandRoles(command)
+	if err != nil {
+		permsLog.Error("Couldn't look up the roles given a command", "command", command,
+			"err", err)
+	}
+
+	if len(roles) == 0 {
+		return false, "· No role's been given `" + command + "` with `perms set`."
+	}
+
+	for _, role := range roles {
+		if member != nil && contains(member.Roles, role) {
+			return true, fmt.Sprintf(
+				"✓ <@&%s> was given `%s` with `perms set`, and they have it.", role, command)
+		}
+	}
+	return false, "· Some roles were given `" + command +
+		"` with `perms set`, but they have none of them."
+}
+
+/*
+ * Read `COMMAND [SUBCOMMAND] role ROLE`, for `perms set` and `perms
+ * unset`. Replies and returns false if it won't do.
+ */
+func parseCommandGrant(ctx *CommandContext, args []string) (command string,
+	role string, ok bool) {
+
+	if len(args) < 3 || len(args) > 4 || args[len(args)-2] != "role" {
+		ctx.SendUsage()
+		return "", "", false
+	}
+
+	role = parseRoleID(args[len(args)-1])
+	if role == "" {
+		ctx.SendUsage()
+		return "", "", false
+	}
+
+	args = args[:len(args)-2]
+	command = strings.Join(args, " ")
+	cmd, ok := BardEvaluator.commandMap[args[0]]
+	if len(args) == 2 {
+		compound, isCompound := cmd.(*CompoundCommand)
+		ok = isCompound
+		if ok {
+			_, ok = compound.commandMap[args[1]]
+		}
+	}
+	if !ok {
+		ctx.Reply("Sire, I have no command named `" + command + "`.")
+		return "", "", false
+	}
+
+	return command, role, true
+}
+
+func cmdPermsSet(ctx *CommandContext, args []string) {
+	command, role, ok := parseCommandGrant(ctx, args)
+	if !ok {
+		return
+	}
+
+	if _, err := ctx.Session.State.Role(Settings.GuildID, role); err != nil {
+		ctx.Reply("Sire, I can't find that role here.")
+		return
+	}
+
+	err := grantCommandRole(command, role)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	permsLog.Info("Gave a role a command", "command", command, "role", role,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
+
+func cmdPermsUnset(ctx *CommandContext, args []string) {
+	command, role, ok := parseCommandGrant(ctx, args)
+	if !ok {
+		return
+	}
+
+	revoked, err := revokeCommandRole(command, role)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !revoked {
+		ctx.Reply("Sire, " + roleName(ctx.Session, role) + " was never given `" +
+			command + "`.")
+		return
+	}
+
+	permsLog.Info("Took a command back from a role", "command", command, "role", role,
+		"user", ctx.Event.Author.ID)
+	ctx.Ack()
+}
+
+func cmdPermsList(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	perms, err := commandPermissions()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(perms) == 0 {
+		ctx.Reply("Sire, no role's been given a command; they run what they were built to.")
+		return
+	}
+
+	commands := make([]string, 0, len(perms))
+	for command := range perms {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	lines := make([]string, len(commands))
+	for i, command := range commands {
+		roles := make([]string, len(perms[command]))
+		for j, role := range perms[command] {
+			roles[j] = roleName(ctx.Session, role)
+		}
+		lines[i] = fmt.Sprintf("• `%s`: %s", command, strings.Join(roles, ", "))
+	}
+	ctx.ReplyList("The commands I've given roles, sire:", lines, RenderPlain)
+}
@@ -0,0 +1,313 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * poll.go - Votes on the next banner. `vote INTERVAL TAGS...` shows the
+ * candidates with a button each; anyone may vote, once, changing their
+ * mind as often as they like until the vote closes. Once INTERVAL is
+ * up, the bard counts the votes, sets the winner as the banner (as
+ * `set` would, stopping any schedule), and posts the results. Ties go
+ * to whichever tag was listed first.
+ *
+ * Polls and votes are kept in the database, and checked for closing
+ * every pollCheckEvery, so a restart loses nothing.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var pollLog = moduleLogger("poll")
+
+const (
+	pollCheckEvery = time.Minute
+	// Discord shows at most ten embeds on a message.
+	MaxPollTags = 10
+)
+
+// The message showing a poll's candidates, with a button for each.
+func pollMessage(poll Poll, tags []Tag) *discordgo.MessageSend {
+	embeds := []*discordgo.MessageEmbed{}
+	rows := []discordgo.MessageComponent{}
+	buttons := []discordgo.MessageComponent{}
+	for i, tag := range tags {
+		embeds = append(embeds, &discordgo.MessageEmbed{
+			Title: fmt.Sprintf("%d. %s", i+1, tag.Name),
+			Image: &discordgo.MessageEmbedImage{URL: tag.Url},
+		})
+
+		buttons = append(buttons, discordgo.Button{
+			Label:    fmt.Sprintf("%d. %s", i+1, tag.Name),
+			Style:    discordgo.SecondaryButton,
+			CustomID: componentID("vote", fmt.Sprintf("%d/%d", poll.ID, i)),
+		})
+		// Five buttons to a row.
+		if len(buttons) == 5 || i == len(tags)-1 {
+			rows = append(rows, discordgo.ActionsRow{Components: buttons})
+			buttons = []discordgo.MessageComponent{}
+		}
+	}
+
+	content := fmt.Sprintf("Sire, which banner next? Vote below; voting closes "+
+		"<t:%d:R>.", poll.ClosesAt.Unix())
+	if poll.Kind == "election" {
+		content = fmt.Sprintf("Sire, it's election day! Vote below for the banner "+
+			"of the week; voting closes <t:%d:R>.", poll.ClosesAt.Unix())
+	}
+
+	return &discordgo.MessageSend{
+		Content:    content,
+		Embeds:     embeds,
+		Components: rows,
+	}
+}
+
+// Save a poll, and post it for voting.
+func openPoll(s *discordgo.Session, poll Poll) (Poll, error) {
+	tags := []Tag{}
+	for _, name := range poll.Tags {
+		tag, err := namedTag(name)
+		if err != nil {
+			return poll, err
+		}
+		tags = append(tags, tag)
+	}
+
+	var err error
+	poll.ID, err = insertPoll(poll)
+	if err != nil {
+		return poll, err
+	}
+
+	message, err := s.ChannelMessageSendComplex(poll.ChannelID, pollMessage(poll, tags))
+	if err != nil {
+		delPoll(poll.ID)
+		return poll, explainDiscordError(err)
+	}
+
+	poll.MessageID = message.ID
+	pollLog.Info("Opened a vote", "poll", poll.ID, "kind", poll.Kind, "tags", poll.Tags,
+		"closes", poll.ClosesAt)
+	return poll, setPollMessage(poll.ID, message.ID)
+}
+
+func cmdVote(ctx *CommandContext, args []string) {
+	if len(args) < 3 {
+		ctx.SendUsage()
+		return
+	}
+
+	interval, ok := parseInterval(ctx, args[0])
+	if !ok {
+		return
+	}
+
+	names := []string{}
+	for _, name := range normTags(args[1:]) {
+		if !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) < 2 {
+		ctx.Reply("Sire, a vote needs two tags at least.")
+		return
+	} else if len(names) > MaxPollTags {
+		ctx.Reply(fmt.Sprintf("Sire, I can only show %d tags in a vote.", MaxPollTags))
+		return
+	}
+
+	for _, name := range names {
+		exists, err := tagExists(name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if !exists {
+			ctx.Reply("Sire, I don't recall any tags named `" + name + "`.")
+			return
+		}
+	}
+
+	_, err := openPoll(ctx.Session, Poll{Kind: "vote", ChannelID: ctx.Event.ChannelID,
+		AuthorID: ctx.Event.Author.ID, ClosesAt: time.Now().Add(interval), Tags: names})
+	handleCommandErrors(ctx, GeneralError, err)
+}
+
+func componentVote(s *discordgo.Session, i *discordgo.InteractionCreate, arg string) {
+	ctx := interactionContext(s, i)
+	ids := strings.SplitN(arg, "/", 2)
+	if len(ids) != 2 {
+		return
+	}
+	id, err := strconv.ParseInt(ids[0], 10, 64)
+	if err != nil {
+		return
+	}
+	position, err := strconv.Atoi(ids[1])
+	if err != nil {
+		return
+	}
+
+	poll, ok, err := pollByID(id)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !ok || time.Now().After(poll.ClosesAt) {
+		replyEphemeral(s, i, "Sire, that vote's closed.")
+		return
+	} else if position < 0 || position >= len(poll.Tags) {
+		return
+	}
+
+	tag := poll.Tags[position]
+	if handleCommandErrors(ctx, SqlError, castVote(id, i.Member.User.ID, tag)) {
+		return
+	}
+	replyEphemeral(s, i, fmt.Sprintf("Sire, your vote is for **%s**. You may change "+
+		"it until the vote closes <t:%d:R>.", tag, poll.ClosesAt.Unix()))
+}
+
+/*
+ * The poll's results, most votes first, and its winner: the tag with
+ * the most votes, or the first listed of those tied. The winner is ""
+ * if nobody voted.
+ */
+func pollResults(poll Poll, tally map[string]int) (order []string, winner string) {
+	order = append(order, poll.Tags...)
+	sort.SliceStable(order, func(a, b int) bool {
+		return tally[order[a]] > tally[order[b]]
+	})
+
+	if len(order) > 0 && tally[order[0]] > 0 {
+		winner = order[0]
+	}
+	return order, winner
+}
+
+// Count a poll's votes, put up the winner, and say how it went.
+func closePoll(s *discordgo.Session, poll Poll) error {
+	tally, err := pollTally(poll.ID)
+	if err != nil {
+		return err
+	}
+	if _, err = delPoll(poll.ID); err != nil {
+		return err
+	}
+
+	order, winner := pollResults(poll, tally)
+	pollLog.Info("Closed a vote", "poll", poll.ID, "winner", winner, "tally", tally)
+
+	buf := bytes.Buffer{}
+	switch {
+	case winner == "":
+		buf.WriteString("Sire, nobody voted, so the banner stays as it is.")
+	case poll.Kind == "election":
+		buf.WriteString(fmt.Sprintf("Sire, the votes are in! **%s** is the banner "+
+			"of the week:\n", winner))
+	default:
+		buf.WriteString(fmt.Sprintf("Sire, the votes are in! **%s** wins:\n", winner))
+	}
+
+	if winner != "" {
+		for _, tag := range order {
+			buf.WriteString(fmt.Sprintf("\n**%s**: %d", tag, tally[tag]))
+		}
+
+		if poll.Kind == "election" {
+			err = recordElectionWinner(poll, winner, tally[winner])
+			handleErrors(s, poll.ChannelID, SqlError, "election", err)
+		}
+
+		Scheduler.Stop()
+		err = setBanner(s, winner, poll.Kind)
+		handleErrors(s, poll.ChannelID, GeneralError, poll.Kind, err)
+	}
+
+	// Clear the buttons, so nobody votes on a closed poll.
+	empty := []discordgo.MessageComponent{}
+	closed := "Sire, voting's closed."
+	s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         poll.MessageID,
+		Channel:    poll.ChannelID,
+		Content:    &closed,
+		Components: empty,
+	})
+
+	_, err = s.ChannelMessageSendComplex(poll.ChannelID, &discordgo.MessageSend{
+		Content: buf.String(),
+		Reference: &discordgo.MessageReference{MessageID: poll.MessageID,
+			ChannelID: poll.ChannelID, GuildID: Settings.GuildID},
+	})
+	return err
+}
+
+/*
+ * Close the polls whose time is up, and open the week's election when
+ * it's time. Like Scheduler.StartJob(), this
+ * lasts forever, so call it with `go`.
+ */
+func StartPolls(s *discordgo.Session) {
+	for ; ; time.Sleep(pollCheckEvery) {
+		// Votes left open while draining are counted once we're back.
+		if Drain.Active() {
+			continue
+		}
+
+		if err := checkElection(s); err != nil {
+			pollLog.Error("Error while checking the election", "err", err)
+		}
+
+		polls, err := allPolls()
+		if err != nil {
+			pollLog.Error("Error while checking polls", "err", err)
+		}
+
+		for _, poll := range polls {
+			if poll.ClosesAt.After(time.Now()) {
+				continue
+			}
+			if err = closePoll(s, poll); err != nil {
+				pollLog.Error("Error while closing a poll", "poll", poll.ID, "err", err)
+			}
+		}
+	}
+}
+
+func cmdVotes(ctx *CommandContext, args []string) {
+	polls, err := allPolls()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	if len(polls) == 0 {
+		ctx.Reply("Sire, there are no votes open.")
+		return
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("The votes open, sire:\n")
+	for _, poll := range polls {
+		tally, err := pollTally(poll.ID)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		votes := 0
+		for _, count := range tally {
+			votes += count
+		}
+		buf.WriteString(fmt.Sprintf("\n`%d` **%s**, closing <t:%d:R> (%d votes so far) "+
+			"https://discord.com/channels/%s/%s/%s", poll.ID,
+			strings.Join(poll.Tags, "**, **"), poll.ClosesAt.Unix(), votes,
+			Settings.GuildID, poll.ChannelID, poll.MessageID))
+	}
+
+	ctx.ReplyLong(buf.String())
+}
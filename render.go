@@ -0,0 +1,193 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * render.go - Fitting long replies into Discord's limits. Lists grow
+ * with the guild, and Discord turns away any message over 2000
+ * characters, so anything that lists things should go through
+ * CommandContext.ReplyLong() or CommandContext.ReplyList(), which split
+ * the reply over as many messages (or embeds) as it takes. Splits fall
+ * on line breaks where they can, and a code block cut in two is closed
+ * and reopened, so every piece renders on its own.
+ *
+ * Lengths are measured in bytes, which is never less than what Discord
+ * counts, so a piece can come up a little short but never too long.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord's limits
+const (
+	MessageLimit          = 2000
+	EmbedTitleLimit       = 256
+	EmbedDescriptionLimit = 4096
+)
+
+// How ReplyList() lays a list out.
+type RenderStyle int
+
+const (
+	RenderPlain     RenderStyle = iota // one item a line
+	RenderCodeblock                    // one item a line, in a code block
+	RenderEmbed                        // one item a line, in embeds
+)
+
+const codeFence = "```"
+
+/*
+ * Split text into pieces of at most limit bytes, breaking between lines
+ * where it can, and inside a line (on a character boundary) only when
+ * the line alone won't fit. A code block open at a break is closed at
+ * the end of one piece and reopened at the start of the next.
+ */
+func splitText(text string, limit int) []string {
+	pieces := []string{}
+	buf := strings.Builder{}
+	fence := ""  // the line that opened the code block we're in, if any
+	written := 0 // lines written to buf since the last break
+
+	// Always leave room to close a code block.
+	room := limit - len("\n"+codeFence)
+
+	flush := func() {
+		piece := buf.String()
+		if fence != "" {
+			piece += "\n" + codeFence
+		}
+		pieces = append(pieces, piece)
+
+		buf.Reset()
+		buf.WriteString(fence)
+		written = 0
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		isFence := strings.HasPrefix(trimmed, codeFence)
+
+		// A closing fence may use the room kept for it
+		fits := room
+		if isFence && fence != "" {
+			fits = limit
+		}
+
+		rest := line
+		for {
+			sep := ""
+			if buf.Len() > 0 {
+				sep = "\n"
+			}
+
+			if buf.Len()+len(sep)+len(rest) <= fits {
+				buf.WriteString(sep + rest)
+				written++
+				break
+			}
+
+			if written > 0 {
+				flush()
+				continue
+			}
+
+			// The line is too long by itself, so cut it
+			cut := room - buf.Len() - len(sep)
+			for cut > 0 && !utf8.RuneStart(rest[cut]) {
+				cut--
+			}
+			if cut <= 0 {
+				_, cut = utf8.DecodeRuneInString(rest)
+			}
+
+			buf.WriteString(sep + rest[:cut])
+			rest = rest[cut:]
+			written++
+			flush()
+		}
+
+		if isFence {
+			if fence == "" {
+				fence = trimmed
+			} else {
+				fence = ""
+			}
+		}
+	}
+
+	if written > 0 || len(pieces) == 0 {
+		pieces = append(pieces, buf.String())
+	}
+
+	return pieces
+}
+
+// Cut text down to at most limit bytes, on a character boundary.
+func clipText(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+
+	cut := limit - len("…")
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "…"
+}
+
+/*
+ * Lay a list out over as many embeds as it needs, each titled the same
+ * and numbered in its footer when there's more than one.
+ */
+func embedPages(title string, lines []string) []*discordgo.MessageEmbed {
+	pages := splitText(strings.Join(lines, "\n"), EmbedDescriptionLimit)
+	embeds := make([]*discordgo.MessageEmbed, 0, len(pages))
+
+	for i, page := range pages {
+		embed := &discordgo.MessageEmbed{
+			Title:       clipText(title, EmbedTitleLimit),
+			Description: page,
+		}
+		if len(pages) > 1 {
+			embed.Footer = &discordgo.MessageEmbedFooter{
+				Text: fmt.Sprintf("Page %d of %d", i+1, len(pages)),
+			}
+		}
+		embeds = append(embeds, embed)
+	}
+
+	return embeds
+}
+
+// Reply with text of any length, over several messages if need be.
+func (ctx *CommandContext) ReplyLong(text string) {
+	for _, piece := range splitText(text, MessageLimit) {
+		ctx.Reply(piece)
+	}
+}
+
+/*
+ * Reply with a header and a list under it, one item a line, over
+ * several messages if need be.
+ */
+func (ctx *CommandContext) ReplyList(header string, lines []string, style RenderStyle) {
+	switch style {
+	case RenderCodeblock:
+		ctx.ReplyLong(header + "\n" + codeFence + "\n" +
+			strings.Join(lines, "\n") + "\n" + codeFence)
+	case RenderEmbed:
+		for _, embed := range embedPages(header, lines) {
+			ctx.Session.ChannelMessageSendEmbed(ctx.Event.ChannelID, embed)
+		}
+	default:
+		ctx.ReplyLong(header + "\n\n" + strings.Join(lines, "\n"))
+	}
+}
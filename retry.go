@@ -0,0 +1,146 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * retry.go - Trying a failed banner again. When the scheduler can't set
+ * a banner for a reason that might pass (Discord rate limiting us, or
+ * having a bad moment), it tries the same tag again after
+ * RetryBaseSeconds, then twice that, and so on, up to RetryAttempts
+ * times -- rather than leaving the old banner up for a whole interval.
+ * If every attempt fails, the staff are told. Moving on to the next tag
+ * drops any retry still waiting.
+ *
+ * Like quiet hours, a waiting retry is a timer that pokes the scheduler
+ * through its channel (TimerRetry), so the retry itself runs in the
+ * scheduler's loop.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var retryLog = moduleLogger("retry")
+
+// A banner waiting to be tried again.
+type BannerRetry struct {
+	tag     string
+	attempt int // how many retries have been made so far
+	timer   *time.Timer
+}
+
+/*
+ * Whether an error might go away if we wait: rate limits, Discord's own
+ * failures, and the network dropping out. Also returns how long Discord
+ * asked us to wait, if it did.
+ */
+func transientError(err error) (bool, time.Duration) {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		status := restErr.Response.StatusCode
+		if status == http.StatusTooManyRequests {
+			return true, retryAfterDuration(restErr.ResponseBody)
+		}
+		return status >= 500, 0
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr), 0
+}
+
+// How long to wait before the given retry (counting from 1).
+func retryDelay(attempt int, asked time.Duration) time.Duration {
+	delay := time.Duration(Settings.RetryBaseSeconds) * time.Second
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+
+	if asked > delay {
+		delay = asked
+	}
+	return delay
+}
+
+/*
+ * Set up another try at the tag after a failure, or give up and tell
+ * the staff if it's had all its tries. Errors that won't pass by
+ * waiting aren't retried.
+ */
+func (scheduler *BannerScheduler) retryLater(tag string, err error) {
+	attempt := 1
+	if scheduler.retry != nil && scheduler.retry.tag == tag {
+		attempt = scheduler.retry.attempt + 1
+	}
+	scheduler.stopRetry()
+
+	transient, asked := transientError(err)
+	if !transient {
+		return
+	}
+
+	if attempt > Settings.RetryAttempts {
+		if Settings.RetryAttempts > 0 {
+			notifyStaff(scheduler.session, "failure", fmt.Sprintf("Sire, I tried %d times "+
+				"to put up **%s**, and failed each time. I'll leave the banner "+
+				"be until the next change.\n%s", attempt, tag, err))
+		}
+		return
+	}
+
+	delay := retryDelay(attempt, asked)
+	retryLog.Info("Trying the banner again", "tag", tag, "delay", delay,
+		"attempt", attempt, "attempts", Settings.RetryAttempts)
+	scheduler.retry = &BannerRetry{
+		tag:     tag,
+		attempt: attempt,
+		timer: time.AfterFunc(delay, func() {
+			scheduler.send(TimerRetry)
+		}),
+	}
+}
+
+// Drop any retry still waiting.
+func (scheduler *BannerScheduler) stopRetry() {
+	if scheduler.retry != nil {
+		scheduler.retry.timer.Stop()
+		scheduler.retry = nil
+	}
+}
+
+// Try the waiting retry. Run in StartJob, on TimerRetry.
+func (scheduler *BannerScheduler) runRetry() {
+	retry := scheduler.retry
+	if retry == nil || !scheduler.active {
+		// Dropped after the timer went off
+		return
+	}
+
+	if scheduler.held() {
+		retryLog.Info("Holding the banner for a one-shot; dropping the retry")
+		scheduler.stopRetry()
+		return
+	}
+
+	err := scheduler.setter(scheduler.session, retry.tag, "schedule")
+	if err != nil {
+		retryLog.Error("Error while setting the banner again", "err", err)
+		scheduler.retryLater(retry.tag, err)
+		if scheduler.retry == nil {
+			scheduler.pass.failures++
+		}
+		return
+	}
+
+	scheduler.retry = nil
+	scheduler.pass.shown++
+	scheduler.watchBanner(retry.tag, 1)
+}
@@ -0,0 +1,159 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * savetag.go - "Save as banner tag", on a message's context menu. Whoever
+ * may make tags can right-click any message with an image (attached, or
+ * a link Discord shows), pick it under Apps, and name the tag in the
+ * modal that opens; no copying URLs about. The name starts out as the
+ * message's words, or the image's file name.
+ *
+ * The tag is credited to whoever posted the image, since they're most
+ * likely its artist, rather than whoever saved it.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var saveTagLog = moduleLogger("savetag")
+
+const SaveTagMenuName = "Save as banner tag"
+
+// The first image in a message, and a name for a tag of it.
+func messageImage(message *discordgo.Message) (url string, name string) {
+	for _, attachment := range message.Attachments {
+		if imageType(attachment.Filename) != "" {
+			url = attachment.URL
+			name = strings.TrimSuffix(attachment.Filename, path.Ext(attachment.Filename))
+			break
+		}
+	}
+
+	for _, embed := range message.Embeds {
+		if url != "" {
+			break
+		}
+		switch {
+		case embed.Image != nil && imageType(embed.Image.URL) != "":
+			url = embed.Image.URL
+		case embed.Thumbnail != nil && imageType(embed.Thumbnail.URL) != "":
+			url = embed.Thumbnail.URL
+		default:
+			continue
+		}
+		name = strings.TrimSuffix(path.Base(url), path.Ext(url))
+	}
+
+	// Words are a better name than a file's, unless they're just the link.
+	if words := strings.Fields(message.Content); len(words) > 0 &&
+		!strings.HasPrefix(words[0], "http") {
+		name = strings.Join(words, "-")
+	}
+	return url, strings.ReplaceAll(strings.ToLower(name), " ", "-")
+}
+
+func menuSaveTag(s *discordgo.Session, i *discordgo.InteractionCreate, messageID string) {
+	ctx := interactionContext(s, i)
+	if !userHasPerms(ctx, PermDefault, "") {
+		replyEphemeral(s, i, "Sire, only those who may make tags can save them.")
+		return
+	}
+
+	message := i.ApplicationCommandData().Resolved.Messages[messageID]
+	if message == nil {
+		return
+	}
+
+	url, name := messageImage(message)
+	if url == "" {
+		replyEphemeral(s, i, "Sire, I see no image in that message; I can take a "+
+			"JPEG, PNG, GIF, or WebP.")
+		return
+	}
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[:100])
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: componentID("save-tag", messageID),
+			Title:    SaveTagMenuName,
+			Components: []discordgo.MessageComponent{discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.TextInput{
+						CustomID:  "name",
+						Label:     "Tag name",
+						Style:     discordgo.TextInputShort,
+						Value:     name,
+						Required:  true,
+						MaxLength: 100,
+					},
+				},
+			}},
+		},
+	})
+	handleCommandErrors(ctx, DiscordError, err)
+}
+
+func componentSaveTag(s *discordgo.Session, i *discordgo.InteractionCreate, messageID string) {
+	ctx := interactionContext(s, i)
+	if !userHasPerms(ctx, PermDefault, "") || refuseChanges(ctx) {
+		return
+	}
+
+	tag := strings.TrimSpace(modalValues(i)["name"])
+	if tag == "" || strings.ContainsAny(tag, " \t\n") {
+		replyEphemeral(s, i, "Sire, a tag's name must be one word, like `snowy`.")
+		return
+	}
+
+	exists, err := tagExists(tag)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if exists {
+		replyEphemeral(s, i, fmt.Sprintf("Sire, I already have a tag named **%s**. "+
+			"`%snew` replaces one, if that's what you're after.", tag, Settings.Prefix))
+		return
+	}
+
+	// Fetch the message again, for a link to the image that hasn't expired.
+	message, err := s.ChannelMessage(i.ChannelID, messageID)
+	if handleCommandErrors(ctx, DiscordError, explainDiscordError(err)) {
+		return
+	}
+	url, _ := messageImage(message)
+	if url == "" {
+		replyEphemeral(s, i, "Sire, the image is gone from that message.")
+		return
+	}
+
+	// Downloading the image can take longer than Discord waits for an answer.
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if handleCommandErrors(ctx, DiscordError, err) {
+		return
+	}
+
+	reply, err := rememberTag(tag, message.Author.ID, url)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	saveTagLog.Info("Saved a message's image as a tag", "tag", tag, "message", messageID,
+		"user", i.Member.User.ID)
+	ctx.Audit("tag new", normTag(tag), url)
+
+	_, err = s.InteractionResponseEdit(Settings.ClientID, i.Interaction,
+		&discordgo.WebhookEdit{Content: reply})
+	handleCommandErrors(ctx, DiscordError, err)
+}
@@ -13,11 +13,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"math/rand"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+var schedulerLog = moduleLogger("scheduler")
+
 type BannerPicker interface {
 	// Attempt to pick a tag. An empty string means to stop the scheduler.
 	pickTag(tags []string) string
@@ -25,16 +33,77 @@ type BannerPicker interface {
 	// Notify that the pick was successful, and change any state
 	// required to prepare for picking the next tag.
 	success()
+
+	// The name the picker is saved under, see PickerModes.
+	mode() string
+}
+
+/*
+ * Pickers are saved by their mode name and their exported fields as
+ * JSON, so anything a picker needs to pick up where it left off after a
+ * restart must be an exported field.
+ */
+var PickerModes = map[string]func() BannerPicker{
+	"shuffle": ScheduleShuffle,
+	"cycle":   ScheduleCycle,
+	"play":    ScheduleOnceonly,
+
+	"play-reverse":  ScheduleReverseOnceonly,
+	"play-random":   ScheduleRandomOnceonly,
+	"play-pingpong": SchedulePingpongOnceonly,
+}
+
+/*
+ * Pickers that go round and round in passes, like cycle, can also say
+ * when they've started over, so the scheduler can report on the pass.
+ */
+type PassPicker interface {
+	// Whether the last pick started a new pass. Asking clears it.
+	wrapped() bool
+}
+
+/*
+ * Pickers that keep a position in the tag list, which `queue add` and
+ * `queue rm` would otherwise throw off. Pickers without one go by name
+ * (or not at all), so tags are just appended or taken out.
+ */
+type QueuePicker interface {
+	// Add a tag where it's still to come, and return the new list.
+	queueInsert(tags []string, tag string) []string
+
+	// Take out the tag at i, and return the new list.
+	queueRemove(tags []string, i int) []string
+
+	// The index of the tag that'll be picked next, or -1 for none.
+	position(tags []string) int
+
+	// Make the tag at i the one picked next.
+	seek(tags []string, i int)
 }
 
 type ShufflePicker struct{}
 
 type CyclePicker struct {
-	index int
+	Index int
+
+	justWrapped bool
 }
 
 type OnceonlyPicker struct {
-	index int
+	Index int
+}
+
+type ReverseOnceonlyPicker struct {
+	Index int // counted from the end
+}
+
+type RandomOnceonlyPicker struct {
+	Played []string
+	Picked string
+}
+
+type PingpongOnceonlyPicker struct {
+	Step int
 }
 
 type BannerScheduler struct {
@@ -43,12 +112,90 @@ type BannerScheduler struct {
 	interval time.Duration
 	picker   BannerPicker
 	chnl     chan int
+	edits    chan func() // run by StartJob, see edit()
 	active   bool
+	pass     PassStats
+	deferred *time.Timer   // for a swap put off by quiet hours
+	source   string        // a tagSource() name, or "" for fixed tags
+	dwell    time.Duration // how long the banner up now stays up
+	catchUp  string        // a CatchUpPolicies name, or "" for the default
+	label    string        // what it's called, or "" for the default (see Label())
+	except   []string      // patterns for tags to leave out, see except.go
+	retry    *BannerRetry  // a failed banner waiting to be tried again
+	watch    *BannerWatch  // a banner waiting to be checked on, see verify.go
+	lane     string        // which lane it is, see lanes.go
+
+	// Cancelled by Shutdown(), which ends StartJob(); see send().
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running atomic.Bool   // StartJob() has begun
+	exited  chan struct{} // closed once StartJob() returns
+
+	// Puts a tag up as the banner. It's setBanner(), except in
+	// simulations (see simulate.go), and in the icon and splash lanes
+	// (see lanes.go).
+	setter func(s *discordgo.Session, name string, source string) error
+}
+
+/*
+ * What to do about the swaps missed while the bard was down, when a
+ * saved schedule is restored:
+ *
+ *   skip-missed   wait for the next tick, as if nothing was missed
+ *   fire-once     change the banner once, straight away
+ *   fast-forward  move the picker along as if it had kept going, and
+ *                 put up the tag that would be up by now
+ */
+var CatchUpPolicies = []string{"skip-missed", "fire-once", "fast-forward"}
+
+const DefaultCatchUp = "skip-missed"
+
+/*
+ * Tag sources give a schedule its tags afresh on every change, for
+ * schedules whose tags aren't fixed when they're set -- e.g. `season
+ * auto` follows whichever playlist is in season. They're saved by name.
+ */
+var TagSources = map[string]func() ([]string, error){
+	"season": seasonTags,
+}
+
+/*
+ * Tag sources that take an argument, saved as "NAME:ARG" -- e.g.
+ * "playlist:cats" follows a smart playlist as tags join it, see smart.go.
+ */
+var ArgTagSources = map[string]func(arg string) ([]string, error){
+	"playlist": playlistTags,
+}
+
+// The tag source saved under a name, from TagSources or ArgTagSources.
+func tagSource(source string) (func() ([]string, error), bool) {
+	if refresh, ok := TagSources[source]; ok {
+		return refresh, true
+	}
+
+	name, arg, found := strings.Cut(source, ":")
+	refresh, ok := ArgTagSources[name]
+	if !found || !ok {
+		return nil, false
+	}
+	return func() ([]string, error) { return refresh(arg) }, true
+}
+
+// How the current pass through the tags is going.
+type PassStats struct {
+	start    time.Time
+	shown    int
+	failures int
 }
 
 const (
 	TimerReset = iota
-	TimerStop
+	TimerResume
+	TimerOneShot
+	TimerDeferred
+	TimerInterval
+	TimerRetry
+	TimerWatchdog
 )
 
 // Banner Pickers. These decide what the next tag should be, or
@@ -60,92 +207,452 @@ func (picker *ShufflePicker) pickTag(tags []string) string {
 
 func (picker *ShufflePicker) success() {}
 
+func (picker *ShufflePicker) mode() string { return "shuffle" }
+
 func ScheduleShuffle() BannerPicker {
 	return new(ShufflePicker)
 }
 
-//
 func (picker *CyclePicker) pickTag(tags []string) string {
-	if len(tags) <= picker.index {
-		picker.index = 0
+	if len(tags) <= picker.Index {
+		picker.Index = 0
+		picker.justWrapped = true
 	}
 
-	return tags[picker.index]
+	return tags[picker.Index]
+}
+
+func (picker *CyclePicker) wrapped() bool {
+	wrapped := picker.justWrapped
+	picker.justWrapped = false
+	return wrapped
 }
 
 func (picker *CyclePicker) success() {
-	picker.index++
+	picker.Index++
+}
+
+func (picker *CyclePicker) mode() string { return "cycle" }
+
+func (picker *CyclePicker) queueInsert(tags []string, tag string) []string {
+	return append(tags, tag)
+}
+
+func (picker *CyclePicker) queueRemove(tags []string, i int) []string {
+	if i < picker.Index {
+		picker.Index--
+	}
+	return append(tags[:i], tags[i+1:]...)
+}
+
+func (picker *CyclePicker) position(tags []string) int {
+	if len(tags) <= picker.Index {
+		return 0
+	}
+	return picker.Index
 }
 
+func (picker *CyclePicker) seek(tags []string, i int) { picker.Index = i }
+
 func ScheduleCycle() BannerPicker {
 	return new(CyclePicker)
 }
 
-//
 func (picker *OnceonlyPicker) pickTag(tags []string) string {
-	if len(tags) <= picker.index {
+	if len(tags) <= picker.Index {
 		return ""
 	} else {
-		return tags[picker.index]
+		return tags[picker.Index]
 	}
 }
 
 func (picker *OnceonlyPicker) success() {
-	picker.index++
+	picker.Index++
+}
+
+func (picker *OnceonlyPicker) mode() string { return "play" }
+
+func (picker *OnceonlyPicker) queueInsert(tags []string, tag string) []string {
+	return append(tags, tag)
 }
 
+func (picker *OnceonlyPicker) queueRemove(tags []string, i int) []string {
+	if i < picker.Index {
+		picker.Index--
+	}
+	return append(tags[:i], tags[i+1:]...)
+}
+
+func (picker *OnceonlyPicker) position(tags []string) int {
+	if len(tags) <= picker.Index {
+		return -1
+	}
+	return picker.Index
+}
+
+func (picker *OnceonlyPicker) seek(tags []string, i int) { picker.Index = i }
+
 func ScheduleOnceonly() BannerPicker {
 	return new(OnceonlyPicker)
 }
 
+// Like once-only, but from the last tag to the first.
+func (picker *ReverseOnceonlyPicker) pickTag(tags []string) string {
+	if len(tags) <= picker.Index {
+		return ""
+	} else {
+		return tags[len(tags)-1-picker.Index]
+	}
+}
+
+func (picker *ReverseOnceonlyPicker) success() {
+	picker.Index++
+}
+
+func (picker *ReverseOnceonlyPicker) mode() string { return "play-reverse" }
+
+// Going backwards, what's still to come is at the front.
+func (picker *ReverseOnceonlyPicker) queueInsert(tags []string, tag string) []string {
+	return append([]string{tag}, tags...)
+}
+
+func (picker *ReverseOnceonlyPicker) queueRemove(tags []string, i int) []string {
+	if i > len(tags)-1-picker.Index {
+		picker.Index--
+	}
+	return append(tags[:i], tags[i+1:]...)
+}
+
+func (picker *ReverseOnceonlyPicker) position(tags []string) int {
+	if len(tags) <= picker.Index {
+		return -1
+	}
+	return len(tags) - 1 - picker.Index
+}
+
+func (picker *ReverseOnceonlyPicker) seek(tags []string, i int) {
+	picker.Index = len(tags) - 1 - i
+}
+
+func ScheduleReverseOnceonly() BannerPicker {
+	return new(ReverseOnceonlyPicker)
+}
+
+/*
+ * Random order, but every tag exactly once. The tags played so far are
+ * remembered by name rather than by position, so removing a deleted
+ * tag from the list doesn't throw off what's left.
+ */
+func (picker *RandomOnceonlyPicker) pickTag(tags []string) string {
+	unplayed := []string{}
+	for _, tag := range tags {
+		if !contains(picker.Played, tag) {
+			unplayed = append(unplayed, tag)
+		}
+	}
+
+	if len(unplayed) == 0 {
+		return ""
+	}
+
+	picker.Picked = unplayed[rand.Intn(len(unplayed))]
+	return picker.Picked
+}
+
+func (picker *RandomOnceonlyPicker) success() {
+	picker.Played = append(picker.Played, picker.Picked)
+}
+
+func (picker *RandomOnceonlyPicker) mode() string { return "play-random" }
+
+func ScheduleRandomOnceonly() BannerPicker {
+	return new(RandomOnceonlyPicker)
+}
+
+// Play from the first tag to the last and back again, once only.
+func (picker *PingpongOnceonlyPicker) pickTag(tags []string) string {
+	// With n tags, the steps are 0..n-1 going out and n..2n-2 coming
+	// back, so the last tag isn't shown twice in a row.
+	last := len(tags) - 1
+	switch {
+	case picker.Step > 2*last:
+		return ""
+	case picker.Step > last:
+		return tags[2*last-picker.Step]
+	default:
+		return tags[picker.Step]
+	}
+}
+
+func (picker *PingpongOnceonlyPicker) success() {
+	picker.Step++
+}
+
+func (picker *PingpongOnceonlyPicker) mode() string { return "play-pingpong" }
+
+/*
+ * Going out, new tags go at the end; coming back, at the front. Either
+ * way they're still to come.
+ */
+func (picker *PingpongOnceonlyPicker) queueInsert(tags []string, tag string) []string {
+	if picker.Step < len(tags) {
+		return append(tags, tag)
+	}
+
+	picker.Step++
+	return append([]string{tag}, tags...)
+}
+
+func (picker *PingpongOnceonlyPicker) queueRemove(tags []string, i int) []string {
+	last := len(tags) - 1
+	switch {
+	case picker.Step <= last:
+		if i < picker.Step {
+			picker.Step--
+		}
+	case i <= 2*last-picker.Step:
+		picker.Step--
+	default:
+		picker.Step -= 2
+	}
+	return append(tags[:i], tags[i+1:]...)
+}
+
+func (picker *PingpongOnceonlyPicker) position(tags []string) int {
+	last := len(tags) - 1
+	switch {
+	case picker.Step > 2*last:
+		return -1
+	case picker.Step > last:
+		return 2*last - picker.Step
+	default:
+		return picker.Step
+	}
+}
+
+// Stay on whichever leg we're on, if the tag is still ahead on it.
+func (picker *PingpongOnceonlyPicker) seek(tags []string, i int) {
+	last := len(tags) - 1
+	if picker.Step > last && i < last {
+		picker.Step = 2*last - i
+	} else {
+		picker.Step = i
+	}
+}
+
+func SchedulePingpongOnceonly() BannerPicker {
+	return new(PingpongOnceonlyPicker)
+}
+
 // The Scheduler
 
 func NewScheduler(s *discordgo.Session) *BannerScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &BannerScheduler{
 		session: s,
 		chnl:    make(chan int),
+		edits:   make(chan func()),
+		setter:  setBanner,
+		lane:    LaneBanner,
+		ctx:     ctx,
+		cancel:  cancel,
+		exited:  make(chan struct{}),
 	}
 }
 
 /*
- * Start the tag scheduler. This procedure lasts forever, so call it
- * with `go` to launch the scheduler in the background.
+ * Start the tag scheduler. This procedure lasts until Shutdown(), so
+ * call it with `go` to launch the scheduler in the background.
+ *
+ * Only this goroutine touches the schedule. Everyone else asks it to,
+ * with edit() for changes and send() for the actions below, and both
+ * give up once it's shut down rather than wait on it forever.
  */
 func (scheduler *BannerScheduler) StartJob(s *discordgo.Session) *BannerScheduler {
 	scheduler.session = s
+	scheduler.running.Store(true)
+	defer close(scheduler.exited)
+	defer scheduler.cancel()
+	defer reportPanic("scheduler")
 	// Allocate a ticker and stop it immediately, so that
 	// accessing ticker.C initially doesn't raise a segfault.
 	ticker := time.NewTicker(time.Hour)
 	ticker.Stop()
+	var armed time.Duration // what the ticker is running at, 0 if stopped
+
+	// Only the banner lane minds what follows; the other lanes leave
+	// these stopped (see lanes.go).
+	primary := scheduler.lane == LaneBanner
+
+	// The one-shot lane for `at`, which runs alongside the ticker.
+	oneShot := time.NewTimer(time.Hour)
+	oneShot.Stop()
+	if primary {
+		scheduler.armOneShot(oneShot)
+	}
+
+	// Event rules are checked on their own, slower ticker.
+	rules := time.NewTicker(time.Duration(Settings.EventCheckMinutes) * time.Minute)
+	if primary {
+		scheduler.evaluateEventRules()
+	} else {
+		rules.Stop()
+	}
+
+	// As is the Twitch channel, if there's one to watch.
+	twitch := time.NewTicker(time.Hour)
+	twitch.Stop()
+	if primary && twitchOn() {
+		twitch.Reset(time.Duration(Settings.TwitchCheckMinutes) * time.Minute)
+		scheduler.checkTwitch()
+	}
+
+	// And the calendar, which can be set at any time.
+	calendar := time.NewTicker(time.Duration(Settings.CalendarCheckMinutes) * time.Minute)
+	if primary {
+		scheduler.checkCalendar()
+	} else {
+		calendar.Stop()
+	}
+
+	// And public holidays, which only change daily.
+	holidays := time.NewTicker(holidayCheckEvery)
+	if primary {
+		scheduler.checkHolidays()
+	} else {
+		holidays.Stop()
+	}
 
 	for {
+		// Bring the ticker in line with however long the banner up
+		// now should stay, which changes from tag to tag.
+		want := time.Duration(0)
+		if scheduler.active {
+			want = scheduler.dwell
+		}
+
+		if want != armed {
+			ticker.Stop()
+			if want != 0 {
+				ticker = time.NewTicker(want)
+			}
+			armed = want
+		}
+
 		select {
+		case <-scheduler.ctx.Done():
+			schedulerLog.Info("Shutting down")
+			ticker.Stop()
+			oneShot.Stop()
+			rules.Stop()
+			twitch.Stop()
+			calendar.Stop()
+			holidays.Stop()
+			scheduler.halt()
+			return scheduler
+		case <-oneShot.C:
+			scheduler.fireOneShots()
+			scheduler.armOneShot(oneShot)
+		case <-rules.C:
+			scheduler.evaluateEventRules()
+		case <-twitch.C:
+			scheduler.checkTwitch()
+		case <-calendar.C:
+			scheduler.checkCalendar()
+		case <-holidays.C:
+			scheduler.checkHolidays()
 		case <-ticker.C:
-			logger.Println("Next banner")
+			if scheduler.held() {
+				schedulerLog.Info("Holding the banner for a one-shot")
+				continue
+			}
+
+			schedulerLog.Info("Next banner")
 			scheduler.Next()
+		case edit := <-scheduler.edits:
+			edit()
 		case action := <-scheduler.chnl:
 			switch action {
 			case TimerReset:
 				// The scheduler has been updated with
-				// new state, update the timer to
-				// reflect the changes.
+				// new state; start the first banner.
 				scheduler.active = true
-				ticker.Stop()
-				ticker = time.NewTicker(scheduler.interval)
-
-				// start the first banner
+				scheduler.pass = PassStats{start: time.Now()}
+				scheduler.dwell = scheduler.interval
+				armed = 0
+				notify("schedule", fmt.Sprintf("A %s schedule has started, "+
+					"changing the %s every %s.", scheduler.picker.mode(),
+					scheduler.changes(), scheduler.interval))
+				scheduler.Next()
+			case TimerResume:
+				// Like TimerReset, but the banner up now
+				// is already the right one, so wait for
+				// the next tick.
+				scheduler.active = true
+				scheduler.pass = PassStats{start: time.Now()}
+				scheduler.dwell = scheduler.interval
+				armed = 0
+			case TimerOneShot:
+				// The one-shots have changed.
+				scheduler.armOneShot(oneShot)
+			case TimerInterval:
+				// Only the interval has changed; keep
+				// everything else.
+				scheduler.dwell = scheduler.interval
+				armed = 0
+			case TimerDeferred:
+				// Quiet hours are over; make the swap
+				// they put off.
+				schedulerLog.Info("Quiet hours over")
+				scheduler.deferred = nil
 				scheduler.Next()
-			case TimerStop:
-				scheduler.active = false
-				logger.Println("TimerStop")
-				ticker.Stop()
+			case TimerRetry:
+				// A banner that failed is due another try.
+				scheduler.runRetry()
+			case TimerWatchdog:
+				// Time to check the last banner is still up.
+				scheduler.runWatchdog()
 			default:
-				logger.Printf("Unknown scheduler value %d\n", action)
+				schedulerLog.Error("Unknown scheduler value", "action", action)
 			}
 		}
 	}
 }
 
+/*
+ * Stop the schedule from inside StartJob(), e.g. when the picker runs
+ * out. The ticker is stopped on the way back around the loop.
+ */
+func (scheduler *BannerScheduler) halt() {
+	scheduler.active = false
+	if scheduler.deferred != nil {
+		scheduler.deferred.Stop()
+		scheduler.deferred = nil
+	}
+	scheduler.stopRetry()
+	scheduler.stopWatch()
+	if scheduler.lane == LaneBanner {
+		Status.Scheduled(time.Time{})
+	}
+}
+
+// Stop the schedule when the picker has nothing left to give.
+func (scheduler *BannerScheduler) runOut() {
+	schedulerLog.Info("Banner picker gave nothing; stopping scheduler")
+	scheduler.halt()
+	notify("schedule", "The schedule has run out of tags, and stopped.")
+}
+
+func contains(slice []string, test string) bool {
+	for _, item := range slice {
+		if test == item {
+			return true
+		}
+	}
+
+	return false
+}
+
 func remove(slice []string, test string) []string {
 	for i, item := range slice {
 		if test == item {
@@ -161,54 +668,268 @@ func (scheduler *BannerScheduler) pickTag() string {
 }
 
 /*
- * Set the next tag.
+ * Set the next tag. This runs on StartJob()'s goroutine; from anywhere
+ * else, use Forward().
  */
 func (scheduler *BannerScheduler) Next() bool {
 	if !scheduler.active {
 		return false
 	}
 
+	// Put the swap off until quiet hours are over.
+	quiet, end, err := inQuietHours(time.Now())
+	if err != nil {
+		schedulerLog.Error("Error while checking quiet hours", "err", err)
+	} else if quiet {
+		scheduler.deferUntil(end)
+		return true
+	}
+
+	if scheduler.source != "" {
+		// Refresh the tags. If the source fails, carry on with
+		// the ones we had.
+		refresh, _ := tagSource(scheduler.source)
+		tags, err := refresh()
+		if err != nil {
+			schedulerLog.Error("Error while refreshing tags", "err", err)
+		} else {
+			scheduler.tags = exceptTags(tags, scheduler.except)
+		}
+
+		if len(scheduler.tags) == 0 {
+			schedulerLog.Info("Tag source gave nothing; waiting", "source", scheduler.source)
+			return true
+		}
+	}
+
 	// Pick a tag
 	tag := scheduler.pickTag()
 	if tag == "" {
-		logger.Println("Banner picker gave nothing; stopping scheduler")
-		scheduler.Stop()
+		scheduler.runOut()
 		return true
 	}
 
 	// If the tag doesn't exist (deleted while cycling), readjust
 	// the tag list and try again.
-	for exists, err := tagExists(tag); !exists || err != nil; {
+	for exists, err := tagExists(tag); !exists || err != nil; exists, err = tagExists(tag) {
 		// Take the tag out
 		scheduler.tags = remove(scheduler.tags, tag)
 		if len(scheduler.tags) == 0 {
-			logger.Println("Banner picker gave nothing; stopping scheduler")
-			scheduler.Stop()
+			scheduler.runOut()
 			return true
 		}
 
 		tag = scheduler.pickTag()
+		if tag == "" {
+			scheduler.runOut()
+			return true
+		}
+	}
+
+	// Pass over tags with broken links, but show something if every
+	// tag left is broken.
+	for tries := 1; tries < len(scheduler.tags) && tagQuarantined(tag); tries++ {
+		schedulerLog.Info("Passing over an unhealthy tag", "tag", tag)
+		scheduler.picker.success()
+
+		next := scheduler.pickTag()
+		if next == "" {
+			break
+		}
+		tag = next
 	}
 	scheduler.picker.success()
 
-	err := setBanner(scheduler.session, tag)
+	if pass, ok := scheduler.picker.(PassPicker); ok && pass.wrapped() {
+		scheduler.reportPass()
+	}
+
+	// A new tag supersedes any retry of (or check on) the last one.
+	scheduler.stopRetry()
+	scheduler.stopWatch()
+	err = scheduler.setter(scheduler.session, tag, "schedule")
+	if err != nil {
+		schedulerLog.Error("Error while setting the banner", "err", err)
+		reportError(ErrorReport{Kind: "discord", Message: err.Error(),
+			Command: "scheduler", Tag: tag})
+		scheduler.retryLater(tag, err)
+		if scheduler.retry == nil {
+			scheduler.pass.failures++
+		}
+	} else {
+		scheduler.pass.shown++
+		if scheduler.setsBanner() {
+			scheduler.watchBanner(tag, 1)
+		}
+	}
+
+	// Some tags ask to stay up longer (or shorter) than the rest.
+	scheduler.dwell = scheduler.interval
+	duration, err := tagDuration(tag)
 	if err != nil {
-		logger.Println("Error while setting the banner: " + err.Error())
+		schedulerLog.Error("Error while getting the tag's duration", "err", err)
+	} else if duration != 0 {
+		scheduler.dwell = duration
 	}
 
+	if scheduler.lane == LaneBanner {
+		Status.Scheduled(time.Now().Add(scheduler.dwell))
+	}
 	return true
 }
 
 /*
- * Stop the scheduler
+ * Log (and post to the log channel) how the pass that just finished
+ * went, and start counting a new one. Long rotations are otherwise hard
+ * to check up on.
+ */
+func (scheduler *BannerScheduler) reportPass() {
+	pass := scheduler.pass
+	message := fmt.Sprintf("Sire, I've gone through all %d tags and am "+
+		"starting over. That pass took %s, with %d banners shown and %d failures.",
+		len(scheduler.tags), time.Since(pass.start).Round(time.Second),
+		pass.shown, pass.failures)
+
+	schedulerLog.Warn(message)
+	if Settings.LogChannelID != "" {
+		scheduler.session.ChannelMessageSend(Settings.LogChannelID, message)
+	}
+	notify("pass", message)
+
+	scheduler.pass = PassStats{start: time.Now()}
+}
+
+// Quiet hours
+
+/*
+ * Make the next swap once quiet hours end. Only the first deferral
+ * counts; ticks during quiet hours don't pile up more swaps.
  */
-func (scheduler *BannerScheduler) Stop() bool {
-	wasActive := scheduler.active
-	scheduler.chnl <- TimerStop
+func (scheduler *BannerScheduler) deferUntil(end time.Time) {
+	if scheduler.deferred != nil {
+		return
+	}
+
+	schedulerLog.Info("Quiet hours; putting the banner off", "until", end)
+	scheduler.deferred = time.AfterFunc(time.Until(end), func() {
+		scheduler.send(TimerDeferred)
+	})
+	if scheduler.lane == LaneBanner {
+		Status.Scheduled(end)
+	}
+}
+
+// Minutes since midnight of a "15:04" time.
+func minuteOfDay(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	return t.Hour()*60 + t.Minute(), err
+}
+
+/*
+ * Whether now falls in quiet hours, and if so, when they end. Windows
+ * whose end comes before their start wrap past midnight.
+ */
+func inQuietHours(now time.Time) (bool, time.Time, error) {
+	windows, err := allQuietWindows()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	now = now.In(guildLocation())
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	current := now.Hour()*60 + now.Minute()
+
+	for _, window := range windows {
+		start, err := minuteOfDay(window.Start)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+
+		end, err := minuteOfDay(window.End)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+
+		endTime := midnight.Add(time.Duration(end) * time.Minute)
+		switch {
+		case start < end && start <= current && current < end:
+			return true, endTime, nil
+		case start > end && current >= start:
+			return true, endTime.AddDate(0, 0, 1), nil
+		case start > end && current < end:
+			return true, endTime, nil
+		}
+	}
+
+	return false, time.Time{}, nil
+}
+
+/*
+ * Stop the scheduler. Returns whether anything was running.
+ */
+func (scheduler *BannerScheduler) Stop() (wasActive bool) {
+	scheduler.edit(func() {
+		wasActive = scheduler.active
+		if wasActive {
+			schedulerLog.Info("Stopping")
+			if scheduler.lane == LaneBanner {
+				notify("schedule", "The schedule has been stopped.")
+			} else {
+				notify("schedule", "The "+scheduler.lane+" schedule has been stopped.")
+			}
+		}
+		scheduler.halt()
+	})
 
 	return wasActive
 }
 
+// Whether a schedule is running.
+func (scheduler *BannerScheduler) Active() (active bool) {
+	scheduler.edit(func() { active = scheduler.active })
+	return active
+}
+
+// Whether the lane puts its tags up as the banner, rather than elsewhere.
+func (scheduler *BannerScheduler) setsBanner() bool {
+	return scheduler.lane == LaneBanner || scheduler.lane == LaneOverride
+}
+
+// What the lane changes, for messages: "banner", "icon", or "splash".
+func (scheduler *BannerScheduler) changes() string {
+	if scheduler.setsBanner() {
+		return "banner"
+	}
+	return scheduler.lane
+}
+
+var ErrSchedulerDown = errors.New("the scheduler has shut down")
+
+/*
+ * Stop the scheduler for good, ending StartJob() and waiting for it to
+ * finish whatever it's doing. Anything asked of the scheduler afterwards
+ * does nothing. The schedule isn't saved; see Save().
+ */
+func (scheduler *BannerScheduler) Shutdown() {
+	scheduler.cancel()
+	if scheduler.running.Load() {
+		<-scheduler.exited
+	}
+}
+
+/*
+ * Send an action to StartJob(). Returns false, rather than waiting
+ * forever, if the scheduler has been shut down.
+ */
+func (scheduler *BannerScheduler) send(action int) bool {
+	select {
+	case scheduler.chnl <- action:
+		return true
+	case <-scheduler.ctx.Done():
+		return false
+	}
+}
+
 /*
  * Set the tag schedule, including the interval between tags, the tags
  * themselves, and the picker used to decide how to choose each next
@@ -219,7 +940,6 @@ func (scheduler *BannerScheduler) Set(interval time.Duration, tags []string,
 
 	// Stop the scheduler for now as we're setting up the state.
 	scheduler.Stop()
-	scheduler.picker = pickerProducer()
 
 	if len(tags) == 0 {
 		// An empty tag list is invalid
@@ -234,8 +954,629 @@ func (scheduler *BannerScheduler) Set(interval time.Duration, tags []string,
 		}
 	}
 
-	scheduler.interval = interval
-	scheduler.tags = tags
-	scheduler.chnl <- TimerReset
+	scheduler.edit(func() {
+		scheduler.picker = pickerProducer()
+		scheduler.interval = interval
+		scheduler.tags = normTags(tags)
+		scheduler.source = ""
+		scheduler.catchUp = ""
+		scheduler.label = ""
+		scheduler.except = nil
+	})
+	scheduler.send(TimerReset)
+	return true, nil
+}
+
+/*
+ * Like Set(), but take the tags from a tag source (see tagSource())
+ * every time the banner changes, rather than from a fixed list, leaving
+ * out those matching except.
+ */
+func (scheduler *BannerScheduler) SetSource(interval time.Duration, source string,
+	except []string, pickerProducer func() BannerPicker) error {
+
+	if _, ok := tagSource(source); !ok {
+		return fmt.Errorf("unknown tag source %q", source)
+	}
+
+	scheduler.Stop()
+	scheduler.edit(func() {
+		scheduler.picker = pickerProducer()
+		scheduler.interval = interval
+		scheduler.tags = nil
+		scheduler.source = source
+		scheduler.catchUp = ""
+		scheduler.label = ""
+		scheduler.except = except
+	})
+	scheduler.send(TimerReset)
+	return nil
+}
+
+/*
+ * Save the schedule so that it can be picked back up with Restore()
+ * after a restart. Stop the scheduler first, so the picker doesn't move
+ * while it's being saved.
+ */
+func (scheduler *BannerScheduler) Save() (err error) {
+	var saved SavedSchedule
+	if !scheduler.edit(func() { saved, err = scheduler.saved() }) {
+		return ErrSchedulerDown
+	} else if err != nil {
+		return err
+	}
+
+	return saveLaneSchedule(scheduler.lane, saved)
+}
+
+// The schedule as Save() saves it. Call on the scheduler's goroutine.
+func (scheduler *BannerScheduler) saved() (SavedSchedule, error) {
+	picker, err := json.Marshal(scheduler.picker)
+	if err != nil {
+		return SavedSchedule{}, err
+	}
+
+	return SavedSchedule{
+		Mode:     scheduler.picker.mode(),
+		Picker:   string(picker),
+		Interval: scheduler.interval,
+		Tags:     append([]string{}, scheduler.tags...),
+		Source:   scheduler.source,
+		CatchUp:  scheduler.catchUp,
+		Label:    scheduler.label,
+		Except:   scheduler.except,
+		SavedAt:  time.Now().UTC(),
+	}, nil
+}
+
+/*
+ * The running schedule as Save() would save it, without stopping it,
+ * for exports. ok is false if nothing's running.
+ */
+func (scheduler *BannerScheduler) Snapshot() (schedule SavedSchedule, ok bool, err error) {
+	scheduler.edit(func() {
+		if scheduler.active {
+			schedule, err = scheduler.saved()
+			ok = err == nil
+		}
+	})
+
+	return schedule, ok, err
+}
+
+/*
+ * Resume the schedule saved by Save(), if there is one. The saved
+ * schedule is forgotten afterwards, so a later crash doesn't bring back
+ * a stale one.
+ */
+func (scheduler *BannerScheduler) Restore() (restored bool, err error) {
+	saved, ok, err := loadLaneSchedule(scheduler.lane)
+	if !ok || err != nil {
+		return false, err
+	}
+
+	if err = clearLaneSchedule(scheduler.lane); err != nil {
+		return false, err
+	}
+
+	producer, ok := PickerModes[saved.Mode]
+	if !ok {
+		return false, fmt.Errorf("unknown picker mode %q", saved.Mode)
+	}
+
+	picker := producer()
+	if err = json.Unmarshal([]byte(saved.Picker), picker); err != nil {
+		return false, err
+	}
+
+	if _, ok := tagSource(saved.Source); saved.Source != "" && !ok {
+		return false, fmt.Errorf("unknown tag source %q", saved.Source)
+	}
+
+	scheduler.edit(func() {
+		scheduler.picker = picker
+		scheduler.interval = saved.Interval
+		scheduler.tags = saved.Tags
+		scheduler.source = saved.Source
+		scheduler.catchUp = saved.CatchUp
+		scheduler.label = saved.Label
+		scheduler.except = saved.Except
+	})
+	scheduler.send(TimerResume)
+
+	scheduler.catchUpSince(saved)
 	return true, nil
 }
+
+// Apply the saved schedule's catch-up policy for the time since it was saved.
+func (scheduler *BannerScheduler) catchUpSince(saved SavedSchedule) {
+	missed := int(time.Since(saved.SavedAt) / saved.Interval)
+	if missed == 0 {
+		return
+	}
+
+	policy := saved.CatchUp
+	if policy == "" {
+		policy = DefaultCatchUp
+	}
+
+	schedulerLog.Info("Missed swaps while down; catching up", "missed", missed,
+		"policy", policy)
+
+	switch policy {
+	case "fire-once":
+		scheduler.Forward()
+	case "fast-forward":
+		scheduler.Skip(missed - 1)
+		scheduler.Forward()
+	}
+}
+
+// Change the running schedule's catch-up policy. Returns false if nothing's running.
+func (scheduler *BannerScheduler) SetCatchUp(policy string) (ok bool) {
+	scheduler.edit(func() {
+		if scheduler.active {
+			scheduler.catchUp = policy
+			ok = true
+		}
+	})
+
+	return ok
+}
+
+// The running schedule's catch-up policy, and whether anything's running.
+func (scheduler *BannerScheduler) CatchUp() (policy string, ok bool) {
+	scheduler.edit(func() {
+		policy, ok = scheduler.catchUp, scheduler.active
+	})
+
+	if policy == "" {
+		policy = DefaultCatchUp
+	}
+	return policy, ok
+}
+
+// Leave tags matching the patterns out of the running schedule from now on.
+func (scheduler *BannerScheduler) SetExcept(patterns []string) (ok bool) {
+	scheduler.edit(func() {
+		if scheduler.active {
+			scheduler.except = patterns
+			ok = true
+		}
+	})
+
+	return ok
+}
+
+// Labels
+
+/*
+ * What a running schedule is called: the label it was given, or else
+ * its tag source, or else its picker's mode. Call on the scheduler's
+ * goroutine.
+ */
+func (scheduler *BannerScheduler) labelOf() string {
+	if scheduler.label != "" {
+		return scheduler.label
+	} else if scheduler.source != "" {
+		return scheduler.source
+	}
+	return scheduler.picker.mode()
+}
+
+// Label the running schedule. Returns false if nothing's running.
+func (scheduler *BannerScheduler) SetLabel(label string) (ok bool) {
+	scheduler.edit(func() {
+		if scheduler.active {
+			scheduler.label = label
+			ok = true
+		}
+	})
+
+	return ok
+}
+
+// What a running schedule is, for `schedules`.
+type ScheduleInfo struct {
+	Lane      string
+	Label     string
+	Mode      string
+	Source    string
+	Interval  time.Duration
+	Tags      []string
+	Next      int // the index of the tag up next, or -1 if unknown
+	Except    []string
+	CatchUp   string
+	PassStart time.Time
+	Shown     int
+}
+
+/*
+ * The running schedules. There's only ever one at a time in a lane for
+ * now, but callers shouldn't count on it; see also ScheduleManager.
+ */
+func (scheduler *BannerScheduler) Schedules() (schedules []ScheduleInfo) {
+	scheduler.edit(func() {
+		if !scheduler.active {
+			return
+		}
+
+		info := ScheduleInfo{Lane: scheduler.lane, Label: scheduler.labelOf(),
+			Mode: scheduler.picker.mode(), Source: scheduler.source,
+			Interval: scheduler.interval, CatchUp: scheduler.catchUp,
+			PassStart: scheduler.pass.start, Shown: scheduler.pass.shown, Next: -1}
+		info.Tags = append(info.Tags, scheduler.tags...)
+		info.Except = append(info.Except, scheduler.except...)
+		if picker, isQueue := scheduler.picker.(QueuePicker); isQueue {
+			info.Next = picker.position(scheduler.tags)
+		}
+		if info.CatchUp == "" {
+			info.CatchUp = DefaultCatchUp
+		}
+		schedules = append(schedules, info)
+	})
+
+	return schedules
+}
+
+// Find a running schedule by label, ignoring case.
+func (scheduler *BannerScheduler) Schedule(label string) (ScheduleInfo, bool) {
+	for _, info := range scheduler.Schedules() {
+		if strings.EqualFold(info.Label, label) {
+			return info, true
+		}
+	}
+	return ScheduleInfo{}, false
+}
+
+// Stop the running schedule with the label. Returns false if there isn't one.
+func (scheduler *BannerScheduler) StopLabel(label string) bool {
+	if _, ok := scheduler.Schedule(label); !ok {
+		return false
+	}
+	return scheduler.Stop()
+}
+
+// The Queue
+
+/*
+ * Run a change to the running schedule on the scheduler's own
+ * goroutine, between swaps, and wait for it to finish. Unlike Set(),
+ * this doesn't restart the ticker. Returns false, without running the
+ * change, if the scheduler has been shut down.
+ */
+func (scheduler *BannerScheduler) edit(change func()) bool {
+	done := make(chan struct{})
+	select {
+	case scheduler.edits <- func() {
+		change()
+		close(done)
+	}:
+	case <-scheduler.ctx.Done():
+		return false
+	}
+
+	<-done
+	return true
+}
+
+/*
+ * Get the running schedule's tags and the index of the one up next (-1
+ * if the picker doesn't know ahead of time). ok is false if nothing's
+ * running.
+ */
+func (scheduler *BannerScheduler) Queue() (tags []string, next int, ok bool) {
+	scheduler.edit(func() {
+		if !scheduler.active {
+			return
+		}
+
+		ok = true
+		tags = append(tags, scheduler.tags...)
+		next = -1
+		if picker, isQueue := scheduler.picker.(QueuePicker); isQueue {
+			next = picker.position(scheduler.tags)
+		}
+	})
+
+	return tags, next, ok
+}
+
+/*
+ * Errors from QueueAdd() and QueueRemove(). The caller is expected to
+ * have checked that the tag exists, if it's being added.
+ */
+var (
+	ErrQueueInactive = errors.New("no schedule is running")
+	ErrQueueSource   = errors.New("the schedule takes its tags from a source")
+	ErrQueueHas      = errors.New("the tag is already queued")
+	ErrQueueExcept   = errors.New("the schedule leaves the tag out")
+	ErrQueueMissing  = errors.New("the tag isn't queued")
+	ErrQueueLast     = errors.New("the tag is the last one queued")
+)
+
+// Add a tag to the running schedule, keeping the picker's place.
+func (scheduler *BannerScheduler) QueueAdd(tag string) (err error) {
+	tag = normTag(tag)
+	scheduler.edit(func() {
+		switch {
+		case !scheduler.active:
+			err = ErrQueueInactive
+		case scheduler.source != "":
+			err = ErrQueueSource
+		case contains(scheduler.tags, tag):
+			err = ErrQueueHas
+		case excludedTag(scheduler.except, tag):
+			err = ErrQueueExcept
+		default:
+			if picker, ok := scheduler.picker.(QueuePicker); ok {
+				scheduler.tags = picker.queueInsert(scheduler.tags, tag)
+			} else {
+				scheduler.tags = append(scheduler.tags, tag)
+			}
+		}
+	})
+
+	return err
+}
+
+// Take a tag out of the running schedule, keeping the picker's place.
+func (scheduler *BannerScheduler) QueueRemove(tag string) (err error) {
+	tag = normTag(tag)
+	scheduler.edit(func() {
+		switch {
+		case !scheduler.active:
+			err = ErrQueueInactive
+		case scheduler.source != "":
+			err = ErrQueueSource
+		case !contains(scheduler.tags, tag):
+			err = ErrQueueMissing
+		case len(scheduler.tags) == 1:
+			err = ErrQueueLast
+		default:
+			picker, ok := scheduler.picker.(QueuePicker)
+			if !ok {
+				scheduler.tags = remove(scheduler.tags, tag)
+				return
+			}
+
+			for i, queued := range scheduler.tags {
+				if queued == tag {
+					scheduler.tags = picker.queueRemove(scheduler.tags, i)
+					break
+				}
+			}
+		}
+	})
+
+	return err
+}
+
+// Rename a tag wherever the running schedule has it, keeping the picker's place.
+func (scheduler *BannerScheduler) QueueRename(from string, to string) {
+	rename := func(tags []string) {
+		for i, tag := range tags {
+			if tag == from {
+				tags[i] = to
+			}
+		}
+	}
+
+	scheduler.edit(func() {
+		rename(scheduler.tags)
+		if picker, ok := scheduler.picker.(*RandomOnceonlyPicker); ok {
+			rename(picker.Played)
+			if picker.Picked == from {
+				picker.Picked = to
+			}
+		}
+	})
+}
+
+/*
+ * Change the time between tags of the running schedule. The next tag
+ * comes one new interval from now. Returns false if nothing's running.
+ */
+func (scheduler *BannerScheduler) SetInterval(interval time.Duration) (ok bool) {
+	scheduler.edit(func() {
+		if scheduler.active {
+			scheduler.interval = interval
+			ok = true
+		}
+	})
+
+	if ok {
+		scheduler.send(TimerInterval)
+	}
+	return ok
+}
+
+// Set the next tag now. Returns false if nothing's running.
+func (scheduler *BannerScheduler) Forward() (ok bool) {
+	scheduler.edit(func() { ok = scheduler.Next() })
+	return ok
+}
+
+/*
+ * Move past the next count tags without showing them. Returns false if
+ * nothing's running; running out of tags is left for Next() to find.
+ */
+func (scheduler *BannerScheduler) Skip(count int) (ok bool) {
+	scheduler.edit(func() {
+		if !scheduler.active {
+			return
+		}
+
+		ok = true
+		for i := 0; i < count && len(scheduler.tags) > 0; i++ {
+			if scheduler.pickTag() == "" {
+				break
+			}
+			scheduler.picker.success()
+		}
+	})
+
+	return ok
+}
+
+var ErrQueueNoSeek = errors.New("the picker can't jump to a tag")
+
+// Make the given tag the next one the running schedule picks.
+func (scheduler *BannerScheduler) Seek(tag string) (err error) {
+	tag = normTag(tag)
+	scheduler.edit(func() {
+		picker, ok := scheduler.picker.(QueuePicker)
+		switch {
+		case !scheduler.active:
+			err = ErrQueueInactive
+		case scheduler.source != "":
+			err = ErrQueueSource
+		case !ok:
+			err = ErrQueueNoSeek
+		case !contains(scheduler.tags, tag):
+			err = ErrQueueMissing
+		default:
+			for i, queued := range scheduler.tags {
+				if queued == tag {
+					picker.seek(scheduler.tags, i)
+					break
+				}
+			}
+		}
+	})
+
+	return err
+}
+
+// One-shots
+
+/*
+ * Tell the scheduler that one-shots were added or removed, so it can
+ * wake up for the right one.
+ */
+func (scheduler *BannerScheduler) Rearm() {
+	scheduler.send(TimerOneShot)
+}
+
+// Set the timer to go off at the soonest one-shot.
+func (scheduler *BannerScheduler) armOneShot(timer *time.Timer) {
+	// Timers have to be stopped and drained before resetting.
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	shot, ok, err := nextOneShot()
+	if err != nil {
+		schedulerLog.Error("Error while arming one-shots", "err", err)
+		return
+	}
+
+	if ok {
+		timer.Reset(time.Until(shot.At))
+	}
+}
+
+/*
+ * Whether the rotation should leave the banner alone, because a
+ * one-shot override is up until it's reverted, or an event rule has its
+ * tag up, or (for the banner lane) the override lane is running. Lanes
+ * that don't change the banner are never held.
+ */
+func (scheduler *BannerScheduler) held() bool {
+	if !scheduler.setsBanner() {
+		return false
+	}
+
+	held, err := revertPending()
+	if err != nil {
+		schedulerLog.Error("Error while checking one-shots", "err", err)
+	}
+
+	if !held {
+		held, err = eventRuleApplied()
+		if err != nil {
+			schedulerLog.Error("Error while checking event rules", "err", err)
+		}
+	}
+
+	if !held {
+		held, err = twitchHeld()
+		if err != nil {
+			schedulerLog.Error("Error while checking the stream", "err", err)
+		}
+	}
+
+	if !held {
+		held, err = calendarHeld()
+		if err != nil {
+			schedulerLog.Error("Error while checking the calendar", "err", err)
+		}
+	}
+
+	if !held {
+		held, err = holidayHeld()
+		if err != nil {
+			schedulerLog.Error("Error while checking holidays", "err", err)
+		}
+	}
+
+	if !held && scheduler.lane == LaneBanner {
+		held = Lanes.overriding()
+	}
+
+	return held
+}
+
+/*
+ * Set every one-shot that's come due. A one-shot that's meant to be
+ * reverted leaves behind another one-shot to put back the banner that
+ * was up before it.
+ */
+func (scheduler *BannerScheduler) fireOneShots() {
+	for {
+		shot, ok, err := nextOneShot()
+		if err != nil {
+			schedulerLog.Error("Error while firing one-shots", "err", err)
+			return
+		}
+
+		if !ok || shot.At.After(time.Now()) {
+			return
+		}
+
+		if _, err = delOneShot(shot.ID); err != nil {
+			schedulerLog.Error("Error while firing one-shots", "err", err)
+			return
+		}
+
+		previous, err := currentBanner()
+		if err != nil {
+			schedulerLog.Error("Error while firing one-shots", "err", err)
+		}
+
+		schedulerLog.Info("One-shot due; setting the banner", "id", shot.ID, "tag", shot.Tag)
+		if err = scheduler.setter(scheduler.session, shot.Tag, "at"); err != nil {
+			schedulerLog.Error("Error while setting the banner", "err", err)
+			reportError(ErrorReport{Kind: "discord", Message: err.Error(),
+				Command: "at", Tag: shot.Tag})
+			continue
+		}
+
+		if shot.RevertAfter == 0 || previous == "" {
+			continue
+		}
+
+		_, err = insertOneShot(OneShot{
+			At:       shot.At.Add(shot.RevertAfter),
+			Tag:      previous,
+			IsRevert: true,
+			AuthorID: shot.AuthorID,
+		})
+		if err != nil {
+			schedulerLog.Error("Error while scheduling a revert", "err", err)
+		}
+	}
+}
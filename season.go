@@ -0,0 +1,264 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * season.go - Seasonal playlists. A playlist can be bound to a stretch
+ * of dates each year (`season set october 10-01 10-31`), and `season
+ * auto` keeps the banner on whichever playlist is in season, falling
+ * back to a default playlist in between. When seasons overlap, the
+ * shorter one wins, so a christmas season can sit inside a winter one.
+ *
+ * The scheduler side of this is the "season" tag source, see
+ * scheduler.go:TagSources.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+var seasonLog = moduleLogger("season")
+
+const seasonDefaultKey = "season_default"
+
+// Read a "01-02" date, returning it zero-padded along with its month and day.
+func parseSeasonDate(raw string) (string, int, error) {
+	date, err := time.Parse("1-2", raw)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return date.Format("01-02"), int(date.Month())*100 + date.Day(), nil
+}
+
+/*
+ * Return the playlist in season on the given day, or "" if none is. An
+ * error in one season's dates fails the whole lookup, since they're
+ * checked when they're set.
+ */
+func inSeason(now time.Time) (string, error) {
+	seasons, err := allSeasons()
+	if err != nil {
+		return "", err
+	}
+
+	now = now.In(guildLocation())
+	today := int(now.Month())*100 + now.Day()
+
+	best, bestSpan := "", 0
+	for _, season := range seasons {
+		_, start, err := parseSeasonDate(season.Start)
+		if err != nil {
+			return "", err
+		}
+
+		_, end, err := parseSeasonDate(season.End)
+		if err != nil {
+			return "", err
+		}
+
+		// Spans are rough (every month is 100 long), but fine
+		// for picking the shorter of two seasons.
+		var in bool
+		var span int
+		if start <= end {
+			in = start <= today && today <= end
+			span = end - start
+		} else {
+			// Wraps past new year
+			in = today >= start || today <= end
+			span = 1231 - start + end
+		}
+
+		if in && (best == "" || span < bestSpan) {
+			best, bestSpan = season.Playlist, span
+		}
+	}
+
+	return best, nil
+}
+
+// The playlist `season auto` should be playing right now, or "".
+func seasonPlaylist() (string, error) {
+	playlist, err := inSeason(time.Now())
+	if err != nil || playlist != "" {
+		return playlist, err
+	}
+
+	return getSetting(seasonDefaultKey)
+}
+
+// The "season" tag source.
+func seasonTags() ([]string, error) {
+	playlist, err := seasonPlaylist()
+	if err != nil || playlist == "" {
+		return nil, err
+	}
+
+	return playlistTags(playlist)
+}
+
+func cmdSeasonSet(ctx *CommandContext, args []string) {
+	if len(args) != 3 {
+		ctx.SendUsage()
+		return
+	}
+
+	playlist := args[0]
+	start, _, err1 := parseSeasonDate(args[1])
+	end, _, err2 := parseSeasonDate(args[2])
+	if err1 != nil || err2 != nil {
+		ctx.Reply("Sire, I need dates like `10-01` and `10-31`.")
+		return
+	}
+
+	exists, err := playlistExists(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !exists {
+		ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
+		return
+	}
+
+	err = insertSeason(Season{Playlist: playlist, Start: start, End: end})
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	seasonLog.Info("Set a season", "playlist", playlist, "start", start, "end", end)
+	ctx.Reply(fmt.Sprintf("**%s** will be in season from %s to %s, sire.",
+		playlist, start, end))
+}
+
+func cmdSeasonRm(ctx *CommandContext, args []string) {
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	ok, err := delSeason(args[0])
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if !ok {
+		ctx.Reply("Sire, **" + args[0] + "** has no season anyways.")
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdSeasonDefault(ctx *CommandContext, args []string) {
+	if len(args) == 0 {
+		playlist, err := getSetting(seasonDefaultKey)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		if playlist == "" {
+			ctx.Reply("Sire, I have no playlist for between seasons.")
+		} else {
+			ctx.Reply("Sire, between seasons I play **" + playlist + "**.")
+		}
+		return
+	}
+
+	if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	playlist := args[0]
+	if playlist == "none" {
+		playlist = ""
+	} else {
+		exists, err := playlistExists(playlist)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		if !exists {
+			ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
+			return
+		}
+	}
+
+	err := putSetting(seasonDefaultKey, playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	ctx.Ack()
+}
+
+func cmdSeasonLs(ctx *CommandContext, args []string) {
+	seasons, err := allSeasons()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	current, err1 := seasonPlaylist()
+	fallback, err2 := getSetting(seasonDefaultKey)
+	if handleCommandErrors(ctx, SqlError, err1, err2) {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("The seasons, sire:\n")
+	for _, season := range seasons {
+		buf.WriteString(fmt.Sprintf("\n**%s** from %s to %s",
+			season.Playlist, season.Start, season.End))
+		if season.Playlist == current {
+			buf.WriteString(" (in season)")
+		}
+	}
+
+	if fallback != "" {
+		buf.WriteString("\n\nBetween seasons, **" + fallback + "**")
+		if fallback == current {
+			buf.WriteString(" (now)")
+		}
+	}
+
+	ctx.ReplyLong(buf.String())
+}
+
+func cmdSeasonAuto(ctx *CommandContext, args []string) {
+	picker := ScheduleShuffle
+	if len(args) == 2 && args[1] == "--cycle" {
+		picker = ScheduleCycle
+	} else if len(args) != 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	interval, ok := parseInterval(ctx, args[0])
+	if !ok {
+		return
+	}
+
+	playlist, err := seasonPlaylist()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	err = Scheduler.SetSource(interval, "season", nil, picker)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	if playlist == "" {
+		ctx.Reply("Yes, sire, though nothing is in season now, and I have " +
+			"no default playlist. I'll wait for a season to come.")
+	} else {
+		ctx.Reply("Yes, sire. **" + playlist + "** is in season.")
+	}
+}
@@ -0,0 +1,399 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * share.go - Sharing playlists between bards. `share PLAYLIST` packs a
+ * playlist's tags (names, image links, descriptions, and credits) into
+ * a code, which another Banner Bard turns back into the playlist with
+ * `import code CODE`, fetching and caching each image as `new` would.
+ * A code is gzipped JSON in URL-safe base64, after shareCodePrefix:
+ *
+ *   bb1:H4sIAAAAAAAA/6pWKk...
+ *
+ * Codes too long for a message are sent as a file instead, which
+ * `import code` takes as an attachment too. Tags the importing bard
+ * already has are left as they are, so an import never changes a tag.
+ *
+ * `share PLAYLIST full` sends a zip of the code (as shareArchiveCode)
+ * with each tag's image beside it, from the cache, as `export full`
+ * does. Importing it puts the images in the cache instead of fetching
+ * them, so the playlist works even where the links have died.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+var shareLog = moduleLogger("share")
+
+// Marks a share code, and which version of the format it's in.
+const shareCodePrefix = "bb1:"
+
+// The most a share code may unpack to.
+const shareCodeLimit = 1024 * 1024 // 1 MB
+
+// Where a zip share keeps its code; the images are under archiveImages.
+const shareArchiveCode = "share.txt"
+
+// A shared playlist, with short keys to keep the codes short.
+type SharedPlaylist struct {
+	Playlist string      `json:"p"`
+	Tags     []SharedTag `json:"t"`
+	// In a zip, where each tag's image is in it, by tag.
+	Images map[string]string `json:"i,omitempty"`
+}
+
+type SharedTag struct {
+	Name        string `json:"n"`
+	Url         string `json:"u"`
+	Description string `json:"d,omitempty"`
+	Artist      string `json:"a,omitempty"`
+}
+
+var errShareCode = errors.New("that isn't a share code of mine")
+
+func encodeShareCode(shared SharedPlaylist) (string, error) {
+	buf := bytes.Buffer{}
+	zip, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err := json.NewEncoder(zip).Encode(shared); err != nil {
+		return "", err
+	}
+	if err := zip.Close(); err != nil {
+		return "", err
+	}
+
+	return shareCodePrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeShareCode(code string) (shared SharedPlaylist, err error) {
+	code = strings.TrimSpace(code)
+	if !strings.HasPrefix(code, shareCodePrefix) {
+		return shared, errShareCode
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(code[len(shareCodePrefix):])
+	if err != nil {
+		return shared, errShareCode
+	}
+
+	zip, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return shared, errShareCode
+	}
+
+	err = json.NewDecoder(io.LimitReader(zip, shareCodeLimit)).Decode(&shared)
+	if err != nil || shared.Playlist == "" || len(shared.Tags) == 0 {
+		return shared, errShareCode
+	}
+	return shared, nil
+}
+
+/*
+ * Write a shared playlist as a zip, with each tag's image. Images that
+ * can't be had are left out, and returned as errs; err is for the zip.
+ */
+func writeShareArchive(w io.Writer, shared SharedPlaylist) (errs []error, err error) {
+	archive := zip.NewWriter(w)
+	shared.Images = map[string]string{}
+	for _, tag := range shared.Tags {
+		data, err := fetchImage(tag.Url)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tag.Name, err))
+			continue
+		}
+
+		name := archiveImages + url.PathEscape(tag.Name)
+		if ext := imageType(tag.Url); ext != "" {
+			name += "." + ext
+		}
+		// Images are compressed already.
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			return errs, err
+		}
+		shared.Images[tag.Name] = name
+	}
+
+	code, err := encodeShareCode(shared)
+	if err != nil {
+		return errs, err
+	}
+	file, err := archive.Create(shareArchiveCode)
+	if err == nil {
+		_, err = io.WriteString(file, code)
+	}
+	if err != nil {
+		return errs, err
+	}
+	return errs, archive.Close()
+}
+
+// Read a zip share, and the images in it, by tag.
+func readShareArchive(data []byte) (shared SharedPlaylist, images map[string][]byte,
+	err error) {
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return shared, nil, errShareCode
+	}
+
+	read := func(name string) ([]byte, error) {
+		file, err := archive.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(io.LimitReader(file, importArchiveMaxSize))
+	}
+
+	code, err := read(shareArchiveCode)
+	if err != nil {
+		return shared, nil, errShareCode
+	}
+	if shared, err = decodeShareCode(string(code)); err != nil {
+		return shared, nil, err
+	}
+
+	images = map[string][]byte{}
+	for tag, name := range shared.Images {
+		if images[tag], err = read(name); err != nil {
+			return shared, nil, fmt.Errorf("**%s**'s image: %w", tag, err)
+		}
+	}
+	return shared, images, nil
+}
+
+func cmdShare(ctx *CommandContext, args []string) {
+	full := len(args) == 2 && args[1] == "full"
+	if len(args) != 1 && !full {
+		ctx.SendUsage()
+		return
+	}
+
+	playlist := args[0]
+	names, err := playlistTags(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if len(names) == 0 {
+		ctx.Reply(fmt.Sprintf("Sire, I don't remember a playlist titled **%s**.", playlist))
+		return
+	}
+
+	shared := SharedPlaylist{Playlist: playlist}
+	for _, name := range names {
+		tag, err := namedTag(name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		credit, err := artCredit(name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		shared.Tags = append(shared.Tags, SharedTag{Name: tag.Name, Url: tag.Url,
+			Description: tag.Description, Artist: credit.Artist})
+	}
+
+	if full {
+		shareArchive(ctx, shared)
+		return
+	}
+
+	code, err := encodeShareCode(shared)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	message := fmt.Sprintf("Sire, another bard can learn **%s** with "+
+		"`import code`, and this:\n", playlist)
+	if len(message)+len(code) > MessageLimit {
+		ctx.Session.ChannelFileSendWithMessage(ctx.Event.ChannelID,
+			fmt.Sprintf("Sire, another bard can learn **%s** with `import code`, "+
+				"and this file attached.", playlist),
+			playlist+".bbshare.txt", strings.NewReader(code))
+		return
+	}
+	ctx.Reply(message + code)
+}
+
+// Upload a shared playlist as a zip, with each tag's image, for `share PLAYLIST full`.
+func shareArchive(ctx *CommandContext, shared SharedPlaylist) {
+	buf := bytes.Buffer{}
+	missing, err := writeShareArchive(&buf, shared)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	_, err = ctx.Session.ChannelFileSendWithMessage(ctx.Event.ChannelID,
+		fmt.Sprintf("Sire, another bard can learn **%s**, images and all, with "+
+			"`import code` and this file attached.", shared.Playlist),
+		shared.Playlist+".bbshare.zip", &buf)
+	if err != nil {
+		shareLog.Error("Couldn't upload a shared playlist", "bytes", buf.Len(), "err", err)
+		ctx.Reply(fmt.Sprintf("Sire, Discord wouldn't take the file, at %s. "+
+			"Share it without `full`.", formatBytes(int64(buf.Len()))))
+		return
+	}
+
+	if len(missing) > 0 {
+		lines := make([]string, len(missing))
+		for i, err := range missing {
+			lines[i] = "- " + err.Error()
+		}
+		ctx.ReplyLong("Sire, I couldn't get these images, so they're left out:\n" +
+			strings.Join(lines, "\n"))
+	}
+}
+
+/*
+ * `import code CODE [PLAYLIST]`, or with the code attached as a file,
+ * or a zip from `share PLAYLIST full`. The playlist keeps its name from
+ * the code unless another is given.
+ */
+func cmdImportCode(ctx *CommandContext, args []string) {
+	var shared SharedPlaylist
+	var images map[string][]byte
+	var err error
+	switch {
+	case len(args) >= 1 && strings.HasPrefix(args[0], shareCodePrefix):
+		shared, err = decodeShareCode(args[0])
+		args = args[1:]
+	case len(ctx.Event.Attachments) == 1:
+		limit := int64(shareCodeLimit)
+		if strings.HasSuffix(strings.ToLower(ctx.Event.Attachments[0].Filename), ".zip") {
+			limit = importArchiveMaxSize
+		}
+
+		data, ok := attachmentData(ctx, limit)
+		if !ok {
+			return
+		}
+		if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+			shared, images, err = readShareArchive(data)
+		} else {
+			shared, err = decodeShareCode(string(data))
+		}
+	default:
+		ctx.SendUsage()
+		return
+	}
+
+	if len(args) > 1 {
+		ctx.SendUsage()
+		return
+	} else if err != nil {
+		ctx.Reply("Sire, " + err.Error() + ".")
+		return
+	}
+
+	playlist := shared.Playlist
+	if len(args) == 1 {
+		playlist = args[0]
+	}
+
+	exists, err := playlistExists(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if exists {
+		ctx.Reply(fmt.Sprintf("Sire, I already remember a playlist titled **%s**. "+
+			"Give the import another name: `import code CODE NAME`.", playlist))
+		return
+	}
+
+	names := []string{}
+	kept := []string{}
+	uncached := []string{}
+	for _, tag := range shared.Tags {
+		if imageType(tag.Url) == "" || strings.ContainsAny(tag.Name, " \t\n") {
+			continue
+		}
+
+		exists, err := tagExists(tag.Name)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+		names = append(names, tag.Name)
+		if exists {
+			kept = append(kept, tag.Name)
+			continue
+		}
+
+		err = insertTag(tag.Name, ctx.Event.Author.ID, tag.Url)
+		if err == nil && tag.Description != "" {
+			_, err = describeTag(tag.Name, tag.Description)
+		}
+		if err == nil && tag.Artist != "" {
+			err = setArtist(tag.Name, tag.Artist)
+		}
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		// The image in the zip, if it came with one.
+		data, ok := images[tag.Name]
+		if ok {
+			err = storeImage(tag.Url, data)
+		} else {
+			data, err = cacheImage(tag.Url)
+		}
+		if err != nil {
+			shareLog.Warn("Couldn't cache a tag's image", "tag", tag.Name, "err", err)
+			uncached = append(uncached, tag.Name)
+			continue
+		}
+		if _, err = hashNewTag(tag.Name, data); err != nil {
+			shareLog.Warn("Couldn't hash a tag's image", "tag", tag.Name, "err", err)
+		}
+	}
+
+	if len(names) == 0 {
+		ctx.Reply("Sire, that code has no tags I can use.")
+		return
+	}
+
+	if handleCommandErrors(ctx, SqlError, editPlaylist(playlist, names)) {
+		return
+	}
+	shareLog.Info("Imported a shared playlist", "playlist", playlist,
+		"count", len(names), "user", ctx.Event.Author.ID)
+	ctx.Audit("import code", playlist, fmt.Sprintf("%d tags, %d of them new", len(names),
+		len(names)-len(kept)))
+	made := []string{}
+	for _, name := range names {
+		if !contains(kept, name) {
+			made = append(made, name)
+		}
+	}
+	ctx.Journal("import code", playlist, undoSnapshot{NewTags: made,
+		NewPlaylists: []string{playlist}})
+
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("I've learned **%s**, with %d tags, sire.",
+		playlist, len(names)))
+	if len(kept) > 0 {
+		buf.WriteString("\nI already knew **" + strings.Join(kept, "**, **") +
+			"**, so I kept mine.")
+	}
+	if len(uncached) > 0 {
+		buf.WriteString("\nI couldn't keep a copy of the images of **" +
+			strings.Join(uncached, "**, **") + "**.")
+	}
+	ctx.ReplyLong(buf.String())
+}
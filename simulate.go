@@ -0,0 +1,350 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * simulate.go - Scenario runs of the scheduler. A scenario is a JSON
+ * file describing a schedule (picker, interval, tags, and anything
+ * special about them) and some queue edits along the way. Running it
+ * drives the real scheduler through Next() on a simulated clock, with
+ * an in-memory database and no Discord, and writes down every banner
+ * change as a timeline:
+ *
+ *   0s cat
+ *   1h0m0s dog
+ *   # queue add bird
+ *   2h0m0s bird
+ *
+ * Each scenario's timeline is compared against the golden file next to
+ * it (NAME.json against NAME.golden), so a change to a picker or the
+ * scheduler that moves any banner shows up as a difference:
+ *
+ *   $ ./banner-bard simulate [-update] [DIR]
+ *
+ * `go test` runs ./scenarios the same way (see simulate_test.go).
+ * DIR defaults to ./scenarios. -update writes the timelines out as the
+ * new golden files instead; look over the diff before committing them.
+ * To cover a new picker, add a scenario using it, run with -update, and
+ * check the timeline by hand once.
+ *
+ * Ticks are counted rather than timed, so quiet hours, one-shots, and
+ * event rules (which go by the wall clock) are left out.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type Scenario struct {
+	Picker      string              // a PickerModes name
+	Interval    string              // e.g. "1h"
+	Tags        []string            // the schedule's tags, in order
+	Durations   map[string]string   // tags that stay up longer or shorter
+	Quarantined []string            // tags with broken links
+	Playlists   map[string][]string // playlists of the tags, by name
+	Seed        int64               // for the random pickers
+	Ticks       int                 // how many times the banner may change
+	Edits       []ScenarioEdit
+}
+
+/*
+ * An edit made just before the given tick (the first change being tick
+ * 0), written as the command would be without the prefix: "queue add
+ * TAG", "queue rm TAG", "jump TAG", "next COUNT", or "playlist rm
+ * PLAYLIST TAGS...". "playlist show PLAYLIST" writes down what's in it.
+ */
+type ScenarioEdit struct {
+	Tick int
+	Do   string
+}
+
+// Read a scenario file.
+func loadScenario(path string) (scenario Scenario, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &scenario)
+	}
+	return scenario, err
+}
+
+/*
+ * Put the scenario's tags in a fresh in-memory database. Any database
+ * already open is replaced.
+ */
+func seedScenarioDb(scenario Scenario) error {
+	if err := openDbAt(":memory:"); err != nil {
+		return err
+	}
+
+	for _, tag := range scenario.Tags {
+		err := insertTag(tag, "simulation", "https://example.invalid/"+tag+".png")
+		if err != nil {
+			return err
+		}
+	}
+
+	for tag, raw := range scenario.Durations {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		if _, err = setTagDuration(tag, duration); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range scenario.Quarantined {
+		if err := setTagHealth(tag, false, "quarantined by the scenario"); err != nil {
+			return err
+		}
+	}
+
+	for name, tags := range scenario.Playlists {
+		if err := editPlaylist(name, tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Make an edit to the running schedule, or the database, returning what
+ * to write down, and what went wrong, if anything.
+ */
+func applyScenarioEdit(scheduler *BannerScheduler, do string) (string, error) {
+	args := strings.Fields(do)
+	switch {
+	case len(args) >= 4 && args[0] == "playlist" && args[1] == "rm":
+		return "", reducePlaylist(args[2], args[3:])
+	case len(args) == 3 && args[0] == "playlist" && args[1] == "show":
+		tags, err := playlistTags(args[2])
+		return args[2] + ": " + strings.Join(tags, " "), err
+	}
+
+	return "", applyScheduleEdit(scheduler, args)
+}
+
+// Make an edit to the running schedule, returning what went wrong, if anything.
+func applyScheduleEdit(scheduler *BannerScheduler, args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "queue" && args[1] == "add":
+		return scheduler.QueueAdd(args[2])
+	case len(args) == 3 && args[0] == "queue" && args[1] == "rm":
+		return scheduler.QueueRemove(args[2])
+	case len(args) == 2 && args[0] == "jump":
+		return scheduler.Seek(args[1])
+	case len(args) == 2 && args[0] == "next":
+		count, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		if !scheduler.Skip(count) {
+			return ErrQueueInactive
+		}
+		return nil
+	}
+
+	return fmt.Errorf("I don't know how to %q", strings.Join(args, " "))
+}
+
+/*
+ * Run a scenario, returning its timeline. The scheduler is set up the
+ * way TimerReset leaves it, and each tick advances the clock by however
+ * long the banner up was meant to stay.
+ */
+func runScenario(scenario Scenario) (string, error) {
+	newPicker, ok := PickerModes[scenario.Picker]
+	if !ok {
+		return "", fmt.Errorf("unknown picker %q", scenario.Picker)
+	}
+
+	interval, err := time.ParseDuration(scenario.Interval)
+	if err != nil {
+		return "", err
+	}
+
+	if err = seedScenarioDb(scenario); err != nil {
+		return "", err
+	}
+	rand.Seed(scenario.Seed)
+
+	timeline := bytes.Buffer{}
+	clock := time.Duration(0)
+
+	scheduler := NewScheduler(nil)
+	scheduler.setter = func(s *discordgo.Session, name string, source string) error {
+		timeline.WriteString(fmt.Sprintf("%s %s\n", clock, name))
+		return nil
+	}
+	scheduler.picker = newPicker()
+	scheduler.interval = interval
+	scheduler.tags = normTags(scenario.Tags)
+	scheduler.active = true
+	scheduler.dwell = interval
+
+	// Stand in for StartJob's loop, for the edits
+	go func() {
+		for edit := range scheduler.edits {
+			edit()
+		}
+	}()
+	defer close(scheduler.edits)
+
+	for tick := 0; tick < scenario.Ticks; tick++ {
+		for _, edit := range scenario.Edits {
+			if edit.Tick != tick {
+				continue
+			}
+
+			timeline.WriteString("# " + edit.Do + "\n")
+			note, err := applyScenarioEdit(scheduler, edit.Do)
+			if note != "" {
+				timeline.WriteString("# " + note + "\n")
+			}
+			if err != nil {
+				timeline.WriteString("# (" + err.Error() + ")\n")
+			}
+		}
+
+		scheduler.Next()
+		if !scheduler.active {
+			timeline.WriteString(fmt.Sprintf("%s stopped\n", clock))
+			break
+		}
+		clock += scheduler.dwell
+	}
+
+	return timeline.String(), nil
+}
+
+/*
+ * Run every scenario in dir, comparing each against its golden file
+ * (or, with update, replacing it). Returns whether they all matched.
+ */
+func runScenarios(dir string, update bool) (bool, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return false, err
+	}
+
+	passed := true
+	for _, path := range paths {
+		scenario, err := loadScenario(path)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+
+		timeline, err := runScenario(scenario)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+
+		golden := strings.TrimSuffix(path, ".json") + ".golden"
+		if update {
+			if err = os.WriteFile(golden, []byte(timeline), 0644); err != nil {
+				return false, err
+			}
+			fmt.Println("wrote", golden)
+			continue
+		}
+
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			return false, err
+		}
+
+		if line, ok := firstDifference(string(want), timeline); !ok {
+			fmt.Printf("FAIL %s, from line %d\n%s", path, line+1,
+				sideBySide(string(want), timeline, line))
+			passed = false
+		} else {
+			fmt.Println("ok  ", path)
+		}
+	}
+
+	return passed, nil
+}
+
+// The first line two timelines differ at, and whether they're the same.
+func firstDifference(want string, got string) (int, bool) {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		if i >= len(wantLines) || i >= len(gotLines) || wantLines[i] != gotLines[i] {
+			return i, false
+		}
+	}
+	return 0, true
+}
+
+// Show the golden and simulated timelines from the given line on.
+func sideBySide(want string, got string, from int) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("  %-30s %s\n", "golden", "simulated"))
+	for i := from; i < len(wantLines) || i < len(gotLines); i++ {
+		var wantLine, gotLine string
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+
+		mark := " "
+		if wantLine != gotLine {
+			mark = "!"
+		}
+		buf.WriteString(fmt.Sprintf("%s %-30s %s\n", mark, wantLine, gotLine))
+	}
+
+	return buf.String()
+}
+
+// `banner-bard simulate`, run in place of the bard.
+func simulateMain(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	update := flags.Bool("update", false, "write the timelines out as the golden files")
+	flags.Parse(args)
+
+	dir := "scenarios"
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+
+	// Leave the settings file out, so it can't change the results,
+	// and keep the scheduler's logging out of the report.
+	applyConfig()
+	setLogWriter(io.Discard)
+
+	// Nothing here runs StartJob's loop to answer the watchdog
+	Settings.WatchdogSeconds = 0
+
+	passed, err := runScenarios(dir, *update)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if !passed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * simulate_test.go - Runs every scenario in ./scenarios against its
+ * golden timeline (see simulate.go), so `go test` fails when a change
+ * moves a banner. To accept a new timeline, run `banner-bard simulate
+ * -update` and look over the diff.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScenarios(t *testing.T) {
+	// As simulateMain sets them up
+	applyConfig()
+	setLogWriter(io.Discard)
+	Settings.WatchdogSeconds = 0
+
+	paths, err := filepath.Glob(filepath.Join("scenarios", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(paths) == 0 {
+		t.Fatal("no scenarios in ./scenarios")
+	}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(name, func(t *testing.T) {
+			scenario, err := loadScenario(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			timeline, err := runScenario(scenario)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := os.ReadFile(strings.TrimSuffix(path, ".json") + ".golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if line, ok := firstDifference(string(want), timeline); !ok {
+				t.Errorf("the timeline differs from line %d\n%s", line+1,
+					sideBySide(string(want), timeline, line))
+			}
+		})
+	}
+}
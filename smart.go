@@ -0,0 +1,152 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * smart.go - Smart playlists, which take in tags by a filter rather
+ * than by hand: `playlist smart cats cat-*` makes cats every tag
+ * starting with cat-, and `--author USER` every tag someone made. A
+ * smart playlist can have tags of its own, and be nested, like any
+ * other; playlistTags() adds whatever its filter matches.
+ *
+ * A schedule of a smart playlist (or one with a smart playlist nested
+ * in it) follows the "playlist:NAME" tag source, which goes through the
+ * playlist afresh at every change, so tags made after it was set join
+ * the rotation as they come.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var smartLog = moduleLogger("smart")
+
+// Whether the filter takes in the tag.
+func (filter SmartFilter) matches(tag Tag) bool {
+	if filter.AuthorID != "" && tag.AuthorID != filter.AuthorID {
+		return false
+	}
+	ok, _ := path.Match(filter.Pattern, tag.Name)
+	return filter.Pattern == "" || ok
+}
+
+// What the filter takes in, as "every tag matching `cat-*` by <@123>".
+func (filter SmartFilter) describe() string {
+	description := "every tag"
+	if filter.Pattern != "" {
+		description += " matching `" + filter.Pattern + "`"
+	}
+	if filter.AuthorID != "" {
+		description += " by <@" + filter.AuthorID + ">"
+	}
+	return description
+}
+
+// What a schedule's tag source is, for `schedules`.
+func sourceDescription(source string) string {
+	if playlist, ok := strings.CutPrefix(source, "playlist:"); ok {
+		return "smart playlist **" + playlist + "**"
+	}
+	return source
+}
+
+/*
+ * Schedule a playlist that takes tags in by a filter, following it as
+ * it changes, for the `playlist` schedule commands.
+ */
+func scheduleSmart(ctx *CommandContext, lane *BannerScheduler, timespec string,
+	playlist string, except []string, picker func() BannerPicker, label string) {
+
+	interval, ok := parseInterval(ctx, timespec)
+	if !ok {
+		return
+	}
+
+	err := lane.SetSource(interval, "playlist:"+playlist, except, picker)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+	lane.SetLabel(label)
+	ctx.auditSchedule(lane)
+
+	ctx.Reply("Yes, sire. **" + playlist + "** is a smart playlist, so I'll take in " +
+		"the tags that join it as I go.")
+}
+
+func cmdPlaylistSmart(ctx *CommandContext, args []string) {
+	if len(args) == 0 {
+		ctx.SendUsage()
+		return
+	}
+	playlist := args[0]
+
+	reply := func(message string) {
+		ctx.Session.ChannelMessageSendComplex(ctx.Event.ChannelID, &discordgo.MessageSend{
+			Content:         message,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+	}
+
+	switch {
+	case len(args) == 1:
+		filter, ok, err := smartFilter(playlist)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if !ok {
+			ctx.Reply("Sire, **" + playlist + "** isn't a smart playlist.")
+			return
+		}
+		reply("Sire, **" + playlist + "** takes in " + filter.describe() + ".")
+		return
+	case len(args) == 2 && strings.ToLower(args[1]) == "none":
+		if handleLockErrors(ctx, playlist, setSmartFilter(playlist, nil)) {
+			return
+		}
+		smartLog.Info("Took a smart filter away", "playlist", playlist,
+			"user", ctx.Event.Author.ID)
+		ctx.Reply("Sire, **" + playlist + "** takes in no tags on its own anymore.")
+		return
+	}
+
+	filter := SmartFilter{}
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "--author" && i+1 < len(args):
+			filter.AuthorID = parseUserID(args[i+1])
+			if filter.AuthorID == "" {
+				ctx.Reply("Sire, I need a member for `--author`, as a mention or an ID.")
+				return
+			}
+			i++
+		case filter.Pattern == "" && !strings.HasPrefix(args[i], "--"):
+			filter.Pattern = normTag(args[i])
+			if _, err := path.Match(filter.Pattern, ""); err != nil {
+				ctx.Reply("Sire, `" + args[i] + "` isn't a pattern I understand.")
+				return
+			}
+		default:
+			ctx.SendUsage()
+			return
+		}
+	}
+
+	if handleLockErrors(ctx, playlist, setSmartFilter(playlist, &filter)) {
+		return
+	}
+	tags, err := playlistTags(playlist)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	smartLog.Info("Set a smart filter", "playlist", playlist, "pattern", filter.Pattern,
+		"author", filter.AuthorID, "user", ctx.Event.Author.ID)
+
+	reply(fmt.Sprintf("Sire, **%s** will take in %s, now and to come. That's %d tags "+
+		"so far.", playlist, filter.describe(), len(tags)))
+}
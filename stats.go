@@ -0,0 +1,190 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * stats.go - How often each tag goes up. setBanner() records every
+ * banner it puts up in the usage table, with the time and what put it
+ * up (`set`, the schedule, a vote, Twitch, and so on), and `stats`
+ * makes that into the most and least shown tags, when each was last up,
+ * and a leaderboard of whose tags are shown most. `stats TAG` shows one
+ * tag's.
+ *
+ * A deleted tag's usage goes with it.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How many tags (and authors) each list in `stats` shows.
+const statsTop = 5
+
+// One tag's usage, summed up.
+type tagStats struct {
+	Tag      string
+	AuthorID string
+	Count    int
+	LastUsed time.Time // zero if it's never been up
+	Sources  map[string]int
+}
+
+func (stats tagStats) lastUsed() string {
+	if stats.LastUsed.IsZero() {
+		return "never"
+	}
+	return stats.LastUsed.In(guildLocation()).Format(DateFormat)
+}
+
+// How often each source put tags up, as "schedule 40, set 12", most first.
+func formatSources(sources map[string]int) string {
+	names := []string{}
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if sources[names[a]] != sources[names[b]] {
+			return sources[names[a]] > sources[names[b]]
+		}
+		return names[a] < names[b]
+	})
+
+	parts := []string{}
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %d", name, sources[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Every tag's usage, most shown first, then the most recently shown.
+func allTagStats() (stats []tagStats, usage []Usage, err error) {
+	tags, err := allTags()
+	if err != nil {
+		return nil, nil, err
+	}
+	usage, err = allUsage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byTag := map[string]*tagStats{}
+	for _, tag := range tags {
+		byTag[tag.Name] = &tagStats{Tag: tag.Name, AuthorID: tag.AuthorID,
+			Sources: map[string]int{}}
+	}
+	for _, use := range usage {
+		tag := byTag[use.Tag]
+		if tag == nil {
+			continue
+		}
+		tag.Count++
+		tag.Sources[use.Source]++
+		if use.At.After(tag.LastUsed) {
+			tag.LastUsed = use.At
+		}
+	}
+
+	for _, tag := range tags {
+		stats = append(stats, *byTag[tag.Name])
+	}
+	sort.SliceStable(stats, func(a, b int) bool {
+		if stats[a].Count != stats[b].Count {
+			return stats[a].Count > stats[b].Count
+		}
+		return stats[a].LastUsed.After(stats[b].LastUsed)
+	})
+	return stats, usage, nil
+}
+
+func cmdStats(ctx *CommandContext, args []string) {
+	if len(args) > 1 {
+		ctx.SendUsage()
+		return
+	}
+
+	stats, usage, err := allTagStats()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	if len(args) == 1 {
+		for _, tag := range stats {
+			if tag.Tag != normTag(args[0]) {
+				continue
+			}
+			if tag.Count == 0 {
+				ctx.Reply("Sire, **" + tag.Tag + "** hasn't been up yet.")
+				return
+			}
+			ctx.Reply(fmt.Sprintf("Sire, **%s** has been up %d times, last on %s (%s).",
+				tag.Tag, tag.Count, tag.lastUsed(), formatSources(tag.Sources)))
+			return
+		}
+		ctx.Reply("Sire, I don't recall any tags named `" + args[0] + "`.")
+		return
+	}
+
+	if len(usage) == 0 {
+		ctx.Reply("Sire, I haven't put any banners up yet.")
+		return
+	}
+
+	buf := bytes.Buffer{}
+	sources := map[string]int{}
+	for _, use := range usage {
+		sources[use.Source]++
+	}
+	buf.WriteString(fmt.Sprintf("Sire, I've put up %d banners since %s (%s).\n",
+		len(usage), usage[0].At.In(guildLocation()).Format(DateFormat),
+		formatSources(sources)))
+
+	buf.WriteString("\n**Most shown**")
+	for i := 0; i < len(stats) && i < statsTop; i++ {
+		buf.WriteString(fmt.Sprintf("\n%d. **%s**: %d times, last on %s", i+1,
+			stats[i].Tag, stats[i].Count, stats[i].lastUsed()))
+	}
+
+	// Least first, and of those tied, the longest since shown.
+	buf.WriteString("\n\n**Least shown**")
+	least := append([]tagStats{}, stats...)
+	sort.SliceStable(least, func(a, b int) bool {
+		if least[a].Count != least[b].Count {
+			return least[a].Count < least[b].Count
+		}
+		return least[a].LastUsed.Before(least[b].LastUsed)
+	})
+	for i := 0; i < len(least) && i < statsTop; i++ {
+		buf.WriteString(fmt.Sprintf("\n%d. **%s**: %d times, last on %s", i+1,
+			least[i].Tag, least[i].Count, least[i].lastUsed()))
+	}
+
+	shown := map[string]int{}
+	authors := []string{}
+	for _, tag := range stats {
+		if tag.Count == 0 {
+			continue
+		}
+		if shown[tag.AuthorID] == 0 {
+			authors = append(authors, tag.AuthorID)
+		}
+		shown[tag.AuthorID] += tag.Count
+	}
+	sort.SliceStable(authors, func(a, b int) bool {
+		return shown[authors[a]] > shown[authors[b]]
+	})
+
+	buf.WriteString("\n\n**Whose tags are shown most**")
+	for i := 0; i < len(authors) && i < statsTop; i++ {
+		buf.WriteString(fmt.Sprintf("\n%d. <@%s>: %d times", i+1, authors[i],
+			shown[authors[i]]))
+	}
+
+	ctx.ReplyLong(buf.String())
+}
@@ -0,0 +1,193 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * status.go - The pinned status message. If StatusChannelID is set, the
+ * bard keeps a single "Current banner" message pinned there, showing
+ * the tag up, its image, and when the banner next changes, and edits it
+ * on every change rather than posting anew. The message's ID is kept
+ * under statusMessageKey, so the same one is edited across restarts.
+ * If it's been deleted, a new one is posted (and pinned); if it's only
+ * been unpinned, it's pinned again.
+ *
+ * Changes come in pairs (setBanner() puts the tag up, then the
+ * scheduler works out how long it stays), so updates wait a moment to
+ * settle, and make one edit for both.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var statusLog = moduleLogger("status")
+
+// The setting the status message is kept under, as CHANNEL/MESSAGE.
+const statusMessageKey = "status_message"
+
+// How long to wait for changes to settle before editing the message.
+const statusSettle = 2 * time.Second
+
+type BannerStatus struct {
+	mutex   sync.Mutex
+	next    time.Time     // when the scheduler changes the banner next, if it will
+	refresh chan struct{} // a waiting update, see Touch()
+}
+
+var Status = BannerStatus{refresh: make(chan struct{}, 1)}
+
+// Ask for the status message to be brought up to date.
+func (status *BannerStatus) Touch() {
+	select {
+	case status.refresh <- struct{}{}:
+	default:
+		// One's already waiting
+	}
+}
+
+/*
+ * Record when the scheduler changes the banner next (the zero time if
+ * it won't), and update the message.
+ */
+func (status *BannerStatus) Scheduled(next time.Time) {
+	status.mutex.Lock()
+	status.next = next
+	status.mutex.Unlock()
+	status.Touch()
+}
+
+func (status *BannerStatus) nextChange() time.Time {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	return status.next
+}
+
+// The status message's embed, as things stand.
+func statusEmbed() (*discordgo.MessageEmbed, error) {
+	embed := &discordgo.MessageEmbed{
+		Title:     "Current banner",
+		Timestamp: time.Now().Format(time.RFC3339),
+		Footer:    &discordgo.MessageEmbedFooter{Text: "Last updated"},
+	}
+
+	name, err := currentBanner()
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		embed.Description = "No banner of mine is up yet, sire."
+	} else {
+		embed.Description = "**" + name + "**"
+
+		tag, err := namedTag(name)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		} else if err == nil {
+			if tag.Description != "" {
+				embed.Description += "\n" + tag.Description
+			}
+			embed.Image = &discordgo.MessageEmbedImage{URL: tag.Url}
+		}
+	}
+
+	next := "Not until someone changes it"
+	if at := Status.nextChange(); !at.IsZero() {
+		next = fmt.Sprintf("<t:%d:f> (<t:%d:R>)", at.Unix(), at.Unix())
+	}
+	embed.Fields = []*discordgo.MessageEmbedField{{Name: "Next change", Value: next}}
+
+	return embed, nil
+}
+
+// Whether an error from Discord says the message (or its channel) is gone.
+func messageGone(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Message == nil {
+		return false
+	}
+	return restErr.Message.Code == discordgo.ErrCodeUnknownMessage ||
+		restErr.Message.Code == discordgo.ErrCodeUnknownChannel
+}
+
+/*
+ * Edit the status message to match how things stand, posting and
+ * pinning a new one if there's none in StatusChannelID.
+ */
+func updateStatus(s *discordgo.Session) error {
+	if Settings.StatusChannelID == "" {
+		return nil
+	}
+
+	embed, err := statusEmbed()
+	if err != nil {
+		return err
+	}
+
+	saved, err := getSetting(statusMessageKey)
+	if err != nil {
+		return err
+	}
+
+	var message *discordgo.Message
+	if channelID, messageID, ok := strings.Cut(saved, "/"); ok &&
+		channelID == Settings.StatusChannelID {
+		message, err = s.ChannelMessageEditEmbed(channelID, messageID, embed)
+		if err != nil && !messageGone(err) {
+			return explainDiscordError(err)
+		} else if err != nil {
+			statusLog.Info("The status message is gone; posting another",
+				"message", messageID)
+			message = nil
+		}
+	}
+
+	if message == nil {
+		message, err = s.ChannelMessageSendEmbed(Settings.StatusChannelID, embed)
+		if err != nil {
+			return explainDiscordError(err)
+		}
+
+		err = putSetting(statusMessageKey, message.ChannelID+"/"+message.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !message.Pinned {
+		err = s.ChannelMessagePin(message.ChannelID, message.ID)
+		if err != nil {
+			statusLog.Warn("Couldn't pin the status message", "err", err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Keep the status message up to date, from now on. This lasts forever,
+ * so call it with `go`.
+ */
+func StartStatus(s *discordgo.Session) {
+	Status.Touch()
+	for range Status.refresh {
+		time.Sleep(statusSettle)
+		select {
+		case <-Status.refresh:
+		default:
+		}
+
+		if err := updateStatus(s); err != nil {
+			statusLog.Error("Error while updating the status message", "err", err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * submit.go - The submissions channel. Images posted to
+ * SubmissionsChannelID become tags without anyone typing `new TAG URL`:
+ * each is named by the message it came with ("snowy" plus an image makes
+ * the tag snowy), or by its file name if the message has no words, with
+ * a number on the end if the name's taken.
+ *
+ * Anyone who may post there makes tags at once, so it's best kept to
+ * trusted members. With SubmissionsConfirm on, images wait as
+ * suggestions instead (see suggest.go), and whoever may make tags
+ * confirms them by reacting ✅ to the message, or turns them down with
+ * ❌.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var submitLog = moduleLogger("submit")
+
+const (
+	confirmEmoji = "✅"
+	rejectEmoji  = "❌"
+)
+
+/*
+ * The first free tag name starting with base: base itself, or base-2,
+ * base-3, and so on. Names in taken count as used.
+ */
+func freeTagName(base string, taken map[string]bool) (string, error) {
+	name := base
+	for n := 2; ; n++ {
+		exists, err := tagExists(name)
+		if err != nil {
+			return "", err
+		} else if !exists && !taken[normTag(name)] {
+			return name, nil
+		}
+		name = base + "-" + strconv.Itoa(n)
+	}
+}
+
+/*
+ * Take the images posted to the submissions channel. Return false if
+ * the message isn't in it, so it can be handled as usual.
+ */
+func submitMessage(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	if Settings.SubmissionsChannelID == "" || m.ChannelID != Settings.SubmissionsChannelID {
+		return false
+	}
+
+	images := []*discordgo.MessageAttachment{}
+	for _, attachment := range m.Attachments {
+		if imageType(attachment.Filename) != "" {
+			images = append(images, attachment)
+		}
+	}
+	if len(images) == 0 {
+		return true
+	}
+
+	ctx := &CommandContext{Session: s, Event: m, Prefix: Settings.Prefix,
+		CommandName: Settings.Prefix + "submit"}
+	if refuseChanges(ctx) {
+		return true
+	}
+
+	// Names waiting to be confirmed are as good as taken.
+	suggestions, err := allSuggestions()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return true
+	}
+	taken := map[string]bool{}
+	for _, suggestion := range suggestions {
+		taken[suggestion.Tag] = true
+	}
+
+	made, waiting := []string{}, 0
+	for _, image := range images {
+		base := strings.Join(strings.Fields(m.Content), "-")
+		if base == "" {
+			base = strings.TrimSuffix(image.Filename, path.Ext(image.Filename))
+		}
+		base = strings.ReplaceAll(strings.ToLower(base), " ", "-")
+
+		name, err := freeTagName(base, taken)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return true
+		}
+		taken[normTag(name)] = true
+
+		// Keep a copy now, since attachment links don't last.
+		if _, err = cacheImage(image.URL); err != nil {
+			ctx.Reply(fmt.Sprintf("Sire, I couldn't fetch %s: %s.", image.Filename, err))
+			continue
+		}
+
+		suggestion := Suggestion{Tag: name, URL: image.URL, AuthorID: m.Author.ID,
+			ChannelID: m.ChannelID, MessageID: m.ID}
+		if Settings.SubmissionsConfirm {
+			suggestion.ID, err = insertSuggestion(suggestion)
+			if handleCommandErrors(ctx, SqlError, err) {
+				return true
+			}
+			submitLog.Info("Took a submission, to be confirmed", "suggestion", suggestion.ID,
+				"tag", name, "user", m.Author.ID)
+			waiting++
+			continue
+		}
+
+		if _, err = makeSuggestedTag(suggestion); handleCommandErrors(ctx, SqlError, err) {
+			return true
+		}
+		submitLog.Info("Took a submission", "tag", name, "user", m.Author.ID)
+		ctx.Audit("tag new", normTag(name), "submitted")
+		made = append(made, name)
+	}
+
+	if waiting > 0 {
+		s.MessageReactionAdd(m.ChannelID, m.ID, confirmEmoji)
+		s.MessageReactionAdd(m.ChannelID, m.ID, rejectEmoji)
+	}
+	if len(made) > 0 {
+		s.ChannelMessageSendReply(m.ChannelID, "I'll remember tag **"+
+			strings.Join(made, "**, **")+"**.", m.Reference())
+	}
+	return true
+}
+
+// Confirm or turn down the submissions on a message, as a reaction says.
+func submitReactionAdd(s *discordgo.Session, event *discordgo.MessageReactionAdd) {
+	defer recoverEvent("submitReactionAdd")
+
+	if event.GuildID != Settings.GuildID || event.ChannelID != Settings.SubmissionsChannelID ||
+		event.Member == nil || event.Member.User == nil || event.UserID == s.State.User.ID {
+		return
+	}
+
+	confirm := event.Emoji.Name == confirmEmoji
+	if !confirm && event.Emoji.Name != rejectEmoji {
+		return
+	}
+
+	suggestions, err := messageSuggestions(event.MessageID)
+	if err != nil {
+		submitLog.Error("Error while looking up submissions", "err", err)
+		return
+	} else if len(suggestions) == 0 {
+		return
+	}
+
+	ctx := &CommandContext{
+		Session: s,
+		Event: &discordgo.MessageCreate{Message: &discordgo.Message{
+			ChannelID: event.ChannelID,
+			GuildID:   event.GuildID,
+			Author:    event.Member.User,
+			Member:    event.Member,
+		}},
+		Prefix:      Settings.Prefix,
+		CommandName: Settings.Prefix + "submit",
+	}
+	if !userHasPerms(ctx, PermDefault, "") || refuseChanges(ctx) {
+		return
+	}
+
+	decided := []string{}
+	for _, suggestion := range suggestions {
+		// Whoever reacted first decides.
+		ours, err := delSuggestion(suggestion.ID)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		} else if !ours {
+			continue
+		}
+
+		// The name may have been taken since.
+		if confirm {
+			suggestion.Tag, err = freeTagName(suggestion.Tag, nil)
+			if err == nil {
+				_, err = makeSuggestedTag(suggestion)
+			}
+			if handleCommandErrors(ctx, SqlError, err) {
+				return
+			}
+			ctx.Audit("tag new", normTag(suggestion.Tag),
+				"submitted by <@"+suggestion.AuthorID+">")
+		}
+		submitLog.Info("Decided a submission", "suggestion", suggestion.ID,
+			"tag", suggestion.Tag, "confirmed", confirm, "user", event.UserID)
+		decided = append(decided, suggestion.Tag)
+	}
+
+	if len(decided) == 0 {
+		return
+	}
+
+	reference := &discordgo.MessageReference{MessageID: event.MessageID,
+		ChannelID: event.ChannelID, GuildID: event.GuildID}
+	message := "I'll remember tag **" + strings.Join(decided, "**, **") + "**."
+	if !confirm {
+		message = "I'll leave **" + strings.Join(decided, "**, **") + "** be, sire."
+	}
+	s.ChannelMessageSendReply(event.ChannelID, message, reference)
+}
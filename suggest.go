@@ -0,0 +1,314 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * suggest.go - Tag suggestions. Anyone may `suggest TAG URL` (or attach
+ * an image); the suggestion waits in the database and is posted to
+ * SuggestChannelID (or the log channel) with buttons, and whoever may
+ * make tags approves it, making the tag, or rejects it. Either way, the
+ * member who suggested it hears how it went.
+ *
+ * The image is cached when it's suggested, so an attachment's link can
+ * expire before anyone gets to it. Each member may only have so many
+ * suggestions waiting at once.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var suggestLog = moduleLogger("suggest")
+
+// How many suggestions a member may have waiting at once.
+const MaxPendingSuggestions = 3
+
+// Where suggestions are posted for the staff.
+func suggestChannel() string {
+	if Settings.SuggestChannelID != "" {
+		return Settings.SuggestChannelID
+	}
+	return Settings.LogChannelID
+}
+
+func cmdSuggest(ctx *CommandContext, args []string) {
+	var tag, url string
+	switch {
+	case len(args) == 2:
+		tag, url = args[0], args[1]
+	case len(args) == 1 && len(ctx.Event.Attachments) == 1:
+		tag, url = args[0], ctx.Event.Attachments[0].URL
+	default:
+		ctx.SendUsage()
+		return
+	}
+
+	channelID := suggestChannel()
+	if channelID == "" {
+		ctx.Reply("Sire, I've nowhere to send suggestions; ask the staff to " +
+			"set `SuggestChannelID`.")
+		return
+	}
+
+	if refuseImageType(ctx, url) {
+		return
+	}
+
+	exists, err := tagExists(tag)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if exists {
+		ctx.Reply("Sire, I already have a tag named **" + tag + "**. Pick another name.")
+		return
+	}
+
+	suggestions, err := allSuggestions()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	pending := 0
+	for _, suggestion := range suggestions {
+		if suggestion.Tag == normTag(tag) {
+			ctx.Reply("Sire, **" + tag + "** has been suggested already.")
+			return
+		}
+		if suggestion.AuthorID == ctx.Event.Author.ID {
+			pending++
+		}
+	}
+	if pending >= MaxPendingSuggestions {
+		ctx.Reply(fmt.Sprintf("Sire, you have %d suggestions waiting already. "+
+			"Let the staff get to those first.", pending))
+		return
+	}
+
+	// Keep a copy now, since attachment links don't last.
+	if _, err = cacheImage(url); err != nil {
+		ctx.Reply(fmt.Sprintf("Sire, I couldn't fetch that image: %s.", err))
+		return
+	}
+
+	suggestion := Suggestion{Tag: tag, URL: url, AuthorID: ctx.Event.Author.ID}
+	suggestion.ID, err = insertSuggestion(suggestion)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	message, err := ctx.Session.ChannelMessageSendComplex(channelID,
+		suggestionMessage(suggestion))
+	if err != nil {
+		delSuggestion(suggestion.ID)
+		handleCommandErrors(ctx, DiscordError, explainDiscordError(err))
+		return
+	}
+
+	err = setSuggestionMessage(suggestion.ID, channelID, message.ID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	suggestLog.Info("Suggested a tag", "suggestion", suggestion.ID, "tag", tag,
+		"url", url, "user", ctx.Event.Author.ID)
+	ctx.Reply("Sire, I've passed **" + tag + "** along to the staff. I'll tell " +
+		"you what they make of it.")
+}
+
+// The message asking the staff about a suggestion.
+func suggestionMessage(suggestion Suggestion) *discordgo.MessageSend {
+	id := strconv.FormatInt(suggestion.ID, 10)
+	return &discordgo.MessageSend{
+		Content: fmt.Sprintf("Sire, <@%s> suggests a new tag, **%s**:",
+			suggestion.AuthorID, suggestion.Tag),
+		Embeds: []*discordgo.MessageEmbed{{
+			Image: &discordgo.MessageEmbedImage{URL: suggestion.URL},
+		}},
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Approve",
+					Emoji:    discordgo.ComponentEmoji{Name: "✅"},
+					Style:    discordgo.SuccessButton,
+					CustomID: componentID("suggest-approve", id),
+				},
+				discordgo.Button{
+					Label:    "Reject",
+					Emoji:    discordgo.ComponentEmoji{Name: "❌"},
+					Style:    discordgo.DangerButton,
+					CustomID: componentID("suggest-reject", id),
+				},
+			},
+		}},
+	}
+}
+
+/*
+ * Look up the suggestion a button is for, checking the clicker may
+ * decide it. ok is false if the click's been dealt with already.
+ */
+func clickedSuggestion(s *discordgo.Session, i *discordgo.InteractionCreate,
+	arg string) (suggestion Suggestion, ok bool) {
+
+	ctx := interactionContext(s, i)
+	if !userHasPerms(ctx, PermDefault, "") || refuseChanges(ctx) {
+		return suggestion, false
+	}
+
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return suggestion, false
+	}
+
+	suggestion, ok, err = suggestionByID(id)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return suggestion, false
+	} else if !ok {
+		// Someone else got to it first.
+		err = updateComponentMessage(s, i, &discordgo.InteractionResponseData{
+			Content:    "Sire, this suggestion's been dealt with already.",
+			Components: []discordgo.MessageComponent{},
+		})
+		handleCommandErrors(ctx, DiscordError, err)
+	}
+	return suggestion, ok
+}
+
+/*
+ * Make a suggestion's tag, returning the tags that look like it. Its
+ * image was cached when it was suggested, so this seldom waits on a
+ * download; failing to hash it is only logged, as for `new`.
+ */
+func makeSuggestedTag(suggestion Suggestion) ([]string, error) {
+	err := insertTag(suggestion.Tag, suggestion.AuthorID, suggestion.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var alike []string
+	data, err := fetchImage(suggestion.URL)
+	if err == nil {
+		alike, err = hashNewTag(suggestion.Tag, data)
+	}
+	if err != nil {
+		suggestLog.Warn("Couldn't hash a suggested tag's image", "tag", suggestion.Tag,
+			"err", err)
+	}
+	return alike, nil
+}
+
+// Tell whoever made a suggestion how it went. Their DMs may be closed.
+func tellSuggester(s *discordgo.Session, suggestion Suggestion, message string) {
+	channel, err := s.UserChannelCreate(suggestion.AuthorID)
+	if err == nil {
+		_, err = s.ChannelMessageSend(channel.ID, message)
+	}
+	if err != nil {
+		suggestLog.Warn("Couldn't tell a member about their suggestion",
+			"suggestion", suggestion.ID, "user", suggestion.AuthorID, "err", err)
+	}
+}
+
+// Clear the buttons off a decided suggestion, saying what was decided.
+func closeSuggestion(s *discordgo.Session, i *discordgo.InteractionCreate,
+	suggestion Suggestion, message string) {
+
+	ctx := interactionContext(s, i)
+	_, err := delSuggestion(suggestion.ID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	err = updateComponentMessage(s, i, &discordgo.InteractionResponseData{
+		Content:         message,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+		Components:      []discordgo.MessageComponent{},
+	})
+	handleCommandErrors(ctx, DiscordError, err)
+}
+
+func componentSuggestApprove(s *discordgo.Session, i *discordgo.InteractionCreate, arg string) {
+	suggestion, ok := clickedSuggestion(s, i, arg)
+	if !ok {
+		return
+	}
+
+	// The name may have been taken since.
+	ctx := interactionContext(s, i)
+	exists, err := tagExists(suggestion.Tag)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if exists {
+		closeSuggestion(s, i, suggestion, fmt.Sprintf("Sire, <@%s>'s **%s** can't be "+
+			"made; there's a tag by that name now.", suggestion.AuthorID, suggestion.Tag))
+		tellSuggester(s, suggestion, "Sire, someone made a tag named **"+
+			suggestion.Tag+"** before yours was approved. Suggest it again by another name.")
+		return
+	}
+
+	note := ""
+	alike, err := makeSuggestedTag(suggestion)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if len(alike) > 0 {
+		note = fmt.Sprintf(" It looks just like **%s**.", strings.Join(alike, "**, **"))
+	}
+	suggestLog.Info("Approved a suggestion", "suggestion", suggestion.ID,
+		"tag", suggestion.Tag, "user", i.Member.User.ID)
+	ctx.Audit("tag new", normTag(suggestion.Tag), "suggested by <@"+suggestion.AuthorID+">")
+
+	closeSuggestion(s, i, suggestion, fmt.Sprintf("<@%s>'s **%s** is a tag now, "+
+		"approved by <@%s>.%s", suggestion.AuthorID, suggestion.Tag, i.Member.User.ID, note))
+	tellSuggester(s, suggestion, "Sire, your suggestion **"+suggestion.Tag+
+		"** was approved, and is a tag now.")
+}
+
+func componentSuggestReject(s *discordgo.Session, i *discordgo.InteractionCreate, arg string) {
+	suggestion, ok := clickedSuggestion(s, i, arg)
+	if !ok {
+		return
+	}
+
+	suggestLog.Info("Rejected a suggestion", "suggestion", suggestion.ID,
+		"tag", suggestion.Tag, "user", i.Member.User.ID)
+	closeSuggestion(s, i, suggestion, fmt.Sprintf("<@%s>'s **%s** was rejected by <@%s>.",
+		suggestion.AuthorID, suggestion.Tag, i.Member.User.ID))
+	tellSuggester(s, suggestion, "Sire, I'm sorry, but your suggestion **"+
+		suggestion.Tag+"** was turned down.")
+}
+
+func cmdSuggestions(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	suggestions, err := allSuggestions()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+	if len(suggestions) == 0 {
+		ctx.Reply("Sire, there are no suggestions waiting.")
+		return
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("The suggestions waiting on you, sire:\n")
+	for _, suggestion := range suggestions {
+		buf.WriteString(fmt.Sprintf("\n**%s** from <@%s>", suggestion.Tag,
+			suggestion.AuthorID))
+		if suggestion.MessageID != "" {
+			buf.WriteString(fmt.Sprintf(" https://discord.com/channels/%s/%s/%s",
+				Settings.GuildID, suggestion.ChannelID, suggestion.MessageID))
+		}
+	}
+
+	ctx.ReplyLong(buf.String())
+}
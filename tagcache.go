@@ -0,0 +1,108 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * tagcache.go - Tags kept in memory, so the scheduler doesn't go to the
+ * database for the same tag every change. namedTag() and tagExists()
+ * read through the cache; the first look at a tag (or at a name with no
+ * tag) asks the database, and later ones don't, until the tag changes.
+ *
+ * Everything in db.go that changes a tag's Tag fields, or whether it
+ * exists, forgets it from the cache: forgetTag() for one tag, and
+ * forgetTags() for changes to many (renames, clearing). Columns that
+ * aren't in Tag (health, locks, durations) don't need to.
+ * `cache stats` shows how well it's doing.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// A tag as cached; exists is false for a name with no tag.
+type cachedTag struct {
+	tag    Tag
+	exists bool
+}
+
+var tagCache = struct {
+	mutex  sync.Mutex
+	tags   map[string]cachedTag
+	hits   int64
+	misses int64
+	forgot int64
+}{tags: map[string]cachedTag{}}
+
+/*
+ * Look a tag up by its stored name, from the cache if it's there, or
+ * else the database. A missing tag is sql.ErrNoRows, as from a query.
+ */
+func cachedNamedTag(name string) (Tag, error) {
+	tagCache.mutex.Lock()
+	cached, ok := tagCache.tags[name]
+	if ok {
+		tagCache.hits++
+	} else {
+		tagCache.misses++
+	}
+	tagCache.mutex.Unlock()
+
+	if !ok {
+		tag, err := scanTag(sqlDb.QueryRow(
+			"SELECT "+tagColumns+" FROM tag WHERE name=?", name))
+		if err != nil && err != sql.ErrNoRows {
+			return tag, err
+		}
+
+		cached = cachedTag{tag: tag, exists: err == nil}
+		tagCache.mutex.Lock()
+		tagCache.tags[name] = cached
+		tagCache.mutex.Unlock()
+	}
+
+	if !cached.exists {
+		return Tag{}, sql.ErrNoRows
+	}
+	return cached.tag, nil
+}
+
+// Forget a tag (by its stored name) after it's changed.
+func forgetTag(name string) {
+	tagCache.mutex.Lock()
+	defer tagCache.mutex.Unlock()
+	delete(tagCache.tags, name)
+	tagCache.forgot++
+}
+
+// Forget every tag, after changes to many.
+func forgetTags() {
+	tagCache.mutex.Lock()
+	defer tagCache.mutex.Unlock()
+	tagCache.tags = map[string]cachedTag{}
+	tagCache.forgot++
+}
+
+func cmdCacheStats(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	tagCache.mutex.Lock()
+	size, hits, misses, forgot := len(tagCache.tags), tagCache.hits, tagCache.misses,
+		tagCache.forgot
+	tagCache.mutex.Unlock()
+
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = 100 * float64(hits) / float64(hits+misses)
+	}
+	ctx.Reply(fmt.Sprintf("Sire, I have %d tags in mind. Of %d lookups, %d (%.1f%%) "+
+		"needed no trip to the database; I've forgotten tags %d times as they changed.",
+		size, hits+misses, hits, rate, forgot))
+}
@@ -0,0 +1,111 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * tagname.go - Tag name normalization. The same name can be typed as
+ * different code points -- an accent composed or not, a letter in
+ * full width or not -- which used to make tags impossible to find.
+ * Names are put in NFC, and folded as the TagFold setting says, every
+ * time they're stored or looked up:
+ *
+ *   none        just NFC; "Café" and "café" are different tags
+ *   case        also fold case; they're the same tag
+ *   case-width  also fold full- and half-width forms, e.g. "ＣＡＴ" is "cat"
+ *
+ * Existing tags are renamed to match at startup. Tags that would end up
+ * with the same name are left alone and reported instead.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+var tagnameLog = moduleLogger("tagname")
+
+var TagFolds = []string{"none", "case", "case-width"}
+
+func checkTagFold(value string) error {
+	if !contains(TagFolds, value) {
+		return fmt.Errorf("%q isn't one of %s", value, strings.Join(TagFolds, ", "))
+	}
+	return nil
+}
+
+// Put a tag name in the form it's stored in.
+func normTag(name string) string {
+	switch Settings.TagFold {
+	case "case-width":
+		name = width.Fold.String(name)
+		fallthrough
+	case "case":
+		name = cases.Fold().String(name)
+	}
+
+	return norm.NFC.String(name)
+}
+
+func normTags(names []string) []string {
+	normed := make([]string, len(names))
+	for i, name := range names {
+		normed[i] = normTag(name)
+	}
+	return normed
+}
+
+/*
+ * Rename existing tags to their normal form. Returns the groups of tags
+ * that would collide, which are left as they are.
+ */
+func migrateTagNames() (collisions [][]string, err error) {
+	names, err := allTagNames()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]string{}
+	order := []string{}
+	for _, name := range names {
+		normed := normTag(name)
+		if _, ok := groups[normed]; !ok {
+			order = append(order, normed)
+		}
+		groups[normed] = append(groups[normed], name)
+	}
+
+	for _, normed := range order {
+		group := groups[normed]
+		switch {
+		case len(group) > 1:
+			collisions = append(collisions, group)
+		case group[0] != normed:
+			tagnameLog.Info("Renaming a tag", "tag", group[0], "to", normed)
+			if err = renameTag(group[0], normed); err != nil {
+				return collisions, err
+			}
+		}
+	}
+
+	return collisions, nil
+}
+
+// Migrate tag names, and let the owner know about any collisions.
+func migrateTagNamesOrPanic() {
+	collisions, err := migrateTagNames()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, group := range collisions {
+		tagnameLog.Warn("Tags share a name once normalized; "+
+			"rename all but one so they can be found", "tags", group)
+	}
+}
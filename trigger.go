@@ -0,0 +1,180 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * trigger.go - Webhook triggers, so other systems (a stream going live,
+ * a deploy, a game server coming up) can change the banner. With
+ * TriggerSecret set, the API's address (ApiListen) also takes
+ *
+ *   POST /trigger   {"tag": "live-now", "for": "3h"}
+ *
+ * which puts the tag up, and with "for", puts back what was up before
+ * once that long has passed, just as `at` does (the trigger is a one-shot
+ * that's due at once). Running schedules carry on around it.
+ *
+ * Calls must be signed, with the time they were made and an HMAC-SHA256
+ * of it and the body, keyed with TriggerSecret:
+ *
+ *   X-Bard-Timestamp: 1718000000
+ *   X-Bard-Signature: sha256=HEX(HMAC(secret, "1718000000." + body))
+ *
+ * From a shell, that's
+ *
+ *   ts=$(date +%s); body='{"tag":"live-now"}'
+ *   sig=$(printf '%s.%s' "$ts" "$body" | openssl dgst -sha256 -hmac "$SECRET" -r | cut -d' ' -f1)
+ *   curl -H "X-Bard-Timestamp: $ts" -H "X-Bard-Signature: sha256=$sig" -d "$body" URL/trigger
+ *
+ * Calls more than triggerSkew old (or ahead) are refused, as are calls
+ * seen before, so a call overheard can't be played again.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var triggerLog = moduleLogger("trigger")
+
+// How far a call's timestamp may be from now.
+const triggerSkew = 5 * time.Minute
+
+// MACs already taken, in lowercase hex, and when they can be forgotten.
+var triggersSeen = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: map[string]time.Time{}}
+
+type triggerServer struct{}
+
+/*
+ * The MAC in a signature, or nil if it isn't one. The hex may be in
+ * either case, with or without "sha256=".
+ */
+func triggerMAC(signature string) []byte {
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || len(sum) == 0 {
+		return nil
+	}
+	return sum
+}
+
+// Whether the MAC was made with TriggerSecret, over the timestamp and body.
+func triggerSigned(timestamp string, body []byte, sum []byte) bool {
+	mac := hmac.New(sha256.New, []byte(Settings.TriggerSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal(sum, mac.Sum(nil))
+}
+
+/*
+ * Remember a call's MAC, failing if it's been seen before. It's kept
+ * decoded, so the same call can't pass again written another way.
+ */
+func triggerFresh(sum []byte) bool {
+	key := hex.EncodeToString(sum)
+
+	triggersSeen.Lock()
+	defer triggersSeen.Unlock()
+
+	now := time.Now()
+	for seen, until := range triggersSeen.until {
+		if now.After(until) {
+			delete(triggersSeen.until, seen)
+		}
+	}
+
+	if _, ok := triggersSeen.until[key]; ok {
+		return false
+	}
+	triggersSeen.until[key] = now.Add(2 * triggerSkew)
+	return true
+}
+
+func (trigger *triggerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, body := trigger.serve(r)
+	triggerLog.Info("Trigger call", "status", status, "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func triggerFail(message string) map[string]string {
+	return map[string]string{"error": message}
+}
+
+func (trigger *triggerServer) serve(r *http.Request) (int, interface{}) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, triggerFail("triggers are POSTed")
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, apiBodyLimit))
+	if err != nil {
+		return http.StatusBadRequest, triggerFail("bad body: " + err.Error())
+	}
+
+	timestamp := r.Header.Get("X-Bard-Timestamp")
+	sum := triggerMAC(r.Header.Get("X-Bard-Signature"))
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || sum == nil || !triggerSigned(timestamp, body, sum) {
+		return http.StatusUnauthorized, triggerFail("bad signature")
+	}
+
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > triggerSkew || skew < -triggerSkew {
+		return http.StatusUnauthorized, triggerFail("stale timestamp")
+	} else if !triggerFresh(sum) {
+		return http.StatusConflict, triggerFail("already triggered")
+	}
+
+	if Drain.Active() {
+		return http.StatusServiceUnavailable, triggerFail("draining; back " + Drain.Eta())
+	}
+
+	var call struct {
+		Tag string `json:"tag"`
+		For string `json:"for"`
+	}
+	if err = json.Unmarshal(body, &call); err != nil || call.Tag == "" {
+		return http.StatusBadRequest, triggerFail(`a trigger needs a "tag"`)
+	}
+
+	shot := OneShot{At: time.Now(), Tag: call.Tag, AuthorID: firstOwner()}
+	if call.For != "" {
+		shot.RevertAfter, err = parseTime(call.For)
+		if err != nil || shot.RevertAfter <= 0 {
+			return http.StatusBadRequest, triggerFail("bad duration " + call.For)
+		}
+	}
+
+	exists, err := tagExists(shot.Tag)
+	if err == nil && !exists {
+		return http.StatusNotFound, triggerFail("no tag named " + shot.Tag)
+	} else if err == nil {
+		shot.ID, err = insertOneShot(shot)
+	}
+	if err != nil {
+		triggerLog.Error("Error while taking a trigger", "err", err)
+		reportError(ErrorReport{Kind: "sql", Message: err.Error(),
+			Command: "trigger", Tag: shot.Tag})
+		return http.StatusInternalServerError, triggerFail(err.Error())
+	}
+	Scheduler.Rearm()
+
+	triggerLog.Info("Triggered a banner", "id", shot.ID, "tag", shot.Tag,
+		"for", shot.RevertAfter)
+	return http.StatusAccepted, map[string]interface{}{"tag": normTag(shot.Tag),
+		"id": shot.ID}
+}
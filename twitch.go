@@ -0,0 +1,195 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * twitch.go - The banner for going live. With TwitchChannel (a channel's
+ * login name) and TwitchLiveTag set, and an app's TwitchClientID and
+ * TwitchClientSecret to ask with, the bard watches the channel, puts the
+ * live tag up while it streams, and puts back what was up before once
+ * it stops. The rotation is held meanwhile, as for event rules.
+ *
+ * The channel is polled every TwitchCheckMinutes, from the scheduler,
+ * rather than followed with EventSub, which would need Twitch to reach
+ * the bard over HTTPS. Whether the live tag is up (and what it covers)
+ * is kept under twitchLiveKey and twitchPreviousKey, so a restart mid
+ * stream still puts things back.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var twitchLog = moduleLogger("twitch")
+
+const (
+	// Set while the live tag is up, and the tag it went up over.
+	twitchLiveKey     = "twitch_live"
+	twitchPreviousKey = "twitch_previous"
+
+	twitchTokenURL   = "https://id.twitch.tv/oauth2/token"
+	twitchStreamsURL = "https://api.twitch.tv/helix/streams"
+)
+
+var twitchClient = &http.Client{Timeout: 10 * time.Second}
+
+/*
+ * The app access token, and when it runs out. Only the scheduler's
+ * goroutine touches it.
+ */
+var twitchToken struct {
+	value   string
+	expires time.Time
+}
+
+func twitchOn() bool {
+	return Settings.TwitchChannel != "" && Settings.TwitchLiveTag != "" &&
+		Settings.TwitchClientID != "" && Settings.TwitchClientSecret != ""
+}
+
+// An app access token, fetched anew if the last has run out.
+func twitchAppToken() (string, error) {
+	if twitchToken.value != "" && time.Now().Before(twitchToken.expires) {
+		return twitchToken.value, nil
+	}
+
+	resp, err := twitchClient.PostForm(twitchTokenURL, url.Values{
+		"client_id":     {Settings.TwitchClientID},
+		"client_secret": {Settings.TwitchClientSecret},
+		"grant_type":    {"client_credentials"},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Twitch answered %s for a token", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	// Give it up a minute early, rather than be caught out.
+	twitchToken.value = token.AccessToken
+	twitchToken.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return twitchToken.value, nil
+}
+
+// Whether TwitchChannel is streaming now.
+func twitchLive() (bool, error) {
+	token, err := twitchAppToken()
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet,
+		twitchStreamsURL+"?user_login="+url.QueryEscape(Settings.TwitchChannel), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Client-Id", Settings.TwitchClientID)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := twitchClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Revoked or expired early; fetch another next time.
+		twitchToken.value = ""
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Twitch answered %s for the stream", resp.Status)
+	}
+
+	var streams struct {
+		Data []struct {
+			Type string `json:"type"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&streams); err != nil {
+		return false, err
+	}
+	return len(streams.Data) > 0 && streams.Data[0].Type == "live", nil
+}
+
+// Whether the live tag is up, holding the rotation.
+func twitchHeld() (bool, error) {
+	live, err := getSetting(twitchLiveKey)
+	return live != "", err
+}
+
+/*
+ * Put the live tag up if the channel's gone live, or put back what it
+ * covered if the stream's over. Run from the scheduler.
+ */
+func (scheduler *BannerScheduler) checkTwitch() {
+	live, err := twitchLive()
+	if err != nil {
+		twitchLog.Error("Error while checking the stream", "err", err)
+		return
+	}
+
+	up, err := twitchHeld()
+	if err != nil {
+		twitchLog.Error("Error while checking the stream", "err", err)
+		return
+	}
+
+	switch {
+	case live && !up:
+		previous, err := currentBanner()
+		if err != nil {
+			twitchLog.Error("Error while going live", "err", err)
+			return
+		}
+
+		twitchLog.Info("Channel went live; setting the banner",
+			"channel", Settings.TwitchChannel, "tag", Settings.TwitchLiveTag)
+		if err = scheduler.setter(scheduler.session, Settings.TwitchLiveTag, "twitch"); err != nil {
+			twitchLog.Error("Error while setting the banner", "err", err)
+			return
+		}
+
+		err = putSetting(twitchPreviousKey, previous)
+		if err == nil {
+			err = putSetting(twitchLiveKey, "1")
+		}
+		if err != nil {
+			twitchLog.Error("Error while going live", "err", err)
+		}
+	case !live && up:
+		previous, err := getSetting(twitchPreviousKey)
+		if err != nil {
+			twitchLog.Error("Error while ending the stream", "err", err)
+			return
+		}
+
+		twitchLog.Info("Stream ended", "channel", Settings.TwitchChannel,
+			"previous", previous)
+		if previous != "" {
+			if err = scheduler.setter(scheduler.session, previous, "twitch"); err != nil {
+				twitchLog.Error("Error while setting the banner", "err", err)
+			}
+		}
+
+		if err = putSetting(twitchLiveKey, ""); err != nil {
+			twitchLog.Error("Error while ending the stream", "err", err)
+		}
+	}
+}
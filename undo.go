@@ -0,0 +1,241 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * undo.go - Taking a change back. Deleting tags, editing playlists, and
+ * imports are kept in the undo_journal table, each with a snapshot of
+ * what it replaced: the tags deleted and the playlists they were in,
+ * the playlist as it was, or for a plain import, everything. `undo`
+ * puts back the latest change of whoever runs it, and forgets it, so
+ * running it again goes further back. Only the newest undoJournalKeeps
+ * changes are kept, everyone's together. Changes made through the API
+ * or the dashboard are kept the same way, the token's as the owner's.
+ *
+ * Undoing puts back what the change replaced as it was then, so later
+ * changes to the same tags and playlists are taken back with it. A
+ * deleted tag comes back with its crop, duration and image hash, and the
+ * rows deleting it took with it (see tagCascades): its stats, credit,
+ * event rules, milestones and nomination. Locked tags and playlists are
+ * left as they are, and an import's schedule isn't put back, nor what a
+ * plain import's deletions took besides the tags and playlists, which
+ * the confirmation says. Undoing a plain import asks first, see
+ * confirm.go.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var undoLog = moduleLogger("undo")
+
+// How many changes the journal keeps; older ones can't be undone.
+const undoJournalKeeps = 50
+
+// What a change replaced, to put back. Tags and playlists are as an export has them.
+type undoSnapshot struct {
+	Tags      []Tag              `json:",omitempty"`
+	Playlists []ExportedPlaylist `json:",omitempty"`
+	// Made by the change, so deleted when it's undone.
+	NewTags      []string `json:",omitempty"`
+	NewPlaylists []string `json:",omitempty"`
+	// Tags and Playlists are everything there was, before a plain import.
+	Whole bool `json:",omitempty"`
+	// What of the tags Tag leaves out, and the rows deleting them takes, by tag.
+	Rows map[string]TagRows `json:",omitempty"`
+}
+
+// Snapshot the tags and playlists a change is about to replace, before it's made.
+func takeSnapshot(tags []string, playlists []string) (snapshot undoSnapshot, err error) {
+	for _, name := range normTags(tags) {
+		tag, err := namedTag(name)
+		if err == sql.ErrNoRows {
+			snapshot.NewTags = append(snapshot.NewTags, name)
+			continue
+		} else if err != nil {
+			return snapshot, err
+		}
+		rows, err := tagRows(name)
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Tags = append(snapshot.Tags, tag)
+		if snapshot.Rows == nil {
+			snapshot.Rows = map[string]TagRows{}
+		}
+		snapshot.Rows[tag.Name] = rows
+	}
+
+	for _, name := range playlists {
+		exists, err := playlistExists(name)
+		if err != nil {
+			return snapshot, err
+		} else if !exists {
+			snapshot.NewPlaylists = append(snapshot.NewPlaylists, name)
+			continue
+		}
+
+		crew, err := playlistCrew(name)
+		if err != nil {
+			return snapshot, err
+		}
+		playlist, err := exportPlaylist(name, crew)
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Playlists = append(snapshot.Playlists, playlist)
+	}
+	return snapshot, nil
+}
+
+// Snapshot tags about to be deleted, with the playlists they're in.
+func takeTagsSnapshot(tags []string) (undoSnapshot, error) {
+	playlists, err := playlistsWithTags(tags)
+	if err != nil {
+		return undoSnapshot{}, err
+	}
+	return takeSnapshot(tags, playlists)
+}
+
+// Snapshot everything, before a plain import replaces it.
+func takeWholeSnapshot() (undoSnapshot, error) {
+	export, err := buildExport(nil)
+	return undoSnapshot{Tags: export.Tags, Playlists: export.Playlists, Whole: true}, err
+}
+
+// Keep a change the command's user made, with what it replaced, for `undo`.
+func (ctx *CommandContext) Journal(action string, target string, snapshot undoSnapshot) {
+	journalChange(ctx.Event.Author.ID, action, target, snapshot)
+}
+
+// Keep a change someone made, from a command or the API, for `undo`.
+func journalChange(userID string, action string, target string, snapshot undoSnapshot) {
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = insertUndoEntry(UndoEntry{At: time.Now(), UserID: userID,
+			Action: action, Target: target, Snapshot: string(data)}, undoJournalKeeps)
+	}
+	if err != nil {
+		undoLog.Error("Couldn't journal a change", "action", action, "target", target,
+			"user", userID, "err", err)
+	}
+}
+
+/*
+ * Keep the deletion of some of the tags in a snapshot from
+ * takeTagsSnapshot(), as one change, named as the audit log names it.
+ */
+func (ctx *CommandContext) journalTags(action string, tags []string, snapshot undoSnapshot) {
+	deleted := []Tag{}
+	rows := map[string]TagRows{}
+	for _, tag := range snapshot.Tags {
+		if contains(tags, tag.Name) {
+			deleted = append(deleted, tag)
+			rows[tag.Name] = snapshot.Rows[tag.Name]
+		}
+	}
+	snapshot.Tags, snapshot.NewTags, snapshot.Rows = deleted, nil, rows
+
+	target := fmt.Sprintf("%d tags", len(tags))
+	if len(tags) == 1 {
+		target = tags[0]
+	}
+	ctx.Journal(action, target, snapshot)
+}
+
+// Put back what a change replaced. Returns what couldn't be, for handleCommandErrors().
+func (snapshot undoSnapshot) restore() (errs []error) {
+	if snapshot.Whole {
+		return importExport(Export{Version: ExportVersion, Tags: snapshot.Tags,
+			Playlists: snapshot.Playlists}, false)
+	}
+
+	for _, name := range snapshot.NewPlaylists {
+		errs = append(errs, undoError("the playlist **"+name+"**", clearPlaylist(name)))
+	}
+	for _, name := range snapshot.NewTags {
+		errs = append(errs, undoError("**"+name+"**", delTag(name)))
+	}
+	// Tags first, so the playlists have them to take back.
+	for _, tag := range snapshot.Tags {
+		err := restoreTag(tag)
+		if err == nil {
+			err = restoreTagRows(tag.Name, snapshot.Rows[tag.Name])
+		}
+		errs = append(errs, undoError("**"+tag.Name+"**", err))
+	}
+	for _, playlist := range snapshot.Playlists {
+		errs = append(errs, undoError("the playlist **"+playlist.Name+"**",
+			restorePlaylist(playlist)))
+	}
+	return errs
+}
+
+// Say what couldn't be put back, if anything.
+func undoError(what string, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	return nil
+}
+
+func cmdUndo(ctx *CommandContext, args []string) {
+	if len(args) > 0 {
+		ctx.SendUsage()
+		return
+	}
+
+	entry, ok, err := lastUndoEntry(ctx.Event.Author.ID)
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	} else if !ok {
+		ctx.Reply("Sire, you've made no change lately I can take back.")
+		return
+	}
+
+	// Numbers as they were, since a tag's image hash takes all 64 bits.
+	var snapshot undoSnapshot
+	decoder := json.NewDecoder(strings.NewReader(entry.Snapshot))
+	decoder.UseNumber()
+	err = decoder.Decode(&snapshot)
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+
+	when := entry.At.In(guildLocation()).Format(DateFormat)
+	undo := func() {
+		// Forgotten first, so it isn't undone twice should putting it back go wrong.
+		err := delUndoEntry(entry.ID)
+		if handleCommandErrors(ctx, SqlError, err) {
+			return
+		}
+
+		errs := snapshot.restore()
+		undoLog.Info("Undid a change", "action", entry.Action, "target", entry.Target,
+			"user", ctx.Event.Author.ID)
+		ctx.Audit("undo", entry.Target, "took back the "+entry.Action+" of "+when)
+		if handleCommandErrors(ctx, GeneralError, errs...) {
+			return
+		}
+		ctx.Reply(fmt.Sprintf("Sire, I've taken back your %s of **%s**, from %s.",
+			entry.Action, entry.Target, when))
+	}
+
+	if !snapshot.Whole {
+		undo()
+		return
+	}
+	confirmAction(ctx,
+		fmt.Sprintf("Sire, that puts my whole memory back as it was before your %s of %s, "+
+			"forgetting whatever's changed since. The stats, credits, event rules, "+
+			"milestones and nominations of tags it deleted stay gone. Shall I?",
+			entry.Action, when),
+		"Sire, putting my memory back.", undo)
+}
@@ -0,0 +1,122 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * upload.go - Sending banners to Discord without copying them. Going
+ * through discordgo's GuildEdit, a banner is in memory three times over:
+ * the image, its base64 data URI, and the JSON body holding that. On a
+ * small host, that's most of the memory a big banner change can use.
+ * So the edit is made by hand here, and the body is written as it's
+ * sent, base64-encoding the image a little at a time. Only the image
+ * itself is ever held whole.
+ *
+ * The request still goes through discordgo's rate limiter, and failures
+ * come back as *discordgo.RESTError, so retry.go and discorderror.go
+ * treat them like any other.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The most of Discord's answer that's read; a guild is a few KB.
+const uploadAnswerLimit = 1024 * 1024 // 1 MB
+
+/*
+ * A request body that reads through to a pipe, and closes it when the
+ * request's done with it, so the goroutine writing it can stop.
+ */
+type uploadBody struct {
+	io.Reader
+	pipe *io.PipeReader
+}
+
+func (body uploadBody) Close() error {
+	return body.pipe.Close()
+}
+
+/*
+ * The JSON for a guild edit setting an image field ("banner", "icon",
+ * or "splash"), written out as it's read, along with its length.
+ */
+func guildEditBody(field string, data []byte, filetype string) (io.ReadCloser, int64) {
+	prefix := `{"` + field + `":"data:image/` + filetype + `;base64,`
+	suffix := `"}`
+
+	pr, pw := io.Pipe()
+	go func() {
+		enc := base64.NewEncoder(base64.StdEncoding, pw)
+		_, err := enc.Write(data)
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	length := len(prefix) + base64.StdEncoding.EncodedLen(len(data)) + len(suffix)
+	body := io.MultiReader(strings.NewReader(prefix), pr, strings.NewReader(suffix))
+	return uploadBody{Reader: body, pipe: pr}, int64(length)
+}
+
+// Set the guild's banner to the image, returning the guild as edited.
+func streamBannerEdit(s *discordgo.Session, data []byte, filetype string) (*discordgo.Guild, error) {
+	return streamGuildEdit(s, "banner", data, filetype)
+}
+
+// Set one of the guild's images to the image, as streamBannerEdit() does the banner.
+func streamGuildEdit(s *discordgo.Session, field string, data []byte,
+	filetype string) (*discordgo.Guild, error) {
+
+	endpoint := discordgo.EndpointGuild(Settings.GuildID)
+	body, length := guildEditBody(field, data, filetype)
+
+	req, err := http.NewRequest(http.MethodPatch, endpoint, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req.ContentLength = length
+	req.Header.Set("authorization", s.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", s.UserAgent)
+
+	bucket := s.Ratelimiter.LockBucket(endpoint)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		bucket.Release(nil)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = bucket.Release(resp.Header); err != nil {
+		return nil, err
+	}
+
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, uploadAnswerLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		restErr := &discordgo.RESTError{Request: req, Response: resp, ResponseBody: answer}
+		var message discordgo.APIErrorMessage
+		if json.Unmarshal(answer, &message) == nil {
+			restErr.Message = &message
+		}
+		return nil, restErr
+	}
+
+	var guild discordgo.Guild
+	err = json.Unmarshal(answer, &guild)
+	return &guild, err
+}
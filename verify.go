@@ -0,0 +1,156 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * verify.go - Making sure the banner members see is the one we put up.
+ * GuildEdit can answer that all went well while the guild goes on
+ * showing the old banner, so after each upload the guild is fetched
+ * afresh and its banner hash compared with the one the edit gave back.
+ * If they differ, the upload is tried once more, and after that the
+ * failure is reported like any other. The hash seen is remembered, so
+ * the tag recorded as up is only ever one Discord is showing.
+ *
+ * Scheduled swaps get a second look a while later too, from the
+ * watchdog below.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var verifyLog = moduleLogger("verify")
+
+// The setting the banner hash Discord last showed is remembered under.
+const bannerHashKey = "banner_hash"
+
+const guidanceUnseen = "Sire, Discord says it took the banner, but goes on " +
+	"showing another, even after I tried twice. Mayhaps try again in a while."
+
+// The hash of the banner the guild shows now, straight from Discord.
+func observedBanner(s *discordgo.Session) (string, error) {
+	guild, err := s.Guild(Settings.GuildID)
+	if err != nil {
+		return "", err
+	}
+	return guild.Banner, nil
+}
+
+/*
+ * Upload a banner (an image of the given type) and check that Discord
+ * shows it, uploading it once more if not. If the guild can't be
+ * fetched to check, the upload is taken at its word.
+ */
+func uploadBanner(s *discordgo.Session, data []byte, filetype string) error {
+	for attempt := 1; ; attempt++ {
+		edited, err := streamBannerEdit(s, data, filetype)
+		if err != nil {
+			return explainDiscordError(err)
+		}
+
+		seen, err := observedBanner(s)
+		if err != nil {
+			verifyLog.Warn("Couldn't check the banner took", "err", err)
+			return putSetting(bannerHashKey, edited.Banner)
+		}
+
+		if edited.Banner != "" && seen == edited.Banner {
+			return putSetting(bannerHashKey, seen)
+		}
+
+		verifyLog.Warn("Uploaded a banner, but the guild shows another",
+			"uploaded", edited.Banner, "seen", seen, "attempt", attempt)
+		if attempt == 2 {
+			return &GuidedError{Guidance: guidanceUnseen,
+				Err: fmt.Errorf("uploaded %q, but the guild shows %q", edited.Banner, seen)}
+		}
+	}
+}
+
+/*
+ * The watchdog. Discord can also drop a banner some time after showing
+ * it, so a while (WatchdogSeconds) after each scheduled swap, the guild
+ * is checked once more. If the banner isn't the one uploaded, the tag
+ * is put up again and checked again, and if that fails too the staff
+ * are told.
+ */
+type BannerWatch struct {
+	tag      string
+	expected string // the banner hash uploaded
+	attempt  int
+	timer    *time.Timer
+}
+
+// Check on the banner after a swap to the given tag.
+func (scheduler *BannerScheduler) watchBanner(tag string, attempt int) {
+	scheduler.stopWatch()
+	if Settings.WatchdogSeconds == 0 || KillSwitch.Engaged() {
+		return
+	}
+
+	expected, err := getSetting(bannerHashKey)
+	if err != nil || expected == "" {
+		return
+	}
+
+	scheduler.watch = &BannerWatch{
+		tag:      tag,
+		expected: expected,
+		attempt:  attempt,
+		timer: time.AfterFunc(time.Duration(Settings.WatchdogSeconds)*time.Second,
+			func() { scheduler.send(TimerWatchdog) }),
+	}
+}
+
+func (scheduler *BannerScheduler) stopWatch() {
+	if scheduler.watch != nil {
+		scheduler.watch.timer.Stop()
+		scheduler.watch = nil
+	}
+}
+
+// Run the check set up by watchBanner(). Run in StartJob, on TimerWatchdog.
+func (scheduler *BannerScheduler) runWatchdog() {
+	watch := scheduler.watch
+	scheduler.watch = nil
+	if watch == nil || !scheduler.active || KillSwitch.Engaged() {
+		return
+	}
+
+	// Anything else uploaded since (`set`, `at`, an event) wins.
+	latest, err := getSetting(bannerHashKey)
+	if err != nil || latest != watch.expected {
+		return
+	}
+
+	seen, err := observedBanner(scheduler.session)
+	if err != nil {
+		verifyLog.Warn("Watchdog couldn't check the banner", "err", err)
+		return
+	} else if seen == watch.expected {
+		return
+	}
+
+	if watch.attempt > 1 {
+		notifyStaff(scheduler.session, "failure", fmt.Sprintf("Sire, I put up **%s** twice, "+
+			"and both times Discord went back to another banner. Discord may "+
+			"be refusing the image; a smaller or simpler one may fare better.",
+			watch.tag))
+		return
+	}
+
+	verifyLog.Warn("Watchdog found another banner; putting the tag up again",
+		"seen", seen, "expected", watch.expected, "tag", watch.tag)
+	if err = scheduler.setter(scheduler.session, watch.tag, "verify"); err != nil {
+		notifyStaff(scheduler.session, "failure", fmt.Sprintf("Sire, Discord dropped the "+
+			"banner **%s**, and I couldn't put it back: %s", watch.tag, err))
+		return
+	}
+	scheduler.watchBanner(watch.tag, watch.attempt+1)
+}
@@ -0,0 +1,202 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * version.go - Which bard this is, and whether there's a newer one.
+ * Release builds stamp their version in at build time:
+ *
+ *   $ go build -ldflags "-X main.Version=v1.2.0"
+ *
+ * and Go stamps the commit on its own when building from a checkout.
+ * `version` shows both. If UpdateCheck is on, the bard asks GitHub for
+ * UpdateRepo's latest release once a day, and tells the owner (once per
+ * release) when it's newer than the running one. Unstamped builds don't
+ * know how old they are, so they don't check.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var versionLog = moduleLogger("version")
+
+// Set with -ldflags "-X main.Version=vX.Y.Z".
+var Version = "dev"
+
+// The setting the newest release the owner's been told of is kept under.
+const updateNotifiedKey = "update_notified"
+
+const updateCheckEvery = 24 * time.Hour
+
+// What Go stamped into the build: the commit, when it was made, and
+// whether the checkout had changes.
+func buildStamp() (revision string, when string, modified bool) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", "", false
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.time":
+			when = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	return revision, when, modified
+}
+
+/*
+ * The numbers in a version like v1.2.3, and whether it is one. Anything
+ * after a dash (v1.2.3-rc1) is ignored.
+ */
+func parseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(version, "v")
+	version = strings.SplitN(version, "-", 2)[0]
+
+	parts := strings.Split(version, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+// Whether version a comes after version b. Missing numbers count as 0.
+func newerVersion(a string, b string) bool {
+	aNumbers, aOk := parseVersion(a)
+	bNumbers, bOk := parseVersion(b)
+	if !aOk || !bOk {
+		return false
+	}
+
+	for i := 0; i < len(aNumbers) || i < len(bNumbers); i++ {
+		var x, y int
+		if i < len(aNumbers) {
+			x = aNumbers[i]
+		}
+		if i < len(bNumbers) {
+			y = bNumbers[i]
+		}
+
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// Ask GitHub for the tag of the update repository's latest release.
+func latestRelease() (string, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get("https://api.github.com/repos/" +
+		Settings.UpdateRepo + "/releases/latest")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub answered %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&release)
+	return release.TagName, err
+}
+
+/*
+ * Check for a newer release, and tell the owner about it if they
+ * haven't heard yet.
+ */
+func checkForUpdate(s *discordgo.Session) error {
+	latest, err := latestRelease()
+	if err != nil || !newerVersion(latest, Version) {
+		return err
+	}
+
+	notified, err := getSetting(updateNotifiedKey)
+	if err != nil || notified == latest {
+		return err
+	}
+
+	notifyOwner(s, fmt.Sprintf("Sire, a newer Banner Bard is out: **%s** "+
+		"(I'm %s). <https://github.com/%s/releases/latest>",
+		latest, Version, Settings.UpdateRepo))
+	return putSetting(updateNotifiedKey, latest)
+}
+
+/*
+ * Check for updates now and once a day, if UpdateCheck is on. This
+ * lasts forever, so call it with `go`.
+ */
+func StartUpdateCheck(s *discordgo.Session) {
+	if !Settings.UpdateCheck {
+		return
+	}
+
+	if _, ok := parseVersion(Version); !ok {
+		versionLog.Info("Not checking for updates; this version isn't a release",
+			"version", Version)
+		return
+	}
+
+	for {
+		if err := checkForUpdate(s); err != nil {
+			versionLog.Error("Error while checking for updates", "err", err)
+		}
+		time.Sleep(updateCheckEvery)
+	}
+}
+
+func cmdVersion(ctx *CommandContext, args []string) {
+	buf := bytes.Buffer{}
+	buf.WriteString("I'm Banner Bard **" + Version + "**, sire")
+
+	revision, when, modified := buildStamp()
+	if revision != "" {
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		buf.WriteString(", built from `" + revision + "`")
+		if modified {
+			buf.WriteString(" (with changes)")
+		}
+		if when != "" {
+			buf.WriteString(" of " + when)
+		}
+	}
+	buf.WriteString(", with " + runtime.Version() + ".")
+
+	if Settings.UpdateCheck {
+		notified, err := getSetting(updateNotifiedKey)
+		if err == nil && newerVersion(notified, Version) {
+			buf.WriteString("\n**" + notified + "** is out, though.")
+		}
+	}
+
+	ctx.Reply(buf.String())
+}
@@ -0,0 +1,238 @@
+/*
+ * Banner Bard: Banner-serving discord bot, sire.
+ *
+ * whatsnew.go - What's changed in this bard, from changelog.json (built
+ * into the binary, newest release first). `whatsnew` shows the changes
+ * since the release before the running one, less those it's shown the
+ * guild already, so admins hear of each new trick once; `whatsnew all`
+ * shows them all again. Changes can name a setting that turns them on,
+ * and a command to try.
+ *
+ * Which changes were shown is kept in the database, under
+ * whatsnewSeenKey, so each guild's bard tracks its own. Once per release,
+ * the bard tells the staff when there's something they haven't seen.
+ *
+ *
+ * This program uses the BSD 3-Clause license. You can find details under
+ * the file LICENSE or under <https://opensource.org/licenses/BSD-3-Clause>.
+ */
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var whatsnewLog = moduleLogger("whatsnew")
+
+const (
+	// The IDs of the changes shown, comma-separated.
+	whatsnewSeenKey = "whatsnew_seen"
+	// The last release the staff were told had something new.
+	whatsnewAnnouncedKey = "whatsnew_announced"
+)
+
+//go:embed changelog.json
+var changelogData []byte
+
+type Change struct {
+	ID      string `json:"id"`
+	Text    string `json:"text"`
+	Setting string `json:"setting"` // the setting that turns it on, if any
+	Try     string `json:"try"`     // a command to try it with, if any
+}
+
+type Release struct {
+	Version string   `json:"version"`
+	Changes []Change `json:"changes"`
+}
+
+// The changelog, newest release first.
+func changelog() ([]Release, error) {
+	var releases []Release
+	err := json.Unmarshal(changelogData, &releases)
+	return releases, err
+}
+
+/*
+ * The releases since the running version's predecessor: that is, the
+ * newest one the running version isn't older than. Unstamped builds
+ * aren't older than any, so they get the newest.
+ */
+func releasesSincePredecessor(releases []Release) []Release {
+	for i, release := range releases {
+		if !newerVersion(release.Version, Version) {
+			return releases[i : i+1]
+		}
+	}
+	return nil
+}
+
+func seenChanges() (map[string]bool, error) {
+	value, err := getSetting(whatsnewSeenKey)
+	seen := map[string]bool{}
+	for _, id := range strings.Split(value, ",") {
+		if id != "" {
+			seen[id] = true
+		}
+	}
+	return seen, err
+}
+
+func markChangesSeen(seen map[string]bool, releases []Release) error {
+	for _, release := range releases {
+		for _, change := range release.Changes {
+			seen[change.ID] = true
+		}
+	}
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	return putSetting(whatsnewSeenKey, strings.Join(ids, ","))
+}
+
+// The releases' changes that haven't been seen, leaving out empty releases.
+func unseenChanges(releases []Release, seen map[string]bool) []Release {
+	unseen := []Release{}
+	for _, release := range releases {
+		changes := []Change{}
+		for _, change := range release.Changes {
+			if !seen[change.ID] {
+				changes = append(changes, change)
+			}
+		}
+		if len(changes) > 0 {
+			unseen = append(unseen, Release{Version: release.Version, Changes: changes})
+		}
+	}
+	return unseen
+}
+
+func countChanges(releases []Release) (count int) {
+	for _, release := range releases {
+		count += len(release.Changes)
+	}
+	return count
+}
+
+// Whether a setting is left at its zero value, which is off for most.
+func settingUnset(name string) bool {
+	field := reflect.ValueOf(Settings).FieldByName(name)
+	return field.IsValid() && field.IsZero()
+}
+
+func writeReleases(buf *bytes.Buffer, releases []Release) {
+	for _, release := range releases {
+		buf.WriteString("\n**" + release.Version + "**\n")
+		for _, change := range release.Changes {
+			buf.WriteString("- " + change.Text)
+			if change.Setting != "" {
+				buf.WriteString(" See `" + change.Setting + "`")
+				if settingUnset(change.Setting) {
+					buf.WriteString(" (not set yet)")
+				}
+				buf.WriteString(".")
+			}
+			if change.Try != "" {
+				buf.WriteString(" Try `" + Settings.Prefix + change.Try + "`.")
+			}
+			buf.WriteString("\n")
+		}
+	}
+}
+
+/*
+ * Tell the staff, once per release, if there are changes they haven't
+ * seen. Only the log channel hears of it; it's not worth a DM.
+ */
+func AnnounceWhatsnew(s *discordgo.Session) {
+	if Settings.LogChannelID == "" {
+		return
+	}
+
+	releases, err := changelog()
+	if err != nil {
+		whatsnewLog.Error("Couldn't read the changelog", "err", err)
+		return
+	}
+	releases = releasesSincePredecessor(releases)
+	if len(releases) == 0 {
+		return
+	}
+
+	announced, err := getSetting(whatsnewAnnouncedKey)
+	if err != nil || announced == releases[0].Version {
+		handleErrors(s, "", SqlError, "whatsnew", err)
+		return
+	}
+
+	seen, err := seenChanges()
+	if err != nil {
+		handleErrors(s, "", SqlError, "whatsnew", err)
+		return
+	}
+
+	if count := countChanges(unseenChanges(releases, seen)); count > 0 {
+		message := fmt.Sprintf("Sire, I've learned new tricks (%d, in %s) that "+
+			"you haven't heard of. `%swhatsnew` will tell of them.", count,
+			releases[0].Version, Settings.Prefix)
+		if _, err = s.ChannelMessageSend(Settings.LogChannelID, message); err != nil {
+			whatsnewLog.Error("Couldn't tell the staff what's new", "err", err)
+			return
+		}
+	}
+	handleErrors(s, "", SqlError, "whatsnew",
+		putSetting(whatsnewAnnouncedKey, releases[0].Version))
+}
+
+func cmdWhatsnew(ctx *CommandContext, args []string) {
+	all := len(args) == 1 && args[0] == "all"
+	if len(args) > 1 || (len(args) == 1 && !all) {
+		ctx.Reply("Sire, that's `whatsnew` or `whatsnew all`.")
+		return
+	}
+
+	releases, err := changelog()
+	if handleCommandErrors(ctx, GeneralError, err) {
+		return
+	}
+	if !all {
+		releases = releasesSincePredecessor(releases)
+	}
+
+	seen, err := seenChanges()
+	if handleCommandErrors(ctx, SqlError, err) {
+		return
+	}
+
+	shown := releases
+	if !all {
+		shown = unseenChanges(releases, seen)
+	}
+	if len(shown) == 0 {
+		ctx.Reply(fmt.Sprintf("Sire, there's nothing new since you last asked. "+
+			"`%swhatsnew all` tells it all again.", Settings.Prefix))
+		return
+	}
+
+	buf := bytes.Buffer{}
+	if all {
+		buf.WriteString("Sire, here's all that's changed in me:\n")
+	} else {
+		buf.WriteString("Sire, here's what's new in me:\n")
+	}
+	writeReleases(&buf, shown)
+
+	if handleCommandErrors(ctx, SqlError, markChangesSeen(seen, shown)) {
+		return
+	}
+	ctx.ReplyLong(buf.String())
+}